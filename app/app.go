@@ -6,9 +6,11 @@ package app
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/http/pprof"
@@ -54,6 +56,13 @@ const (
 	// DID_PREPARE is emitted when App.Prepare ends without errors.
 	// The object is the App.
 	DID_PREPARE = "gnd.la/app.did-prepare"
+	// WILL_STOP is emitted at the beginning of App.Shutdown, before
+	// the App stops accepting new connections. The object is the App.
+	WILL_STOP = "gnd.la/app.will-stop"
+	// DID_STOP is emitted at the end of App.Shutdown, after all the
+	// pending requests and background contexts have finished and the
+	// App resources have been closed. The object is the App.
+	DID_STOP = "gnd.la/app.did-stop"
 )
 
 var (
@@ -85,7 +94,11 @@ type ContextProcessor func(*Context) bool
 // to the client. The parameters are the current context,
 // the error message and the error code. If the handler
 // returns true, the error is considered as handled and
-// no further data is sent to the client.
+// no further data is sent to the client. Otherwise, the App
+// sends a plain text error or, for errors from Context.Bind and
+// Context.Respond or when error documents are enabled (see
+// App.SetErrorDocuments), an ErrorDocument to clients which prefer
+// JSON, XML or msgpack.
 type ErrorHandler func(*Context, string, int) bool
 
 // LanguageHandler is use to determine the language
@@ -93,13 +106,36 @@ type ErrorHandler func(*Context, string, int) bool
 type LanguageHandler func(*Context) string
 
 type handlerInfo struct {
-	host      string
-	name      string
-	path      string
-	pathMatch []int
-	re        *regexp.Regexp
-	rc        *regexpCache
-	handler   Handler
+	host    string
+	name    string
+	methods []string
+	// order indicates the order the handler was added in. Among
+	// the handlers matching a request, the one with the lowest order
+	// is used, with the exception of routes, which prefer static
+	// paths over parameters.
+	order int
+	// routes and literal regexps are stored in the router, using
+	// tokens and params, while the rest use re and rc
+	tokens  []*routeToken
+	params  []string
+	re      *regexp.Regexp
+	rc      *regexpCache
+	handler Handler
+}
+
+// allows returns true iff the handler accepts requests
+// with the given method. Handlers accepting GET also
+// accept HEAD.
+func (h *handlerInfo) allows(method string) bool {
+	if h.methods == nil {
+		return true
+	}
+	for _, v := range h.methods {
+		if v == method || (v == "GET" && method == "HEAD") {
+			return true
+		}
+	}
+	return false
 }
 
 type includedApp struct {
@@ -122,6 +158,10 @@ func (a *includedApp) assetFunc(t *template.Template) func(string) (string, erro
 
 const (
 	poolSize = 16
+	// defaultShutdownTimeout is the maximum amount of time
+	// ListenAndServe waits for pending requests when the process
+	// receives a termination signal.
+	defaultShutdownTimeout = 30 * time.Second
 )
 
 var (
@@ -178,12 +218,17 @@ type App struct {
 	values map[string]interface{}
 
 	handlers           []*handlerInfo
+	router             router
+	regexpHandlers     []*handlerInfo
+	middlewares        []*Middleware
 	trustXHeaders      bool
 	appendSlash        bool
+	errorDocuments     bool
 	errorHandler       ErrorHandler
 	languageHandler    LanguageHandler
 	name               string
 	userFunc           UserFunc
+	sessions           *sessions
 	assetsManager      *assets.Manager
 	templatesFS        vfs.VFS
 	templatesMutex     sync.RWMutex
@@ -193,6 +238,13 @@ type App struct {
 	hooks              []*template.Hook
 	started            time.Time
 	address            string
+	shutdownTimeout    time.Duration
+	server             *http.Server
+	redirectServer     *http.Server
+	stopped            chan struct{}
+	background         sync.WaitGroup
+	shutdownCtx        context.Context
+	closing            bool
 	mu                 sync.Mutex
 	c                  *Cache
 	o                  *Orm
@@ -216,34 +268,112 @@ func (app *App) HandleNamed(pattern string, handler Handler, name string) {
 	app.HandleOptions(pattern, handler, &HandlerOptions{Name: name})
 }
 
+// HandleMethods is a shorthand for HandleOptions, passing an Options
+// instance with just the methods set.
+func (app *App) HandleMethods(pattern string, handler Handler, methods ...string) {
+	app.HandleOptions(pattern, handler, &HandlerOptions{Methods: methods})
+}
+
 // HandleOptions adds a new handler to the App. If the Options include a
 // non-empty name, it can be be reversed using Context.Reverse or
 // the "reverse" template function. To add a host-specific Handler,
-// set the Host field in Options to a non-empty string. Note that handler patterns
-// are tried in the same order that they were added to the App.
+// set the Host field in Options to a non-empty string. To restrict the
+// Handler to some HTTP methods, set the Methods field.
+//
+// Patterns starting with a slash, containing at least one parameter
+// enclosed in braces and no other regular expression metacharacters
+// are routes, which match the path exactly. Parameters consume a path
+// segment and are specified as {name} or {name:type}, where type is
+// one of:
+//
+//  string (the default): any non-empty segment
+//  int: an integer, optionally negative
+//  uint: a non-negative integer
+//  alpha: ASCII letters
+//  alnum: ASCII letters and digits
+//  slug: ASCII letters, digits, dashes and underscores
+//  hex: hexadecimal digits
+//  uuid: an UUID, in its canonical form
+//  path: the rest of the path, including slashes. It must be the last parameter.
+//
+// For example, /article/{id:int}/{slug}/ would match /article/42/the-answer/.
+// Parameters might be retrieved by name (e.g. Context.ParamValue("id")) or
+// by index (e.g. Context.IndexValue(0)).
+//
+// Any other pattern is interpreted as a regular expression, which
+// matches any path containing it unless it's anchored (e.g. / matches
+// every path, while ^/$ only matches the root). When several handlers
+// match a request, the one added first is used. Routes and anchored
+// regular expressions without any other metacharacters (e.g. ^/about/$)
+// are looked up in a tree. The rest of the regular expressions, including
+// anchored ones with groups or classes (e.g. ^/article/(\d+)/$), are tried
+// one by one in the order they were added, until one of them matches or
+// the handler found in the tree is reached. Thus, adding the routes before
+// these regular expressions avoids trying them for the paths the routes match.
+//
+// When a path is matched only by handlers restricted to other HTTP methods,
+// the App responds with a 405 and an Allow header listing the accepted
+// methods. OPTIONS requests for such paths are automatically answered with
+// the Allow header.
 func (app *App) HandleOptions(pattern string, handler Handler, opts *HandlerOptions) {
+	app.handle(pattern, handler, opts, false)
+}
+
+func (app *App) handle(pattern string, handler Handler, opts *HandlerOptions, first bool) {
 	if handler == nil {
 		panic(fmt.Errorf("handler for pattern %q can't be nil", pattern))
 	}
-	re := regexp.MustCompile(pattern)
-	var host string
-	var name string
-	if opts != nil {
-		host = opts.Host
-		name = opts.Name
-	}
 	info := &handlerInfo{
-		host:    host,
-		name:    name,
-		re:      re,
-		rc:      newRegexpCache(re),
 		handler: handler,
 	}
-	if p := literalRegexp(re); p != "" {
-		info.path = p
-		info.pathMatch = []int{0, len(p)}
+	if opts != nil {
+		info.host = opts.Host
+		info.name = opts.Name
+		for _, v := range opts.Methods {
+			info.methods = append(info.methods, strings.ToUpper(v))
+		}
+	}
+	if isRoutePattern(pattern) {
+		tokens, err := parseRoute(pattern)
+		if err != nil {
+			panic(err)
+		}
+		info.tokens = tokens
+		for _, v := range tokens {
+			if v.typ != nil {
+				info.params = append(info.params, v.name)
+			}
+		}
+	} else {
+		re := regexp.MustCompile(pattern)
+		if p := literalRegexp(re); p != "" {
+			info.tokens = []*routeToken{{literal: p}}
+		} else {
+			info.re = re
+			info.rc = newRegexpCache(re)
+		}
+	}
+	if first {
+		// Shift the rest of the handlers, their relative
+		// order doesn't change so there's no need to
+		// update the router.
+		for _, v := range app.handlers {
+			v.order++
+		}
+		app.handlers = append([]*handlerInfo{info}, app.handlers...)
+		if info.re != nil {
+			app.regexpHandlers = append([]*handlerInfo{info}, app.regexpHandlers...)
+		}
+	} else {
+		info.order = len(app.handlers)
+		app.handlers = append(app.handlers, info)
+		if info.re != nil {
+			app.regexpHandlers = append(app.regexpHandlers, info)
+		}
+	}
+	if info.tokens != nil {
+		app.router.add(info.host, info.tokens, info)
 	}
-	app.handlers = append(app.handlers, info)
 }
 
 // AddContextProcessor adds context processor to the App.
@@ -292,7 +422,11 @@ func (app *App) AddRecoverHandler(rh RecoverHandler) {
 }
 
 func (app *App) Include(prefix string, included *App, containerTemplate string) {
-	if err := app.include(prefix, included, containerTemplate); err != nil {
+	app.includeGroup(prefix, included, containerTemplate, nil)
+}
+
+func (app *App) includeGroup(prefix string, included *App, containerTemplate string, g *Group) {
+	if err := app.include(prefix, included, containerTemplate, g); err != nil {
 		panic(err)
 	}
 	if app.namespace == nil {
@@ -309,7 +443,7 @@ func (app *App) Include(prefix string, included *App, containerTemplate string)
 	app.namespace.vars["Apps"] = apps
 }
 
-func (app *App) include(prefix string, child *App, containerTemplate string) error {
+func (app *App) include(prefix string, child *App, containerTemplate string, g *Group) error {
 	if child.parent != nil {
 		return fmt.Errorf("app %v already has been included in another app", child)
 	}
@@ -373,7 +507,11 @@ func (app *App) include(prefix string, child *App, containerTemplate string) err
 		}
 	}
 	// All checks passed, add the included app handler
-	app.HandleOptions("^"+prefix, includedAppHandler(child, prefix), nil)
+	handler := includedAppHandler(child, prefix)
+	if g != nil {
+		handler = g.wrap(handler)
+	}
+	app.HandleOptions("^"+regexp.QuoteMeta(prefix), handler, nil)
 	return nil
 }
 
@@ -426,6 +564,26 @@ func (app *App) SetAppendSlash(b bool) {
 	app.appendSlash = b
 }
 
+// ErrorDocuments returns if the app sends errors as an ErrorDocument
+// to clients which prefer JSON, XML or msgpack. See SetErrorDocuments
+// for a more detailed description.
+func (app *App) ErrorDocuments() bool {
+	return app.errorDocuments
+}
+
+// SetErrorDocuments enables or disables sending every error (e.g.
+// from Context.NotFound, Context.Forbidden or a panic) as an
+// ErrorDocument to clients which prefer JSON, XML or msgpack
+// over plain text and HTML, either via the Accept header or the
+// format parameter (see FormatParameterName). Errors from
+// Context.Bind and errors passed to Context.Respond are always
+// sent as an ErrorDocument when the client prefers one of those
+// formats. The default is disabled, which sends the rest of the
+// errors as plain text.
+func (app *App) SetErrorDocuments(b bool) {
+	app.errorDocuments = b
+}
+
 func (app *App) Name() string {
 	return app.name
 }
@@ -714,6 +872,25 @@ func (app *App) SetAddress(address string) {
 	app.address = address
 }
 
+// ShutdownTimeout returns the maximum amount of time the app
+// waits for pending requests and background contexts to finish
+// when it's stopped by a termination signal. See SetShutdownTimeout
+// for further information.
+func (app *App) ShutdownTimeout() time.Duration {
+	if app.shutdownTimeout > 0 {
+		return app.shutdownTimeout
+	}
+	return defaultShutdownTimeout
+}
+
+// SetShutdownTimeout sets the maximum amount of time the app will
+// wait for pending requests and background contexts to finish when
+// the process receives SIGINT or SIGTERM while running ListenAndServe.
+// Values <= 0 reset the timeout to its default value, 30 seconds.
+func (app *App) SetShutdownTimeout(timeout time.Duration) {
+	app.shutdownTimeout = timeout
+}
+
 // HandleAssets adds several handlers to the app which handle
 // assets efficiently and allows the use of the "assset"
 // function from the templates. This function will also modify the
@@ -782,7 +959,13 @@ func (app *App) reverse(name string, args []interface{}) (string, error) {
 func (app *App) reverseHandler(name string, args []interface{}) (bool, string, error) {
 	for _, v := range app.handlers {
 		if v.name == name {
-			reversed, err := formatRegexp(v.rc, args)
+			var reversed string
+			var err error
+			if v.rc != nil {
+				reversed, err = formatRegexp(v.rc, args)
+			} else {
+				reversed, err = formatRoute(v.tokens, args)
+			}
 			if err != nil {
 				if acerr, ok := err.(*argumentCountError); ok {
 					if acerr.Min == acerr.Max {
@@ -815,7 +998,15 @@ func (app *App) reverseHandler(name string, args []interface{}) (bool, string, e
 }
 
 // ListenAndServe starts listening on the configured address and
-// port (see Address() and Port).
+// port (see Address() and Port). If the Config includes a TLS certificate
+// and key, the App serves HTTPS and HTTP/2, reloading the certificate
+// when the files change, and optionally redirects plain HTTP requests
+// received on TLSRedirectPort to HTTPS.
+//
+// When the process receives either SIGINT or SIGTERM, the App is gracefully
+// stopped by calling Shutdown with a timeout of ShutdownTimeout().
+// ListenAndServe only returns after the App has been completely stopped,
+// either by a signal or by calling Shutdown.
 func (app *App) ListenAndServe() error {
 	if err := app.Prepare(); err != nil {
 		return err
@@ -824,24 +1015,227 @@ func (app *App) ListenAndServe() error {
 		return err
 	}
 	signal.Emit(WILL_LISTEN, app)
+	ln, err := net.Listen("tcp", app.address+":"+strconv.Itoa(app.cfg.Port))
+	if err != nil {
+		return err
+	}
+	return app.serveListener(ln)
+}
+
+// serveListener serves the App on ln until the server fails or the App is
+// stopped. In the latter case, it waits for Shutdown to finish.
+func (app *App) serveListener(ln net.Listener) error {
+	server := &http.Server{
+		Handler: app,
+	}
+	useTLS := app.cfg.TLS()
+	if useTLS {
+		tlsConfig, err := app.tlsConfig()
+		if err != nil {
+			ln.Close()
+			return fmt.Errorf("error loading TLS certificate: %s", err)
+		}
+		server.TLSConfig = tlsConfig
+	}
 	app.started = time.Now().UTC()
 	if app.Logger != nil && os.Getenv("GONDOLA_DEV_SERVER") == "" {
+		scheme := "HTTP"
+		if useTLS {
+			scheme = "HTTPS"
+		}
+		port := app.cfg.Port
+		if addr, ok := ln.Addr().(*net.TCPAddr); ok {
+			port = addr.Port
+		}
 		if app.address != "" {
-			app.Logger.Infof("Listening on %s, port %d", app.address, app.cfg.Port)
+			app.Logger.Infof("Listening on %s, port %d (%s)", app.address, port, scheme)
 		} else {
-			app.Logger.Infof("Listening on port %d", app.cfg.Port)
+			app.Logger.Infof("Listening on port %d (%s)", port, scheme)
+		}
+	}
+	var redirect *http.Server
+	if useTLS && app.cfg.TLSRedirectPort > 0 {
+		redirect = app.newRedirectServer()
+	}
+	app.mu.Lock()
+	app.server = server
+	app.redirectServer = redirect
+	app.stopped = make(chan struct{})
+	app.shutdownCtx = nil
+	app.closing = false
+	stopped := app.stopped
+	app.mu.Unlock()
+	stopListening := listenStopSignals(func(sig os.Signal) {
+		if app.Logger != nil {
+			app.Logger.Infof("Received %s, stopping", sig)
 		}
+		ctx, cancel := context.WithTimeout(context.Background(), app.ShutdownTimeout())
+		defer cancel()
+		if err := app.Shutdown(ctx); err != nil && app.Logger != nil {
+			app.Logger.Errorf("error stopping app: %s", err)
+		}
+	})
+	defer stopListening()
+	if redirect != nil {
+		go func() {
+			if err := redirect.ListenAndServe(); err != nil && err != http.ErrServerClosed && app.Logger != nil {
+				app.Logger.Errorf("error listening for HTTP redirects on port %d: %s", app.cfg.TLSRedirectPort, err)
+			}
+		}()
+	}
+	// ln is already accepting connections, they'll
+	// be served as soon as Serve starts.
+	signal.Emit(DID_LISTEN, app)
+	var err error
+	if useTLS {
+		// Certificates are provided by TLSConfig.GetCertificate
+		err = server.ServeTLS(ln, "", "")
+	} else {
+		err = server.Serve(ln)
+	}
+	if err == http.ErrServerClosed {
+		// Shutdown was called, wait for it to finish
+		<-stopped
+		return nil
+	}
+	if redirect != nil {
+		redirect.Close()
+	}
+	return err
+}
+
+// Shutdown gracefully stops the App. First, WILL_STOP is emitted and the
+// App stops accepting new connections. Then, Shutdown waits for all the
+// requests being served and the background contexts started with Context.Go
+// to finish, as well as the events already dispatched to the asynchronous
+// listeners in gnd.la/signal.DefaultBus (which is shared by the whole process,
+// so it's not closed). Finally, the App Orm, Cache and Blobstore are closed
+// and DID_STOP is emitted. Any scheduled tasks from gnd.la/tasks are stopped too.
+//
+// If ctx expires before the pending requests and background contexts finish,
+// the App resources are closed anyway and the error from ctx is returned.
+// Shutdown might be called from any goroutine and ListenAndServe won't return
+// until Shutdown has finished. Calling Shutdown again while the App is
+// stopping or after it has stopped does nothing and returns nil.
+func (app *App) Shutdown(ctx context.Context) error {
+	app.mu.Lock()
+	if app.shutdownCtx != nil {
+		app.mu.Unlock()
+		return nil
 	}
+	server := app.server
+	redirect := app.redirectServer
+	stopped := app.stopped
+	app.server = nil
+	app.redirectServer = nil
+	app.stopped = nil
+	app.shutdownCtx = ctx
+	app.mu.Unlock()
+	signal.Emit(WILL_STOP, app)
 	var err error
-	time.AfterFunc(500*time.Millisecond, func() {
+	if redirect != nil {
+		redirect.Shutdown(ctx)
+	}
+	if server != nil {
+		err = server.Shutdown(ctx)
+	}
+	// Requests have been drained, so background contexts
+	// can't be started from them anymore. Context.Go checks
+	// this value while holding mu, so no new background
+	// contexts are added once we start waiting for them.
+	app.mu.Lock()
+	app.closing = true
+	app.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		app.background.Wait()
+		if app.parent == nil {
+			// Let the asynchronous event listeners finish
+			signal.DefaultBus.Wait()
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
 		if err == nil {
-			signal.Emit(DID_LISTEN, app)
+			err = ctx.Err()
 		}
-	})
-	err = http.ListenAndServe(app.address+":"+strconv.Itoa(app.cfg.Port), app)
+	}
+	if cerr := app.closeResources(); cerr != nil && err == nil {
+		err = cerr
+	}
+	signal.Emit(DID_STOP, app)
+	if stopped != nil {
+		close(stopped)
+	}
+	return err
+}
+
+// ShutdownContext returns the context.Context passed to Shutdown,
+// or nil if the App is not shutting down. Listeners for WILL_STOP
+// might use it for limiting the time they wait for any pending work.
+func (app *App) ShutdownContext() context.Context {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	return app.shutdownCtx
+}
+
+// closeResources closes the Orm, Cache and Blobstore
+// shared by this app and its included apps. It returns
+// the first error found while closing them.
+func (app *App) closeResources() error {
+	if app.parent != nil {
+		// Resources are owned by the parent
+		return nil
+	}
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	var err error
+	if app.o != nil {
+		err = app.o.Orm.Close()
+		app.o = nil
+	}
+	if app.c != nil {
+		if cerr := app.c.Cache.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		app.c = nil
+	}
+	if app.store != nil {
+		if serr := app.store.Close(); serr != nil && err == nil {
+			err = serr
+		}
+		app.store = nil
+	}
+	for _, v := range app.included {
+		v.app.resetResources()
+	}
 	return err
 }
 
+// resetResources removes the references to the resources
+// shared with the parent app, after they have been closed.
+func (app *App) resetResources() {
+	app.mu.Lock()
+	app.o = nil
+	app.c = nil
+	app.store = nil
+	app.mu.Unlock()
+	for _, v := range app.included {
+		v.app.resetResources()
+	}
+}
+
+// root returns the top level app, which is the app itself unless
+// it has been included into another one.
+func (app *App) root() *App {
+	for app.parent != nil {
+		app = app.parent
+	}
+	return app
+}
+
 // MustListenAndServe works like ListenAndServe, but panics if
 // there's an error
 func (app *App) MustListenAndServe() {
@@ -919,17 +1313,55 @@ func (app *App) readXHeaders(r *http.Request) {
 }
 
 func (app *App) handleHTTPError(ctx *Context, error string, code int) {
+	app.sendError(ctx, nil, error, code, nil)
+}
+
+// sendError sends an error response with the given message and code,
+// giving the App error handler the opportunity to intercept it. If
+// there's no error handler or it doesn't handle the error, the response
+// is written by writeError. err is the original error, if any, while f
+// is the format for the response (nil means negotiating it with the
+// client, see Context.errorFormat).
+func (app *App) sendError(ctx *Context, err error, message string, code int, f *responseFormat) {
 	ctx.statusCode = -code
 	defer app.recover(ctx)
-	if app.errorHandler == nil || !app.errorHandler(ctx, error, code) {
-		http.Error(ctx, error, code)
+	if app.errorHandler == nil || !app.errorHandler(ctx, message, code) {
+		app.writeError(ctx, err, message, code, f)
+	}
+}
+
+// writeError writes the default response for an error, which is an
+// ErrorDocument (including the invalid fields for errors from
+// Context.Bind) for clients which prefer JSON, XML or msgpack and
+// plain text otherwise. If f is nil, the format is only negotiated
+// for errors from Context.Bind or when error documents are enabled.
+func (app *App) writeError(ctx *Context, err error, message string, code int, f *responseFormat) {
+	if f == nil {
+		_, isBind := err.(*BindError)
+		if !isBind && !app.errorDocuments {
+			http.Error(ctx, message, code)
+			return
+		}
+		addVary(ctx.Header(), "Accept")
+		if f = ctx.errorFormat(err); f == nil {
+			http.Error(ctx, message, code)
+			return
+		}
+	}
+	doc := &ErrorDocument{Code: code, Message: message}
+	if berr, ok := err.(*BindError); ok {
+		doc.Message = berr.Message
+		doc.Fields = berr.Fields
+	}
+	if werr := ctx.writeResponse(f, "", doc); werr != nil {
+		ctx.logger().Errorf("error writing error document: %s", werr)
 	}
 }
 
 func (app *App) handleError(ctx *Context, err interface{}) bool {
 	if gerr, ok := err.(Error); ok {
 		log.Debugf("HTTP error: %s (%d)", gerr.Error(), gerr.StatusCode())
-		app.handleHTTPError(ctx, gerr.Error(), gerr.StatusCode())
+		app.sendError(ctx, gerr, gerr.Error(), gerr.StatusCode(), nil)
 		return true
 	}
 	return false
@@ -1106,13 +1538,23 @@ func (app *App) serveOrNotFound(path string, ctx *Context) {
 }
 
 func (app *App) serve(path string, ctx *Context) bool {
-	if handler := app.matchHandler(path, ctx); handler != nil {
-		handler(ctx)
+	handler, allowed := app.matchHandler(path, ctx)
+	if handler != nil {
+		runMiddlewares(ctx, app.middlewares, handler)
+		return true
+	}
+	if allowed != nil {
+		ctx.Header().Set("Allow", allowHeader(allowed))
+		if ctx.R.Method == "OPTIONS" {
+			ctx.WriteHeader(http.StatusOK)
+		} else {
+			app.handleHTTPError(ctx, "Method Not Allowed", http.StatusMethodNotAllowed)
+		}
 		return true
 	}
 
 	if app.appendSlash && (ctx.R.Method == "GET" || ctx.R.Method == "HEAD") && !strings.HasSuffix(path, "/") {
-		if app.matchHandler(path+"/", ctx) != nil {
+		if handler, _ := app.matchHandler(path+"/", ctx); handler != nil {
 			prevPath := ctx.R.URL.Path
 			ctx.R.URL.Path += "/"
 			ctx.Redirect(ctx.R.URL.String(), true)
@@ -1123,28 +1565,43 @@ func (app *App) serve(path string, ctx *Context) bool {
 	return false
 }
 
-func (app *App) matchHandler(path string, ctx *Context) Handler {
-	for _, v := range app.handlers {
+// matchHandler returns the handler for the given path and the request
+// in ctx. If no handler matches but there are handlers for the path
+// restricted to other methods, it returns a non-nil slice with
+// the methods accepted by them.
+func (app *App) matchHandler(path string, ctx *Context) (Handler, []string) {
+	method := ctx.R.Method
+	info, values, allowed := app.router.match(ctx.R.Host, path, method)
+	for _, v := range app.regexpHandlers {
+		if info != nil && v.order > info.order {
+			break
+		}
 		if v.host != "" && v.host != ctx.R.Host {
 			continue
 		}
-		if v.path != "" {
-			if v.path == path {
-				ctx.reProvider.reset(v.re, path, v.pathMatch)
-				ctx.handlerName = v.name
-				return v.handler
-			}
-		} else {
-			// Use FindStringSubmatchIndex, since this way we can
-			// reuse the slices used to store context arguments
-			if m := v.re.FindStringSubmatchIndex(path); m != nil {
-				ctx.reProvider.reset(v.re, path, m)
-				ctx.handlerName = v.name
-				return v.handler
+		// Use FindStringSubmatchIndex, since this way we can
+		// reuse the slices used to store context arguments
+		if m := v.re.FindStringSubmatchIndex(path); m != nil {
+			if !v.allows(method) {
+				allowed = append(allowed, v.methods...)
+				continue
 			}
+			ctx.reProvider.reset(v.re, path, m)
+			ctx.provider = ctx.reProvider
+			ctx.handlerName = v.name
+			return v.handler, nil
 		}
 	}
-	return nil
+	if info != nil {
+		if ctx.roProvider == nil {
+			ctx.roProvider = &routeProvider{}
+		}
+		ctx.roProvider.reset(info.params, values)
+		ctx.provider = ctx.roProvider
+		ctx.handlerName = info.name
+		return info.handler, nil
+	}
+	return nil, allowed
 }
 
 // newContext returns a new context, using the
@@ -1155,6 +1612,11 @@ func (app *App) newContext(w http.ResponseWriter, r *http.Request) *Context {
 	if app.trustXHeaders {
 		app.readXHeaders(r)
 	}
+	if r.TLS != nil {
+		if hsts := app.hstsHeader(); hsts != "" {
+			w.Header().Set("Strict-Transport-Security", hsts)
+		}
+	}
 	return ctx
 }
 
@@ -1185,6 +1647,9 @@ func (app *App) CloseContext(ctx *Context) {
 		v(ctx)
 	}
 	ctx.Close()
+	if !ctx.background && ctx.R != nil {
+		observeRequest(ctx)
+	}
 	if !ctx.background && app.Logger != nil && ctx.R != nil && ctx.R.URL.Path != devStatusPage && ctx.R.URL.Path != monitorAPIPage {
 		// Log at most with Warning level, to avoid potentially generating
 		// an email to the admin when running in production mode. If there
@@ -1347,6 +1812,17 @@ func (app *App) Clone() *App {
 	for k, v := range app.values {
 		a.values[k] = v
 	}
+	// Don't share the router tree, otherwise handlers
+	// added to the clone would be added to both apps.
+	a.handlers = append([]*handlerInfo(nil), app.handlers...)
+	a.regexpHandlers = append([]*handlerInfo(nil), app.regexpHandlers...)
+	a.middlewares = append([]*Middleware(nil), app.middlewares...)
+	a.router = router{}
+	for _, v := range a.handlers {
+		if v.tokens != nil {
+			a.router.add(v.host, v.tokens, v)
+		}
+	}
 	return &a
 }
 
@@ -1381,6 +1857,11 @@ func (app *App) Prepare() error {
 			return err
 		}
 	}
+	if p := app.cfg.MetricsPath; p != "" && app.parent == nil {
+		// Add the metrics handler before any other one, so
+		// catch-all handlers don't shadow it.
+		app.handle("^"+regexp.QuoteMeta(p)+"$", metricsHandler, &HandlerOptions{Name: "gondola-metrics"}, true)
+	}
 	signal.Emit(WILL_PREPARE, app)
 	if s := app.cfg.Secret; s != "" && len(s) < 32 && os.Getenv("GONDOLA_ALLOW_SHORT_SECRET") == "" {
 		if os.Getenv("GONDOLA_IS_DEV_SERVER") != "" {
@@ -1398,6 +1879,7 @@ func (app *App) Prepare() error {
 		child.Cipherer = app.Cipherer
 		child.languageHandler = app.languageHandler
 		child.userFunc = app.userFunc
+		child.sessions = app.sessions
 		child.Logger = app.Logger
 	}
 	// Add hooks from each included app to all the other apps
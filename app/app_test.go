@@ -1,9 +1,17 @@
 package app_test
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"gnd.la/app"
 	"gnd.la/app/tester"
+	"gnd.la/log"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -48,3 +56,156 @@ func TestGoWait(t *testing.T) {
 	tt.Get("/wait", nil).Expect("43")
 	tt.Get("/nowait", nil).Expect("42")
 }
+
+// metricValue returns the value for the given sample in
+// the metrics output body, or 0 if it's not present.
+func metricValue(t *testing.T, body string, sample string) float64 {
+	for _, line := range strings.Split(body, "\n") {
+		if strings.HasPrefix(line, sample+" ") {
+			v, err := strconv.ParseFloat(strings.TrimSpace(line[len(sample):]), 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return v
+		}
+	}
+	return 0
+}
+
+func TestMetricsPath(t *testing.T) {
+	a := app.New()
+	a.Config().MetricsPath = "/metrics"
+	a.HandleNamed("^/hello$", func(ctx *app.Context) {
+		ctx.WriteString("hello")
+	}, "hello")
+	a.Handle("^/", func(ctx *app.Context) {
+		ctx.NotFound("")
+	})
+	if err := a.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(a)
+	defer srv.Close()
+	readMetrics := func() string {
+		resp, err := http.Get(srv.URL + "/metrics")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	// Metrics are shared by all the apps in the process, so
+	// other tests might have already updated them.
+	samples := []struct {
+		sample string
+		delta  float64
+	}{
+		{"gondola_http_requests_total{handler=\"hello\",code=\"200\"}", 2},
+		{"gondola_http_requests_total{handler=\"\",code=\"404\"}", 1},
+		{"gondola_http_request_duration_seconds_count{handler=\"hello\"}", 2},
+	}
+	before := readMetrics()
+	for _, p := range []string{"/hello", "/hello", "/missing"} {
+		resp, err := http.Get(srv.URL + p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	after := readMetrics()
+	for _, v := range samples {
+		if d := metricValue(t, after, v.sample) - metricValue(t, before, v.sample); d != v.delta {
+			t.Errorf("expecting %s to increase by %v, got %v:\n%s", v.sample, v.delta, d, after)
+		}
+	}
+}
+
+func TestLoggerFields(t *testing.T) {
+	var buf bytes.Buffer
+	a := app.New()
+	a.Logger = log.New(log.NewJSONWriter(&buf, log.LDebug), log.LstdFlags, log.LDebug)
+	a.SetTrustXHeaders(true)
+	a.HandleNamed("^/$", func(ctx *app.Context) {
+		ctx.Logger().Info("hello")
+		ctx.Go(func(bg *app.Context) {
+			bg.Logger().Info("background")
+		})
+		ctx.Wait()
+	}, "index")
+	srv := httptest.NewServer(a)
+	defer srv.Close()
+	req, err := http.NewRequest("GET", srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Request-Id", "abcdef")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	// Handler message + background message + request log
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte{'\n'})
+	if len(lines) != 3 {
+		t.Fatalf("expecting 3 log lines, got %d: %s", len(lines), buf.String())
+	}
+	for ii, msg := range []string{"hello", "background"} {
+		var m map[string]interface{}
+		if err := json.Unmarshal(lines[ii], &m); err != nil {
+			t.Fatal(err)
+		}
+		expected := map[string]interface{}{
+			"level":       "info",
+			"msg":         msg,
+			"request_id":  "abcdef",
+			"handler":     "index",
+			"remote_addr": "127.0.0.1",
+		}
+		for k, v := range expected {
+			if m[k] != v {
+				t.Errorf("expecting %s = %v in message %q, got %v", k, v, msg, m[k])
+			}
+		}
+	}
+}
+
+func TestLoggerCache(t *testing.T) {
+	var buf bytes.Buffer
+	a := app.New()
+	a.Config().Secret = "ha3dkhGgvP8JhdBFjO3oFnyf2Kc9aVBq"
+	a.Logger = log.New(log.NewJSONWriter(&buf, log.LDebug), log.LstdFlags, log.LDebug)
+	a.SetUserFunc(func(ctx *app.Context, id int64) app.User {
+		return sessionUser(id)
+	})
+	a.HandleNamed("^/$", func(ctx *app.Context) {
+		logger := ctx.Logger()
+		if ctx.Logger() != logger {
+			t.Error("Context.Logger() was not cached")
+		}
+		ctx.MustSignIn(sessionUser(7))
+		logger = ctx.Logger()
+		logger.Info("signed in")
+		if ctx.Logger() != logger {
+			t.Error("Context.Logger() was not cached after signing in")
+		}
+	}, "index")
+	srv := httptest.NewServer(a)
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte{'\n'})
+	var m map[string]interface{}
+	if err := json.Unmarshal(lines[0], &m); err != nil {
+		t.Fatal(err)
+	}
+	if m["msg"] != "signed in" || m["user_id"] != float64(7) {
+		t.Errorf("expecting message with user_id = 7, got %s", lines[0])
+	}
+}
@@ -4,6 +4,7 @@ package app
 
 import (
 	"errors"
+	"os"
 
 	"gnd.la/blobstore"
 	"gnd.la/cache"
@@ -76,6 +77,11 @@ func (app *App) checkPort() error {
 	return nil
 }
 
+func listenStopSignals(f func(os.Signal)) func() {
+	// App Engine manages the instance lifecycle
+	return func() {}
+}
+
 func (c *Context) cache() *Cache {
 	ca, err := cache.New(c.app.cfg.Cache)
 	if err != nil {
@@ -0,0 +1,368 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"gnd.la/encoding/codec"
+	"gnd.la/form/input"
+	"gnd.la/i18n"
+	"gnd.la/util/structs"
+)
+
+const (
+	// MaxBindBodySize is the maximum request body size, in bytes,
+	// accepted by Context.Bind.
+	MaxBindBodySize = 10 << 20
+	// StatusUnprocessableEntity is the status code sent when the
+	// request body passed to Context.Bind fails validation.
+	StatusUnprocessableEntity = 422
+)
+
+var (
+	bindTags      = []string{"form", "gondola"}
+	parserType    = reflect.TypeOf((*input.Parser)(nil)).Elem()
+	errBindTarget = fmt.Errorf("Bind requires a non-nil pointer to a struct")
+)
+
+type bindFormat int
+
+const (
+	bindForm bindFormat = iota
+	bindJSON
+	bindXML
+	bindMsgpack
+)
+
+// FieldError represents a validation error in a field of
+// a value passed to Context.Bind.
+type FieldError struct {
+	XMLName xml.Name `json:"-" xml:"field"`
+	// Field is the name of the field, as it appears in the request
+	// body (e.g. the JSON key for JSON bodies).
+	Field string `json:"field" xml:"name,attr"`
+	// Message is the translated error message.
+	Message string `json:"message" xml:",chardata"`
+}
+
+// BindError is returned by Context.Bind when the request body can't
+// be decoded or fails validation. Its status code is 400 for malformed
+// bodies, 413 for bodies bigger than MaxBindBodySize, 415 for unsupported
+// content types and 422 (StatusUnprocessableEntity) for validation errors.
+//
+// When used as an Error (e.g. by panicking with it or using Context.MustBind)
+// or passed to Context.Respond, the App replies with an ErrorDocument which
+// includes the field errors, encoded in the format preferred by the client
+// or, when it has no preference, in the same format as the request body
+// (XML for XML requests, JSON otherwise), like:
+//
+//  {"code": 422, "message": "invalid data", "errors": [{"field": "username", "message": "too short (minimum length is 4)"}]}
+type BindError struct {
+	// Message is the translated error message.
+	Message string
+	// Fields contains an error for each invalid field.
+	Fields []*FieldError
+	code   int
+	format bindFormat
+	err    error
+}
+
+// StatusCode implements the Error interface.
+func (e *BindError) StatusCode() int {
+	return e.code
+}
+
+func (e *BindError) Error() string {
+	if e.err != nil {
+		return fmt.Sprintf("%s: %s", e.Message, e.err)
+	}
+	if len(e.Fields) > 0 {
+		fields := make([]string, len(e.Fields))
+		for ii, v := range e.Fields {
+			fields[ii] = fmt.Sprintf("%s: %s", v.Field, v.Message)
+		}
+		return fmt.Sprintf("%s (%s)", e.Message, strings.Join(fields, ", "))
+	}
+	return e.Message
+}
+
+// Field returns the error for the given field, or nil if
+// the field has no errors.
+func (e *BindError) Field(name string) *FieldError {
+	for _, v := range e.Fields {
+		if v.Field == name {
+			return v
+		}
+	}
+	return nil
+}
+
+// responseFormat returns the format used for sending the
+// error when the client has no preference.
+func (e *BindError) responseFormat() *responseFormat {
+	if e.format == bindXML {
+		return xmlFormat
+	}
+	return jsonFormat
+}
+
+// Bind decodes the request body into v, which must be a pointer to a
+// struct, and validates it. The format is selected using the request
+// Content-Type: JSON, XML and msgpack (only when gnd.la/encoding/codec/msgpack
+// has been imported) bodies are decoded using their respective encoders,
+// while form encoded bodies (as well as requests without a body, whose
+// query parameters are used) are parsed like gnd.la/form does, with
+// field names obtained from the "form" tag.
+//
+// Once decoded, v is validated using the same rules as gnd.la/form: the
+// max_length, min_length, alphanumeric, required and optional tag options
+// and the Validate<Field> functions (see gnd.la/util/structs.Validate), which
+// receive the *Context as their argument. Note that fields in form encoded
+// bodies are required unless tagged as optional, like in forms, while fields
+// in the other formats are only required when tagged as such, since their
+// zero values can't be told apart from missing values.
+//
+// If there are any errors, a *BindError is returned, with its messages
+// translated to the request language.
+func (c *Context) Bind(v interface{}) error {
+	val := reflect.ValueOf(v)
+	if val.Kind() != reflect.Ptr || val.IsNil() || val.Elem().Kind() != reflect.Struct {
+		panic(errBindTarget)
+	}
+	s, err := structs.NewStruct(v, bindTags)
+	if err != nil {
+		panic(err)
+	}
+	format, berr := c.decodeBody(v)
+	if berr != nil {
+		return berr
+	}
+	var fields []*FieldError
+	addError := func(name string, err error) {
+		fields = append(fields, &FieldError{
+			Field:   name,
+			Message: i18n.TranslatedError(err, c).Error(),
+		})
+	}
+	elem := val.Elem()
+	for ii, mname := range s.MNames {
+		field, ok := bindField(elem, s.Indexes[ii])
+		if !ok {
+			continue
+		}
+		name := bindFieldName(s.Type, s.Indexes[ii], format, mname)
+		tag := s.Tags[ii]
+		if format == bindForm {
+			if err := c.bindFormValue(mname, field, tag); err != nil {
+				addError(name, err)
+				continue
+			}
+		} else if err := validateBindValue(field, tag); err != nil {
+			addError(name, err)
+			continue
+		}
+		indexes := s.Indexes[ii]
+		parent, _ := bindField(elem, indexes[:len(indexes)-1])
+		if err := structs.Validate(parent.Addr().Interface(), s.QNames[ii], c); err != nil {
+			addError(name, err)
+		}
+	}
+	if len(fields) > 0 {
+		return &BindError{
+			Message: i18n.T(c, "invalid data"),
+			Fields:  fields,
+			code:    StatusUnprocessableEntity,
+			format:  format,
+		}
+	}
+	return nil
+}
+
+// MustBind works like Bind, but panics with the *BindError
+// if there are any errors, so the App replies with the error
+// document.
+func (c *Context) MustBind(v interface{}) {
+	if err := c.Bind(v); err != nil {
+		panic(err)
+	}
+}
+
+func (c *Context) decodeBody(v interface{}) (bindFormat, *BindError) {
+	if c.R == nil {
+		return bindForm, nil
+	}
+	ct := c.R.Header.Get("Content-Type")
+	mediaType, _, _ := mime.ParseMediaType(ct)
+	var format bindFormat
+	switch {
+	case mediaType == "", mediaType == "application/x-www-form-urlencoded", mediaType == "multipart/form-data":
+		return bindForm, nil
+	case mediaType == "application/json", strings.HasSuffix(mediaType, "+json"):
+		format = bindJSON
+	case mediaType == "application/xml", mediaType == "text/xml", strings.HasSuffix(mediaType, "+xml"):
+		format = bindXML
+	case mediaType == "application/msgpack", mediaType == "application/x-msgpack":
+		format = bindMsgpack
+	default:
+		return bindForm, c.bindError(http.StatusUnsupportedMediaType, bindForm, fmt.Errorf("content type %q", ct))
+	}
+	if c.R.Body == nil {
+		return format, nil
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(c.R.Body, MaxBindBodySize+1))
+	if err != nil {
+		return format, c.bindError(http.StatusBadRequest, format, err)
+	}
+	if len(data) > MaxBindBodySize {
+		return format, c.bindError(http.StatusRequestEntityTooLarge, format, nil)
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return format, nil
+	}
+	switch format {
+	case bindJSON:
+		err = json.Unmarshal(data, v)
+	case bindXML:
+		err = xml.Unmarshal(data, v)
+	case bindMsgpack:
+		cod := codec.Get("msgpack")
+		if cod == nil {
+			return format, c.bindError(http.StatusUnsupportedMediaType, bindForm, fmt.Errorf("msgpack codec is not registered"))
+		}
+		err = cod.Decode(data, v)
+	}
+	if err != nil {
+		return format, c.bindError(http.StatusBadRequest, format, err)
+	}
+	return format, nil
+}
+
+func (c *Context) bindError(code int, format bindFormat, err error) *BindError {
+	return &BindError{
+		Message: defaultMessages[code].TranslatedString(c),
+		code:    code,
+		format:  format,
+		err:     err,
+	}
+}
+
+func (c *Context) bindFormValue(name string, field reflect.Value, tag *structs.Tag) error {
+	if !isBindParseable(field.Type()) {
+		return nil
+	}
+	if c.R != nil && c.R.Form == nil {
+		c.R.ParseMultipartForm(MaxBindBodySize)
+	}
+	if c.R == nil || c.R.Form == nil {
+		return validateBindValue(field, tag)
+	}
+	if _, ok := c.R.Form[name]; !ok {
+		// Keep the current value, but check it
+		// like if it was submitted.
+		if field.Kind() != reflect.Bool && !tag.Optional() && isZero(field) {
+			return input.RequiredInputError("")
+		}
+		return validateBindValue(field, tag)
+	}
+	return input.Input(c.FormValue(name), field.Addr().Interface(), tag, true)
+}
+
+// validateBindValue checks the value against the constraints
+// in its tag.
+func validateBindValue(field reflect.Value, tag *structs.Tag) error {
+	if tag.Required() && isZero(field) {
+		return input.RequiredInputError("")
+	}
+	if field.Kind() == reflect.String {
+		var s string
+		return input.Input(field.String(), &s, tag, false)
+	}
+	return nil
+}
+
+func isBindParseable(typ reflect.Type) bool {
+	if typ.Implements(parserType) || reflect.PtrTo(typ).Implements(parserType) {
+		return true
+	}
+	switch typ.Kind() {
+	case reflect.Bool, reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+func isZero(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	}
+	return reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface())
+}
+
+// bindField returns the field at the given indexes, allocating
+// any nil pointers to embedded structs in the way. Pointers in the
+// field itself are only followed when they're not nil. The second
+// return value is false if the field can't be addressed.
+func bindField(v reflect.Value, indexes []int) (reflect.Value, bool) {
+	for ii, idx := range indexes {
+		v = v.Field(idx)
+		if ii < len(indexes)-1 {
+			for v.Kind() == reflect.Ptr {
+				if v.IsNil() {
+					v.Set(reflect.New(v.Type().Elem()))
+				}
+				v = v.Elem()
+			}
+		}
+	}
+	for v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	}
+	return v, v.CanAddr()
+}
+
+// bindFieldName returns the name of the field as it's used
+// in the request body with the given format.
+func bindFieldName(typ reflect.Type, indexes []int, format bindFormat, mname string) string {
+	var key string
+	switch format {
+	case bindJSON:
+		key = "json"
+	case bindXML:
+		key = "xml"
+	case bindMsgpack:
+	default:
+		return mname
+	}
+	names := make([]string, len(indexes))
+	for ii, idx := range indexes {
+		for typ.Kind() == reflect.Ptr {
+			typ = typ.Elem()
+		}
+		field := typ.Field(idx)
+		name := field.Name
+		if key != "" {
+			if tag := strings.Split(field.Tag.Get(key), ",")[0]; tag != "" && tag != "-" {
+				// Ignore XML paths like a>b
+				if p := strings.LastIndex(tag, ">"); p >= 0 {
+					tag = tag[p+1:]
+				}
+				name = tag
+			}
+		}
+		names[ii] = name
+		typ = field.Type
+	}
+	return strings.Join(names, ".")
+}
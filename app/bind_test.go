@@ -0,0 +1,140 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+type bindTest struct {
+	Username string `form:",min_length=4,max_length=16,alphanumeric" json:"username" xml:"username"`
+	Email    string `form:",optional" json:"email" xml:"email"`
+	Age      int    `form:",optional" json:"age" xml:"age"`
+	Admin    bool   `json:"admin" xml:"admin"`
+}
+
+func (b *bindTest) ValidateAge(ctx *Context) error {
+	if b.Age < 0 {
+		return errors.New("age can't be negative")
+	}
+	return nil
+}
+
+func bindTestContext(a *App, method string, contentType string, body string) *Context {
+	r, _ := http.NewRequest(method, "http://localhost/bind/", strings.NewReader(body))
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	return a.newContext(httptest.NewRecorder(), r)
+}
+
+func TestBind(t *testing.T) {
+	a := New()
+	type bindResult struct {
+		contentType string
+		body        string
+		code        int
+		fields      []string
+		expect      bindTest
+	}
+	form := url.Values{"username": {"gondola"}, "age": {"7"}, "admin": {"on"}}
+	tests := []*bindResult{
+		{"application/json", `{"username": "gondola", "age": 7, "admin": true}`, 0, nil, bindTest{Username: "gondola", Age: 7, Admin: true}},
+		{"application/json; charset=utf-8", `{"username": "go-la", "age": -1}`, 422, []string{"username", "age"}, bindTest{}},
+		{"application/json", `{"username": `, 400, nil, bindTest{}},
+		{"application/xml", `<bindTest><username>gondola</username><age>7</age></bindTest>`, 0, nil, bindTest{Username: "gondola", Age: 7}},
+		{"text/xml", `<bindTest><username>go</username></bindTest>`, 422, []string{"username"}, bindTest{}},
+		{"application/x-www-form-urlencoded", form.Encode(), 0, nil, bindTest{Username: "gondola", Age: 7, Admin: true}},
+		{"application/x-www-form-urlencoded", "age=7", 422, []string{"username"}, bindTest{}},
+		{"application/x-www-form-urlencoded", "username=gondola&age=seven", 422, []string{"age"}, bindTest{}},
+		{"text/plain", "gondola", 415, nil, bindTest{}},
+	}
+	for _, v := range tests {
+		var b bindTest
+		err := bindTestContext(a, "POST", v.contentType, v.body).Bind(&b)
+		if v.code == 0 {
+			if err != nil {
+				t.Errorf("error binding %s %q: %s", v.contentType, v.body, err)
+			} else if b != v.expect {
+				t.Errorf("binding %s %q: expecting %+v, got %+v", v.contentType, v.body, v.expect, b)
+			}
+			continue
+		}
+		berr, ok := err.(*BindError)
+		if !ok {
+			t.Errorf("binding %s %q: expecting *BindError, got %v", v.contentType, v.body, err)
+			continue
+		}
+		if berr.StatusCode() != v.code {
+			t.Errorf("binding %s %q: expecting code %d, got %d (%s)", v.contentType, v.body, v.code, berr.StatusCode(), berr)
+		}
+		if len(berr.Fields) != len(v.fields) {
+			t.Errorf("binding %s %q: expecting errors in %v, got %s", v.contentType, v.body, v.fields, berr)
+			continue
+		}
+		for _, f := range v.fields {
+			if berr.Field(f) == nil {
+				t.Errorf("binding %s %q: expecting error in field %s, got %s", v.contentType, v.body, f, berr)
+			}
+		}
+	}
+}
+
+func TestBindErrorDocument(t *testing.T) {
+	a := New()
+	a.Handle("/bind/", func(ctx *Context) {
+		var b bindTest
+		ctx.MustBind(&b)
+		ctx.WriteString("ok")
+	})
+	r, _ := http.NewRequest("POST", "http://localhost/bind/", strings.NewReader(`{"username": "go"}`))
+	r.Header.Set("Content-Type", "application/json")
+	w := serveTestRequest(a, r)
+	if w.Code != StatusUnprocessableEntity {
+		t.Fatalf("expecting code %d, got %d", StatusUnprocessableEntity, w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("expecting JSON error document, got %q", ct)
+	}
+	var doc struct {
+		Message string
+		Errors  []*FieldError
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.Message == "" || len(doc.Errors) != 1 || doc.Errors[0].Field != "username" || doc.Errors[0].Message == "" {
+		t.Errorf("unexpected error document %s", w.Body.String())
+	}
+}
+
+func TestBindErrorHandler(t *testing.T) {
+	a := New()
+	a.Handle("/bind/", func(ctx *Context) {
+		var b bindTest
+		ctx.MustBind(&b)
+		ctx.WriteString("ok")
+	})
+	var handled int
+	a.SetErrorHandler(func(ctx *Context, msg string, code int) bool {
+		handled = code
+		ctx.WriteString("custom error")
+		return true
+	})
+	r, _ := http.NewRequest("POST", "http://localhost/bind/", strings.NewReader(`{"username": "go"}`))
+	r.Header.Set("Content-Type", "application/json")
+	w := serveTestRequest(a, r)
+	if handled != StatusUnprocessableEntity {
+		t.Errorf("expecting error handler to be called with code %d, got %d", StatusUnprocessableEntity, handled)
+	}
+	if w.Code != StatusUnprocessableEntity {
+		t.Errorf("expecting code %d, got %d", StatusUnprocessableEntity, w.Code)
+	}
+	if body := w.Body.String(); body != "custom error" {
+		t.Errorf("expecting body from the error handler, got %q", body)
+	}
+}
@@ -24,6 +24,32 @@ type Config struct {
 	Database  *config.URL `help:"Default database to use, used by Context.Orm()"`
 	Cache     *config.URL `help:"Default cache, returned by Context.Cache()"`
 	Blobstore *config.URL `help:"Default blobstore, returned by Context.Blobstore()"`
+	// TLSCertificate is the path to the PEM encoded certificate
+	// (optionally followed by the intermediate certificates) used
+	// for serving HTTPS. If both TLSCertificate and TLSKey are set,
+	// the app will serve HTTPS and HTTP/2 on Port. Changes to the
+	// certificate and key files are picked up without restarting
+	// the app.
+	TLSCertificate string `help:"Path to the TLS certificate. If set with tls-key, the app serves HTTPS"`
+	// TLSKey is the path to the PEM encoded private key for
+	// TLSCertificate.
+	TLSKey string `help:"Path to the TLS private key"`
+	// TLSRedirectPort indicates the port where the app will
+	// listen on plain HTTP and redirect every request to HTTPS.
+	// If zero, no redirecting listener is started. It has no
+	// effect unless TLS is enabled.
+	TLSRedirectPort int `help:"If non-zero, redirect plain HTTP requests on this port to HTTPS"`
+	// HSTSMaxAge is the value in seconds for the max-age directive
+	// of the Strict-Transport-Security header sent with every
+	// response served over HTTPS. If zero, the header is not sent.
+	HSTSMaxAge int `help:"If non-zero, send a Strict-Transport-Security header with this max-age over HTTPS"`
+	// HSTSIncludeSubdomains adds the includeSubDomains directive
+	// to the Strict-Transport-Security header.
+	HSTSIncludeSubdomains bool `help:"Add includeSubDomains to the Strict-Transport-Security header"`
+	// MetricsPath is the path where the app serves its metrics
+	// (see gnd.la/app/metrics) using the Prometheus text format.
+	// If empty, metrics are still collected but not served.
+	MetricsPath string `help:"If non-empty, serve Prometheus metrics at this path (e.g. /metrics)"`
 	// Secret indicates the secret associated with the app,
 	// which is used for signed cookies. It should be a
 	// random string with at least 32 characters.
@@ -35,6 +61,11 @@ type Config struct {
 	EncryptionKey string `help:"Key used for encryption (e.g. encrypted cookies)"`
 }
 
+// TLS returns true iff both TLSCertificate and TLSKey are set.
+func (c *Config) TLS() bool {
+	return c.TLSCertificate != "" && c.TLSKey != ""
+}
+
 var (
 	defaultConfig = Config{
 		Port: 8888,
@@ -19,9 +19,12 @@ import (
 	"gnd.la/internal"
 	"gnd.la/log"
 	"gnd.la/net/urlutil"
+	"gnd.la/util/stringutil"
 	"gnd.la/util/types"
 )
 
+const maxRequestIdLength = 128
+
 var (
 	// CookieSalt is the default salt used for signing
 	// cookies. For extra security, you might change this
@@ -38,29 +41,36 @@ type Context struct {
 	R               *http.Request
 	provider        ContextProvider
 	reProvider      *regexpProvider
+	roProvider      *routeProvider
 	handlerName     string
+	requestId       string
 	app             *App
 	statusCode      int
 	started         time.Time
 	cookies         *cookies.Cookies
 	user            User
+	session         *Session
 	translations    *table.Table
 	hasTranslations bool
 	background      bool
 	wg              *sync.WaitGroup
 	values          map[string]interface{}
+	log             contextLogger
 }
 
 func (c *Context) reset() {
 	c.ResponseWriter = nil
 	c.R = nil
 	c.statusCode = 0
+	c.requestId = ""
 	c.started = time.Now()
 	c.cookies = nil
 	c.user = nil
+	c.session = nil
 	c.translations = nil
 	c.hasTranslations = false
 	c.values = nil
+	c.log = contextLogger{}
 }
 
 // Count returns the number of elements captured
@@ -235,6 +245,26 @@ func (c *Context) HandlerName() string {
 	return c.handlerName
 }
 
+// RequestId returns a string which uniquely identifies the
+// request, which is attached to the messages logged using
+// Context.Logger. If the App trusts X headers (see
+// App.SetTrustXHeaders) and the request includes an
+// X-Request-Id header, its value is used as the id.
+// Otherwise, a random id is generated.
+func (c *Context) RequestId() string {
+	if c.requestId == "" {
+		if c.app.trustXHeaders && c.R != nil {
+			if id := c.R.Header.Get("X-Request-Id"); id != "" && len(id) <= maxRequestIdLength {
+				c.requestId = id
+			}
+		}
+		if c.requestId == "" {
+			c.requestId = stringutil.Random(20)
+		}
+	}
+	return c.requestId
+}
+
 // App returns the App this Context originated from.
 func (c *Context) App() *App {
 	return c.app
@@ -324,6 +354,10 @@ func (c *Context) requestScheme() string {
 		if c.R.TLS != nil {
 			return "https"
 		}
+		// Scheme might have been set from the X headers
+		if s := c.R.URL.Scheme; s != "" {
+			return s
+		}
 		return "http"
 	}
 	return ""
@@ -334,9 +368,7 @@ func (c *Context) URL() *url.URL {
 	if c.R != nil {
 		u := *c.R.URL
 		u.Host = c.R.Host
-		if u.Scheme == "" {
-			u.Scheme = c.requestScheme()
-		}
+		u.Scheme = c.requestScheme()
 		return &u
 	}
 	return nil
@@ -453,7 +485,7 @@ func (c *Context) IsXHR() bool {
 // It's automatically called by the App, so you
 // don't need to call it manually
 func (c *Context) Close() {
-	// currently a no-op
+	c.saveSession()
 }
 
 // BackgroundContext returns a copy of the given Context
@@ -467,7 +499,12 @@ func (c *Context) backgroundContext() *Context {
 	ctx.background = true
 	ctx.provider = c.provider
 	ctx.reProvider = c.reProvider
+	ctx.roProvider = c.roProvider
 	ctx.ResponseWriter = discard
+	// Keep the request fields in the messages logged
+	// from the background context.
+	ctx.requestId = c.RequestId()
+	ctx.handlerName = c.handlerName
 	return ctx
 }
 
@@ -501,7 +538,9 @@ func (c *Context) finalize(wg *sync.WaitGroup) {
 // might outlast the Handler's lifetime). Additionaly, Go also
 // handles error recovering and profiling in the spawned
 // goroutine. The initial Context can also wait for all
-// background contexts to finish by calling Wait().
+// background contexts to finish by calling Wait(), while
+// App.Shutdown waits for all the background contexts spawned
+// from any request before closing the App.
 //
 // In the following example, the handler finishes and returns the
 // executed template while CrunchData is still potentially running.
@@ -513,7 +552,26 @@ func (c *Context) finalize(wg *sync.WaitGroup) {
 //	}
 //	ctx.MustExecute("mytemplate.html", data)
 //  }
+//
+// Once App.Shutdown has finished waiting for the requests being served,
+// Go refuses to spawn new goroutines from requests (an error is logged
+// and f is not called), since the App is about to close its resources.
+// Background contexts might still use Go, since they are waited for too.
 func (c *Context) Go(f func(*Context)) {
+	root := c.app.root()
+	root.mu.Lock()
+	if root.closing && !c.background {
+		root.mu.Unlock()
+		c.logger().Errorf("not spawning background context, app is shutting down")
+		return
+	}
+	// Track the goroutine in the top level app too, so
+	// App.Shutdown can wait for it. This must be done
+	// while holding the lock, otherwise Shutdown could
+	// start waiting between the check and the call to Add.
+	background := &root.background
+	background.Add(1)
+	root.mu.Unlock()
 	if c.wg == nil {
 		c.wg = new(sync.WaitGroup)
 	}
@@ -524,6 +582,7 @@ func (c *Context) Go(f func(*Context)) {
 		id = profile.ID()
 	}
 	go func() {
+		defer background.Done()
 		if profile.On {
 			profile.Begin()
 			defer profile.End(id)
@@ -563,6 +622,10 @@ func (c *Context) Set(key string, value interface{}) {
 
 // Logger returns a Logger which allows logging mesages in several
 // levels. See gnd.la/log.Interface interface for more information.
+// When the Context is serving a request, the messages include
+// the request id (see RequestId), the handler name, the remote
+// address and the signed in user id (if any) as structured fields
+// (see gnd.la/log.Logger.With).
 // Note that this function will always return non-nil even when logging
 // is disabled, so it's safe to call any gnd.la/log.Interface methods
 // unconditionally (i.e. don't check if the returned value is nil, it'll
@@ -0,0 +1,177 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// CORSOptions specify the options for the CORS transformer.
+type CORSOptions struct {
+	// AllowedOrigins lists the origins (e.g. https://www.example.com)
+	// which are allowed to perform cross-origin requests. An element
+	// with the value "*" allows any origin. If empty, any origin
+	// is allowed.
+	AllowedOrigins []string
+	// AllowOrigin, if non-nil, is called to check if an origin not
+	// listed in AllowedOrigins is allowed.
+	AllowOrigin func(ctx *Context, origin string) bool
+	// AllowedMethods lists the methods allowed in cross-origin
+	// requests. If empty, it defaults to GET, HEAD and POST.
+	AllowedMethods []string
+	// AllowedHeaders lists the request headers allowed in
+	// cross-origin requests. If empty, the headers requested
+	// in preflight requests are allowed.
+	AllowedHeaders []string
+	// ExposedHeaders lists the response headers which
+	// might be read by the client.
+	ExposedHeaders []string
+	// AllowCredentials indicates if the requests might include
+	// credentials, like cookies or HTTP authentication. Since the
+	// allowed origin is echoed back, it can't be used when any origin
+	// is allowed, so the allowed origins must be restricted with
+	// AllowedOrigins (without "*") or AllowOrigin.
+	AllowCredentials bool
+	// MaxAge is the number of seconds the result of a preflight
+	// request might be cached by the client. Zero omits the
+	// Access-Control-Max-Age header.
+	MaxAge int
+}
+
+// allowsAnyOrigin returns true iff the options allow
+// requests from any origin.
+func (o *CORSOptions) allowsAnyOrigin() bool {
+	if len(o.AllowedOrigins) == 0 && o.AllowOrigin == nil {
+		return true
+	}
+	for _, v := range o.AllowedOrigins {
+		if v == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+func (o *CORSOptions) originAllowed(ctx *Context, origin string) bool {
+	if len(o.AllowedOrigins) == 0 && o.AllowOrigin == nil {
+		return true
+	}
+	for _, v := range o.AllowedOrigins {
+		if v == "*" || strings.EqualFold(v, origin) {
+			return true
+		}
+	}
+	return o.AllowOrigin != nil && o.AllowOrigin(ctx, origin)
+}
+
+func (o *CORSOptions) methodAllowed(method string) bool {
+	if len(o.AllowedMethods) == 0 {
+		return method == "GET" || method == "HEAD" || method == "POST"
+	}
+	for _, v := range o.AllowedMethods {
+		if strings.EqualFold(v, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedHeaders returns the value for the Access-Control-Allow-Headers
+// header given the value of the Access-Control-Request-Headers one. The
+// second return value is false if any of the headers is not allowed.
+func (o *CORSOptions) allowedHeaders(requested string) (string, bool) {
+	if len(o.AllowedHeaders) == 0 || requested == "" {
+		return requested, true
+	}
+	for _, h := range strings.Split(requested, ",") {
+		h = strings.TrimSpace(h)
+		if h == "" {
+			continue
+		}
+		found := false
+		for _, v := range o.AllowedHeaders {
+			if strings.EqualFold(v, h) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return "", false
+		}
+	}
+	return strings.Join(o.AllowedHeaders, ", "), true
+}
+
+// CORS returns a new Handler which implements Cross-Origin Resource
+// Sharing, as specified by the given options (which might be nil, to
+// allow simple requests from any origin). Preflight requests (OPTIONS
+// requests with an Access-Control-Request-Method header) are answered
+// without calling the handler. Note that handlers restricted to some
+// methods (see HandlerOptions.Methods) must accept OPTIONS, otherwise
+// preflight requests are answered by the App before reaching the
+// transformed handler. If opts allow credentials from any origin,
+// CORS panics.
+func CORS(handler Handler, opts *CORSOptions) Handler {
+	if opts == nil {
+		opts = &CORSOptions{}
+	}
+	if opts.AllowCredentials && opts.allowsAnyOrigin() {
+		panic(fmt.Errorf("CORS can't allow credentials from any origin, restrict the allowed origins"))
+	}
+	methods := strings.Join(opts.AllowedMethods, ", ")
+	if methods == "" {
+		methods = "GET, HEAD, POST"
+	}
+	exposed := strings.Join(opts.ExposedHeaders, ", ")
+	var maxAge string
+	if opts.MaxAge > 0 {
+		maxAge = strconv.Itoa(opts.MaxAge)
+	}
+	return func(ctx *Context) {
+		h := ctx.Header()
+		h.Add("Vary", "Origin")
+		origin := ctx.R.Header.Get("Origin")
+		preflight := ctx.R.Method == "OPTIONS" && ctx.R.Header.Get("Access-Control-Request-Method") != ""
+		if origin == "" || !opts.originAllowed(ctx, origin) {
+			if preflight {
+				// Don't let the request reach the handler,
+				// the client won't make the actual request
+				// without the CORS headers.
+				ctx.WriteHeader(http.StatusNoContent)
+				return
+			}
+			handler(ctx)
+			return
+		}
+		if preflight {
+			headers, ok := opts.allowedHeaders(ctx.R.Header.Get("Access-Control-Request-Headers"))
+			if ok && opts.methodAllowed(ctx.R.Header.Get("Access-Control-Request-Method")) {
+				setCORSOrigin(h, origin, opts.AllowCredentials)
+				h.Set("Access-Control-Allow-Methods", methods)
+				if headers != "" {
+					h.Set("Access-Control-Allow-Headers", headers)
+				}
+				if maxAge != "" {
+					h.Set("Access-Control-Max-Age", maxAge)
+				}
+			}
+			ctx.WriteHeader(http.StatusNoContent)
+			return
+		}
+		setCORSOrigin(h, origin, opts.AllowCredentials)
+		if exposed != "" {
+			h.Set("Access-Control-Expose-Headers", exposed)
+		}
+		handler(ctx)
+	}
+}
+
+func setCORSOrigin(h http.Header, origin string, credentials bool) {
+	// Always echo the origin rather than using "*", since
+	// the latter is not allowed with credentials.
+	h.Set("Access-Control-Allow-Origin", origin)
+	if credentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
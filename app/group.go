@@ -0,0 +1,173 @@
+package app
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Group represents a group of handlers which share a common
+// prefix and a set of middlewares. Groups are created using
+// App.Group and might be nested using Group.Group.
+//
+//  admin := a.Group("/admin", &app.Middleware{Before: requireAdmin})
+//  admin.Handle("^/$", AdminHandler)             // matches /admin/
+//  admin.Handle("/users/{id:int}/", UserHandler) // matches /admin/users/42/
+//
+// Regular expressions are anchored to the Group prefix, so
+// admin.Handle("/", h) would match every path starting with /admin/.
+//
+// Middlewares added with Use also affect the handlers which were
+// already added to the Group and to its nested groups.
+type Group struct {
+	app         *App
+	parent      *Group
+	children    []*Group
+	prefix      string
+	middlewares []*Middleware
+	// chain contains the middlewares for the group, including
+	// the ones from its parents. It's rebuilt by Use, rather
+	// than on every request.
+	chain    []*Middleware
+	handlers []*handlerInfo
+}
+
+// Group returns a new Group with the given prefix and middlewares. The
+// prefix is prepended to the patterns of the handlers added to the
+// Group and might be empty, for groups which only share middlewares.
+func (app *App) Group(prefix string, middlewares ...*Middleware) *Group {
+	g := &Group{
+		app:         app,
+		prefix:      cleanGroupPrefix(prefix),
+		middlewares: middlewares,
+	}
+	g.buildChain()
+	return g
+}
+
+func cleanGroupPrefix(prefix string) string {
+	if prefix == "" {
+		return ""
+	}
+	if prefix[0] != '/' {
+		prefix = "/" + prefix
+	}
+	return strings.TrimRight(prefix, "/")
+}
+
+// App returns the App this Group belongs to.
+func (g *Group) App() *App {
+	return g.app
+}
+
+// Prefix returns the full prefix for the Group, including
+// the prefixes of its parents.
+func (g *Group) Prefix() string {
+	return g.prefix
+}
+
+// Group returns a new Group nested into g. Its prefix is appended
+// to the prefix of g and its middlewares run after the ones in g.
+func (g *Group) Group(prefix string, middlewares ...*Middleware) *Group {
+	child := &Group{
+		app:         g.app,
+		parent:      g,
+		prefix:      g.prefix + cleanGroupPrefix(prefix),
+		middlewares: middlewares,
+	}
+	child.buildChain()
+	g.children = append(g.children, child)
+	return child
+}
+
+// Use adds the given middlewares to the Group. See Middleware
+// for the details about how they're executed.
+func (g *Group) Use(middlewares ...*Middleware) {
+	g.middlewares = append(g.middlewares, middlewares...)
+	g.buildChain()
+}
+
+// buildChain sets the middlewares for the group, including the
+// ones from its parents, and rebuilds the ones for its children.
+func (g *Group) buildChain() {
+	var parent []*Middleware
+	if g.parent != nil {
+		parent = g.parent.chain
+	}
+	chain := make([]*Middleware, 0, len(parent)+len(g.middlewares))
+	chain = append(chain, parent...)
+	g.chain = append(chain, g.middlewares...)
+	for _, v := range g.children {
+		v.buildChain()
+	}
+}
+
+func (g *Group) wrap(handler Handler) Handler {
+	return func(ctx *Context) {
+		runMiddlewares(ctx, g.chain, handler)
+	}
+}
+
+// pattern returns the pattern relative to the App for the given
+// pattern relative to the group. Regular expressions are anchored
+// to the group prefix.
+func (g *Group) pattern(pattern string) string {
+	if g.prefix == "" {
+		return pattern
+	}
+	if p := g.prefix + pattern; isRoutePattern(p) {
+		return p
+	}
+	if strings.IndexByte(g.prefix, '{') >= 0 {
+		panic(fmt.Errorf("can't add regular expression %q to group with parameters in its prefix %q", pattern, g.prefix))
+	}
+	return "^" + regexp.QuoteMeta(g.prefix) + strings.TrimPrefix(pattern, "^")
+}
+
+// Handle is a shorthand for HandleOptions, passing nil as the Options.
+func (g *Group) Handle(pattern string, handler Handler) {
+	g.HandleOptions(pattern, handler, nil)
+}
+
+// HandleNamed is a shorthand for HandleOptions, passing an Options instance
+// with just the name set.
+func (g *Group) HandleNamed(pattern string, handler Handler, name string) {
+	g.HandleOptions(pattern, handler, &HandlerOptions{Name: name})
+}
+
+// HandleMethods is a shorthand for HandleOptions, passing an Options
+// instance with just the methods set.
+func (g *Group) HandleMethods(pattern string, handler Handler, methods ...string) {
+	g.HandleOptions(pattern, handler, &HandlerOptions{Methods: methods})
+}
+
+// HandleOptions works like App.HandleOptions, but the pattern is
+// relative to the Group prefix and the handler is wrapped by the
+// Group middlewares.
+func (g *Group) HandleOptions(pattern string, handler Handler, opts *HandlerOptions) {
+	if handler == nil {
+		panic(fmt.Errorf("handler for pattern %q can't be nil", pattern))
+	}
+	g.app.HandleOptions(g.pattern(pattern), g.wrap(handler), opts)
+	g.handlers = append(g.handlers, g.app.handlers[len(g.app.handlers)-1])
+}
+
+// Include works like App.Include, but the prefix is relative to the
+// Group prefix and the included app handlers are wrapped by the Group
+// middlewares, which run before the middlewares of the included app.
+func (g *Group) Include(prefix string, included *App, containerTemplate string) {
+	if strings.IndexByte(g.prefix, '{') >= 0 {
+		panic(fmt.Errorf("can't include app %s into group with parameters in its prefix %q", included.name, g.prefix))
+	}
+	g.app.includeGroup(g.prefix+cleanGroupPrefix(prefix), included, containerTemplate, g)
+	g.handlers = append(g.handlers, g.app.handlers[len(g.app.handlers)-1])
+}
+
+// Transform transforms all the handlers registered in the Group
+// using the given Transformer. Like App.Transform, handlers
+// registered after this call won't be transformed.
+func (g *Group) Transform(tr Transformer) {
+	for _, v := range g.handlers {
+		v.handler = tr(v.handler)
+	}
+}
@@ -0,0 +1,137 @@
+package app
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type upperWriter struct {
+	http.ResponseWriter
+	buf bytes.Buffer
+}
+
+func (w *upperWriter) Write(data []byte) (int, error) {
+	return w.buf.Write(data)
+}
+
+func (w *upperWriter) Close() error {
+	_, err := w.ResponseWriter.Write(bytes.ToUpper(w.buf.Bytes()))
+	return err
+}
+
+func traceMiddleware(name string, stop bool) *Middleware {
+	return &Middleware{
+		Before: func(ctx *Context) bool {
+			ctx.WriteString(name + "-before ")
+			return stop
+		},
+		After: func(ctx *Context) {
+			ctx.WriteString(" " + name + "-after")
+		},
+	}
+}
+
+func TestGroup(t *testing.T) {
+	a := New()
+	a.Use(traceMiddleware("app", false))
+	a.Handle("^/$", routeTestHandler("index"))
+	admin := a.Group("/admin/", traceMiddleware("admin", false))
+	admin.Handle("^/$", routeTestHandler("admin"))
+	admin.Handle("^/legacy/(\\d+)$", routeTestHandler("legacy"))
+	users := admin.Group("users", traceMiddleware("users", false))
+	users.Handle("/{id:int}/", routeTestHandler("user"))
+	private := a.Group("/private", traceMiddleware("private", true))
+	private.Handle("^/$", routeTestHandler("private"))
+	upper := a.Group("/upper", &Middleware{
+		Writer: func(ctx *Context) http.ResponseWriter {
+			return &upperWriter{ResponseWriter: ctx.ResponseWriter}
+		},
+	})
+	upper.Handle("^/$", routeTestHandler("upper"))
+	// Added after the handlers, must run too
+	admin.Use(traceMiddleware("late", false))
+	tests := map[string]string{
+		"/":               "app-before index app-after",
+		"/admin/":         "app-before admin-before late-before admin late-after admin-after app-after",
+		"/admin/legacy/3": "app-before admin-before late-before legacy 3 late-after admin-after app-after",
+		"/admin/users/7/": "app-before admin-before late-before users-before user 7 users-after late-after admin-after app-after",
+		"/private/":       "app-before private-before  private-after app-after",
+		"/upper/":         "app-before UPPER app-after",
+	}
+	for k, v := range tests {
+		if body := serveTest(a, "GET", k).Body.String(); body != v {
+			t.Errorf("GET %s: expecting body %q, got %q", k, v, body)
+		}
+	}
+}
+
+func TestGroupInclude(t *testing.T) {
+	child := New()
+	child.SetName("child")
+	child.Use(traceMiddleware("child", false))
+	child.Handle("/page/", routeTestHandler("page"))
+	a := New()
+	g := a.Group("/admin", traceMiddleware("admin", false))
+	g.Include("/child", child, "")
+	expect := "admin-before child-before page child-after admin-after"
+	if body := serveTest(a, "GET", "/admin/child/page/").Body.String(); body != expect {
+		t.Errorf("expecting body %q, got %q", expect, body)
+	}
+	if body := serveTest(a, "GET", "/child/page/").Body.String(); strings.Contains(body, "page") {
+		t.Errorf("included app served outside of its group prefix: %q", body)
+	}
+}
+
+type closeRecorder struct {
+	http.ResponseWriter
+	closed bool
+}
+
+func (w *closeRecorder) Close() error {
+	w.closed = true
+	return nil
+}
+
+func TestMiddlewarePanic(t *testing.T) {
+	r, _ := http.NewRequest("GET", "http://localhost/", nil)
+	rw := httptest.NewRecorder()
+	ctx := New().newContext(rw, r)
+	var after []string
+	var writers []*closeRecorder
+	middleware := func(name string) *Middleware {
+		return &Middleware{
+			Writer: func(ctx *Context) http.ResponseWriter {
+				w := &closeRecorder{ResponseWriter: ctx.ResponseWriter}
+				writers = append(writers, w)
+				return w
+			},
+			After: func(ctx *Context) {
+				after = append(after, name)
+			},
+		}
+	}
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Error("expecting a panic")
+			}
+		}()
+		runMiddlewares(ctx, []*Middleware{middleware("m1"), middleware("m2")}, func(ctx *Context) {
+			panic("handler panicked")
+		})
+	}()
+	if len(after) != 2 || after[0] != "m2" || after[1] != "m1" {
+		t.Errorf("expecting After to run for m2 and m1, got %v", after)
+	}
+	if ctx.ResponseWriter != rw {
+		t.Errorf("expecting original ResponseWriter to be restored, got %T", ctx.ResponseWriter)
+	}
+	for ii, v := range writers {
+		if v.closed {
+			t.Errorf("writer %d was closed after a panic", ii)
+		}
+	}
+}
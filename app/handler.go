@@ -19,6 +19,12 @@ type HandlerOptions struct {
 	// Host specifies the host the Handler will match. If non-empty,
 	// only requests to this specific host will match the Handler.
 	Host string
+	// Methods restricts the Handler to the given HTTP methods. If
+	// empty, the Handler will match requests with any method. Handlers
+	// accepting GET also accept HEAD. See App.HandleOptions for the
+	// responses sent when a path is matched by handlers restricted
+	// to other methods.
+	Methods []string
 }
 
 type HandlerInfo struct {
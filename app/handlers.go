@@ -105,3 +105,20 @@ func ExecuteHandler(dataHandler DataHandler, template string) Handler {
 		ctx.MustExecute(template, data)
 	}
 }
+
+// RespondHandler returns a Handler which executes the given DataHandler
+// and sends the obtained data back to the client using
+// Context.RespondTemplate, with the format selected by the client. If the
+// DataHandler returns an error, it's sent as an ErrorDocument. The template
+// might be empty, which disables HTML responses.
+func RespondHandler(dataHandler DataHandler, template string) Handler {
+	return func(ctx *Context) {
+		data, err := dataHandler(ctx)
+		if err != nil {
+			data = err
+		}
+		if err := ctx.RespondTemplate(template, data); err != nil {
+			panic(err)
+		}
+	}
+}
@@ -1,5 +1,77 @@
 package app
 
+import (
+	"gnd.la/log"
+)
+
+// contextLogger caches the Logger returned by Context.Logger
+// while serving a request, since building it for every message
+// would be too expensive.
+type contextLogger struct {
+	logger  log.Interface
+	handler string
+	userId  int64
+	// user id from the cookie, only used when there
+	// are no sessions.
+	cookieUserId    int64
+	hasCookieUserId bool
+}
+
+// requestLogger returns the App Logger with the request fields
+// attached. The Logger is cached and only rebuilt when the fields
+// which might change while serving the request (the handler and
+// the signed in user) do.
+func (c *Context) requestLogger() log.Interface {
+	userId := c.loggedUserId()
+	if c.log.logger == nil || c.log.handler != c.handlerName || c.log.userId != userId {
+		c.log.logger = c.app.Logger.With(c.logFields(userId)...)
+		c.log.handler = c.handlerName
+		c.log.userId = userId
+	}
+	return c.log.logger
+}
+
+// logFields returns the fields attached to the messages logged
+// using Context.Logger while serving a request.
+func (c *Context) logFields(userId int64) []interface{} {
+	fields := []interface{}{"request_id", c.RequestId()}
+	if c.handlerName != "" {
+		fields = append(fields, "handler", c.handlerName)
+	}
+	fields = append(fields, "remote_addr", c.RemoteAddress())
+	if userId != 0 {
+		fields = append(fields, "user_id", userId)
+	}
+	return fields
+}
+
+// loggedUserId returns the id of the signed in user for logging
+// purposes. To avoid side effects, it never calls the UserFunc
+// nor loads the session when they haven't been loaded yet.
+func (c *Context) loggedUserId() int64 {
+	if c.user != nil {
+		return c.user.Id()
+	}
+	if c.app.userFunc == nil {
+		return 0
+	}
+	if c.app.sessions != nil {
+		if c.session != nil {
+			return c.session.UserId()
+		}
+		return 0
+	}
+	if !c.log.hasCookieUserId {
+		var id int64
+		if c.Cookies().GetSecure(USER_COOKIE_NAME, &id) != nil {
+			id = 0
+		}
+		c.log.cookieUserId = id
+		c.log.hasCookieUserId = true
+	}
+	return c.log.cookieUserId
+}
+
 // nullLogger logs everything to /dev/null
 type nullLogger struct {
 }
@@ -38,7 +38,7 @@ func (c *Context) logger() log.Interface {
 		if c.app.Logger == nil {
 			return nullLogger{}
 		}
-		return c.app.Logger
+		return c.requestLogger()
 	}
 	return &gaeLogger{c: appengine.NewContext(c.R)}
 }
@@ -8,5 +8,8 @@ func (c *Context) logger() log.Interface {
 	if c.app.Logger == nil {
 		return nullLogger{}
 	}
-	return c.app.Logger
+	if c.R == nil {
+		return c.app.Logger
+	}
+	return c.requestLogger()
 }
@@ -0,0 +1,562 @@
+// Package metrics implements a small registry of metrics (counters,
+// gauges and histograms) which can be exported using the Prometheus
+// text format.
+//
+// Gondola registers its own metrics in the Default registry, covering
+// requests and response codes per handler, ORM operation timings, cache
+// hits and misses and task and job runs and failures. Apps can add their
+// own metrics to it too:
+//
+//  var signups = metrics.Default.NewCounter("myapp_signups_total", "Number of signups", "source")
+//  ...
+//  signups.Inc("facebook")
+//
+// To serve the metrics, set the MetricsPath field in gnd.la/app.Config (or
+// the -metrics-path flag or metrics-path in the config file).
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	nameRe  = regexp.MustCompile("^[a-zA-Z_:][a-zA-Z0-9_:]*$")
+	labelRe = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+
+	// DefaultBuckets are the default histogram buckets, suitable
+	// for measuring latencies in seconds.
+	DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+	// Default is the Registry used by the package level functions
+	// and by Gondola for registering its own metrics.
+	Default = NewRegistry()
+)
+
+// Metric is the interface implemented by all metrics
+// which can be added to a Registry.
+type Metric interface {
+	// Name returns the metric name.
+	Name() string
+	// Help returns the description of the metric.
+	Help() string
+	// Type returns the metric type (counter, gauge or histogram).
+	Type() string
+	// Write writes the metric samples to w, in the
+	// Prometheus text format.
+	Write(w io.Writer) error
+}
+
+type desc struct {
+	name   string
+	help   string
+	labels []string
+}
+
+func newDesc(name string, help string, labels []string) desc {
+	if !nameRe.MatchString(name) {
+		panic(fmt.Errorf("invalid metric name %q", name))
+	}
+	for _, v := range labels {
+		if !labelRe.MatchString(v) || strings.HasPrefix(v, "__") {
+			panic(fmt.Errorf("invalid label name %q in metric %s", v, name))
+		}
+	}
+	return desc{name: name, help: help, labels: labels}
+}
+
+func (d *desc) Name() string {
+	return d.name
+}
+
+func (d *desc) Help() string {
+	return d.help
+}
+
+// key returns the key used for storing the series with
+// the given label values, panicking if the number of
+// values doesn't match the number of labels.
+func (d *desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Errorf("metric %s has %d labels, %d values provided", d.name, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// labelPairs formats the labels with the given values, adding
+// the extra name/value pairs at the end.
+func (d *desc) labelPairs(values []string, extra ...string) string {
+	if len(d.labels) == 0 && len(extra) == 0 {
+		return ""
+	}
+	var buf []string
+	for ii, v := range d.labels {
+		buf = append(buf, v+"=\""+escapeLabel(values[ii])+"\"")
+	}
+	for ii := 0; ii < len(extra); ii += 2 {
+		buf = append(buf, extra[ii]+"=\""+escapeLabel(extra[ii+1])+"\"")
+	}
+	return "{" + strings.Join(buf, ",") + "}"
+}
+
+type value struct {
+	labels []string
+	v      float64
+}
+
+type values struct {
+	desc
+	mu     sync.Mutex
+	series map[string]*value
+}
+
+func (v *values) add(delta float64, labelValues []string) {
+	k := v.key(labelValues)
+	v.mu.Lock()
+	s := v.series[k]
+	if s == nil {
+		s = &value{labels: append([]string(nil), labelValues...)}
+		v.series[k] = s
+	}
+	s.v += delta
+	v.mu.Unlock()
+}
+
+func (v *values) set(val float64, labelValues []string) {
+	k := v.key(labelValues)
+	v.mu.Lock()
+	s := v.series[k]
+	if s == nil {
+		s = &value{labels: append([]string(nil), labelValues...)}
+		v.series[k] = s
+	}
+	s.v = val
+	v.mu.Unlock()
+}
+
+func (v *values) value(labelValues []string) float64 {
+	k := v.key(labelValues)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if s := v.series[k]; s != nil {
+		return s.v
+	}
+	return 0
+}
+
+func (v *values) Write(w io.Writer) error {
+	v.mu.Lock()
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	lines := make([]string, len(keys))
+	for ii, k := range keys {
+		s := v.series[k]
+		lines[ii] = v.name + v.labelPairs(s.labels) + " " + formatFloat(s.v) + "\n"
+	}
+	v.mu.Unlock()
+	for _, l := range lines {
+		if _, err := io.WriteString(w, l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Counter is a metric which can only increase. Counters might
+// have labels, in that case the label values must be provided
+// (in the same order the labels were declared) when updating
+// the counter.
+type Counter struct {
+	values
+}
+
+// NewCounter returns a new Counter, which is not registered in any
+// Registry. Use Registry.NewCounter to create and register a
+// Counter at the same time.
+func NewCounter(name string, help string, labels ...string) *Counter {
+	return &Counter{values{desc: newDesc(name, help, labels), series: make(map[string]*value)}}
+}
+
+// Type returns "counter".
+func (c *Counter) Type() string {
+	return "counter"
+}
+
+// Inc increments the counter by 1.
+func (c *Counter) Inc(labelValues ...string) {
+	c.add(1, labelValues)
+}
+
+// Add increments the counter by v, which must be non-negative.
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		panic(fmt.Errorf("can't decrease counter %s", c.name))
+	}
+	c.add(v, labelValues)
+}
+
+// Value returns the current value of the counter.
+func (c *Counter) Value(labelValues ...string) float64 {
+	return c.value(labelValues)
+}
+
+// Gauge is a metric which can increase and decrease.
+type Gauge struct {
+	values
+}
+
+// NewGauge returns a new Gauge, which is not registered in
+// any Registry.
+func NewGauge(name string, help string, labels ...string) *Gauge {
+	return &Gauge{values{desc: newDesc(name, help, labels), series: make(map[string]*value)}}
+}
+
+// Type returns "gauge".
+func (g *Gauge) Type() string {
+	return "gauge"
+}
+
+// Set sets the gauge to v.
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.set(v, labelValues)
+}
+
+// Add adds v, which might be negative, to the gauge.
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	g.add(v, labelValues)
+}
+
+// Inc increments the gauge by 1.
+func (g *Gauge) Inc(labelValues ...string) {
+	g.add(1, labelValues)
+}
+
+// Dec decrements the gauge by 1.
+func (g *Gauge) Dec(labelValues ...string) {
+	g.add(-1, labelValues)
+}
+
+// Value returns the current value of the gauge.
+func (g *Gauge) Value(labelValues ...string) float64 {
+	return g.value(labelValues)
+}
+
+// GaugeFunc is a gauge without labels whose value is
+// obtained by calling a function each time the metrics
+// are written.
+type GaugeFunc struct {
+	desc
+	fn func() float64
+}
+
+// NewGaugeFunc returns a new GaugeFunc, which is not registered
+// in any Registry.
+func NewGaugeFunc(name string, help string, fn func() float64) *GaugeFunc {
+	return &GaugeFunc{desc: newDesc(name, help, nil), fn: fn}
+}
+
+// Type returns "gauge".
+func (g *GaugeFunc) Type() string {
+	return "gauge"
+}
+
+func (g *GaugeFunc) Write(w io.Writer) error {
+	_, err := io.WriteString(w, g.name+" "+formatFloat(g.fn())+"\n")
+	return err
+}
+
+type histogramValue struct {
+	labels []string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// Histogram counts observations (e.g. request durations) in
+// configurable buckets, also keeping their count and sum.
+type Histogram struct {
+	desc
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogramValue
+}
+
+// NewHistogram returns a new Histogram, which is not registered in any
+// Registry. If buckets is empty, DefaultBuckets are used.
+func NewHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	for _, v := range labels {
+		if v == "le" {
+			panic(fmt.Errorf("histogram %s can't use the label le", name))
+		}
+	}
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	b := append([]float64(nil), buckets...)
+	sort.Float64s(b)
+	return &Histogram{
+		desc:    newDesc(name, help, labels),
+		buckets: b,
+		series:  make(map[string]*histogramValue),
+	}
+}
+
+// Type returns "histogram".
+func (h *Histogram) Type() string {
+	return "histogram"
+}
+
+// Observe adds a new observation to the histogram.
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	k := h.key(labelValues)
+	idx := sort.SearchFloat64s(h.buckets, v)
+	h.mu.Lock()
+	s := h.series[k]
+	if s == nil {
+		s = &histogramValue{
+			labels: append([]string(nil), labelValues...),
+			counts: make([]uint64, len(h.buckets)),
+		}
+		h.series[k] = s
+	}
+	if idx < len(s.counts) {
+		s.counts[idx]++
+	}
+	s.count++
+	s.sum += v
+	h.mu.Unlock()
+}
+
+// ObserveDuration adds the given duration, in seconds, as an
+// observation.
+func (h *Histogram) ObserveDuration(d time.Duration, labelValues ...string) {
+	h.Observe(d.Seconds(), labelValues...)
+}
+
+// Since is a shorthand for h.ObserveDuration(time.Since(t), labelValues...).
+func (h *Histogram) Since(t time.Time, labelValues ...string) {
+	h.ObserveDuration(time.Since(t), labelValues...)
+}
+
+// Count returns the number of observations in the histogram.
+func (h *Histogram) Count(labelValues ...string) uint64 {
+	k := h.key(labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if s := h.series[k]; s != nil {
+		return s.count
+	}
+	return 0
+}
+
+func (h *Histogram) Write(w io.Writer) error {
+	h.mu.Lock()
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var lines []string
+	for _, k := range keys {
+		s := h.series[k]
+		var cumulative uint64
+		for ii, b := range h.buckets {
+			cumulative += s.counts[ii]
+			lines = append(lines, h.name+"_bucket"+h.labelPairs(s.labels, "le", formatFloat(b))+" "+strconv.FormatUint(cumulative, 10)+"\n")
+		}
+		lines = append(lines, h.name+"_bucket"+h.labelPairs(s.labels, "le", "+Inf")+" "+strconv.FormatUint(s.count, 10)+"\n")
+		lines = append(lines, h.name+"_sum"+h.labelPairs(s.labels)+" "+formatFloat(s.sum)+"\n")
+		lines = append(lines, h.name+"_count"+h.labelPairs(s.labels)+" "+strconv.FormatUint(s.count, 10)+"\n")
+	}
+	h.mu.Unlock()
+	for _, l := range lines {
+		if _, err := io.WriteString(w, l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Registry holds a set of metrics, identified by their names.
+type Registry struct {
+	mu      sync.RWMutex
+	metrics map[string]Metric
+}
+
+// NewRegistry returns a new empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]Metric)}
+}
+
+// Register adds a metric to the registry. If there's already a
+// metric with the same name, an error is returned.
+func (r *Registry) Register(m Metric) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	name := m.Name()
+	if r.metrics[name] != nil {
+		return fmt.Errorf("there's already a metric named %s", name)
+	}
+	r.metrics[name] = m
+	return nil
+}
+
+// MustRegister works like Register, but panics if there's an error.
+func (r *Registry) MustRegister(m Metric) {
+	if err := r.Register(m); err != nil {
+		panic(err)
+	}
+}
+
+// Unregister removes the metric with the given name from the
+// registry. It returns true iff the metric was registered.
+func (r *Registry) Unregister(name string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.metrics[name]
+	delete(r.metrics, name)
+	return ok
+}
+
+// Get returns the metric with the given name, or nil.
+func (r *Registry) Get(name string) Metric {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.metrics[name]
+}
+
+// NewCounter creates a new Counter and registers it, panicking if
+// there's already a metric with the same name.
+func (r *Registry) NewCounter(name string, help string, labels ...string) *Counter {
+	c := NewCounter(name, help, labels...)
+	r.MustRegister(c)
+	return c
+}
+
+// NewGauge creates a new Gauge and registers it, panicking if
+// there's already a metric with the same name.
+func (r *Registry) NewGauge(name string, help string, labels ...string) *Gauge {
+	g := NewGauge(name, help, labels...)
+	r.MustRegister(g)
+	return g
+}
+
+// NewGaugeFunc creates a new GaugeFunc and registers it, panicking
+// if there's already a metric with the same name.
+func (r *Registry) NewGaugeFunc(name string, help string, fn func() float64) *GaugeFunc {
+	g := NewGaugeFunc(name, help, fn)
+	r.MustRegister(g)
+	return g
+}
+
+// NewHistogram creates a new Histogram and registers it, panicking if
+// there's already a metric with the same name.
+func (r *Registry) NewHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	h := NewHistogram(name, help, buckets, labels...)
+	r.MustRegister(h)
+	return h
+}
+
+// WriteTo writes all the metrics in the registry to w, sorted
+// by name, using the Prometheus text format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.RLock()
+	names := make([]string, 0, len(r.metrics))
+	for k := range r.metrics {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	metrics := make([]Metric, len(names))
+	for ii, v := range names {
+		metrics[ii] = r.metrics[v]
+	}
+	r.mu.RUnlock()
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, m := range metrics {
+		if help := m.Help(); help != "" {
+			fmt.Fprintf(bw, "# HELP %s %s\n", m.Name(), escapeHelp(help))
+		}
+		fmt.Fprintf(bw, "# TYPE %s %s\n", m.Name(), m.Type())
+		if err := m.Write(bw); err != nil {
+			return cw.n, err
+		}
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// Register adds the metric to the Default registry.
+func Register(m Metric) error {
+	return Default.Register(m)
+}
+
+// MustRegister adds the metric to the Default registry, panicking
+// if there's already a metric with the same name.
+func MustRegister(m Metric) {
+	Default.MustRegister(m)
+}
+
+// Unregister removes the metric with the given name from
+// the Default registry.
+func Unregister(name string) bool {
+	return Default.Unregister(name)
+}
+
+// Get returns the metric with the given name from the Default
+// registry, or nil.
+func Get(name string) Metric {
+	return Default.Get(name)
+}
+
+// WriteTo writes all the metrics in the Default registry to w.
+func WriteTo(w io.Writer) (int64, error) {
+	return Default.WriteTo(w)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	labelReplacer = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+	helpReplacer  = strings.NewReplacer("\\", "\\\\", "\n", "\\n")
+)
+
+func escapeLabel(s string) string {
+	return labelReplacer.Replace(s)
+}
+
+func escapeHelp(s string) string {
+	return helpReplacer.Replace(s)
+}
@@ -0,0 +1,75 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteTo(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("test_requests_total", "Number of\nrequests", "handler", "code")
+	c.Inc("index", "200")
+	c.Add(2, "index", "200")
+	c.Inc("say \"hi\"", "404")
+	g := r.NewGauge("test_temperature", "")
+	g.Set(21.5)
+	h := r.NewHistogram("test_duration_seconds", "Duration", []float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(5)
+	var buf bytes.Buffer
+	if _, err := r.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := strings.Join([]string{
+		"# HELP test_duration_seconds Duration",
+		"# TYPE test_duration_seconds histogram",
+		"test_duration_seconds_bucket{le=\"0.1\"} 1",
+		"test_duration_seconds_bucket{le=\"1\"} 2",
+		"test_duration_seconds_bucket{le=\"+Inf\"} 3",
+		"test_duration_seconds_sum 5.55",
+		"test_duration_seconds_count 3",
+		"# HELP test_requests_total Number of\\nrequests",
+		"# TYPE test_requests_total counter",
+		"test_requests_total{handler=\"index\",code=\"200\"} 3",
+		"test_requests_total{handler=\"say \\\"hi\\\"\",code=\"404\"} 1",
+		"# TYPE test_temperature gauge",
+		"test_temperature 21.5",
+	}, "\n") + "\n"
+	if s := buf.String(); s != expected {
+		t.Errorf("expecting output:\n%s\ngot:\n%s", expected, s)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("test_total", "")
+	if err := r.Register(NewGauge("test_total", "")); err == nil {
+		t.Error("expecting an error when registering a duplicate metric")
+	}
+	if !r.Unregister("test_total") {
+		t.Error("expecting Unregister to remove test_total")
+	}
+	if m := r.Get("test_total"); m != nil {
+		t.Errorf("expecting no metric after Unregister, got %v", m)
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	for _, fn := range []func(){
+		func() { NewCounter("invalid-name", "") },
+		func() { NewCounter("test_total", "", "__reserved") },
+		func() { NewHistogram("test_seconds", "", nil, "le") },
+		func() { NewCounter("test_total", "", "a").Inc() },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Error("expecting a panic")
+				}
+			}()
+			fn()
+		}()
+	}
+}
@@ -0,0 +1,72 @@
+package app
+
+import (
+	"io"
+	"net/http"
+)
+
+// Middleware represents code which runs before and after the handlers
+// of an App or a Group. Any of its fields might be nil.
+//
+// Middlewares run in the order they were added, with the Before functions
+// running before the handler and the After functions running after it, in
+// reverse order. For example, given middlewares m1 and m2, the execution
+// order would be m1.Before, m2.Before, handler, m2.After, m1.After.
+type Middleware struct {
+	// Writer, if non-nil, is called before Before and returns an
+	// http.ResponseWriter which replaces the Context's ResponseWriter
+	// (available as ctx.ResponseWriter) while the rest of the chain runs.
+	// The previous ResponseWriter is restored after After runs, even if
+	// the handler panics. If the returned value implements io.Closer,
+	// it's closed right before restoring the previous one (e.g. to flush
+	// a compressed response), unless the handler panicked, since the
+	// error response is written to the previous ResponseWriter.
+	Writer func(ctx *Context) http.ResponseWriter
+	// Before runs before the handler. If it returns true, the request is
+	// considered as served and neither the handler nor the remaining
+	// middlewares run. The After functions of the middlewares which
+	// already ran, including the one which stopped the chain, still run.
+	Before func(ctx *Context) bool
+	// After runs after the handler, even if the chain was stopped by
+	// a Before function or the handler panicked.
+	After func(ctx *Context)
+}
+
+// runMiddlewares runs the given handler wrapped by
+// the middlewares, as described in Middleware.
+func runMiddlewares(ctx *Context, middlewares []*Middleware, handler Handler) {
+	if len(middlewares) == 0 {
+		handler(ctx)
+		return
+	}
+	m := middlewares[0]
+	completed := false
+	if m.Writer != nil {
+		prev := ctx.ResponseWriter
+		if w := m.Writer(ctx); w != nil {
+			ctx.ResponseWriter = w
+			defer func() {
+				if c, ok := w.(io.Closer); ok && completed {
+					c.Close()
+				}
+				ctx.ResponseWriter = prev
+			}()
+		}
+	}
+	if m.After != nil {
+		defer m.After(ctx)
+	}
+	if m.Before == nil || !m.Before(ctx) {
+		runMiddlewares(ctx, middlewares[1:], handler)
+	}
+	completed = true
+}
+
+// Use adds the given middlewares to the App. They run for every request
+// matched by any of the App handlers, including the handlers for apps
+// included with Include (in which case the middlewares of the including
+// app run first), but not when no handler matches the request. See
+// Middleware for the details about how they're executed.
+func (app *App) Use(middlewares ...*Middleware) {
+	app.middlewares = append(app.middlewares, middlewares...)
+}
@@ -1,9 +1,53 @@
 package app
 
 import (
+	"net/http"
 	"runtime"
+	"strconv"
+
+	"gnd.la/app/metrics"
+)
+
+var (
+	requestsTotal = metrics.Default.NewCounter("gondola_http_requests_total",
+		"Number of HTTP requests served, by handler name and status code", "handler", "code")
+	requestDuration = metrics.Default.NewHistogram("gondola_http_request_duration_seconds",
+		"Time taken for serving HTTP requests, by handler name", nil, "handler")
 )
 
+func init() {
+	metrics.Default.NewGaugeFunc("gondola_goroutines", "Number of goroutines", func() float64 {
+		return float64(runtime.NumGoroutine())
+	})
+	metrics.Default.NewGaugeFunc("gondola_memory_alloc_bytes", "Bytes allocated and still in use", func() float64 {
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+		return float64(stats.Alloc)
+	})
+}
+
+// observeRequest records the metrics for the request served
+// by the given Context. Requests served by handlers without a
+// name (see HandleNamed) or not matching any handler are recorded
+// with an empty handler name.
+func observeRequest(ctx *Context) {
+	code := ctx.statusCode
+	if code < 0 {
+		code = -code
+	} else if code == 0 {
+		code = http.StatusOK
+	}
+	requestsTotal.Inc(ctx.handlerName, strconv.Itoa(code))
+	requestDuration.ObserveDuration(ctx.Elapsed(), ctx.handlerName)
+}
+
+func metricsHandler(ctx *Context) {
+	ctx.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if _, err := metrics.WriteTo(ctx); err != nil {
+		panic(err)
+	}
+}
+
 func monitorHandler(ctx *Context) {
 	t := newInternalTemplate(ctx.app)
 	if err := t.parse("monitor.html", nil); err != nil {
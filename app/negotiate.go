@@ -0,0 +1,152 @@
+package app
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type acceptValue struct {
+	value string
+	q     float64
+}
+
+// parseAccept parses an Accept like header, returning its
+// values sorted by decreasing quality. Values with q=0 are
+// preserved, since they explicitly forbid a value.
+func parseAccept(header string) []acceptValue {
+	var values []acceptValue
+	for _, v := range strings.Split(header, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		q := 1.0
+		params := strings.Split(v, ";")
+		for _, p := range params[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				if f, err := strconv.ParseFloat(p[2:], 64); err == nil {
+					q = f
+				}
+			}
+		}
+		values = append(values, acceptValue{
+			value: strings.ToLower(strings.TrimSpace(params[0])),
+			q:     q,
+		})
+	}
+	sort.Stable(acceptValues(values))
+	return values
+}
+
+type acceptValues []acceptValue
+
+func (a acceptValues) Len() int           { return len(a) }
+func (a acceptValues) Less(i, j int) bool { return a[i].q > a[j].q }
+func (a acceptValues) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+// acceptQuality returns the quality assigned to the given value by the
+// parsed values, using the most specific match. The match function returns
+// the specificity of a match, or a negative number if it doesn't match.
+func acceptQuality(values []acceptValue, value string, match func(pattern, value string) int) float64 {
+	q := 0.0
+	best := -1
+	for _, v := range values {
+		if s := match(v.value, value); s > best {
+			best = s
+			q = v.q
+		}
+	}
+	return q
+}
+
+func matchMediaType(pattern, value string) int {
+	switch {
+	case pattern == value:
+		return 2
+	case pattern == "*/*":
+		return 0
+	case strings.HasSuffix(pattern, "/*") && strings.HasPrefix(value, pattern[:len(pattern)-1]):
+		return 1
+	}
+	return -1
+}
+
+func matchEncoding(pattern, value string) int {
+	switch pattern {
+	case value:
+		return 1
+	case "*":
+		return 0
+	}
+	return -1
+}
+
+// negotiate returns the first of the offered values with the highest
+// quality according to the parsed header, or the empty string if
+// none of them is acceptable.
+func negotiate(values []acceptValue, offers []string, match func(pattern, value string) int) string {
+	var best string
+	bestQ := 0.0
+	for _, v := range offers {
+		if q := acceptQuality(values, v, match); q > bestQ {
+			best = v
+			bestQ = q
+		}
+	}
+	return best
+}
+
+type contentEncoding struct {
+	name      string
+	newWriter func(w io.Writer) (io.WriteCloser, error)
+}
+
+// contentEncodings are sorted by decreasing preference
+var contentEncodings = []*contentEncoding{
+	{"gzip", func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(w), nil }},
+	{"deflate", func(w io.Writer) (io.WriteCloser, error) { return zlib.NewWriter(w), nil }},
+}
+
+// RegisterContentEncoding registers a content encoding (e.g. "br") which
+// might be used by Context.Respond for compressing responses. If there's
+// already an encoding with the same name, it's replaced. Otherwise, the
+// new encoding is preferred over the existing ones (gzip and deflate are
+// registered by default) when the client accepts all of them with the same
+// quality. The writer returned by f must write its compressed output to w
+// and flush it when closed. Keep in mind that this function is not thread
+// safe, so it should only be called from the main goroutine.
+func RegisterContentEncoding(name string, f func(w io.Writer) (io.WriteCloser, error)) {
+	name = strings.ToLower(name)
+	for _, v := range contentEncodings {
+		if v.name == name {
+			v.newWriter = f
+			return
+		}
+	}
+	contentEncodings = append([]*contentEncoding{{name, f}}, contentEncodings...)
+}
+
+// negotiateEncoding returns the content encoding to use for a response
+// given the Accept-Encoding header, or nil if no encoding should be used.
+func negotiateEncoding(header string) *contentEncoding {
+	if header == "" {
+		return nil
+	}
+	values := parseAccept(header)
+	offers := make([]string, len(contentEncodings))
+	for ii, v := range contentEncodings {
+		offers[ii] = v.name
+	}
+	name := negotiate(values, offers, matchEncoding)
+	for _, v := range contentEncodings {
+		if v.name == name {
+			return v
+		}
+	}
+	return nil
+}
@@ -75,3 +75,36 @@ func (r *regexpProvider) reset(re *regexp.Regexp, path string, matches []int) {
 	r.matches = matches
 	r.arguments = r.arguments[:0]
 }
+
+type routeProvider struct {
+	names  []string
+	values []string
+}
+
+func (r *routeProvider) Count() int {
+	return len(r.values)
+}
+
+func (r *routeProvider) Arg(idx int) string {
+	if idx < len(r.values) {
+		return r.values[idx]
+	}
+	return ""
+}
+
+func (r *routeProvider) Param(name string) string {
+	for ii, v := range r.names {
+		if v == name {
+			if ii < len(r.values) {
+				return r.values[ii]
+			}
+			break
+		}
+	}
+	return ""
+}
+
+func (r *routeProvider) reset(names []string, values []string) {
+	r.names = names
+	r.values = values
+}
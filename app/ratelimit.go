@@ -0,0 +1,273 @@
+package app
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gnd.la/cache"
+)
+
+const (
+	rateLimitKeyPrefix = "gondola-ratelimit:"
+	rateLimitAttempts  = 5
+	// interval for removing the memory
+	// buckets which are full again
+	rateLimitSweepInterval = time.Minute
+)
+
+// RateLimitOptions specify the options for the RateLimit transformer.
+// Requests are limited using a token bucket for each client, which holds
+// up to Burst tokens and is refilled at Rate tokens per second. Each request
+// takes a token from the bucket and requests arriving when the bucket is
+// empty are rejected.
+type RateLimitOptions struct {
+	// Rate is the number of requests per second allowed
+	// for each client in the long term. It must be positive.
+	Rate float64
+	// Burst is the maximum number of requests a client might
+	// perform at once. If zero, it defaults to Rate, rounded up.
+	Burst int
+	// Key returns the key which identifies the client making the
+	// request. If nil, RateLimitByIP is used. See also RateLimitByUser
+	// and RateLimitByHandler.
+	Key func(ctx *Context) string
+	// Scope, if non-empty, makes all the handlers transformed with the
+	// same Scope share their buckets. Otherwise, each handler uses its
+	// own buckets, identified by the handler name or, for handlers
+	// without a name, by the order RateLimit was called in, which is
+	// only stable across instances running the same code. Set a Scope
+	// for unnamed handlers if you're sharing the buckets with other
+	// code.
+	Scope string
+	// Shared makes the limiter store the buckets in the App cache,
+	// so the limits are enforced across all the instances of the App
+	// using the same cache. If the cache driver supports neither
+	// compare-and-swap nor counters, buckets are stored in memory.
+	Shared bool
+}
+
+func (o *RateLimitOptions) burst() float64 {
+	if o.Burst > 0 {
+		return float64(o.Burst)
+	}
+	return math.Ceil(o.Rate)
+}
+
+// RateLimitByIP limits the requests by the client IP address. Note
+// that when running behind a proxy, App.SetTrustXHeaders should be
+// enabled, otherwise all requests will appear to come from the proxy.
+func RateLimitByIP(ctx *Context) string {
+	return ctx.RemoteAddress()
+}
+
+// RateLimitByUser limits the requests by the signed in user id,
+// falling back to the client IP address for anonymous users.
+func RateLimitByUser(ctx *Context) string {
+	if user := ctx.User(); user != nil {
+		return "user-" + strconv.FormatInt(user.Id(), 10)
+	}
+	return RateLimitByIP(ctx)
+}
+
+// RateLimitByHandler uses a single bucket for each handler, limiting
+// all the requests it receives, regardless of the client.
+func RateLimitByHandler(ctx *Context) string {
+	return ""
+}
+
+type rateBucket struct {
+	Tokens  float64
+	Updated int64 // UnixNano
+}
+
+// take refills the bucket and tries to take a token from it. If
+// there are no tokens available, it returns the time until one
+// will be.
+func (b *rateBucket) take(now int64, rate float64, burst float64) (bool, time.Duration) {
+	if elapsed := float64(now-b.Updated) / float64(time.Second); elapsed > 0 {
+		b.Tokens = math.Min(burst, b.Tokens+elapsed*rate)
+	}
+	b.Updated = now
+	if b.Tokens >= 1 {
+		b.Tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.Tokens) / rate * float64(time.Second))
+}
+
+// rateLimitCount is used for generating the
+// scope of unnamed handlers, see RateLimit.
+var rateLimitCount uint64
+
+type memoryBucket struct {
+	rateBucket
+	// time (UnixNano) when the bucket will be full again
+	full int64
+}
+
+var memoryBuckets struct {
+	sync.Mutex
+	buckets map[string]*memoryBucket
+	sweeper sync.Once
+}
+
+func takeMemory(key string, now int64, rate float64, burst float64) (bool, time.Duration) {
+	memoryBuckets.sweeper.Do(func() {
+		go sweepMemoryBucketsLoop()
+	})
+	memoryBuckets.Lock()
+	defer memoryBuckets.Unlock()
+	if memoryBuckets.buckets == nil {
+		memoryBuckets.buckets = make(map[string]*memoryBucket)
+	}
+	b := memoryBuckets.buckets[key]
+	if b == nil {
+		b = &memoryBucket{rateBucket: rateBucket{Tokens: burst, Updated: now}}
+		memoryBuckets.buckets[key] = b
+	}
+	allowed, wait := b.take(now, rate, burst)
+	b.full = b.Updated + int64((burst-b.Tokens)/rate*float64(time.Second))
+	return allowed, wait
+}
+
+func sweepMemoryBucketsLoop() {
+	ticker := time.NewTicker(rateLimitSweepInterval)
+	for t := range ticker.C {
+		sweepMemoryBuckets(t.UnixNano())
+	}
+}
+
+// sweepMemoryBuckets removes the buckets which are full again
+// at the given time. Since buckets are created full, removing
+// them doesn't change the limits.
+func sweepMemoryBuckets(now int64) {
+	memoryBuckets.Lock()
+	defer memoryBuckets.Unlock()
+	for k, v := range memoryBuckets.buckets {
+		if v.full <= now {
+			delete(memoryBuckets.buckets, k)
+		}
+	}
+}
+
+// takeShared takes a token from the bucket stored in the cache, using
+// compare-and-swap. If the driver doesn't support it, it falls back to
+// a fixed window counter. The last return value is false if neither
+// is supported.
+func takeShared(c *cache.Cache, key string, now int64, rate float64, burst float64) (bool, time.Duration, bool) {
+	// Time for an empty bucket to be full again. After that
+	// time, a missing bucket is equivalent to a full one.
+	timeout := int(math.Ceil(burst/rate)) + 1
+	for ii := 0; ii < rateLimitAttempts; ii++ {
+		var b rateBucket
+		token, err := c.GetCAS(key, &b)
+		if err == cache.ErrNotFound {
+			b = rateBucket{Tokens: burst, Updated: now}
+			allowed, wait := b.take(now, rate, burst)
+			added, err := c.Add(key, &b, timeout)
+			if err != nil {
+				if cache.IsNotImplemented(err) {
+					return takeCounter(c, key, now, rate, burst)
+				}
+				break
+			}
+			if added {
+				return allowed, wait, true
+			}
+			// Another request created the bucket, try again
+			continue
+		}
+		if err != nil {
+			if cache.IsNotImplemented(err) {
+				return takeCounter(c, key, now, rate, burst)
+			}
+			break
+		}
+		allowed, wait := b.take(now, rate, burst)
+		if !allowed {
+			// No need to store the bucket, it didn't change
+			return false, wait, true
+		}
+		swapped, err := c.CompareAndSwap(key, &b, token, timeout)
+		if err != nil {
+			break
+		}
+		if swapped {
+			return true, 0, true
+		}
+	}
+	// Either the cache is failing or the bucket is too contended.
+	// Don't reject requests because of a problem on our side.
+	return true, 0, true
+}
+
+// takeCounter approximates the token bucket using a counter in a
+// fixed window, with the length required for refilling the bucket.
+func takeCounter(c *cache.Cache, key string, now int64, rate float64, burst float64) (bool, time.Duration, bool) {
+	window := int64(math.Ceil(burst / rate))
+	sec := now / int64(time.Second)
+	start := sec - sec%window
+	count, err := c.Increment(fmt.Sprintf("%s:%d", key, start), 1, int(window)+1)
+	if err != nil {
+		if cache.IsNotImplemented(err) {
+			return false, 0, false
+		}
+		return true, 0, true
+	}
+	if float64(count) <= burst {
+		return true, 0, true
+	}
+	return false, time.Duration((start+window)*int64(time.Second) - now), true
+}
+
+// RateLimit returns a new Handler which limits the rate of the requests
+// as specified by opts. When a request is rejected, the client receives a
+// 429 (Too Many Requests) response with a Retry-After header indicating
+// the number of seconds until the next request will be allowed. If opts
+// is nil or its Rate is not positive, RateLimit panics.
+func RateLimit(handler Handler, opts *RateLimitOptions) Handler {
+	if opts == nil || opts.Rate <= 0 {
+		panic(fmt.Errorf("rate limit must be positive"))
+	}
+	keyFunc := opts.Key
+	if keyFunc == nil {
+		keyFunc = RateLimitByIP
+	}
+	burst := opts.burst()
+	// Used as the scope for unnamed handlers, otherwise
+	// they would share the same buckets.
+	id := fmt.Sprintf("#%d", atomic.AddUint64(&rateLimitCount, 1))
+	return func(ctx *Context) {
+		scope := opts.Scope
+		if scope == "" {
+			if scope = ctx.HandlerName(); scope == "" {
+				scope = id
+			}
+		}
+		key := rateLimitKeyPrefix + scope + ":" + keyFunc(ctx)
+		now := time.Now().UnixNano()
+		var allowed, ok bool
+		var wait time.Duration
+		if opts.Shared {
+			allowed, wait, ok = takeShared(ctx.Cache().Cache, key, now, opts.Rate, burst)
+		}
+		if !ok {
+			allowed, wait = takeMemory(key, now, opts.Rate, burst)
+		}
+		if !allowed {
+			retry := int(math.Ceil(wait.Seconds()))
+			if retry < 1 {
+				retry = 1
+			}
+			ctx.Header().Set("Retry-After", strconv.Itoa(retry))
+			ctx.app.handleHTTPError(ctx, "Too Many Requests", http.StatusTooManyRequests)
+			return
+		}
+		handler(ctx)
+	}
+}
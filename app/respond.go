@@ -0,0 +1,280 @@
+package app
+
+import (
+	"bytes"
+	"encoding/xml"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"gnd.la/app/serialize"
+	"gnd.la/encoding/codec"
+)
+
+const (
+	// FormatParameterName is the name of the query parameter which
+	// might be used to override the format selected by Context.Respond
+	// using the Accept header (e.g. /articles/?format=xml). Valid values
+	// are "json", "xml", "msgpack" and "html".
+	FormatParameterName = "format"
+	// responses smaller than this are not compressed
+	compressMinSize = 512
+)
+
+type responseFormat struct {
+	name         string
+	contentType  string
+	contentTypes []string
+}
+
+var (
+	jsonFormat    = &responseFormat{"json", "application/json", []string{"application/json"}}
+	xmlFormat     = &responseFormat{"xml", "application/xml", []string{"application/xml", "text/xml"}}
+	msgpackFormat = &responseFormat{"msgpack", "application/msgpack", []string{"application/msgpack", "application/x-msgpack"}}
+	htmlFormat    = &responseFormat{"html", "text/html; charset=utf-8", []string{"text/html", "application/xhtml+xml"}}
+)
+
+// ErrorDocument is the document sent by Context.Respond when
+// its data is an error and by the App for errors from Context.Bind
+// when the client prefers JSON, XML or msgpack over plain text and
+// HTML. The App also sends it for any other error (e.g. from
+// Context.Error or a panic) when enabled with App.SetErrorDocuments.
+type ErrorDocument struct {
+	XMLName xml.Name `json:"-" xml:"error"`
+	// Code is the HTTP status code.
+	Code int `json:"code" xml:"code"`
+	// Message is the error message.
+	Message string `json:"message" xml:"message"`
+	// Fields contains the errors for each invalid field,
+	// when the error is a *BindError.
+	Fields []*FieldError `json:"errors,omitempty" xml:"fields>field,omitempty"`
+}
+
+// Respond is a shorthand for RespondTemplate("", data). Note that
+// this means HTML is not offered as a format.
+func (c *Context) Respond(data interface{}) error {
+	return c.RespondTemplate("", data)
+}
+
+// RespondTemplate sends data back to the client, using the format
+// preferred by the client according to its Accept header. The
+// supported formats are JSON, XML, msgpack (only when the msgpack
+// codec has been registered by importing gnd.la/encoding/codec/msgpack)
+// and, if template is non-empty, HTML, by executing the named template
+// with the given data. When the client has no preference, JSON is used.
+// The format might also be explicitly selected using the query parameter
+// named by FormatParameterName. If none of the formats is acceptable,
+// a 406 (Not Acceptable) error is sent.
+//
+// The response is compressed using the best encoding accepted by the
+// client in its Accept-Encoding header (gzip and deflate are supported by
+// default, see RegisterContentEncoding for adding more).
+//
+// If data is an error, it's handled like errors raised with Context.Error,
+// so it can be intercepted by the App error handler, using the status code
+// and message from the error when it implements Error, or a 500 status
+// code and a generic message (the error is logged) otherwise. Unless the
+// error handler intercepts it, an ErrorDocument is sent in the selected
+// format or, if the selected format is HTML, the client might receive
+// the error as plain text (see ErrorHandler).
+//
+// The returned error is non-nil only if the data could not be encoded or
+// the template could not be executed.
+func (c *Context) RespondTemplate(template string, data interface{}) error {
+	addVary(c.Header(), "Accept")
+	f := c.negotiateFormat(template != "", jsonFormat)
+	if err, ok := data.(error); ok {
+		return c.respondError(err, f)
+	}
+	if f == nil {
+		c.app.handleHTTPError(c, defaultMessages[http.StatusNotAcceptable].TranslatedString(c), http.StatusNotAcceptable)
+		return nil
+	}
+	return c.writeResponse(f, template, data)
+}
+
+// negotiateFormat returns the format to use for the response, or nil if
+// none of the available formats is acceptable. The def format is used when
+// the client has no preference.
+func (c *Context) negotiateFormat(html bool, def *responseFormat) *responseFormat {
+	offers := []*responseFormat{def}
+	for _, v := range []*responseFormat{jsonFormat, xmlFormat, msgpackFormat, htmlFormat} {
+		if v == def || (v == msgpackFormat && codec.Get("msgpack") == nil) || (v == htmlFormat && !html) {
+			continue
+		}
+		offers = append(offers, v)
+	}
+	if c.R == nil {
+		return def
+	}
+	if name := c.R.URL.Query().Get(FormatParameterName); name != "" {
+		for _, v := range offers {
+			if v.name == name {
+				return v
+			}
+		}
+		return nil
+	}
+	accept := c.R.Header.Get("Accept")
+	if accept == "" {
+		return def
+	}
+	values := parseAccept(accept)
+	var best *responseFormat
+	bestQ := 0.0
+	for _, v := range offers {
+		for _, ct := range v.contentTypes {
+			if q := acceptQuality(values, ct, matchMediaType); q > bestQ {
+				best = v
+				bestQ = q
+			}
+		}
+	}
+	return best
+}
+
+func (c *Context) respondError(err error, f *responseFormat) error {
+	code := http.StatusInternalServerError
+	var message string
+	switch e := err.(type) {
+	case *BindError:
+		code = e.code
+		message = e.Message
+	case Error:
+		code = e.StatusCode()
+		message = e.Error()
+	default:
+		c.logger().Errorf("error responding to request: %s", err)
+	}
+	if message == "" {
+		message = defaultMessages[code].TranslatedString(c)
+	}
+	if f == htmlFormat {
+		// Let the client choose between an error
+		// document and the plain text error.
+		f = nil
+	}
+	c.app.sendError(c, err, message, code, f)
+	return nil
+}
+
+// errorFormat returns the format for sending err as an ErrorDocument,
+// or nil if it should be sent as plain text. Clients which prefer
+// JSON, XML or msgpack over plain text and HTML receive a document.
+// When the client has no preference, errors from Context.Bind are sent
+// in the same format as the request body and the rest of them as
+// plain text.
+func (c *Context) errorFormat(err error) *responseFormat {
+	var def *responseFormat
+	if berr, ok := err.(*BindError); ok {
+		def = berr.responseFormat()
+	}
+	var offers []*responseFormat
+	if def != nil {
+		offers = append(offers, def)
+	}
+	for _, v := range []*responseFormat{jsonFormat, xmlFormat, msgpackFormat} {
+		if v != def && (v != msgpackFormat || codec.Get("msgpack") != nil) {
+			offers = append(offers, v)
+		}
+	}
+	if c.R == nil {
+		return def
+	}
+	if name := c.R.URL.Query().Get(FormatParameterName); name != "" {
+		for _, v := range offers {
+			if v.name == name {
+				return v
+			}
+		}
+		return nil
+	}
+	accept := c.R.Header.Get("Accept")
+	if accept == "" {
+		return def
+	}
+	values := parseAccept(accept)
+	textQ := acceptQuality(values, "text/plain", matchMediaType)
+	if q := acceptQuality(values, "text/html", matchMediaType); q > textQ {
+		textQ = q
+	}
+	var best *responseFormat
+	bestQ := 0.0
+	for _, v := range offers {
+		for _, ct := range v.contentTypes {
+			if q := acceptQuality(values, ct, matchMediaType); q > bestQ {
+				best = v
+				bestQ = q
+			}
+		}
+	}
+	if best != nil && (bestQ > textQ || (bestQ == textQ && best == def)) {
+		return best
+	}
+	return nil
+}
+
+// addVary adds value to the Vary header in h,
+// unless it's already present.
+func addVary(h http.Header, value string) {
+	for _, v := range h["Vary"] {
+		for _, field := range strings.Split(v, ",") {
+			if field = strings.TrimSpace(field); field == "*" || strings.EqualFold(field, value) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", value)
+}
+
+func (c *Context) writeResponse(f *responseFormat, template string, data interface{}) error {
+	var buf bytes.Buffer
+	switch f {
+	case jsonFormat:
+		if _, err := serialize.WriteJSON(&buf, data); err != nil {
+			return err
+		}
+	case xmlFormat:
+		if _, err := serialize.WriteXML(&buf, data); err != nil {
+			return err
+		}
+	case msgpackFormat:
+		b, err := codec.Get("msgpack").Encode(data)
+		if err != nil {
+			return err
+		}
+		buf.Write(b)
+	case htmlFormat:
+		tmpl, err := c.app.LoadTemplate(template)
+		if err != nil {
+			return err
+		}
+		if err := tmpl.ExecuteTo(&buf, c, data); err != nil {
+			return err
+		}
+	}
+	body := buf.Bytes()
+	h := c.Header()
+	h.Set("Content-Type", f.contentType)
+	addVary(h, "Accept-Encoding")
+	if len(body) >= compressMinSize && h.Get("Content-Encoding") == "" && c.R != nil {
+		if enc := negotiateEncoding(c.R.Header.Get("Accept-Encoding")); enc != nil {
+			var cbuf bytes.Buffer
+			w, err := enc.newWriter(&cbuf)
+			if err != nil {
+				return err
+			}
+			if _, err := w.Write(body); err != nil {
+				return err
+			}
+			if err := w.Close(); err != nil {
+				return err
+			}
+			h.Set("Content-Encoding", enc.name)
+			body = cbuf.Bytes()
+		}
+	}
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	_, err := c.Write(body)
+	return err
+}
@@ -0,0 +1,226 @@
+package app
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type respondTest struct {
+	XMLName xml.Name `json:"-" xml:"article"`
+	Id      int      `json:"id" xml:"id"`
+	Title   string   `json:"title" xml:"title"`
+}
+
+func respondTestRequest(path string, headers map[string]string) *http.Request {
+	r, _ := http.NewRequest("GET", "http://localhost"+path, nil)
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	return r
+}
+
+func TestRespondNegotiation(t *testing.T) {
+	a := New()
+	a.Handle("/article/", RespondHandler(func(ctx *Context) (interface{}, error) {
+		return &respondTest{Id: 1, Title: "Hello"}, nil
+	}, ""))
+	tests := []struct {
+		path   string
+		accept string
+		code   int
+		ct     string
+	}{
+		{"/article/", "", 200, "application/json"},
+		{"/article/", "*/*", 200, "application/json"},
+		{"/article/", "application/xml", 200, "application/xml"},
+		{"/article/", "text/xml;q=0.9, application/json;q=0.5", 200, "application/xml"},
+		{"/article/", "application/json;q=0, */*", 200, "application/xml"},
+		{"/article/?format=xml", "application/json", 200, "application/xml"},
+		{"/article/?format=yaml", "", 406, ""},
+		{"/article/", "image/png", 406, ""},
+	}
+	for _, v := range tests {
+		w := serveTestRequest(a, respondTestRequest(v.path, map[string]string{"Accept": v.accept}))
+		if w.Code != v.code {
+			t.Errorf("%s (Accept %q): expecting code %d, got %d", v.path, v.accept, v.code, w.Code)
+			continue
+		}
+		if v.ct != "" {
+			if ct := w.Header().Get("Content-Type"); ct != v.ct {
+				t.Errorf("%s (Accept %q): expecting Content-Type %q, got %q", v.path, v.accept, v.ct, ct)
+			}
+			var res respondTest
+			var err error
+			if v.ct == "application/xml" {
+				err = xml.Unmarshal(w.Body.Bytes(), &res)
+			} else {
+				err = json.Unmarshal(w.Body.Bytes(), &res)
+			}
+			if err != nil || res.Id != 1 || res.Title != "Hello" {
+				t.Errorf("%s (Accept %q): unexpected body %q (%v)", v.path, v.accept, w.Body.String(), err)
+			}
+		}
+	}
+}
+
+func TestRespondCompression(t *testing.T) {
+	a := New()
+	title := strings.Repeat("gondola ", 200)
+	a.Handle("/article/", RespondHandler(func(ctx *Context) (interface{}, error) {
+		return &respondTest{Id: 1, Title: title}, nil
+	}, ""))
+	w := serveTestRequest(a, respondTestRequest("/article/", map[string]string{"Accept-Encoding": "deflate;q=0.5, gzip"}))
+	if ce := w.Header().Get("Content-Encoding"); ce != "gzip" {
+		t.Fatalf("expecting gzip Content-Encoding, got %q", ce)
+	}
+	r, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res respondTest
+	if err := json.Unmarshal(data, &res); err != nil || res.Title != title {
+		t.Errorf("unexpected decompressed body %q (%v)", string(data), err)
+	}
+	w = serveTestRequest(a, respondTestRequest("/article/", map[string]string{"Accept-Encoding": "gzip;q=0, identity"}))
+	if ce := w.Header().Get("Content-Encoding"); ce != "" {
+		t.Errorf("expecting no Content-Encoding, got %q", ce)
+	}
+}
+
+func TestRespondError(t *testing.T) {
+	a := New()
+	a.Handle("/missing/", RespondHandler(func(ctx *Context) (interface{}, error) {
+		return nil, &NotFoundError{}
+	}, ""))
+	w := serveTestRequest(a, respondTestRequest("/missing/", map[string]string{"Accept": "application/xml"}))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expecting code %d, got %d", http.StatusNotFound, w.Code)
+	}
+	var doc ErrorDocument
+	if err := xml.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.Code != http.StatusNotFound || doc.Message == "" {
+		t.Errorf("unexpected error document %q", w.Body.String())
+	}
+}
+
+func TestErrorNegotiation(t *testing.T) {
+	a := New()
+	a.Logger = nil
+	a.SetErrorDocuments(true)
+	a.Handle("^/missing/$", func(ctx *Context) {
+		ctx.NotFound("no such article")
+	})
+	a.Handle("^/panic/$", func(ctx *Context) {
+		panic("handler panicked")
+	})
+	tests := []struct {
+		path   string
+		accept string
+		code   int
+		ct     string
+	}{
+		{"/missing/", "", 404, "text/plain; charset=utf-8"},
+		{"/missing/", "*/*", 404, "text/plain; charset=utf-8"},
+		{"/missing/", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", 404, "text/plain; charset=utf-8"},
+		{"/missing/", "application/json", 404, "application/json"},
+		{"/missing/", "application/xml, text/plain;q=0.5", 404, "application/xml"},
+		{"/missing/?format=json", "", 404, "application/json"},
+		{"/panic/", "application/json", 500, "application/json"},
+		{"/panic/", "", 500, "text/plain; charset=utf-8"},
+	}
+	for _, v := range tests {
+		w := serveTestRequest(a, respondTestRequest(v.path, map[string]string{"Accept": v.accept}))
+		if w.Code != v.code {
+			t.Errorf("%s (Accept %q): expecting code %d, got %d", v.path, v.accept, v.code, w.Code)
+			continue
+		}
+		if ct := w.Header().Get("Content-Type"); ct != v.ct {
+			t.Errorf("%s (Accept %q): expecting Content-Type %q, got %q", v.path, v.accept, v.ct, ct)
+			continue
+		}
+		if v.ct == "application/json" {
+			var doc ErrorDocument
+			if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+				t.Errorf("%s (Accept %q): error decoding document: %s", v.path, v.accept, err)
+			} else if doc.Code != v.code || doc.Message == "" {
+				t.Errorf("%s (Accept %q): unexpected error document %q", v.path, v.accept, w.Body.String())
+			}
+		}
+	}
+}
+
+func TestErrorDocumentsDisabled(t *testing.T) {
+	a := New()
+	a.Handle("^/missing/$", func(ctx *Context) {
+		ctx.NotFound("no such article")
+	})
+	w := serveTestRequest(a, respondTestRequest("/missing/", map[string]string{"Accept": "application/json"}))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expecting code %d, got %d", http.StatusNotFound, w.Code)
+	}
+	if ct, exp := w.Header().Get("Content-Type"), "text/plain; charset=utf-8"; ct != exp {
+		t.Errorf("expecting Content-Type %q, got %q", exp, ct)
+	}
+}
+
+func TestRespondErrorHandler(t *testing.T) {
+	a := New()
+	a.Handle("^/missing/$", RespondHandler(func(ctx *Context) (interface{}, error) {
+		return nil, &NotFoundError{}
+	}, ""))
+	var handled int
+	a.SetErrorHandler(func(ctx *Context, msg string, code int) bool {
+		handled = code
+		ctx.WriteString("custom error")
+		return true
+	})
+	w := serveTestRequest(a, respondTestRequest("/missing/", map[string]string{"Accept": "application/json"}))
+	if handled != http.StatusNotFound {
+		t.Errorf("expecting error handler to be called with code %d, got %d", http.StatusNotFound, handled)
+	}
+	if body := w.Body.String(); body != "custom error" {
+		t.Errorf("expecting body from the error handler, got %q", body)
+	}
+}
+
+func TestRespondVary(t *testing.T) {
+	a := New()
+	a.Handle("^/bind/$", Vary(func(ctx *Context) {
+		var b bindTest
+		ctx.MustBind(&b)
+	}, []string{"Accept"}))
+	a.Handle("^/article/$", func(ctx *Context) {
+		ctx.Header().Set("Vary", "accept-encoding, Accept")
+		ctx.Respond(&respondTest{Id: 1, Title: strings.Repeat("Hello", 200)})
+	})
+	r, _ := http.NewRequest("POST", "http://localhost/bind/", strings.NewReader(`{"username": "go"}`))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Accept", "application/json")
+	for _, w := range []*httptest.ResponseRecorder{
+		serveTestRequest(a, r),
+		serveTestRequest(a, respondTestRequest("/article/", map[string]string{"Accept-Encoding": "gzip"})),
+	} {
+		seen := make(map[string]bool)
+		for _, v := range w.Header()["Vary"] {
+			for _, f := range strings.Split(v, ",") {
+				f = strings.ToLower(strings.TrimSpace(f))
+				if seen[f] {
+					t.Errorf("%s included twice in Vary %q", f, w.Header()["Vary"])
+				}
+				seen[f] = true
+			}
+		}
+	}
+}
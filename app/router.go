@@ -0,0 +1,429 @@
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// segmentType represents the type of a parameter
+// in a route pattern (e.g. {id:int}).
+type segmentType struct {
+	name string
+	// priority determines the order parameters are stored
+	// in when several of them are at the same position.
+	// Lower priorities come first.
+	priority int
+	// catchAll indicates that the parameter consumes
+	// the rest of the path, including slashes.
+	catchAll bool
+	match    func(s string) bool
+}
+
+func isDigits(s string) bool {
+	for ii := 0; ii < len(s); ii++ {
+		if s[ii] < '0' || s[ii] > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+func isAlpha(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isHex(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func allBytes(s string, f func(c byte) bool) bool {
+	for ii := 0; ii < len(s); ii++ {
+		if !f(s[ii]) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+var segmentTypes = map[string]*segmentType{
+	"string": {
+		name:     "string",
+		priority: 1,
+		match:    func(s string) bool { return s != "" && strings.IndexByte(s, '/') < 0 },
+	},
+	"int": {
+		name: "int",
+		match: func(s string) bool {
+			if s != "" && s[0] == '-' {
+				s = s[1:]
+			}
+			return isDigits(s)
+		},
+	},
+	"uint": {
+		name:  "uint",
+		match: isDigits,
+	},
+	"alpha": {
+		name:  "alpha",
+		match: func(s string) bool { return allBytes(s, isAlpha) },
+	},
+	"alnum": {
+		name: "alnum",
+		match: func(s string) bool {
+			return allBytes(s, func(c byte) bool { return isAlpha(c) || (c >= '0' && c <= '9') })
+		},
+	},
+	"slug": {
+		name: "slug",
+		match: func(s string) bool {
+			return allBytes(s, func(c byte) bool { return isAlpha(c) || (c >= '0' && c <= '9') || c == '-' || c == '_' })
+		},
+	},
+	"hex": {
+		name:  "hex",
+		match: func(s string) bool { return allBytes(s, isHex) },
+	},
+	"uuid": {
+		name: "uuid",
+		match: func(s string) bool {
+			if len(s) != 36 {
+				return false
+			}
+			for ii := 0; ii < len(s); ii++ {
+				switch ii {
+				case 8, 13, 18, 23:
+					if s[ii] != '-' {
+						return false
+					}
+				default:
+					if !isHex(s[ii]) {
+						return false
+					}
+				}
+			}
+			return true
+		},
+	},
+	"path": {
+		name:     "path",
+		priority: 2,
+		catchAll: true,
+		match:    func(s string) bool { return s != "" },
+	},
+}
+
+// routeToken is either a literal string or a parameter
+// in a route pattern.
+type routeToken struct {
+	literal string
+	name    string
+	typ     *segmentType
+}
+
+// isRoutePattern returns true iff the pattern should be parsed
+// as a route rather than as a regular expression. Routes start
+// with a slash, contain at least one parameter and don't contain
+// any regexp metacharacters outside of the parameters. Patterns
+// without parameters are always regular expressions, so they keep
+// matching any path which contains them (e.g. / matches every path).
+func isRoutePattern(pattern string) bool {
+	if pattern == "" || pattern[0] != '/' {
+		return false
+	}
+	params := 0
+	for ii := 0; ii < len(pattern); ii++ {
+		switch c := pattern[ii]; c {
+		case '{':
+			end := strings.IndexByte(pattern[ii:], '}')
+			if end < 0 || !isParamName(pattern[ii+1:ii+end]) {
+				return false
+			}
+			params++
+			ii += end
+		case '^', '$', '(', ')', '[', ']', '*', '+', '?', '|', '\\', '}':
+			return false
+		}
+	}
+	return params > 0
+}
+
+// isParamName returns true iff s is a valid parameter
+// in a route, without the braces (e.g. id or id:int).
+// This allows distinguishing parameters from regular
+// expression repetitions like {2} or {1,3}.
+func isParamName(s string) bool {
+	if sep := strings.IndexByte(s, ':'); sep >= 0 {
+		s = s[:sep]
+	}
+	if s == "" || !(isAlpha(s[0]) || s[0] == '_') {
+		return false
+	}
+	return allBytes(s, func(c byte) bool { return isAlpha(c) || (c >= '0' && c <= '9') || c == '_' })
+}
+
+func parseRoute(pattern string) ([]*routeToken, error) {
+	var tokens []*routeToken
+	s := pattern
+	for s != "" {
+		start := strings.IndexByte(s, '{')
+		if start < 0 {
+			tokens = append(tokens, &routeToken{literal: s})
+			break
+		}
+		if start > 0 {
+			tokens = append(tokens, &routeToken{literal: s[:start]})
+		}
+		end := strings.IndexByte(s[start:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated parameter in route %q", pattern)
+		}
+		end += start
+		param := s[start+1 : end]
+		name, typeName := param, "string"
+		if sep := strings.IndexByte(param, ':'); sep >= 0 {
+			name, typeName = param[:sep], param[sep+1:]
+		}
+		if name == "" {
+			return nil, fmt.Errorf("empty parameter name in route %q", pattern)
+		}
+		typ := segmentTypes[typeName]
+		if typ == nil {
+			return nil, fmt.Errorf("invalid parameter type %q in route %q", typeName, pattern)
+		}
+		s = s[end+1:]
+		if s != "" && s[0] != '/' {
+			return nil, fmt.Errorf("parameter %q in route %q must be followed by a slash or by the end of the route", name, pattern)
+		}
+		if typ.catchAll && s != "" {
+			return nil, fmt.Errorf("parameter %q of type %s in route %q must be at the end of the route", name, typ.name, pattern)
+		}
+		tokens = append(tokens, &routeToken{name: name, typ: typ})
+	}
+	return tokens, nil
+}
+
+// formatRoute returns the path for the route with
+// the given tokens and arguments.
+func formatRoute(tokens []*routeToken, args []interface{}) (string, error) {
+	count := 0
+	for _, v := range tokens {
+		if v.typ != nil {
+			count++
+		}
+	}
+	if len(args) != count {
+		return "", &argumentCountError{len(args), count, count}
+	}
+	var buf bytes.Buffer
+	ii := 0
+	for _, v := range tokens {
+		if v.typ == nil {
+			buf.WriteString(v.literal)
+			continue
+		}
+		cur := fmt.Sprintf("%v", args[ii])
+		if !v.typ.match(cur) || (!v.typ.catchAll && strings.IndexByte(cur, '/') >= 0) {
+			return "", fmt.Errorf("Invalid replacement at index %d. Parameter %q is of type %s, replacement is %q.", ii, v.name, v.typ.name, cur)
+		}
+		buf.WriteString(cur)
+		ii++
+	}
+	return buf.String(), nil
+}
+
+// routeParam is a parameter child of a routeNode.
+type routeParam struct {
+	typ  *segmentType
+	node *routeNode
+}
+
+// routeNode is a node in the radix tree used for matching routes.
+// Static children are stored compressed, with each one having a
+// different first byte, while parameters consume a segment of the
+// path (or the rest of it, for catch-all parameters).
+type routeNode struct {
+	path   string
+	static []*routeNode
+	params []*routeParam
+	// handlers registered for the path ending at this
+	// node, sorted by the order they were added.
+	handlers []*handlerInfo
+}
+
+func commonPrefix(a, b string) int {
+	ii := 0
+	for ii < len(a) && ii < len(b) && a[ii] == b[ii] {
+		ii++
+	}
+	return ii
+}
+
+func (n *routeNode) insertStatic(s string) *routeNode {
+	if s == "" {
+		return n
+	}
+	for _, c := range n.static {
+		if c.path[0] != s[0] {
+			continue
+		}
+		l := commonPrefix(c.path, s)
+		if l < len(c.path) {
+			// Split the child at the common prefix
+			child := &routeNode{
+				path:     c.path[l:],
+				static:   c.static,
+				params:   c.params,
+				handlers: c.handlers,
+			}
+			c.path = c.path[:l]
+			c.static = []*routeNode{child}
+			c.params = nil
+			c.handlers = nil
+		}
+		return c.insertStatic(s[l:])
+	}
+	c := &routeNode{path: s}
+	n.static = append(n.static, c)
+	return c
+}
+
+func (n *routeNode) insertParam(typ *segmentType) *routeNode {
+	for _, v := range n.params {
+		if v.typ == typ {
+			return v.node
+		}
+	}
+	p := &routeParam{typ: typ, node: &routeNode{}}
+	// Keep params sorted by priority
+	pos := len(n.params)
+	for pos > 0 && n.params[pos-1].typ.priority > typ.priority {
+		pos--
+	}
+	n.params = append(n.params, nil)
+	copy(n.params[pos+1:], n.params[pos:])
+	n.params[pos] = p
+	return p.node
+}
+
+func (n *routeNode) insert(tokens []*routeToken, info *handlerInfo) {
+	node := n
+	for _, v := range tokens {
+		if v.typ == nil {
+			node = node.insertStatic(v.literal)
+		} else {
+			node = node.insertParam(v.typ)
+		}
+	}
+	// Keep handlers sorted by the order they were added in
+	pos := len(node.handlers)
+	for pos > 0 && node.handlers[pos-1].order > info.order {
+		pos--
+	}
+	node.handlers = append(node.handlers, nil)
+	copy(node.handlers[pos+1:], node.handlers[pos:])
+	node.handlers[pos] = info
+}
+
+// routeMatch is the best match found by routeNode.lookup.
+type routeMatch struct {
+	info   *handlerInfo
+	values []string
+}
+
+// lookup finds the first handler (in the order they were added)
+// which accepts the given method for the given path, which doesn't
+// include the path of n, storing it and its parameter values in
+// best if it was added before the one already there. Since a path
+// might be matched by both static children and parameters (e.g.
+// /things/new and /things/{name}), all of them are tried. The
+// methods accepted by the handlers for matching paths which don't
+// accept the given method are appended to allowed.
+func (n *routeNode) lookup(path string, values []string, method string, allowed *[]string, best *routeMatch) {
+	if path == "" {
+		for _, v := range n.handlers {
+			if v.allows(method) {
+				if best.info == nil || v.order < best.info.order {
+					best.info = v
+					best.values = append([]string(nil), values...)
+				}
+				return
+			}
+			*allowed = append(*allowed, v.methods...)
+		}
+		return
+	}
+	for _, c := range n.static {
+		if c.path[0] == path[0] && strings.HasPrefix(path, c.path) {
+			c.lookup(path[len(c.path):], values, method, allowed, best)
+		}
+	}
+	for _, p := range n.params {
+		end := len(path)
+		if !p.typ.catchAll {
+			if slash := strings.IndexByte(path, '/'); slash >= 0 {
+				end = slash
+			}
+		}
+		if end == 0 || !p.typ.match(path[:end]) {
+			continue
+		}
+		p.node.lookup(path[end:], append(values, path[:end]), method, allowed, best)
+	}
+}
+
+// router contains the trees for the handlers registered using
+// routes or literal regular expressions, one per host.
+type router struct {
+	trees map[string]*routeNode
+}
+
+func (r *router) add(host string, tokens []*routeToken, info *handlerInfo) {
+	if r.trees == nil {
+		r.trees = make(map[string]*routeNode)
+	}
+	root := r.trees[host]
+	if root == nil {
+		root = &routeNode{}
+		r.trees[host] = root
+	}
+	root.insert(tokens, info)
+}
+
+// match returns the first handler (in the order they were added) for
+// the given host, path and method, as well as its parameter values. If
+// there are handlers for the path but none of them accepts the method,
+// the methods accepted by them are returned.
+func (r *router) match(host string, path string, method string) (*handlerInfo, []string, []string) {
+	var best routeMatch
+	var allowed []string
+	for _, h := range [...]string{host, ""} {
+		if root := r.trees[h]; root != nil {
+			root.lookup(path, nil, method, &allowed, &best)
+		}
+		if host == "" {
+			break
+		}
+	}
+	return best.info, best.values, allowed
+}
+
+// allowHeader returns the value for the Allow header
+// given the methods accepted by the handlers for a path.
+func allowHeader(methods []string) string {
+	seen := map[string]bool{"OPTIONS": true}
+	for _, v := range methods {
+		seen[v] = true
+		if v == "GET" {
+			seen["HEAD"] = true
+		}
+	}
+	allowed := make([]string, 0, len(seen))
+	for k := range seen {
+		allowed = append(allowed, k)
+	}
+	sort.Strings(allowed)
+	return strings.Join(allowed, ", ")
+}
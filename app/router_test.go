@@ -0,0 +1,226 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type routeTest struct {
+	method string
+	path   string
+	code   int
+	body   string
+	allow  string
+}
+
+func routeTestHandler(body string) Handler {
+	return func(ctx *Context) {
+		ctx.WriteString(body)
+		for ii := 0; ii < ctx.Count(); ii++ {
+			ctx.WriteString(" " + ctx.IndexValue(ii))
+		}
+	}
+}
+
+// serveTest serves the request without going through ServeHTTP, so
+// the requests are not recorded by the metrics, which are global.
+func serveTest(a *App, method string, path string) *httptest.ResponseRecorder {
+	r, _ := http.NewRequest(method, "http://localhost"+path, nil)
+	w := httptest.NewRecorder()
+	ctx := a.newContext(w, r)
+	a.serveOrNotFound(r.URL.Path, ctx)
+	return w
+}
+
+func TestRouter(t *testing.T) {
+	a := New()
+	a.SetAppendSlash(false)
+	a.Handle("^/$", routeTestHandler("index"))
+	a.Handle("^/articles/$", routeTestHandler("articles"))
+	a.Handle("^/articles/latest/$", routeTestHandler("latest"))
+	a.Handle("/articles/{id:int}/", routeTestHandler("article"))
+	a.Handle("/articles/{id:int}/{slug}/", routeTestHandler("article-slug"))
+	a.Handle("/articles/{name}/", routeTestHandler("article-name"))
+	a.Handle("/users/{id:uuid}", routeTestHandler("user"))
+	a.Handle("/files/{path:path}", routeTestHandler("file"))
+	a.Handle("^/legacy/(\\d+)/$", routeTestHandler("legacy"))
+	a.HandleMethods("^/api/items/$", routeTestHandler("items-get"), "GET")
+	a.HandleMethods("^/api/items/$", routeTestHandler("items-post"), "POST")
+	a.HandleMethods("/api/items/{id:int}", routeTestHandler("item-delete"), "DELETE")
+	a.HandleMethods("^/api/legacy/$", routeTestHandler("legacy-put"), "PUT")
+	tests := []*routeTest{
+		{"GET", "/", 200, "index", ""},
+		{"GET", "/articles/", 200, "articles", ""},
+		{"GET", "/articles/latest/", 200, "latest", ""},
+		{"GET", "/articles/42/", 200, "article 42", ""},
+		{"GET", "/articles/-1/", 200, "article -1", ""},
+		{"GET", "/articles/42/the-answer/", 200, "article-slug 42 the-answer", ""},
+		{"GET", "/articles/foo/", 200, "article-name foo", ""},
+		{"GET", "/articles/42", 404, "", ""},
+		{"GET", "/articles/foo/bar/", 404, "", ""},
+		{"GET", "/users/0b4c6e44-55a1-4e3a-9b1e-5b0b7f0e2c9d", 200, "user 0b4c6e44-55a1-4e3a-9b1e-5b0b7f0e2c9d", ""},
+		{"GET", "/users/42", 404, "", ""},
+		{"GET", "/files/a/b/c.txt", 200, "file a/b/c.txt", ""},
+		{"GET", "/files/", 404, "", ""},
+		{"GET", "/legacy/7/", 200, "legacy 7", ""},
+		{"GET", "/api/items/", 200, "items-get", ""},
+		{"HEAD", "/api/items/", 200, "items-get", ""},
+		{"POST", "/api/items/", 200, "items-post", ""},
+		{"PUT", "/api/items/", 405, "", "GET, HEAD, OPTIONS, POST"},
+		{"OPTIONS", "/api/items/", 200, "", "GET, HEAD, OPTIONS, POST"},
+		{"DELETE", "/api/items/3", 200, "item-delete 3", ""},
+		{"GET", "/api/items/3", 405, "", "DELETE, OPTIONS"},
+		{"PUT", "/api/legacy/", 200, "legacy-put", ""},
+		{"GET", "/api/legacy/", 405, "", "OPTIONS, PUT"},
+	}
+	for _, v := range tests {
+		w := serveTest(a, v.method, v.path)
+		if w.Code != v.code {
+			t.Errorf("%s %s: expecting code %d, got %d", v.method, v.path, v.code, w.Code)
+			continue
+		}
+		if v.body != "" {
+			if body := w.Body.String(); body != v.body {
+				t.Errorf("%s %s: expecting body %q, got %q", v.method, v.path, v.body, body)
+			}
+		}
+		if allow := w.Header().Get("Allow"); allow != v.allow {
+			t.Errorf("%s %s: expecting Allow %q, got %q", v.method, v.path, v.allow, allow)
+		}
+	}
+}
+
+func TestRouterOrder(t *testing.T) {
+	a := New()
+	// Regexps added before a route take precedence
+	a.Handle("^/first/", routeTestHandler("regexp"))
+	a.Handle("^/first/page/$", routeTestHandler("route"))
+	a.Handle("^/second/page/$", routeTestHandler("route"))
+	a.Handle("^/second/", routeTestHandler("regexp"))
+	// Between routes, the one added first is used too
+	a.Handle("/third/{name}/", routeTestHandler("param"))
+	a.Handle("^/third/new/$", routeTestHandler("static"))
+	a.Handle("/third/{id:int}/", routeTestHandler("int"))
+	a.Handle("^/fourth/new/$", routeTestHandler("static"))
+	a.Handle("/fourth/{name}/", routeTestHandler("param"))
+	tests := map[string]string{
+		"/first/page/":  "regexp",
+		"/second/page/": "route",
+		"/second/other": "regexp",
+		"/third/new/":   "param new",
+		"/third/42/":    "param 42",
+		"/fourth/new/":  "static",
+		"/fourth/old/":  "param old",
+	}
+	for k, v := range tests {
+		if body := serveTest(a, "GET", k).Body.String(); body != v {
+			t.Errorf("GET %s: expecting body %q, got %q", k, v, body)
+		}
+	}
+}
+
+func TestRouterBacktracking(t *testing.T) {
+	a := New()
+	a.SetAppendSlash(false)
+	a.HandleMethods("^/things/new$", routeTestHandler("new"), "GET")
+	a.HandleMethods("/things/{name}", routeTestHandler("update"), "POST")
+	a.HandleMethods("/things/{id:int}/edit", routeTestHandler("edit"), "GET")
+	a.HandleMethods("/things/{name}/view", routeTestHandler("view"), "GET")
+	a.HandleMethods("/things/{name}/edit", routeTestHandler("edit-name"), "POST")
+	a.HandleMethods("/things/{id:int}/files/{path:path}", routeTestHandler("file"), "GET")
+	a.HandleMethods("/things/{name}/{path:path}", routeTestHandler("named-file"), "PUT")
+	tests := []*routeTest{
+		{"GET", "/things/new", 200, "new", ""},
+		// Static route doesn't accept POST, use the parameter
+		{"POST", "/things/new", 200, "update new", ""},
+		{"PUT", "/things/new", 405, "", "GET, HEAD, OPTIONS, POST"},
+		{"GET", "/things/42/edit", 200, "edit 42", ""},
+		// int parameter matches, but the rest of the path doesn't
+		{"GET", "/things/42/view", 200, "view 42", ""},
+		// int parameter matches, but the method doesn't
+		{"POST", "/things/42/edit", 200, "edit-name 42", ""},
+		{"DELETE", "/things/42/edit", 405, "", "GET, HEAD, OPTIONS, POST, PUT"},
+		{"GET", "/things/42/files/a/b.txt", 200, "file 42 a/b.txt", ""},
+		{"PUT", "/things/42/files/a/b.txt", 200, "named-file 42 files/a/b.txt", ""},
+	}
+	for _, v := range tests {
+		w := serveTest(a, v.method, v.path)
+		if w.Code != v.code {
+			t.Errorf("%s %s: expecting code %d, got %d", v.method, v.path, v.code, w.Code)
+			continue
+		}
+		if v.body != "" {
+			if body := w.Body.String(); body != v.body {
+				t.Errorf("%s %s: expecting body %q, got %q", v.method, v.path, v.body, body)
+			}
+		}
+		if allow := w.Header().Get("Allow"); allow != v.allow {
+			t.Errorf("%s %s: expecting Allow %q, got %q", v.method, v.path, v.allow, allow)
+		}
+	}
+}
+
+func TestRegexpPatterns(t *testing.T) {
+	a := New()
+	a.SetAppendSlash(false)
+	a.Handle("/static/", routeTestHandler("static"))
+	a.Handle("/", routeTestHandler("catch-all"))
+	tests := map[string]string{
+		"/":                 "catch-all",
+		"/foo":              "catch-all",
+		"/foo/bar/":         "catch-all",
+		"/static/":          "static",
+		"/static/css/a.css": "static",
+		"/app/static/":      "static",
+	}
+	for k, v := range tests {
+		if body := serveTest(a, "GET", k).Body.String(); body != v {
+			t.Errorf("GET %s: expecting body %q, got %q", k, v, body)
+		}
+	}
+	patterns := map[string]bool{
+		"/":                   false,
+		"/about/":             false,
+		"/{id:int}":           true,
+		"/articles/{slug}/":   true,
+		"^/articles/{slug}/$": false,
+		"/archive/\\d{4}/":    false,
+		"/a{2}":               false,
+		"/a{1,3}/{id}":        false,
+		"articles/{id}":       false,
+	}
+	for k, v := range patterns {
+		if r := isRoutePattern(k); r != v {
+			t.Errorf("isRoutePattern(%q) = %v, want %v", k, r, v)
+		}
+	}
+}
+
+func TestReverseRoute(t *testing.T) {
+	a := New()
+	a.HandleNamed("/article/{id:int}/{slug}/", helloHandler, "article")
+	a.HandleNamed("/files/{path:path}", helloHandler, "file")
+	a.HandleOptions("/about/", helloHandler, &HandlerOptions{Name: "about", Host: "www.example.com"})
+	testReverse(t, "/article/42/the-answer/", a, "article", []interface{}{42, "the-answer"})
+	testReverse(t, "", a, "article", []interface{}{"foo", "the-answer"})
+	testReverse(t, "", a, "article", []interface{}{42, "the/answer"})
+	testReverse(t, "", a, "article", []interface{}{42})
+	testReverse(t, "/files/a/b.txt", a, "file", []interface{}{"a/b.txt"})
+	testReverse(t, "//www.example.com/about/", a, "about", nil)
+}
+
+func TestBadRoutes(t *testing.T) {
+	routes := []string{
+		"/article/{id:int",
+		"/article/{:int}/",
+		"/article/{id:float}/",
+		"/article/{id}-{slug}/",
+		"/files/{path:path}/edit",
+	}
+	for _, v := range routes {
+		if _, err := parseRoute(v); err == nil {
+			t.Errorf("expecting an error parsing route %q", v)
+		}
+	}
+}
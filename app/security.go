@@ -0,0 +1,108 @@
+package app
+
+import (
+	"strings"
+
+	"gnd.la/util/stringutil"
+)
+
+const (
+	cspNonceKey    = "___gondola_csp_nonce"
+	cspNonceLength = 22
+	// CSPNoncePlaceholder is the placeholder which is replaced by the
+	// request nonce in SecurityOptions.ContentSecurityPolicy.
+	CSPNoncePlaceholder = "{nonce}"
+)
+
+// SecurityOptions specify the headers added by the SecurityHeaders
+// transformer. Empty fields omit their corresponding header.
+type SecurityOptions struct {
+	// ContentSecurityPolicy is the value for the Content-Security-Policy
+	// header. Any occurrence of CSPNoncePlaceholder is replaced by a random nonce,
+	// generated for each request, which might be retrieved with
+	// Context.CSPNonce or the csp_nonce template function.
+	ContentSecurityPolicy string
+	// CSPReportOnly makes the policy to be sent using the
+	// Content-Security-Policy-Report-Only header, so violations are
+	// reported but not enforced.
+	CSPReportOnly bool
+	// FrameOptions is the value for the X-Frame-Options header.
+	FrameOptions string
+	// ContentTypeOptions is the value for the
+	// X-Content-Type-Options header.
+	ContentTypeOptions string
+	// ReferrerPolicy is the value for the Referrer-Policy header.
+	ReferrerPolicy string
+	// PermissionsPolicy is the value for the
+	// Permissions-Policy header.
+	PermissionsPolicy string
+}
+
+// DefaultSecurityOptions are the options used by SecurityHeaders
+// when no options are provided. Its policy only allows loading
+// resources from the same origin, plus inline scripts and styles
+// using the nonce.
+var DefaultSecurityOptions = &SecurityOptions{
+	ContentSecurityPolicy: "default-src 'self'; script-src 'self' 'nonce-" + CSPNoncePlaceholder + "'; " +
+		"style-src 'self' 'nonce-" + CSPNoncePlaceholder + "'; object-src 'none'; base-uri 'self'; frame-ancestors 'self'",
+	FrameOptions:       "SAMEORIGIN",
+	ContentTypeOptions: "nosniff",
+	ReferrerPolicy:     "strict-origin-when-cross-origin",
+}
+
+// SecurityHeaders returns a new Handler which adds security related
+// headers to every response, as specified by opts. If opts is nil,
+// DefaultSecurityOptions is used. Templates might use the csp_nonce
+// function for allowing inline scripts and styles with the policy:
+//
+//  <script nonce="{{ csp_nonce }}">...</script>
+//
+// Note that the headers are set before calling the handler, so
+// handlers might alter or remove them.
+func SecurityHeaders(handler Handler, opts *SecurityOptions) Handler {
+	if opts == nil {
+		opts = DefaultSecurityOptions
+	}
+	cspHeader := "Content-Security-Policy"
+	if opts.CSPReportOnly {
+		cspHeader = "Content-Security-Policy-Report-Only"
+	}
+	hasNonce := strings.Contains(opts.ContentSecurityPolicy, CSPNoncePlaceholder)
+	return func(ctx *Context) {
+		h := ctx.Header()
+		if csp := opts.ContentSecurityPolicy; csp != "" {
+			if hasNonce {
+				nonce := stringutil.Random(cspNonceLength)
+				ctx.Set(cspNonceKey, nonce)
+				csp = strings.Replace(csp, CSPNoncePlaceholder, nonce, -1)
+			}
+			h.Set(cspHeader, csp)
+		}
+		if opts.FrameOptions != "" {
+			h.Set("X-Frame-Options", opts.FrameOptions)
+		}
+		if opts.ContentTypeOptions != "" {
+			h.Set("X-Content-Type-Options", opts.ContentTypeOptions)
+		}
+		if opts.ReferrerPolicy != "" {
+			h.Set("Referrer-Policy", opts.ReferrerPolicy)
+		}
+		if opts.PermissionsPolicy != "" {
+			h.Set("Permissions-Policy", opts.PermissionsPolicy)
+		}
+		handler(ctx)
+	}
+}
+
+// CSPNonce returns the Content-Security-Policy nonce for the
+// current request, generated by the SecurityHeaders transformer.
+// If the handler was not transformed by SecurityHeaders or its
+// policy doesn't use a nonce, an empty string is returned.
+func (c *Context) CSPNonce() string {
+	nonce, _ := c.Get(cspNonceKey).(string)
+	return nonce
+}
+
+func template_csp_nonce(ctx *Context) string {
+	return ctx.CSPNonce()
+}
@@ -0,0 +1,468 @@
+package app
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gnd.la/app/cookies"
+	"gnd.la/encoding/codec"
+)
+
+const (
+	// The name of the cookie used to store the session id.
+	SESSION_COOKIE_NAME = "session"
+
+	// DefaultSessionIdleTimeout is the idle timeout used for
+	// sessions when SessionOptions.IdleTimeout is zero.
+	DefaultSessionIdleTimeout = 24 * time.Hour
+	// DefaultSessionMaxAge is the absolute timeout used for
+	// sessions when SessionOptions.MaxAge is zero.
+	DefaultSessionMaxAge = 30 * 24 * time.Hour
+
+	sessionIdLength = 24
+	sessionPrefix   = "gondola-session-"
+	revokedPrefix   = sessionPrefix + "revoked-"
+	revokedAll      = revokedPrefix + "all"
+	revokedUser     = revokedPrefix + "user-"
+)
+
+var (
+	// ErrNoSessionValue is returned from Session.Get when the
+	// session has no value for the given key.
+	ErrNoSessionValue = errors.New("no such value in session")
+
+	errNoSessionStore = errors.New("no SessionStore set in this App - use App.SetSessionStore() to configure one")
+	sessionCodec      = codec.Get("gob")
+)
+
+// SessionOptions specify the expiration parameters for sessions.
+// See App.SetSessionStore.
+type SessionOptions struct {
+	// IdleTimeout is the maximum time between two requests using
+	// the same session. Sessions which are not used during this
+	// time expire. If zero, DefaultSessionIdleTimeout is used,
+	// while negative values disable the idle timeout.
+	IdleTimeout time.Duration
+	// MaxAge is the maximum age of a session, since it was created
+	// or since the user signed in, regardless of its activity. If
+	// zero, DefaultSessionMaxAge is used, while negative values
+	// disable the absolute timeout.
+	MaxAge time.Duration
+}
+
+func (o *SessionOptions) idleTimeout() time.Duration {
+	if o == nil || o.IdleTimeout == 0 {
+		return DefaultSessionIdleTimeout
+	}
+	return o.IdleTimeout
+}
+
+func (o *SessionOptions) maxAge() time.Duration {
+	if o == nil || o.MaxAge == 0 {
+		return DefaultSessionMaxAge
+	}
+	return o.MaxAge
+}
+
+type sessions struct {
+	store SessionStore
+	opts  *SessionOptions
+}
+
+// sessionData is the part of the session which
+// is persisted in the SessionStore.
+type sessionData struct {
+	UserId   int64
+	Created  int64
+	Accessed int64
+	Values   map[string][]byte
+}
+
+// Session represents a server side session, stored in the SessionStore
+// configured in the App. Only the session id is sent to the client, using
+// a cookie named SESSION_COOKIE_NAME. Use Context.Session to obtain the
+// current Session.
+//
+// Changes to the session are saved when the Context is closed, but
+// the session cookie is sent when the session is first modified, so
+// sessions should be modified before writing the response body.
+type Session struct {
+	ctx       *Context
+	id        string
+	prevId    string
+	data      sessionData
+	dirty     bool
+	hasCookie bool
+}
+
+// Id returns the session id.
+func (s *Session) Id() string {
+	return s.id
+}
+
+// Created returns the time when the session was created or,
+// if there's a signed in user, when the user signed in.
+func (s *Session) Created() time.Time {
+	return time.Unix(0, s.data.Created)
+}
+
+// Accessed returns the last time the session was accessed. To
+// reduce the number of writes to the SessionStore, it's only
+// updated when it's older than a tenth of the idle timeout.
+func (s *Session) Accessed() time.Time {
+	return time.Unix(0, s.data.Accessed)
+}
+
+// UserId returns the id of the user signed in with this
+// session, or zero if there's no user signed in.
+func (s *Session) UserId() int64 {
+	return s.data.UserId
+}
+
+// Has returns true iff the session has a value for the given key.
+func (s *Session) Has(key string) bool {
+	_, ok := s.data.Values[key]
+	return ok
+}
+
+// Get decodes the value for the given key into out, which must be
+// a pointer. If there's no value for the key, ErrNoSessionValue is
+// returned.
+func (s *Session) Get(key string, out interface{}) error {
+	data, ok := s.data.Values[key]
+	if !ok {
+		return ErrNoSessionValue
+	}
+	return sessionCodec.Decode(data, out)
+}
+
+// Set stores the given value in the session. Values are encoded using
+// encoding/gob, so non-basic types must be registered with gob.Register.
+func (s *Session) Set(key string, value interface{}) error {
+	data, err := sessionCodec.Encode(value)
+	if err != nil {
+		return err
+	}
+	if s.data.Values == nil {
+		s.data.Values = make(map[string][]byte)
+	}
+	s.data.Values[key] = data
+	s.changed()
+	return nil
+}
+
+// Delete removes the value for the given key from the session.
+func (s *Session) Delete(key string) {
+	if _, ok := s.data.Values[key]; ok {
+		delete(s.data.Values, key)
+		s.changed()
+	}
+}
+
+// Rotate assigns a new id to the session, keeping its values. The
+// previous id is invalidated when the session is saved. Context.SignIn
+// calls this function to prevent session fixation attacks.
+func (s *Session) Rotate() error {
+	id, err := newSessionId()
+	if err != nil {
+		return err
+	}
+	if s.prevId == "" && s.hasCookie {
+		s.prevId = s.id
+	}
+	s.id = id
+	s.hasCookie = false
+	s.changed()
+	return nil
+}
+
+// Destroy removes the session from the SessionStore and deletes the
+// session cookie. Following calls to Context.Session return a new,
+// empty, Session.
+func (s *Session) Destroy() error {
+	ctx := s.ctx
+	if ctx.session == s {
+		ctx.session = nil
+	}
+	store := ctx.app.sessions.store
+	var err error
+	if s.hasCookie {
+		err = store.Delete(ctx, sessionPrefix+s.id)
+	}
+	if s.prevId != "" {
+		if perr := store.Delete(ctx, sessionPrefix+s.prevId); err == nil {
+			err = perr
+		}
+	}
+	if s.hasCookie || s.prevId != "" {
+		ctx.Cookies().Delete(SESSION_COOKIE_NAME)
+	}
+	s.dirty = false
+	return err
+}
+
+func (s *Session) changed() {
+	s.dirty = true
+	if !s.hasCookie {
+		s.setCookie()
+		s.hasCookie = true
+	}
+}
+
+func (s *Session) setCookie() {
+	ctx := s.ctx
+	opts := ctx.app.CookieOptions
+	if opts == nil {
+		opts = cookies.Defaults()
+	}
+	cookie := &http.Cookie{
+		Name:     SESSION_COOKIE_NAME,
+		Value:    s.id,
+		Path:     opts.Path,
+		Domain:   opts.Domain,
+		Secure:   opts.Secure,
+		HttpOnly: true,
+	}
+	if maxAge := ctx.app.sessions.opts.maxAge(); maxAge > 0 {
+		cookie.Expires = time.Unix(0, s.data.Created).Add(maxAge)
+	}
+	ctx.Cookies().SetCookie(cookie)
+}
+
+// ttl returns the time until the session expires,
+// or zero if it never expires.
+func (s *Session) ttl(now time.Time) time.Duration {
+	opts := s.ctx.app.sessions.opts
+	ttl := opts.idleTimeout()
+	if maxAge := opts.maxAge(); maxAge > 0 {
+		remaining := time.Unix(0, s.data.Created).Add(maxAge).Sub(now)
+		if ttl <= 0 || remaining < ttl {
+			ttl = remaining
+		}
+	}
+	if ttl < 0 {
+		return 0
+	}
+	return ttl
+}
+
+func (s *Session) save() error {
+	ctx := s.ctx
+	store := ctx.app.sessions.store
+	if s.prevId != "" {
+		if err := store.Delete(ctx, sessionPrefix+s.prevId); err != nil {
+			return err
+		}
+		s.prevId = ""
+	}
+	now := time.Now()
+	if !s.dirty {
+		idle := ctx.app.sessions.opts.idleTimeout()
+		if idle <= 0 || !s.hasCookie || now.Sub(s.Accessed()) < idle/10 {
+			return nil
+		}
+	}
+	s.data.Accessed = now.UnixNano()
+	data, err := sessionCodec.Encode(&s.data)
+	if err != nil {
+		return err
+	}
+	s.dirty = false
+	return store.Save(ctx, sessionPrefix+s.id, data, s.ttl(now))
+}
+
+func (s *Session) expired(now time.Time) bool {
+	opts := s.ctx.app.sessions.opts
+	if idle := opts.idleTimeout(); idle > 0 && now.Sub(s.Accessed()) > idle {
+		return true
+	}
+	if maxAge := opts.maxAge(); maxAge > 0 && now.Sub(s.Created()) > maxAge {
+		return true
+	}
+	return false
+}
+
+// revoked returns true if the session has been invalidated by
+// Context.RevokeAllSessions or Context.RevokeUserSessions.
+func (s *Session) revoked() (bool, error) {
+	keys := []string{revokedAll}
+	if s.data.UserId != 0 {
+		keys = append(keys, revokedUser+strconv.FormatInt(s.data.UserId, 10))
+	}
+	store := s.ctx.app.sessions.store
+	for _, v := range keys {
+		data, err := store.Load(s.ctx, v)
+		if err != nil {
+			return false, err
+		}
+		if data != nil {
+			var revoked int64
+			if err := sessionCodec.Decode(data, &revoked); err != nil {
+				return false, err
+			}
+			if s.data.Created <= revoked {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func newSessionId() (string, error) {
+	b := make([]byte, sessionIdLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func isValidSessionId(id string) bool {
+	if len(id) != base64.RawURLEncoding.EncodedLen(sessionIdLength) {
+		return false
+	}
+	_, err := base64.RawURLEncoding.DecodeString(id)
+	return err == nil
+}
+
+func newSession(ctx *Context) (*Session, error) {
+	id, err := newSessionId()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UnixNano()
+	return &Session{
+		ctx: ctx,
+		id:  id,
+		data: sessionData{
+			Created:  now,
+			Accessed: now,
+		},
+	}, nil
+}
+
+func (c *Context) loadSession() (*Session, error) {
+	sessions := c.app.sessions
+	if sessions == nil {
+		return nil, errNoSessionStore
+	}
+	if cookie, err := c.Cookies().GetCookie(SESSION_COOKIE_NAME); err == nil && isValidSessionId(cookie.Value) {
+		key := sessionPrefix + cookie.Value
+		data, err := sessions.store.Load(c, key)
+		if err != nil {
+			return nil, err
+		}
+		if data != nil {
+			s := &Session{ctx: c, id: cookie.Value, hasCookie: true}
+			if err := sessionCodec.Decode(data, &s.data); err == nil && !s.expired(time.Now()) {
+				revoked, err := s.revoked()
+				if err != nil {
+					return nil, err
+				}
+				if !revoked {
+					return s, nil
+				}
+			}
+			if err := sessions.store.Delete(c, key); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return newSession(c)
+}
+
+// Session returns the current session, creating a new one if there's
+// none or if it has expired. In order to use sessions, the App must
+// have a SessionStore (see App.SetSessionStore). If there's no
+// SessionStore or the session can't be loaded, this function panics.
+func (c *Context) Session() *Session {
+	if c.session == nil {
+		s, err := c.loadSession()
+		if err != nil {
+			panic(err)
+		}
+		c.session = s
+	}
+	return c.session
+}
+
+// HasSessions returns true iff the App has a SessionStore.
+func (c *Context) HasSessions() bool {
+	return c.app.sessions != nil
+}
+
+// RevokeUserSessions invalidates all the sessions created for the user
+// with the given id up to this moment, signing out the user in all the
+// devices where it was signed in. The current session is not modified,
+// use SignOutEverywhere to also sign out the user in the current session.
+func (c *Context) RevokeUserSessions(userId int64) error {
+	return c.revokeSessions(revokedUser + strconv.FormatInt(userId, 10))
+}
+
+// RevokeAllSessions invalidates all the sessions created up to this moment,
+// signing out every user in the App.
+func (c *Context) RevokeAllSessions() error {
+	return c.revokeSessions(revokedAll)
+}
+
+func (c *Context) revokeSessions(key string) error {
+	sessions := c.app.sessions
+	if sessions == nil {
+		return errNoSessionStore
+	}
+	data, err := sessionCodec.Encode(time.Now().UnixNano())
+	if err != nil {
+		return err
+	}
+	// Sessions created before the revocation expire after MaxAge,
+	// so there's no need to keep the revocation after that.
+	ttl := sessions.opts.maxAge()
+	if ttl < 0 {
+		ttl = 0
+	}
+	return sessions.store.Save(c, key, data, ttl)
+}
+
+// saveSession saves the current session, if any. It's
+// called when the Context is closed.
+func (c *Context) saveSession() {
+	s := c.session
+	if s == nil {
+		return
+	}
+	if err := s.save(); err != nil {
+		c.Logger().Errorf("error saving session %s: %s", s.id, err)
+	}
+}
+
+// SessionStore returns the SessionStore used by the App, if any.
+func (app *App) SessionStore() SessionStore {
+	if app.sessions != nil {
+		return app.sessions.store
+	}
+	return nil
+}
+
+// SetSessionStore sets the SessionStore used by the App for storing
+// server side sessions (see Context.Session) and the options for them.
+// If opts is nil, the default options are used. Gondola includes stores
+// for using the App cache, ORM and blobstore (see CacheSessionStore,
+// OrmSessionStore and BlobstoreSessionStore). Passing a nil store disables
+// sessions.
+//
+// When the App has a SessionStore, the signed in user is stored in the
+// session rather than in a signed cookie. Context.SignIn rotates the
+// session id, while Context.SignOut destroys the session.
+func (app *App) SetSessionStore(store SessionStore, opts *SessionOptions) {
+	var s *sessions
+	if store != nil {
+		s = &sessions{store: store, opts: opts}
+	}
+	app.sessions = s
+	for _, v := range app.included {
+		v.app.sessions = s
+	}
+}
@@ -0,0 +1,185 @@
+package app
+
+import (
+	"reflect"
+	"sync"
+	"time"
+
+	"gnd.la/cache"
+	"gnd.la/orm"
+)
+
+// SessionStore is the interface implemented by the session backends.
+// Stores only need to save and retrieve opaque byte slices by their
+// key. Expiration and invalidation are handled by the App.
+type SessionStore interface {
+	// Load returns the data stored with the given key. If there's
+	// no data for the key, it must return nil with no error.
+	Load(ctx *Context, key string) ([]byte, error)
+	// Save stores data associated with the given key. If ttl is
+	// non-zero, the store might drop the data after ttl has
+	// elapsed.
+	Save(ctx *Context, key string, data []byte, ttl time.Duration) error
+	// Delete removes the data associated with the given key.
+	// Deleting a non-existent key must not return an error.
+	Delete(ctx *Context, key string) error
+}
+
+// CacheSessionStore stores the sessions in the App cache (see
+// Context.Cache). Note that the cache must be shared among all
+// the instances of the App and it should be configured to avoid
+// evicting items before they expire, otherwise users might be
+// signed out at random.
+type CacheSessionStore struct {
+}
+
+func (s *CacheSessionStore) Load(ctx *Context, key string) ([]byte, error) {
+	data, err := ctx.Cache().GetBytes(key)
+	if err == cache.ErrNotFound {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (s *CacheSessionStore) Save(ctx *Context, key string, data []byte, ttl time.Duration) error {
+	return ctx.Cache().SetBytes(key, data, ttlSeconds(ttl))
+}
+
+func (s *CacheSessionStore) Delete(ctx *Context, key string) error {
+	return ctx.Cache().Delete(key)
+}
+
+// SessionRecord is the model used by OrmSessionStore for storing
+// sessions in the gondola_sessions table.
+type SessionRecord struct {
+	Key  string `orm:",primary_key,max_length=255"`
+	Data []byte
+	// Expires is the time when the record expires. If it's
+	// zero, the record never expires.
+	Expires time.Time `orm:",index"`
+}
+
+var (
+	sessionRecordType       = reflect.TypeOf(SessionRecord{})
+	registerSessionRecordMu sync.Mutex
+	sessionRecordRegistered bool
+)
+
+// OrmSessionStore stores the sessions using the App ORM (see
+// Context.Orm). Use NewOrmSessionStore to create one. Expired
+// sessions are removed when they're accessed, use Purge to
+// periodically remove the ones which are never accessed again.
+type OrmSessionStore struct {
+}
+
+// NewOrmSessionStore returns a new OrmSessionStore, registering its
+// model with the ORM. It must be called before the ORM is initialized
+// (e.g. from an init function or before calling App.Prepare).
+func NewOrmSessionStore() *OrmSessionStore {
+	registerSessionRecordMu.Lock()
+	defer registerSessionRecordMu.Unlock()
+	if !sessionRecordRegistered {
+		orm.Register((*SessionRecord)(nil), &orm.Options{
+			Table: "gondola_sessions",
+		})
+		sessionRecordRegistered = true
+	}
+	return &OrmSessionStore{}
+}
+
+func (s *OrmSessionStore) Load(ctx *Context, key string) ([]byte, error) {
+	var rec SessionRecord
+	ok, err := ctx.Orm().One(orm.Eq("Key", key), &rec)
+	if err != nil || !ok {
+		return nil, err
+	}
+	if !rec.Expires.IsZero() && rec.Expires.Before(time.Now()) {
+		return nil, s.Delete(ctx, key)
+	}
+	return rec.Data, nil
+}
+
+func (s *OrmSessionStore) Save(ctx *Context, key string, data []byte, ttl time.Duration) error {
+	rec := &SessionRecord{Key: key, Data: data}
+	if ttl > 0 {
+		rec.Expires = time.Now().Add(ttl)
+	}
+	_, err := ctx.Orm().Save(rec)
+	return err
+}
+
+func (s *OrmSessionStore) Delete(ctx *Context, key string) error {
+	o := ctx.Orm()
+	_, err := o.DeleteFrom(o.TypeTable(sessionRecordType), orm.Eq("Key", key))
+	return err
+}
+
+// Purge removes all the expired sessions from the database. It
+// might be called periodically, using e.g. gnd.la/tasks.
+func (s *OrmSessionStore) Purge(ctx *Context) error {
+	o := ctx.Orm()
+	q := orm.And(orm.Neq("Expires", time.Time{}), orm.Lt("Expires", time.Now()))
+	_, err := o.DeleteFrom(o.TypeTable(sessionRecordType), q)
+	return err
+}
+
+// BlobstoreSessionStore stores the sessions in the App blobstore (see
+// Context.Blobstore). The expiration time is stored in the file metadata
+// and expired sessions are removed when they're accessed. Since not all
+// the blobstore drivers report missing files in the same way, any error
+// opening a session file is considered a missing session.
+type BlobstoreSessionStore struct {
+}
+
+type blobstoreSessionMeta struct {
+	Expires int64
+}
+
+func (s *BlobstoreSessionStore) Load(ctx *Context, key string) ([]byte, error) {
+	bs := ctx.Blobstore()
+	f, err := bs.Open(key)
+	if err != nil {
+		return nil, nil
+	}
+	var meta blobstoreSessionMeta
+	if err := f.GetMeta(&meta); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if meta.Expires != 0 && meta.Expires < time.Now().Unix() {
+		f.Close()
+		return nil, bs.Remove(key)
+	}
+	data, err := f.ReadAll()
+	f.Close()
+	return data, err
+}
+
+func (s *BlobstoreSessionStore) Save(ctx *Context, key string, data []byte, ttl time.Duration) error {
+	var meta blobstoreSessionMeta
+	if ttl > 0 {
+		meta.Expires = time.Now().Add(ttl).Unix()
+	}
+	_, err := ctx.Blobstore().StoreId(key, data, &meta)
+	return err
+}
+
+func (s *BlobstoreSessionStore) Delete(ctx *Context, key string) error {
+	bs := ctx.Blobstore()
+	if f, err := bs.Open(key); err == nil {
+		f.Close()
+		return bs.Remove(key)
+	}
+	return nil
+}
+
+func ttlSeconds(ttl time.Duration) int {
+	if ttl <= 0 {
+		return 0
+	}
+	secs := int(ttl / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	return secs
+}
@@ -0,0 +1,157 @@
+package app_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"gnd.la/app"
+	"gnd.la/config"
+)
+
+type sessionUser int64
+
+func (u sessionUser) Id() int64     { return int64(u) }
+func (u sessionUser) IsAdmin() bool { return false }
+
+func newSessionApp() *app.App {
+	a := app.New()
+	a.Config().Cache = config.MustParseURL("memory://")
+	a.SetSessionStore(&app.CacheSessionStore{}, nil)
+	a.SetUserFunc(func(ctx *app.Context, id int64) app.User {
+		return sessionUser(id)
+	})
+	a.Handle("^/set/(.+)$", func(ctx *app.Context) {
+		ctx.Session().Set("value", ctx.IndexValue(0))
+	})
+	a.Handle("^/get$", func(ctx *app.Context) {
+		var value string
+		ctx.Session().Get("value", &value)
+		ctx.WriteString(value)
+	})
+	a.Handle("^/signin/(\\d+)$", func(ctx *app.Context) {
+		var id int64
+		ctx.MustParseIndexValue(0, &id)
+		ctx.MustSignIn(sessionUser(id))
+	})
+	a.Handle("^/user$", func(ctx *app.Context) {
+		if u := ctx.User(); u != nil {
+			ctx.WriteString(strconv.FormatInt(u.Id(), 10))
+		}
+	})
+	a.Handle("^/signout$", func(ctx *app.Context) {
+		ctx.SignOut()
+	})
+	a.Handle("^/signout-everywhere$", func(ctx *app.Context) {
+		if err := ctx.SignOutEverywhere(); err != nil {
+			panic(err)
+		}
+	})
+	return a
+}
+
+type sessionClient struct {
+	t      *testing.T
+	client *http.Client
+	url    string
+}
+
+func newSessionClient(t *testing.T, url string) *sessionClient {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &sessionClient{t: t, client: &http.Client{Jar: jar}, url: url}
+}
+
+func (c *sessionClient) get(path string) string {
+	resp, err := c.client.Get(c.url + path)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return string(data)
+}
+
+func (c *sessionClient) sessionId() string {
+	req, _ := http.NewRequest("GET", c.url, nil)
+	for _, v := range c.client.Jar.Cookies(req.URL) {
+		if v.Name == app.SESSION_COOKIE_NAME {
+			return v.Value
+		}
+	}
+	return ""
+}
+
+func TestSession(t *testing.T) {
+	a := newSessionApp()
+	srv := httptest.NewServer(a)
+	defer srv.Close()
+	c := newSessionClient(t, srv.URL)
+	if v := c.get("/get"); v != "" {
+		t.Errorf("expecting empty value, got %q", v)
+	}
+	if id := c.sessionId(); id != "" {
+		t.Errorf("unmodified session should not set a cookie, got id %q", id)
+	}
+	c.get("/set/foo")
+	if v := c.get("/get"); v != "foo" {
+		t.Errorf("expecting session value foo, got %q", v)
+	}
+	anonymous := c.sessionId()
+	c.get("/signin/42")
+	if id := c.sessionId(); id == anonymous || id == "" {
+		t.Errorf("session id was not rotated on SignIn (before %q, after %q)", anonymous, id)
+	}
+	if v := c.get("/get"); v != "foo" {
+		t.Errorf("expecting session value foo after rotation, got %q", v)
+	}
+	if u := c.get("/user"); u != "42" {
+		t.Errorf("expecting user 42, got %q", u)
+	}
+	// The previous session id must not be valid anymore
+	fixated := newSessionClient(t, srv.URL)
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	fixated.client.Jar.SetCookies(req.URL, []*http.Cookie{{Name: app.SESSION_COOKIE_NAME, Value: anonymous}})
+	if v := fixated.get("/get"); v != "" {
+		t.Errorf("previous session id is still valid, got value %q", v)
+	}
+	c.get("/signout")
+	if u := c.get("/user"); u != "" {
+		t.Errorf("expecting no user after SignOut, got %q", u)
+	}
+	if v := c.get("/get"); v != "" {
+		t.Errorf("expecting empty session after SignOut, got %q", v)
+	}
+}
+
+func TestSignOutEverywhere(t *testing.T) {
+	a := newSessionApp()
+	srv := httptest.NewServer(a)
+	defer srv.Close()
+	c1 := newSessionClient(t, srv.URL)
+	c2 := newSessionClient(t, srv.URL)
+	c3 := newSessionClient(t, srv.URL)
+	c1.get("/signin/1")
+	c2.get("/signin/1")
+	c3.get("/signin/2")
+	c1.get("/signout-everywhere")
+	if u := c2.get("/user"); u != "" {
+		t.Errorf("expecting no user after SignOutEverywhere, got %q", u)
+	}
+	if u := c3.get("/user"); u != "2" {
+		t.Errorf("expecting user 2 to be still signed in, got %q", u)
+	}
+	// Signing in again must work after revocation
+	c2.get("/signin/1")
+	if u := c2.get("/user"); u != "1" {
+		t.Errorf("expecting user 1 after signing in again, got %q", u)
+	}
+}
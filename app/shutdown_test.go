@@ -0,0 +1,72 @@
+package app
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gnd.la/signal"
+)
+
+func TestShutdown(t *testing.T) {
+	a := New()
+	var willStop int32
+	stopping := make(chan struct{})
+	token := signal.Listen(WILL_STOP, func(_ string, obj interface{}) {
+		if obj == a && atomic.AddInt32(&willStop, 1) == 1 {
+			close(stopping)
+		}
+	})
+	defer signal.Stop(WILL_STOP, token)
+	var value int32
+	started := make(chan struct{})
+	a.Handle("^/$", func(ctx *Context) {
+		close(started)
+		// Requests being drained by Shutdown
+		// can still start background contexts.
+		<-stopping
+		ctx.Go(func(bg *Context) {
+			time.Sleep(100 * time.Millisecond)
+			atomic.AddInt32(&value, 1)
+		})
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- a.serveListener(ln)
+	}()
+	requested := make(chan error, 1)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String() + "/")
+		if err == nil {
+			resp.Body.Close()
+		}
+		requested <- err
+	}()
+	<-started
+	if err := a.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-requested; err != nil {
+		t.Errorf("request being served during Shutdown failed: %s", err)
+	}
+	if err := <-stopped; err != nil {
+		t.Errorf("serveListener returned error %s", err)
+	}
+	if v := atomic.LoadInt32(&value); v != 1 {
+		t.Errorf("Shutdown did not wait for background context, value is %d", v)
+	}
+	// Calling Shutdown again does nothing
+	if err := a.Shutdown(context.Background()); err != nil {
+		t.Errorf("second Shutdown returned error %s", err)
+	}
+	if n := atomic.LoadInt32(&willStop); n != 1 {
+		t.Errorf("expecting WILL_STOP to be emitted once, got %d", n)
+	}
+}
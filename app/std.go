@@ -4,6 +4,9 @@ package app
 
 import (
 	"fmt"
+	"os"
+	ossignal "os/signal"
+	"syscall"
 
 	"gnd.la/blobstore"
 	"gnd.la/cache"
@@ -119,3 +122,23 @@ func (c *Context) blobstore() *blobstore.Blobstore {
 func (c *Context) prepareMessage(msg *mail.Message) {
 	// nop except on GAE
 }
+
+// listenStopSignals calls f in a new goroutine when the process
+// receives SIGINT or SIGTERM. The returned function must be called
+// to stop listening for the signals.
+func listenStopSignals(f func(os.Signal)) func() {
+	ch := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	ossignal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-ch:
+			f(sig)
+		case <-done:
+		}
+	}()
+	return func() {
+		ossignal.Stop(ch)
+		close(done)
+	}
+}
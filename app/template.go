@@ -20,11 +20,12 @@ var (
 	errNoLoadedTemplate   = errors.New("this template was not loaded from App.LoadTemplate nor NewTemplate")
 
 	templateFuncs = template.FuncMap{
-		"!t":   template_t,
-		"!tn":  template_tn,
-		"!tc":  template_tc,
-		"!tnc": template_tnc,
-		"app":  nop,
+		"!t":         template_t,
+		"!tn":        template_tn,
+		"!tc":        template_tc,
+		"!tnc":       template_tnc,
+		"!csp_nonce": template_csp_nonce,
+		"app":        nop,
 		templateutil.BeginTranslatableBlock: nop,
 		templateutil.EndTranslatableBlock:   nop,
 	}
@@ -0,0 +1,183 @@
+package app
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"gnd.la/log"
+)
+
+const (
+	// certificateCheckInterval is the minimum interval between
+	// checks for changes in the certificate and key files.
+	certificateCheckInterval = 10 * time.Second
+)
+
+// certificateLoader loads a TLS certificate from disk and reloads
+// it when either the certificate or the key file change, so
+// certificates can be rotated without restarting the app.
+type certificateLoader struct {
+	certFile string
+	keyFile  string
+	logger   *log.Logger
+
+	mu         sync.RWMutex
+	cert       *tls.Certificate
+	certMod    time.Time
+	keyMod     time.Time
+	lastCheck  time.Time
+	reloadLock sync.Mutex
+}
+
+func newCertificateLoader(certFile string, keyFile string, logger *log.Logger) (*certificateLoader, error) {
+	l := &certificateLoader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		logger:   logger,
+	}
+	if err := l.load(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *certificateLoader) modTimes() (time.Time, time.Time, error) {
+	cst, err := os.Stat(l.certFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	kst, err := os.Stat(l.keyFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return cst.ModTime(), kst.ModTime(), nil
+}
+
+func (l *certificateLoader) load() error {
+	certMod, keyMod, err := l.modTimes()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	l.cert = &cert
+	l.certMod = certMod
+	l.keyMod = keyMod
+	l.lastCheck = time.Now()
+	l.mu.Unlock()
+	return nil
+}
+
+// reload checks if the certificate or the key changed since they
+// were loaded and, in that case, loads them again. If there's an
+// error loading the new certificate, it's logged and the previous
+// one is kept.
+func (l *certificateLoader) reload() {
+	// Avoid multiple simultaneous reloads
+	l.reloadLock.Lock()
+	defer l.reloadLock.Unlock()
+	l.mu.RLock()
+	recent := time.Since(l.lastCheck) < certificateCheckInterval
+	certMod, keyMod := l.certMod, l.keyMod
+	l.mu.RUnlock()
+	if recent {
+		return
+	}
+	newCertMod, newKeyMod, err := l.modTimes()
+	if err == nil && newCertMod.Equal(certMod) && newKeyMod.Equal(keyMod) {
+		l.mu.Lock()
+		l.lastCheck = time.Now()
+		l.mu.Unlock()
+		return
+	}
+	if err == nil {
+		err = l.load()
+	}
+	if err != nil {
+		if l.logger != nil {
+			l.logger.Errorf("error reloading TLS certificate %s: %s", l.certFile, err)
+		}
+		// Don't retry until the next interval
+		l.mu.Lock()
+		l.lastCheck = time.Now()
+		l.mu.Unlock()
+		return
+	}
+	if l.logger != nil {
+		l.logger.Infof("reloaded TLS certificate %s", l.certFile)
+	}
+}
+
+// GetCertificate implements the GetCertificate function
+// from crypto/tls.Config.
+func (l *certificateLoader) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	l.mu.RLock()
+	cert := l.cert
+	check := time.Since(l.lastCheck) >= certificateCheckInterval
+	l.mu.RUnlock()
+	if check {
+		l.reload()
+		l.mu.RLock()
+		cert = l.cert
+		l.mu.RUnlock()
+	}
+	return cert, nil
+}
+
+// tlsConfig returns the *tls.Config used by the app for serving
+// HTTPS. HTTP/2 is enabled by net/http when the server is
+// started with ListenAndServeTLS.
+func (app *App) tlsConfig() (*tls.Config, error) {
+	loader, err := newCertificateLoader(app.cfg.TLSCertificate, app.cfg.TLSKey, app.Logger)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: loader.GetCertificate,
+	}, nil
+}
+
+// hstsHeader returns the value for the Strict-Transport-Security
+// header or the empty string if HSTS is disabled.
+func (app *App) hstsHeader() string {
+	if app.cfg.HSTSMaxAge <= 0 {
+		return ""
+	}
+	value := "max-age=" + strconv.Itoa(app.cfg.HSTSMaxAge)
+	if app.cfg.HSTSIncludeSubdomains {
+		value += "; includeSubDomains"
+	}
+	return value
+}
+
+// newRedirectServer returns an *http.Server which listens on
+// TLSRedirectPort and redirects all the requests to the
+// same URL using HTTPS.
+func (app *App) newRedirectServer() *http.Server {
+	port := app.cfg.Port
+	return &http.Server{
+		Addr: app.address + ":" + strconv.Itoa(app.cfg.TLSRedirectPort),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			host := r.Host
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+			if port != 443 {
+				host = net.JoinHostPort(host, strconv.Itoa(port))
+			}
+			u := *r.URL
+			u.Scheme = "https"
+			u.Host = host
+			http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+		}),
+	}
+}
@@ -0,0 +1,149 @@
+package app
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTestCertificate(t *testing.T, certFile string, keyFile string, name string, mod time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{name},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{certFile, keyFile} {
+		if err := os.Chtimes(v, mod, mod); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func certificateName(t *testing.T, l *certificateLoader) string {
+	cert, err := l.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed.Subject.CommonName
+}
+
+func TestCertificateReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gondola-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	now := time.Now()
+	writeTestCertificate(t, certFile, keyFile, "first.example.com", now.Add(-time.Minute))
+	l, err := newCertificateLoader(certFile, keyFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := certificateName(t, l); name != "first.example.com" {
+		t.Fatalf("expecting first certificate, got %q", name)
+	}
+	writeTestCertificate(t, certFile, keyFile, "second.example.com", now)
+	// Changes are not checked until the interval passes
+	if name := certificateName(t, l); name != "first.example.com" {
+		t.Errorf("certificate reloaded before the check interval, got %q", name)
+	}
+	l.mu.Lock()
+	l.lastCheck = now.Add(-2 * certificateCheckInterval)
+	l.mu.Unlock()
+	if name := certificateName(t, l); name != "second.example.com" {
+		t.Errorf("expecting reloaded certificate, got %q", name)
+	}
+	// A broken certificate keeps the previous one
+	if err := ioutil.WriteFile(certFile, []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(certFile, now.Add(time.Minute), now.Add(time.Minute))
+	l.mu.Lock()
+	l.lastCheck = now.Add(-2 * certificateCheckInterval)
+	l.mu.Unlock()
+	if name := certificateName(t, l); name != "second.example.com" {
+		t.Errorf("expecting previous certificate after failed reload, got %q", name)
+	}
+}
+
+func TestTLSRedirect(t *testing.T) {
+	tests := []struct {
+		port   int
+		url    string
+		expect string
+	}{
+		{443, "http://www.example.com/foo?bar=1", "https://www.example.com/foo?bar=1"},
+		{443, "http://www.example.com:8080/", "https://www.example.com/"},
+		{8443, "http://www.example.com:8080/foo", "https://www.example.com:8443/foo"},
+	}
+	for _, v := range tests {
+		a := New()
+		a.Config().Port = v.port
+		a.Config().TLSRedirectPort = 8080
+		r, _ := http.NewRequest("GET", v.url, nil)
+		w := httptest.NewRecorder()
+		a.newRedirectServer().Handler.ServeHTTP(w, r)
+		if w.Code != http.StatusMovedPermanently {
+			t.Errorf("%s: expecting code %d, got %d", v.url, http.StatusMovedPermanently, w.Code)
+		}
+		if loc := w.Header().Get("Location"); loc != v.expect {
+			t.Errorf("%s: expecting redirect to %q, got %q", v.url, v.expect, loc)
+		}
+	}
+}
+
+func TestHSTS(t *testing.T) {
+	a := New()
+	a.Handle("/", routeTestHandler("index"))
+	a.Config().HSTSMaxAge = 3600
+	a.Config().HSTSIncludeSubdomains = true
+	r, _ := http.NewRequest("GET", "https://localhost/", nil)
+	r.TLS = &tls.ConnectionState{}
+	w := httptest.NewRecorder()
+	a.newContext(w, r)
+	if hsts := w.Header().Get("Strict-Transport-Security"); hsts != "max-age=3600; includeSubDomains" {
+		t.Errorf("unexpected Strict-Transport-Security header %q", hsts)
+	}
+	// No HSTS over plain HTTP
+	if hsts := serveTest(a, "GET", "/").Header().Get("Strict-Transport-Security"); hsts != "" {
+		t.Errorf("unexpected Strict-Transport-Security header %q over HTTP", hsts)
+	}
+}
@@ -0,0 +1,222 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveTestRequest works like serveTest, but receives the *http.Request
+// and recovers from panics like ServeHTTP does.
+func serveTestRequest(a *App, r *http.Request) (w *httptest.ResponseRecorder) {
+	w = httptest.NewRecorder()
+	ctx := a.newContext(w, r)
+	defer a.recover(ctx)
+	a.serveOrNotFound(r.URL.Path, ctx)
+	return w
+}
+
+func TestCORS(t *testing.T) {
+	a := New()
+	a.Handle("/api/", CORS(routeTestHandler("api"), &CORSOptions{
+		AllowedOrigins:   []string{"https://www.example.com"},
+		AllowedMethods:   []string{"GET", "PUT"},
+		ExposedHeaders:   []string{"X-Total"},
+		AllowCredentials: true,
+		MaxAge:           600,
+	}))
+	// Simple request from an allowed origin
+	r, _ := http.NewRequest("GET", "http://localhost/api/", nil)
+	r.Header.Set("Origin", "https://www.example.com")
+	w := serveTestRequest(a, r)
+	if o := w.Header().Get("Access-Control-Allow-Origin"); o != "https://www.example.com" {
+		t.Errorf("expecting allowed origin, got %q", o)
+	}
+	if c := w.Header().Get("Access-Control-Allow-Credentials"); c != "true" {
+		t.Errorf("expecting credentials to be allowed, got %q", c)
+	}
+	if e := w.Header().Get("Access-Control-Expose-Headers"); e != "X-Total" {
+		t.Errorf("expecting exposed headers X-Total, got %q", e)
+	}
+	if body := w.Body.String(); body != "api" {
+		t.Errorf("expecting body \"api\", got %q", body)
+	}
+	// Simple request from another origin
+	r, _ = http.NewRequest("GET", "http://localhost/api/", nil)
+	r.Header.Set("Origin", "https://evil.example.com")
+	w = serveTestRequest(a, r)
+	if o := w.Header().Get("Access-Control-Allow-Origin"); o != "" {
+		t.Errorf("expecting no allowed origin, got %q", o)
+	}
+	// Preflight
+	r, _ = http.NewRequest("OPTIONS", "http://localhost/api/", nil)
+	r.Header.Set("Origin", "https://www.example.com")
+	r.Header.Set("Access-Control-Request-Method", "PUT")
+	r.Header.Set("Access-Control-Request-Headers", "Content-Type")
+	w = serveTestRequest(a, r)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("expecting preflight code %d, got %d", http.StatusNoContent, w.Code)
+	}
+	if m := w.Header().Get("Access-Control-Allow-Methods"); m != "GET, PUT" {
+		t.Errorf("expecting allowed methods \"GET, PUT\", got %q", m)
+	}
+	if h := w.Header().Get("Access-Control-Allow-Headers"); h != "Content-Type" {
+		t.Errorf("expecting allowed headers \"Content-Type\", got %q", h)
+	}
+	if m := w.Header().Get("Access-Control-Max-Age"); m != "600" {
+		t.Errorf("expecting max age 600, got %q", m)
+	}
+	if body := w.Body.String(); body != "" {
+		t.Errorf("preflight request reached the handler: %q", body)
+	}
+	// Preflight with a method not allowed
+	r, _ = http.NewRequest("OPTIONS", "http://localhost/api/", nil)
+	r.Header.Set("Origin", "https://www.example.com")
+	r.Header.Set("Access-Control-Request-Method", "DELETE")
+	w = serveTestRequest(a, r)
+	if o := w.Header().Get("Access-Control-Allow-Origin"); o != "" {
+		t.Errorf("expecting no allowed origin for DELETE, got %q", o)
+	}
+}
+
+func TestCORSCredentials(t *testing.T) {
+	invalid := []*CORSOptions{
+		{AllowCredentials: true},
+		{AllowCredentials: true, AllowedOrigins: []string{"*"}},
+		{AllowCredentials: true, AllowedOrigins: []string{"https://www.example.com", "*"}},
+	}
+	for ii, v := range invalid {
+		func() {
+			defer func() {
+				if r := recover(); r == nil {
+					t.Errorf("%d: expecting a panic when allowing credentials from any origin", ii)
+				}
+			}()
+			CORS(routeTestHandler("api"), v)
+		}()
+	}
+	// Credentials with origins checked by a function are fine
+	a := New()
+	a.Handle("/api/", CORS(routeTestHandler("api"), &CORSOptions{
+		AllowOrigin: func(ctx *Context, origin string) bool {
+			return strings.HasSuffix(origin, ".example.com")
+		},
+		AllowCredentials: true,
+	}))
+	for origin, allowed := range map[string]bool{"https://www.example.com": true, "https://evil.com": false} {
+		r, _ := http.NewRequest("GET", "http://localhost/api/", nil)
+		r.Header.Set("Origin", origin)
+		w := serveTestRequest(a, r)
+		o := w.Header().Get("Access-Control-Allow-Origin")
+		c := w.Header().Get("Access-Control-Allow-Credentials")
+		if allowed && (o != origin || c != "true") {
+			t.Errorf("expecting origin %s to be allowed with credentials, got origin %q and credentials %q", origin, o, c)
+		}
+		if !allowed && (o != "" || c != "") {
+			t.Errorf("expecting origin %s not to be allowed, got origin %q and credentials %q", origin, o, c)
+		}
+	}
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	a := New()
+	a.Handle("/", SecurityHeaders(func(ctx *Context) {
+		ctx.WriteString(ctx.CSPNonce())
+	}, nil))
+	w := serveTest(a, "GET", "/")
+	nonce := w.Body.String()
+	if nonce == "" {
+		t.Fatal("empty CSP nonce")
+	}
+	csp := w.Header().Get("Content-Security-Policy")
+	if !strings.Contains(csp, "'nonce-"+nonce+"'") || strings.Contains(csp, CSPNoncePlaceholder) {
+		t.Errorf("nonce %q not replaced in policy %q", nonce, csp)
+	}
+	if f := w.Header().Get("X-Frame-Options"); f != "SAMEORIGIN" {
+		t.Errorf("expecting X-Frame-Options SAMEORIGIN, got %q", f)
+	}
+	if c := w.Header().Get("X-Content-Type-Options"); c != "nosniff" {
+		t.Errorf("expecting X-Content-Type-Options nosniff, got %q", c)
+	}
+	if other := serveTest(a, "GET", "/").Body.String(); other == nonce {
+		t.Errorf("nonce %q reused between requests", nonce)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	a := New()
+	a.Handle("/limited/", RateLimit(routeTestHandler("limited"), &RateLimitOptions{
+		Rate:  0.1,
+		Burst: 2,
+		Key:   RateLimitByHandler,
+	}))
+	for ii := 0; ii < 2; ii++ {
+		if w := serveTest(a, "GET", "/limited/"); w.Code != http.StatusOK {
+			t.Fatalf("request %d: expecting code %d, got %d", ii, http.StatusOK, w.Code)
+		}
+	}
+	w := serveTest(a, "GET", "/limited/")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expecting code %d, got %d", http.StatusTooManyRequests, w.Code)
+	}
+	if r := w.Header().Get("Retry-After"); r != "10" {
+		t.Errorf("expecting Retry-After 10, got %q", r)
+	}
+}
+
+func TestRateLimitSweep(t *testing.T) {
+	const key = "test-sweep"
+	now := time.Now().UnixNano()
+	// 2 tokens per second, so the bucket is full again after 1s
+	for ii := 0; ii < 2; ii++ {
+		if allowed, _ := takeMemory(key, now, 2, 2); !allowed {
+			t.Fatalf("request %d was not allowed", ii)
+		}
+	}
+	exists := func() bool {
+		memoryBuckets.Lock()
+		defer memoryBuckets.Unlock()
+		return memoryBuckets.buckets[key] != nil
+	}
+	sweepMemoryBuckets(now + int64(999*time.Millisecond))
+	if !exists() {
+		t.Fatal("bucket removed before being full again")
+	}
+	sweepMemoryBuckets(now + int64(time.Second))
+	if exists() {
+		t.Fatal("full bucket was not removed")
+	}
+}
+
+func TestRateLimitScope(t *testing.T) {
+	a := New()
+	opts := &RateLimitOptions{
+		Rate:  0.1,
+		Burst: 1,
+		Key:   RateLimitByHandler,
+	}
+	a.Handle("^/first/$", RateLimit(routeTestHandler("first"), opts))
+	a.Handle("^/second/$", RateLimit(routeTestHandler("second"), opts))
+	a.HandleNamed("^/scoped/a/$", RateLimit(routeTestHandler("a"), &RateLimitOptions{Rate: 0.1, Burst: 1, Key: RateLimitByHandler, Scope: "scoped"}), "scoped-a")
+	a.HandleNamed("^/scoped/b/$", RateLimit(routeTestHandler("b"), &RateLimitOptions{Rate: 0.1, Burst: 1, Key: RateLimitByHandler, Scope: "scoped"}), "scoped-b")
+	tests := []struct {
+		path string
+		code int
+	}{
+		// Unnamed handlers don't share their buckets
+		{"/first/", http.StatusOK},
+		{"/second/", http.StatusOK},
+		{"/first/", http.StatusTooManyRequests},
+		{"/second/", http.StatusTooManyRequests},
+		// Handlers with the same scope do
+		{"/scoped/a/", http.StatusOK},
+		{"/scoped/b/", http.StatusTooManyRequests},
+	}
+	for _, v := range tests {
+		if w := serveTest(a, "GET", v.path); w.Code != v.code {
+			t.Errorf("GET %s: expecting code %d, got %d", v.path, v.code, w.Code)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package app
 
 import (
 	"errors"
+	"time"
 )
 
 const (
@@ -34,26 +35,46 @@ type UserFunc func(ctx *Context, id int64) User
 // UserFunc defined.
 func (c *Context) User() User {
 	if c.user == nil && c.app.userFunc != nil {
-		var id int64
-		err := c.Cookies().GetSecure(USER_COOKIE_NAME, &id)
-		if err == nil {
-			c.user = c.app.userFunc(c, id)
+		if c.app.sessions != nil {
+			if id := c.Session().UserId(); id != 0 {
+				c.user = c.app.userFunc(c, id)
+			}
+		} else {
+			var id int64
+			err := c.Cookies().GetSecure(USER_COOKIE_NAME, &id)
+			if err == nil {
+				c.user = c.app.userFunc(c, id)
+			}
 		}
 	}
 	return c.user
 }
 
 // SignIn sets the cookie for signin in the given user. The default
-// cookie options for the App are used.
+// cookie options for the App are used. If the App has a SessionStore,
+// the user is stored in the session instead and the session id is
+// rotated.
 func (c *Context) SignIn(user User) error {
 	if c.app.userFunc == nil {
 		return errNoUserFunc
 	}
-	err := c.Cookies().SetSecure(USER_COOKIE_NAME, user.Id())
-	if err != nil {
-		return err
+	if c.app.sessions != nil {
+		s := c.Session()
+		// Restart the absolute timeout, which also makes
+		// the session survive previous revocations.
+		s.data.Created = time.Now().UnixNano()
+		s.data.UserId = user.Id()
+		if err := s.Rotate(); err != nil {
+			return err
+		}
+	} else {
+		err := c.Cookies().SetSecure(USER_COOKIE_NAME, user.Id())
+		if err != nil {
+			return err
+		}
 	}
 	c.user = user
+	c.log.hasCookieUserId = false
 	return nil
 }
 
@@ -64,8 +85,32 @@ func (c *Context) MustSignIn(user User) {
 	}
 }
 
-// SignOut deletes the signed in cookie for the current user. If there's
+// SignOut deletes the signed in cookie for the current user. If the App
+// has a SessionStore, the current session is also destroyed. If there's
 // no current signed in user, it does nothing.
 func (c *Context) SignOut() {
+	if c.app.sessions != nil {
+		if err := c.Session().Destroy(); err != nil {
+			c.Logger().Errorf("error destroying session: %s", err)
+		}
+	}
 	c.Cookies().Delete(USER_COOKIE_NAME)
+	c.user = nil
+	c.log.hasCookieUserId = false
+}
+
+// SignOutEverywhere signs out the current user from all the sessions
+// where it's signed in, including the current one. The App must have
+// a SessionStore. See also RevokeUserSessions.
+func (c *Context) SignOutEverywhere() error {
+	if c.app.sessions == nil {
+		return errNoSessionStore
+	}
+	if id := c.Session().UserId(); id != 0 {
+		if err := c.RevokeUserSessions(id); err != nil {
+			return err
+		}
+	}
+	c.SignOut()
+	return nil
 }
@@ -7,7 +7,10 @@ import (
 	"net/http"
 	"os"
 	"reflect"
+	"runtime"
 	"strings"
+	"sync"
+	"time"
 
 	"gnd.la/blobstore/driver"
 	"gnd.la/config"
@@ -17,6 +20,7 @@ var (
 	imports = map[string]string{
 		"file":   "gnd.la/blobstore/driver/file",
 		"gridfs": "gnd.la/blobstore/driver/gridfs",
+		"mirror": "gnd.la/blobstore/driver/mirror",
 		"s3":     "gnd.la/blobstore/driver/s3",
 	}
 
@@ -28,6 +32,19 @@ var (
 const (
 	metaSuffix  = ".meta"
 	minIdLength = 8
+	// metaVersion is the version written to the .meta files.
+	// Version 1 files, written by older versions of Gondola,
+	// are also supported for reading.
+	metaVersion = 2
+
+	// Flags stored in the metadata. See file_format.txt.
+
+	// flagManifest indicates that the file data is
+	// a manifest of chunks rather than the data itself.
+	flagManifest = 1 << 0
+	// flagCreated indicates that the metadata
+	// includes the file creation time.
+	flagCreated = 1 << 1
 )
 
 // Iter iterates over all the files available in
@@ -57,6 +74,8 @@ type Blobstore struct {
 	srv       driver.Server
 	drvName   string
 	drvNoMeta bool
+	dedup     bool
+	dedupMu   sync.Mutex
 }
 
 // New returns a new *Blobstore using the given url as its configure
@@ -64,6 +83,10 @@ type Blobstore struct {
 // values in the URL are driver dependent. Please, see the package
 // documentation for the available drivers and each driver sub-package
 // for driver-specific documentation.
+//
+// Additionally, all the drivers support the dedup fragment option
+// (e.g. file:///var/data#dedup=1), which enables the deduplicating
+// mode. See the package documentation for more details.
 func New(url *config.URL) (*Blobstore, error) {
 	if url == nil {
 		return nil, fmt.Errorf("blobstore is not configured")
@@ -82,6 +105,7 @@ func New(url *config.URL) (*Blobstore, error) {
 	s := &Blobstore{
 		drv:     drv,
 		drvName: url.Scheme,
+		dedup:   url.Fragment.Get("dedup") != "",
 	}
 	if srv, ok := drv.(driver.Server); ok {
 		s.srv = srv
@@ -99,33 +123,74 @@ func (s *Blobstore) Create() (*WFile, error) {
 // CreateId works like Create, but uses the given id rather than generating
 // a new one. If a file with the same id already exists, it's overwritten.
 func (s *Blobstore) CreateId(id string) (*WFile, error) {
+	if s.dedup && isInternalId(id) {
+		return nil, fmt.Errorf("invalid id %s, can't start with %s", id, dedupPrefix)
+	}
+	return s.createId(id, s.dedup)
+}
+
+// Dedup returns true iff the Blobstore is using the deduplicating mode.
+func (s *Blobstore) Dedup() bool {
+	return s.dedup
+}
+
+func (s *Blobstore) createId(id string, dedup bool) (*WFile, error) {
 	if strings.HasSuffix(id, metaSuffix) {
 		return nil, fmt.Errorf("invalid id %s, can't end with .meta", id)
 	}
 	if len(id) < minIdLength {
 		return nil, fmt.Errorf("id is too short (%d characters), minimum length is %d", len(id), minIdLength)
 	}
+	var prev []manifestEntry
+	if dedup {
+		// Retrieve the manifest for the file we're about to
+		// overwrite (if any), so its chunks can be released.
+		var err error
+		if prev, err = s.manifest(id); err != nil {
+			return nil, err
+		}
+	}
 	w, err := s.drv.Create(id)
 	if err != nil {
 		return nil, err
 	}
-	return &WFile{
+	f := &WFile{
 		id:       id,
 		file:     w,
 		dataHash: newHash(),
 		store:    s,
-	}, nil
+		created:  time.Now(),
+	}
+	if dedup {
+		f.chunker, f.chunks = newChunker(s)
+		f.prev = prev
+		// Release the stored chunks if the file
+		// is never closed.
+		runtime.SetFinalizer(f, (*WFile).abandon)
+	}
+	return f, nil
 }
 
 // Open opens the file with the given id for reading. Note that
 // the file should be closed by calling RFile.Close after you're
 // done with it.
 func (s *Blobstore) Open(id string) (*RFile, error) {
+	return s.open(id, s.dedup)
+}
+
+func (s *Blobstore) open(id string, dedup bool) (*RFile, error) {
 	f, err := s.drv.Open(id)
 	if err != nil {
 		return nil, err
 	}
-	return &RFile{id: id, file: f, store: s}, nil
+	r := &RFile{id: id, file: f, store: s}
+	if dedup {
+		if err := r.openManifest(); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return r, nil
 }
 
 // ReadAll is a shorthand for Open(f).ReadAll()
@@ -138,6 +203,17 @@ func (s *Blobstore) ReadAll(id string) (data []byte, err error) {
 	return f.ReadAll()
 }
 
+// readAll works like ReadAll, but never interprets
+// the file as a manifest.
+func (s *Blobstore) readAll(id string) ([]byte, error) {
+	f, err := s.open(id, false)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.ReadAll()
+}
+
 // Store works like StoreId, but generates a new id for the file.
 func (s *Blobstore) Store(b []byte, meta interface{}) (string, error) {
 	return s.StoreId(newId(), b, meta)
@@ -147,7 +223,14 @@ func (s *Blobstore) Store(b []byte, meta interface{}) (string, error) {
 // in meta with the given file id. If a file with the same id exists, it's
 // overwritten.
 func (s *Blobstore) StoreId(id string, b []byte, meta interface{}) (string, error) {
-	f, err := s.CreateId(id)
+	if s.dedup && isInternalId(id) {
+		return "", fmt.Errorf("invalid id %s, can't start with %s", id, dedupPrefix)
+	}
+	return s.storeId(id, b, meta, s.dedup)
+}
+
+func (s *Blobstore) storeId(id string, b []byte, meta interface{}, dedup bool) (string, error) {
+	f, err := s.createId(id, dedup)
 	if err != nil {
 		return "", err
 	}
@@ -163,8 +246,24 @@ func (s *Blobstore) StoreId(id string, b []byte, meta interface{}) (string, erro
 	return f.Id(), nil
 }
 
-// Remove deletes the file with the given id.
+// Remove deletes the file with the given id. In deduplicating
+// mode, the chunks which are no longer referenced by any file
+// are removed too.
 func (s *Blobstore) Remove(id string) error {
+	var entries []manifestEntry
+	if s.dedup {
+		var err error
+		if entries, err = s.manifest(id); err != nil {
+			return err
+		}
+	}
+	if err := s.removeId(id); err != nil {
+		return err
+	}
+	return s.releaseChunks(entries)
+}
+
+func (s *Blobstore) removeId(id string) error {
 	s.drv.Remove(s.metaName(id))
 	return s.drv.Remove(id)
 }
@@ -179,7 +278,7 @@ func (s *Blobstore) Driver() driver.Driver {
 // the file will be read from the blobstore and written to w. The rng parameter might be
 // used for sending a partial response to the client.
 func (s *Blobstore) Serve(w http.ResponseWriter, id string, rng *Range) error {
-	if s.srv != nil {
+	if s.srv != nil && !s.dedup {
 		if ok, err := s.srv.Serve(w, id, rng); ok || err != nil {
 			return err
 		}
@@ -221,9 +320,14 @@ func (s *Blobstore) Serve(w http.ResponseWriter, id string, rng *Range) error {
 // Iter returns an iterator which visits all the files
 // available in the blobstore. If the underlying driver
 // does not support iteration, (nil, ErrNotIterable) will be returned.
+// In deduplicating mode, the chunks are not returned by the iterator.
 func (s *Blobstore) Iter() (Iter, error) {
 	if iterable, ok := s.drv.(driver.Iterable); ok {
-		return iterable.Iter()
+		iter, err := iterable.Iter()
+		if err != nil || !s.dedup {
+			return iter, err
+		}
+		return &dedupIter{Iter: iter}, nil
 	}
 	return nil, ErrNotIterable
 }
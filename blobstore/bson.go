@@ -1,6 +1,8 @@
 package blobstore
 
 import (
+	"time"
+
 	"gnd.la/internal/bson"
 )
 
@@ -15,3 +17,12 @@ func unmarshal(data []byte, out interface{}) error {
 func newId() string {
 	return bson.NewObjectId().Hex()
 }
+
+// idTime returns the time encoded in the given id if it
+// was generated by newId, or the zero time.Time otherwise.
+func idTime(id string) time.Time {
+	if bson.IsObjectIdHex(id) {
+		return bson.ObjectIdHex(id).Time()
+	}
+	return time.Time{}
+}
@@ -0,0 +1,474 @@
+package blobstore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gnd.la/blobstore/driver"
+)
+
+var (
+	// ErrNotRepairable is returned from Repair when the
+	// issue can't be repaired. See Issue.Repairable.
+	ErrNotRepairable = errors.New("the issue can't be repaired")
+)
+
+// IssueType indicates the type of an issue found
+// by Blobstore.Check.
+type IssueType int
+
+const (
+	// IssueCorrupted indicates that the file data or its metadata
+	// can't be read or doesn't match the stored checksums.
+	IssueCorrupted IssueType = iota + 1
+	// IssueMissingMeta indicates that the file data is present,
+	// but its .meta file is missing.
+	IssueMissingMeta
+	// IssueOrphanedMeta indicates that there's a .meta
+	// file without its corresponding data.
+	IssueOrphanedMeta
+	// IssueOrphanedChunk indicates that there's a chunk which
+	// is not used by any file (only in deduplicating mode).
+	IssueOrphanedChunk
+	// IssueInvalidRefCount indicates that the stored reference
+	// count for a chunk doesn't match the number of references
+	// to it (only in deduplicating mode).
+	IssueInvalidRefCount
+)
+
+func (t IssueType) String() string {
+	switch t {
+	case IssueCorrupted:
+		return "corrupted"
+	case IssueMissingMeta:
+		return "missing meta"
+	case IssueOrphanedMeta:
+		return "orphaned meta"
+	case IssueOrphanedChunk:
+		return "orphaned chunk"
+	case IssueInvalidRefCount:
+		return "invalid reference count"
+	}
+	return fmt.Sprintf("IssueType(%d)", int(t))
+}
+
+// Issue represents an issue found by Blobstore.Check.
+type Issue struct {
+	// Id is the id of the affected file, as used
+	// by the driver (e.g. for IssueOrphanedMeta, it
+	// includes the .meta suffix).
+	Id string
+	// Type is the issue type.
+	Type IssueType
+	// Err is the error found while checking the
+	// file, if any.
+	Err error
+	// Reference counting state seen by Check, used
+	// by Repair to detect changes made since then.
+	refCount       uint64
+	storedRefCount uint64
+	refIds         []string
+}
+
+// Repairable returns true iff the issue can be repaired by
+// Blobstore.Repair. Corrupted files can't be repaired, but they
+// can be quarantined using Blobstore.Quarantine.
+func (i *Issue) Repairable() bool {
+	return i.Type != IssueCorrupted
+}
+
+func (i *Issue) String() string {
+	s := i.Id + ": " + i.Type.String()
+	switch {
+	case i.Err != nil:
+		s += " (" + i.Err.Error() + ")"
+	case i.Type == IssueInvalidRefCount:
+		s += fmt.Sprintf(" (should be %d)", i.refCount)
+	}
+	return s
+}
+
+// Verify checks the integrity of the file with the given id,
+// recomputing the checksums of its data and metadata. In
+// deduplicating mode, the integrity of its chunks is also
+// verified. A non-nil return value indicates that the file
+// is corrupted.
+func (s *Blobstore) Verify(id string) error {
+	f, err := s.Open(id)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Check()
+}
+
+// Check walks over all the files in the blobstore, verifying their
+// integrity and looking for orphaned and missing .meta files and, in
+// deduplicating mode, orphaned chunks and invalid reference counts. It
+// returns the issues found, sorted by id. Use Repair and Quarantine to
+// act on them. If the driver does not support iteration, ErrNotIterable
+// is returned.
+func (s *Blobstore) Check() ([]*Issue, error) {
+	var iter driver.Iter
+	var err error
+	var raw bool
+	switch x := s.drv.(type) {
+	case driver.RawIterable:
+		iter, err = x.IterRaw()
+		raw = true
+	case driver.Iterable:
+		iter, err = x.Iter()
+	default:
+		return nil, ErrNotIterable
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+	c := &checker{
+		store:     s,
+		noMeta:    raw || s.drvNoMeta,
+		chunks:    make(map[string]bool),
+		refs:      make(map[string]uint64),
+		refIds:    make(map[string][]string),
+		refCounts: make(map[string]uint64),
+	}
+	var id string
+	for iter.Next(&id) {
+		c.check(id)
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	return c.finish(), nil
+}
+
+type pendingIssue struct {
+	id          string
+	err         error
+	missingMeta bool
+}
+
+type checker struct {
+	store     *Blobstore
+	noMeta    bool // true if the driver doesn't handle metadata
+	issues    []*Issue
+	pending   []pendingIssue
+	chunks    map[string]bool
+	refs      map[string]uint64   // references found in manifests
+	refIds    map[string][]string // files referencing each chunk
+	refCounts map[string]uint64   // stored reference counts
+}
+
+func (c *checker) add(id string, typ IssueType, err error) {
+	c.issues = append(c.issues, &Issue{Id: id, Type: typ, Err: err})
+}
+
+func (c *checker) check(id string) {
+	s := c.store
+	switch {
+	case strings.HasSuffix(id, metaSuffix):
+		f, err := s.drv.Open(strings.TrimSuffix(id, metaSuffix))
+		if err != nil {
+			c.add(id, IssueOrphanedMeta, nil)
+			return
+		}
+		f.Close()
+	case s.dedup && strings.HasPrefix(id, chunkPrefix):
+		key := id[len(chunkPrefix):]
+		c.chunks[key] = true
+		if err := s.verifyChunk(id, key); err != nil {
+			c.add(id, IssueCorrupted, err)
+		}
+	case s.dedup && strings.HasPrefix(id, refPrefix):
+		key := id[len(refPrefix):]
+		e := manifestEntry{}
+		if _, err := hex.Decode(e.Hash[:], []byte(key)); err != nil {
+			c.add(id, IssueCorrupted, err)
+			return
+		}
+		count, err := s.refCount(&e)
+		if err != nil {
+			c.add(id, IssueCorrupted, err)
+			return
+		}
+		c.refCounts[key] = count
+	default:
+		counted, err := c.verify(id)
+		if err != nil {
+			// Classified in finish(), since at this point we
+			// might not know if the driver handles metadata.
+			mf, merr := s.drv.Open(s.metaName(id))
+			if merr == nil {
+				mf.Close()
+			}
+			if merr != nil && !counted && s.dedup {
+				// The metadata might be lost, but the references
+				// in the manifest must still be counted, otherwise
+				// its chunks would be considered orphaned.
+				c.addRefs(id, s.rawManifest(id))
+			}
+			c.pending = append(c.pending, pendingIssue{id: id, err: err, missingMeta: merr != nil})
+		}
+	}
+}
+
+// verify checks the file with the given id. If the file is stored
+// as a manifest, its chunk references are counted and verify returns
+// true.
+func (c *checker) verify(id string) (bool, error) {
+	f, err := c.store.Open(id)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	m, ok := f.file.(*manifestFile)
+	if ok {
+		c.addRefs(id, m.entries)
+	}
+	return ok, f.Check()
+}
+
+// addRefs counts the chunk references from the
+// manifest of the file with the given id.
+func (c *checker) addRefs(id string, entries []manifestEntry) {
+	for _, v := range entries {
+		key := v.key()
+		c.refs[key]++
+		if ids := c.refIds[key]; len(ids) == 0 || ids[len(ids)-1] != id {
+			c.refIds[key] = append(ids, id)
+		}
+	}
+}
+
+func (c *checker) finish() []*Issue {
+	for _, v := range c.pending {
+		if v.missingMeta && (c.noMeta || c.store.drvNoMeta) {
+			c.add(v.id, IssueMissingMeta, nil)
+		} else {
+			c.add(v.id, IssueCorrupted, v.err)
+		}
+	}
+	keys := make(map[string]bool)
+	for k := range c.refs {
+		keys[k] = true
+	}
+	for k := range c.refCounts {
+		keys[k] = true
+	}
+	for k := range c.chunks {
+		keys[k] = true
+	}
+	for k := range keys {
+		expected := c.refs[k]
+		switch {
+		case c.chunks[k] && expected == 0:
+			c.issues = append(c.issues, &Issue{Id: chunkPrefix + k, Type: IssueOrphanedChunk, storedRefCount: c.refCounts[k]})
+		case !c.chunks[k] && expected > 0:
+			// Missing chunk, files using it have
+			// been already reported as corrupted.
+		case c.refCounts[k] != expected:
+			c.issues = append(c.issues, &Issue{
+				Id:             refPrefix + k,
+				Type:           IssueInvalidRefCount,
+				refCount:       expected,
+				storedRefCount: c.refCounts[k],
+				refIds:         c.refIds[k],
+			})
+		}
+	}
+	sort.Sort(issuesById(c.issues))
+	return c.issues
+}
+
+func (s *Blobstore) verifyChunk(id string, key string) error {
+	f, err := s.open(id, false)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := f.Check(); err != nil {
+		return err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if hex.EncodeToString(h.Sum(nil)) != key {
+		return ErrInvalidDataHash
+	}
+	return nil
+}
+
+// Repair fixes the given issue, as returned by Check. Missing .meta
+// files are regenerated from the data (the file metadata, if any, is
+// lost), orphaned .meta files and chunks are removed and reference
+// counts are set to their correct values. Corrupted files can't be
+// repaired and return ErrNotRepairable.
+//
+// Before repairing orphaned chunks and invalid reference counts, the
+// reference count and the files which referenced the chunk are read
+// again. If they changed since Check (e.g. a file using the chunk
+// was stored or removed), the issue is skipped and Repair returns nil.
+func (s *Blobstore) Repair(issue *Issue) error {
+	switch issue.Type {
+	case IssueMissingMeta:
+		return s.repairMeta(issue.Id)
+	case IssueOrphanedMeta:
+		return s.drv.Remove(issue.Id)
+	case IssueOrphanedChunk:
+		unlock, err := s.lockDedup()
+		if err != nil {
+			return err
+		}
+		defer unlock()
+		e := manifestEntry{}
+		if _, err := hex.Decode(e.Hash[:], []byte(issue.Id[len(chunkPrefix):])); err != nil {
+			return err
+		}
+		if changed, err := s.refsChanged(issue, &e); err != nil || changed {
+			return err
+		}
+		// The reference count might not exist
+		s.removeId(e.refId())
+		if err := s.removeId(issue.Id); err != nil && !driver.IsNotExist(s.drv, err) {
+			return err
+		}
+		return nil
+	case IssueInvalidRefCount:
+		unlock, err := s.lockDedup()
+		if err != nil {
+			return err
+		}
+		defer unlock()
+		e := manifestEntry{}
+		if _, err := hex.Decode(e.Hash[:], []byte(issue.Id[len(refPrefix):])); err != nil {
+			return err
+		}
+		if changed, err := s.refsChanged(issue, &e); err != nil || changed {
+			return err
+		}
+		if issue.refCount == 0 {
+			return s.removeId(issue.Id)
+		}
+		return s.setRefCount(&e, issue.refCount)
+	}
+	return ErrNotRepairable
+}
+
+// refsChanged returns true if the stored reference count for the
+// given chunk or the references to it from the files which used it
+// have changed since the issue was found by Check. Must be called
+// with the lock returned by lockDedup held.
+func (s *Blobstore) refsChanged(issue *Issue, e *manifestEntry) (bool, error) {
+	count, err := s.refCount(e)
+	if err != nil {
+		return false, err
+	}
+	if count != issue.storedRefCount {
+		return true, nil
+	}
+	key := e.key()
+	var refs uint64
+	for _, id := range issue.refIds {
+		entries, err := s.manifest(id)
+		if err != nil || entries == nil {
+			// Metadata might be missing or already regenerated
+			entries = s.rawManifest(id)
+		}
+		for _, v := range entries {
+			if v.key() == key {
+				refs++
+			}
+		}
+	}
+	return refs != issue.refCount, nil
+}
+
+func (s *Blobstore) repairMeta(id string) error {
+	var flags uint64
+	var f io.ReadCloser
+	if entries := s.rawManifest(id); entries != nil {
+		// The data and its hash must be computed
+		// from the chunks, not from the manifest.
+		flags |= flagManifest
+		f = newManifestFile(s, entries)
+	} else {
+		var err error
+		if f, err = s.drv.Open(id); err != nil {
+			return err
+		}
+	}
+	defer f.Close()
+	h := newHash()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return err
+	}
+	created := idTime(id)
+	if created.IsZero() {
+		created = time.Now()
+	}
+	w := &WFile{
+		id:         id,
+		store:      s,
+		dataHash:   h,
+		dataLength: uint64(n),
+		created:    created,
+		flags:      flags,
+	}
+	return w.putMeta()
+}
+
+// Quarantine copies the file with the given id, as stored by the driver,
+// to the given directory (which is created if it doesn't exist) and then
+// removes it from the blobstore. If the file has a .meta file, it's also
+// quarantined. Note that in deduplicating mode, the chunks used by the
+// quarantined file are not released. Run Check again after quarantining
+// files to find them.
+func (s *Blobstore) Quarantine(id string, dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, v := range []string{id, s.metaName(id)} {
+		f, err := s.drv.Open(v)
+		if err != nil {
+			if v == id {
+				return err
+			}
+			continue
+		}
+		err = copyToFile(f, filepath.Join(dir, v))
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return s.removeId(id)
+}
+
+func copyToFile(r io.Reader, name string) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+type issuesById []*Issue
+
+func (i issuesById) Len() int           { return len(i) }
+func (i issuesById) Less(a, b int) bool { return i[a].Id < i[b].Id }
+func (i issuesById) Swap(a, b int)      { i[a], i[b] = i[b], i[a] }
@@ -0,0 +1,165 @@
+// Package rolling implements a content-defined chunker, which
+// uses a rolling hash to determine the chunk boundaries.
+//
+// Since the boundaries only depend on the data near them, inserting
+// or removing bytes in a stream only changes the chunks around the
+// modification, while the rest of them remain the same. This makes
+// this chunker well suited for deduplicating similar data.
+//
+// The rolling hash is a Gear hash, which is also used by FastCDC. Its
+// table is generated from a fixed seed, so boundaries are stable across
+// different processes and versions of this package.
+package rolling
+
+import (
+	"fmt"
+
+	"gnd.la/blobstore/chunk"
+)
+
+const (
+	// DefaultMinSize is the minimum chunk size used
+	// when Options.MinSize is zero.
+	DefaultMinSize = 64 * 1024 // 64KiB
+	// DefaultAvgSize is the average chunk size used
+	// when Options.AvgSize is zero.
+	DefaultAvgSize = 256 * 1024 // 256KiB
+	// DefaultMaxSize is the maximum chunk size used
+	// when Options.MaxSize is zero.
+	DefaultMaxSize = 1024 * 1024 // 1MiB
+
+	gearSeed = 0x676e642e6c61 // "gnd.la"
+)
+
+var gear [256]uint64
+
+// Options specify the chunk sizes. Zero values
+// are replaced with their defaults.
+type Options struct {
+	// MinSize is the minimum chunk size. No boundaries
+	// are looked for until the chunk reaches this size.
+	MinSize int
+	// AvgSize is the desired average chunk size. It must
+	// be a power of 2.
+	AvgSize int
+	// MaxSize is the maximum chunk size. Chunks are cut
+	// at this size if no boundary has been found.
+	MaxSize int
+}
+
+type chunker struct {
+	buf    []byte
+	pos    int
+	min    int
+	mask   uint64
+	hash   uint64
+	writer chunk.Writer
+}
+
+// New returns a new content-defined chunker which writes to the given
+// chunk.Writer. The opts argument might be nil, in that case the default
+// sizes are used. It panics if the options are not valid.
+func New(writer chunk.Writer, opts *Options) chunk.Chunker {
+	var o Options
+	if opts != nil {
+		o = *opts
+	}
+	if o.MinSize == 0 {
+		o.MinSize = DefaultMinSize
+	}
+	if o.AvgSize == 0 {
+		o.AvgSize = DefaultAvgSize
+	}
+	if o.MaxSize == 0 {
+		o.MaxSize = DefaultMaxSize
+	}
+	if o.AvgSize&(o.AvgSize-1) != 0 {
+		panic(fmt.Errorf("average chunk size %d is not a power of 2", o.AvgSize))
+	}
+	if o.MinSize <= 0 || o.MinSize > o.AvgSize || o.AvgSize > o.MaxSize {
+		panic(fmt.Errorf("invalid chunk sizes min = %d, avg = %d, max = %d", o.MinSize, o.AvgSize, o.MaxSize))
+	}
+	return &chunker{
+		buf:    make([]byte, o.MaxSize),
+		min:    o.MinSize,
+		mask:   boundaryMask(o.AvgSize),
+		writer: writer,
+	}
+}
+
+// boundaryMask returns the mask used for finding boundaries
+// for chunks with the given average size. It uses the highest
+// bits of the hash, since they depend on the last 64 bytes while
+// the lowest ones only depend on the last few bytes.
+func boundaryMask(avg int) uint64 {
+	bits := uint(0)
+	for 1<<bits < avg {
+		bits++
+	}
+	if bits == 0 {
+		return 0
+	}
+	return (1<<bits - 1) << (64 - bits)
+}
+
+func (c *chunker) Write(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		nn := copy(c.buf[c.pos:], p[n:])
+		end := c.pos + nn
+		cut := -1
+		for ii := c.pos; ii < end; ii++ {
+			c.hash = (c.hash << 1) + gear[c.buf[ii]]
+			if ii+1 >= c.min && c.hash&c.mask == 0 {
+				cut = ii + 1
+				break
+			}
+		}
+		if cut < 0 {
+			c.pos = end
+			n += nn
+			if c.pos == len(c.buf) {
+				if err := c.Flush(); err != nil {
+					return n, err
+				}
+			}
+			continue
+		}
+		n += cut - c.pos
+		c.pos = cut
+		if err := c.Flush(); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (c *chunker) Flush() error {
+	var err error
+	if c.pos > 0 {
+		err = c.writer.WriteChunk(c.buf[:c.pos])
+		c.Reset()
+	}
+	return err
+}
+
+func (c *chunker) Reset() {
+	c.pos = 0
+	c.hash = 0
+}
+
+func (c *chunker) Remaining() []byte {
+	return c.buf[:c.pos]
+}
+
+func init() {
+	// splitmix64, so the table doesn't depend on math/rand
+	x := uint64(gearSeed)
+	for ii := range gear {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gear[ii] = z ^ (z >> 31)
+	}
+}
@@ -0,0 +1,143 @@
+package blobstore
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// CopyOptions specify the options for Copy.
+type CopyOptions struct {
+	// Filter, if non-nil, restricts the files which are copied.
+	Filter *Filter
+	// Verify makes Copy read back each copied file from the
+	// destination blobstore and verify its checksums.
+	Verify bool
+	// KeepGoing makes Copy continue copying the remaining files
+	// when a file can't be copied. Errors are reported in
+	// CopyResult.Failed.
+	KeepGoing bool
+	// Progress, if non-nil, is called after each file is processed,
+	// with skipped set to true when the file was already present in
+	// the destination blobstore.
+	Progress func(id string, skipped bool, err error)
+}
+
+// CopyResult contains the result of a Copy.
+type CopyResult struct {
+	// Copied is the number of files copied.
+	Copied int
+	// Skipped is the number of files which were
+	// already present in the destination blobstore.
+	Skipped int
+	// Failed contains the files which couldn't be copied, with
+	// the errors produced while copying them. It's only populated
+	// when CopyOptions.KeepGoing is true.
+	Failed map[string]error
+}
+
+// Copy copies all the files from src to dst, preserving their ids,
+// metadata and creation times. Since metadata is copied without
+// decoding it, callers don't need to know its type. The source data
+// and metadata are verified against their checksums while copying
+// them, so corrupted files are never copied. Files which are already
+// present in dst with the same data and metadata are skipped, which
+// allows resuming an interrupted Copy by calling it again. The opts
+// argument might be nil, to use the default options.
+//
+// Copy requires src to support iteration (see Iter) and works between
+// deduplicating and regular blobstores in any direction, since files are
+// copied using their data rather than their manifests.
+func Copy(src *Blobstore, dst *Blobstore, opts *CopyOptions) (*CopyResult, error) {
+	if opts == nil {
+		opts = &CopyOptions{}
+	}
+	iter, err := src.IterFilter(opts.Filter)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+	res := &CopyResult{}
+	var id string
+	for iter.Next(&id) {
+		skipped, err := copyFile(src, dst, id, opts.Verify)
+		if opts.Progress != nil {
+			opts.Progress(id, skipped, err)
+		}
+		if err != nil {
+			err = fmt.Errorf("error copying %s: %s", id, err)
+			if !opts.KeepGoing {
+				return res, err
+			}
+			if res.Failed == nil {
+				res.Failed = make(map[string]error)
+			}
+			res.Failed[id] = err
+			continue
+		}
+		if skipped {
+			res.Skipped++
+		} else {
+			res.Copied++
+		}
+	}
+	return res, iter.Err()
+}
+
+func copyFile(src *Blobstore, dst *Blobstore, id string, verify bool) (bool, error) {
+	r, err := src.Open(id)
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+	if err := r.decodeMeta(); err != nil {
+		return false, err
+	}
+	if r.metadataHash != 0 {
+		h := newHash()
+		h.Write(r.metadataData)
+		if h.Sum64() != r.metadataHash {
+			return false, ErrInvalidMetadataHash
+		}
+	}
+	info, err := dst.Stat(id)
+	if err == nil && info.Size == r.dataLength &&
+		info.Checksum == r.dataHash && bytes.Equal(info.metadata, r.metadataData) {
+		return true, nil
+	}
+	existed := err == nil
+	w, err := dst.CreateId(id)
+	if err != nil {
+		return false, err
+	}
+	w.rawMeta = r.metadataData
+	if !r.created.IsZero() {
+		w.created = r.created
+	}
+	n, err := io.Copy(w, r)
+	if err == nil && uint64(n) != r.dataLength {
+		err = ErrInvalidDataLength
+	}
+	if err == nil && w.dataHash.Sum64() != r.dataHash {
+		err = ErrInvalidDataHash
+	}
+	if err != nil {
+		// Don't store a partial file, which would
+		// also overwrite the previous one (if any).
+		w.abort()
+		return false, err
+	}
+	if err := w.Close(); err != nil {
+		return false, err
+	}
+	if verify {
+		if err := dst.Verify(id); err != nil {
+			if !existed {
+				// Don't leave an invalid copy behind
+				dst.Remove(id)
+			}
+			return false, fmt.Errorf("error verifying copy: %s", err)
+		}
+	}
+	return false, nil
+}
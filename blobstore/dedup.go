@@ -0,0 +1,410 @@
+package blobstore
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"gnd.la/blobstore/chunk"
+	"gnd.la/blobstore/chunk/rolling"
+	"gnd.la/blobstore/driver"
+)
+
+const (
+	dedupPrefix     = "dedup-"
+	chunkPrefix     = dedupPrefix + "chunk-"
+	refPrefix       = dedupPrefix + "ref-"
+	manifestVersion = 1
+	// size of each encoded manifestEntry
+	manifestEntrySize = sha256.Size + 4
+	// name of the lock protecting the reference
+	// counts, see Blobstore.lockDedup
+	dedupLockName = "dedup"
+)
+
+// manifestEntry represents a chunk in a manifest, identified
+// by the SHA256 of its data.
+type manifestEntry struct {
+	Hash [sha256.Size]byte
+	Size uint32
+}
+
+func (e *manifestEntry) key() string {
+	return hex.EncodeToString(e.Hash[:])
+}
+
+func (e *manifestEntry) chunkId() string {
+	return chunkPrefix + e.key()
+}
+
+func (e *manifestEntry) refId() string {
+	return refPrefix + e.key()
+}
+
+func writeManifest(w io.Writer, entries []manifestEntry) error {
+	if err := bwrite(w, uint8(manifestVersion)); err != nil {
+		return err
+	}
+	if err := bwrite(w, uint64(len(entries))); err != nil {
+		return err
+	}
+	for _, v := range entries {
+		if err := bwrite(w, &v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readManifest(r io.ReadSeeker) ([]manifestEntry, error) {
+	var version uint8
+	if err := bread(r, &version); err != nil {
+		return nil, err
+	}
+	if version != manifestVersion {
+		return nil, fmt.Errorf("can't read manifests with version %d", version)
+	}
+	var count uint64
+	if err := bread(r, &count); err != nil {
+		return nil, err
+	}
+	// Don't trust count for allocating the entries, a corrupted
+	// manifest might declare more entries than it can hold.
+	remaining, err := remainingSize(r)
+	if err != nil {
+		return nil, err
+	}
+	if count > uint64(remaining)/manifestEntrySize {
+		return nil, fmt.Errorf("corrupted manifest, declares %d entries but has room for %d", count, uint64(remaining)/manifestEntrySize)
+	}
+	entries := make([]manifestEntry, int(count))
+	if err := bread(r, entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// remainingSize returns the number of bytes from the current
+// position to the end of r.
+func remainingSize(r io.Seeker) (int64, error) {
+	cur, err := r.Seek(0, os.SEEK_CUR)
+	if err != nil {
+		return 0, err
+	}
+	end, err := r.Seek(0, os.SEEK_END)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := r.Seek(cur, os.SEEK_SET); err != nil {
+		return 0, err
+	}
+	return end - cur, nil
+}
+
+// isInternalId returns true iff the given id is used
+// internally by the deduplicating mode.
+func isInternalId(id string) bool {
+	return strings.HasPrefix(id, dedupPrefix)
+}
+
+// manifest returns the manifest for the file with the given id.
+// If the file is not stored as a manifest or it can't be opened,
+// it returns nil.
+func (s *Blobstore) manifest(id string) ([]manifestEntry, error) {
+	f, err := s.drv.Open(id)
+	if err != nil {
+		return nil, nil
+	}
+	r := &RFile{id: id, file: f, store: s}
+	defer r.Close()
+	if err := r.decodeMeta(); err != nil {
+		return nil, err
+	}
+	if r.flags&flagManifest == 0 {
+		return nil, nil
+	}
+	return readManifest(r.file)
+}
+
+// rawManifest returns the manifest stored in the data of the file
+// with the given id, without reading its metadata. It's used for
+// recovering files which lost their metadata. If the file can't be
+// opened, it's not stored in deduplicating mode or the manifest
+// references any missing chunk, it returns nil.
+func (s *Blobstore) rawManifest(id string) []manifestEntry {
+	if !s.dedup {
+		return nil
+	}
+	f, err := s.drv.Open(id)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	entries, err := readManifest(f)
+	if err != nil {
+		return nil
+	}
+	if remaining, err := remainingSize(f); err != nil || remaining != 0 {
+		// Data after the manifest, so it's a regular file
+		// which happens to start like a manifest.
+		return nil
+	}
+	for ii := range entries {
+		cf, err := s.drv.Open(entries[ii].chunkId())
+		if err != nil {
+			return nil
+		}
+		cf.Close()
+	}
+	if entries == nil {
+		entries = []manifestEntry{}
+	}
+	return entries
+}
+
+// lockDedup acquires the lock which protects the reference counts
+// and returns a function which releases it. If the driver implements
+// driver.Locker, the lock is shared with all the processes using
+// the same storage. Otherwise, it only protects the reference counts
+// from concurrent modifications in the same process.
+func (s *Blobstore) lockDedup() (func(), error) {
+	s.dedupMu.Lock()
+	if locker, ok := s.drv.(driver.Locker); ok {
+		unlock, err := locker.Lock(dedupLockName)
+		if err != nil && err != driver.ErrLockNotHandled {
+			s.dedupMu.Unlock()
+			return nil, fmt.Errorf("error acquiring deduplication lock: %s", err)
+		}
+		if err == nil {
+			return func() {
+				unlock()
+				s.dedupMu.Unlock()
+			}, nil
+		}
+	}
+	return s.dedupMu.Unlock, nil
+}
+
+// storeChunk stores the given chunk if it's not already present
+// and increments its reference count.
+func (s *Blobstore) storeChunk(data []byte) (manifestEntry, error) {
+	e := manifestEntry{Hash: sha256.Sum256(data), Size: uint32(len(data))}
+	unlock, err := s.lockDedup()
+	if err != nil {
+		return e, err
+	}
+	defer unlock()
+	count, err := s.refCount(&e)
+	if err != nil {
+		return e, err
+	}
+	if count == 0 {
+		if _, err := s.storeId(e.chunkId(), data, nil, false); err != nil {
+			return e, err
+		}
+	}
+	return e, s.setRefCount(&e, count+1)
+}
+
+// releaseChunks decrements the reference count of the given chunks,
+// removing the ones which are not referenced anymore.
+func (s *Blobstore) releaseChunks(entries []manifestEntry) error {
+	for ii := range entries {
+		if err := s.releaseChunk(&entries[ii]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseChunk decrements the reference count of the given chunk,
+// removing it if it's not referenced anymore. The lock is acquired
+// for each chunk, so it's not held for too long while releasing
+// big files.
+func (s *Blobstore) releaseChunk(e *manifestEntry) error {
+	unlock, err := s.lockDedup()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	count, err := s.refCount(e)
+	if err != nil {
+		return err
+	}
+	if count > 1 {
+		return s.setRefCount(e, count-1)
+	}
+	if err := s.removeId(e.chunkId()); err != nil && !driver.IsNotExist(s.drv, err) {
+		return err
+	}
+	if err := s.removeId(e.refId()); err != nil && !driver.IsNotExist(s.drv, err) {
+		return err
+	}
+	return nil
+}
+
+// refCount returns the reference count for the given chunk, which
+// is zero when the chunk is not stored. Must be called with the
+// lock returned by lockDedup held.
+func (s *Blobstore) refCount(e *manifestEntry) (uint64, error) {
+	f, err := s.open(e.refId(), false)
+	if err != nil {
+		if driver.IsNotExist(s.drv, err) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("error reading reference count for chunk %s: %s", e.key(), err)
+	}
+	defer f.Close()
+	var count uint64
+	if err := bread(f, &count); err != nil {
+		return 0, fmt.Errorf("error reading reference count for chunk %s: %s", e.key(), err)
+	}
+	return count, nil
+}
+
+// setRefCount sets the reference count for the given chunk. Must be
+// called with the lock returned by lockDedup held.
+func (s *Blobstore) setRefCount(e *manifestEntry, count uint64) error {
+	var buf bytes.Buffer
+	if err := bwrite(&buf, count); err != nil {
+		return err
+	}
+	_, err := s.storeId(e.refId(), buf.Bytes(), nil, false)
+	return err
+}
+
+// chunkWriter implements chunk.Writer by storing each
+// chunk in the blobstore and adding it to the manifest.
+type chunkWriter struct {
+	store    *Blobstore
+	manifest []manifestEntry
+}
+
+func (w *chunkWriter) WriteChunk(b []byte) error {
+	e, err := w.store.storeChunk(b)
+	if err != nil {
+		return err
+	}
+	w.manifest = append(w.manifest, e)
+	return nil
+}
+
+func newChunker(s *Blobstore) (chunk.Chunker, *chunkWriter) {
+	w := &chunkWriter{store: s}
+	return rolling.New(w, nil), w
+}
+
+// manifestFile implements driver.RFile for files stored as manifests,
+// loading each chunk into memory as it's needed.
+type manifestFile struct {
+	store   *Blobstore
+	entries []manifestEntry
+	offsets []int64 // offset of each chunk, plus the total size
+	pos     int64
+	current int
+	data    []byte
+}
+
+func newManifestFile(s *Blobstore, entries []manifestEntry) *manifestFile {
+	offsets := make([]int64, len(entries)+1)
+	for ii, v := range entries {
+		offsets[ii+1] = offsets[ii] + int64(v.Size)
+	}
+	return &manifestFile{
+		store:   s,
+		entries: entries,
+		offsets: offsets,
+		current: -1,
+	}
+}
+
+func (f *manifestFile) size() int64 {
+	return f.offsets[len(f.offsets)-1]
+}
+
+func (f *manifestFile) load(idx int) error {
+	if idx == f.current {
+		return nil
+	}
+	e := &f.entries[idx]
+	data, err := f.store.readAll(e.chunkId())
+	if err != nil {
+		return fmt.Errorf("error reading chunk %s: %s", e.key(), err)
+	}
+	if len(data) != int(e.Size) || sha256.Sum256(data) != e.Hash {
+		return fmt.Errorf("chunk %s is corrupted", e.key())
+	}
+	f.current = idx
+	f.data = data
+	return nil
+}
+
+func (f *manifestFile) Read(p []byte) (int, error) {
+	if f.pos >= f.size() {
+		return 0, io.EOF
+	}
+	// Find the last chunk which starts at or before pos
+	idx := sort.Search(len(f.entries), func(ii int) bool {
+		return f.offsets[ii+1] > f.pos
+	})
+	if err := f.load(idx); err != nil {
+		return 0, err
+	}
+	n := copy(p, f.data[f.pos-f.offsets[idx]:])
+	f.pos += int64(n)
+	return n, nil
+}
+
+func (f *manifestFile) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case os.SEEK_SET:
+		pos = offset
+	case os.SEEK_CUR:
+		pos = f.pos + offset
+	case os.SEEK_END:
+		pos = f.size() + offset
+	default:
+		return f.pos, fmt.Errorf("invalid whence %d", whence)
+	}
+	if pos < 0 {
+		return f.pos, fmt.Errorf("invalid offset %d", pos)
+	}
+	f.pos = pos
+	return pos, nil
+}
+
+func (f *manifestFile) Close() error {
+	f.data = nil
+	return nil
+}
+
+func (f *manifestFile) Metadata() ([]byte, error) {
+	// Metadata is always decoded before opening the manifest,
+	// so this is never called by RFile.
+	return nil, nil
+}
+
+// dedupIter wraps an Iter, skipping the files used
+// internally by the deduplicating mode.
+type dedupIter struct {
+	Iter
+}
+
+func (i *dedupIter) Next(id *string) bool {
+	var cur string
+	for i.Iter.Next(&cur) {
+		if !isInternalId(cur) {
+			if id != nil {
+				*id = cur
+			}
+			return true
+		}
+	}
+	return false
+}
@@ -13,4 +13,37 @@
 // File metadata must be a struct and is serialized using BSON. For more
 // information about the BSON format and struct tags that you might use to
 // control the serialization, see gnd.la/internal/bson.
+//
+// Deduplication
+//
+// When the dedup option is specified in the blobstore URL fragment (e.g.
+// file:///var/data#dedup=1), the blobstore stores files as manifests of
+// content-addressed chunks. Data is split using the content-defined chunker
+// in gnd.la/blobstore/chunk/rolling and each chunk is stored only once,
+// identified by its SHA256, so identical and overlapping files share their
+// storage. Chunks are reference counted and Remove deletes the ones which
+// are not referenced by any other file.
+//
+// Reference counts are protected by a lock shared by all the processes
+// using the same storage when the driver implements driver.Locker (the
+// file driver does, and the mirror driver delegates to its primary one).
+// With other drivers the lock is only held by the Blobstore, so a
+// deduplicating blobstore must only be written from a single process.
+// Chunks stored by files which fail to be written or which are never
+// closed are released, but their reference counts might become invalid
+// if the process exits before that. Use Check and Repair to fix them.
+// Additionally, once files have been stored in deduplicating mode, the
+// dedup option must not be removed, since otherwise their manifests would
+// be returned rather than their data.
+//
+// Replication and migration
+//
+// Files can be replicated into two stores using the driver in
+// gnd.la/blobstore/driver/mirror, which writes to both of them and
+// falls back to the secondary store when a file can't be read from the
+// primary one. To move files between two blobstores (e.g. when switching
+// drivers or populating a mirror), use Copy, which preserves their ids and
+// metadata, verifies their checksums and can be resumed after being
+// interrupted. The gondola command provides a blobstore-copy subcommand
+// which wraps it.
 package blobstore
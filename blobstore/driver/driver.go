@@ -3,13 +3,20 @@
 package driver
 
 import (
+	"errors"
 	"net/http"
+	"os"
 
 	"gnd.la/config"
 )
 
 var (
 	registry = map[string]Opener{}
+
+	// ErrLockNotHandled might be returned from Locker.Lock by
+	// drivers which can only provide locks in some cases (e.g.
+	// depending on the drivers they wrap).
+	ErrLockNotHandled = errors.New("this driver does not handle locks")
 )
 
 type Opener func(url *config.URL) (Driver, error)
@@ -35,6 +42,59 @@ type Iterable interface {
 	Iter() (Iter, error)
 }
 
+// RawIterable is implemented by drivers which don't handle metadata
+// (see ErrMetadataNotHandled) and whose iterators skip the .meta files
+// created by the blobstore. IterRaw must return an iterator which
+// visits all the files, including the .meta ones. It's used by the
+// blobstore for detecting orphaned .meta files.
+type RawIterable interface {
+	IterRaw() (Iter, error)
+}
+
+// NotExistChecker is implemented by drivers which return errors
+// not recognized by os.IsNotExist when opening a file which does
+// not exist. See IsNotExist.
+type NotExistChecker interface {
+	IsNotExist(err error) bool
+}
+
+// IsNotExist returns true iff the given error, returned by
+// the given driver when opening a file, indicates that the
+// file does not exist.
+func IsNotExist(drv Driver, err error) bool {
+	if os.IsNotExist(err) {
+		return true
+	}
+	if c, ok := drv.(NotExistChecker); ok {
+		return c.IsNotExist(err)
+	}
+	return false
+}
+
+// Locker is implemented by drivers which can provide locks shared
+// by all the processes using the same storage. The blobstore uses
+// them for protecting the reference counts in deduplicating mode.
+type Locker interface {
+	// Lock acquires the lock with the given name, waiting until
+	// it's available, and returns a function which releases it.
+	Lock(name string) (unlock func() error, err error)
+}
+
+// Aborter is implemented by WFile implementations which can discard
+// a file being written without storing it. Files which don't
+// implement it are discarded by not closing them. See Abort.
+type Aborter interface {
+	Abort() error
+}
+
+// Abort discards the given file without storing it.
+func Abort(f WFile) error {
+	if a, ok := f.(Aborter); ok {
+		return a.Abort()
+	}
+	return nil
+}
+
 type Range interface {
 	IsValid() bool
 	Range() (*int64, *int64)
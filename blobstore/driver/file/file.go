@@ -76,12 +76,22 @@ func (f *fsDriver) Open(id string) (driver.RFile, error) {
 	// data in legacy format.
 	if !strings.HasSuffix(id, ".meta") {
 		metaPath := f.path(id + ".meta")
-		_, err := os.Stat(metaPath)
-		if err != nil {
-			return readLegacyFile(r)
+		if _, err := os.Stat(metaPath); err != nil {
+			lf, lerr := readLegacyFile(r)
+			if lerr == nil {
+				r.Close()
+				return lf, nil
+			}
+			// Not a legacy file, just a file with a missing
+			// .meta. Return it as is, so the blobstore can
+			// report the missing .meta (and possibly repair it).
+			if _, err := r.Seek(0, os.SEEK_SET); err != nil {
+				r.Close()
+				return nil, err
+			}
 		}
 	}
-	return (*rfile)(r), err
+	return (*rfile)(r), nil
 }
 
 func (f *fsDriver) Remove(id string) error {
@@ -93,6 +103,15 @@ func (f *fsDriver) Close() error {
 }
 
 func (f *fsDriver) Iter() (driver.Iter, error) {
+	return f.iter(false)
+}
+
+// IterRaw implements driver.RawIterable.
+func (f *fsDriver) IterRaw() (driver.Iter, error) {
+	return f.iter(true)
+}
+
+func (f *fsDriver) iter(meta bool) (driver.Iter, error) {
 	res, err := ioutil.ReadDir(f.dir)
 	if err != nil {
 		return nil, err
@@ -101,12 +120,12 @@ func (f *fsDriver) Iter() (driver.Iter, error) {
 	for _, v := range res {
 		if v.IsDir() {
 			name := v.Name()
-			if name != "tmp" || name[0] != '.' {
+			if name != "tmp" && name[0] != '.' {
 				dirs = append(dirs, filepath.Join(f.dir, name))
 			}
 		}
 	}
-	return &fsIter{dirs: dirs}, nil
+	return &fsIter{dirs: dirs, meta: meta}, nil
 }
 
 func fsOpener(url *config.URL) (driver.Driver, error) {
@@ -133,6 +152,7 @@ type fsIter struct {
 	dirIndex int
 	names    []string
 	err      error
+	meta     bool
 }
 
 func (f *fsIter) Next(id *string) bool {
@@ -158,14 +178,16 @@ func (f *fsIter) Next(id *string) bool {
 			return false
 		}
 		for _, v := range names {
-			if filepath.Ext(v) != ".meta" {
+			if f.meta || filepath.Ext(v) != ".meta" {
 				f.names = append(f.names, v)
 			}
 		}
 		f.base = filepath.Base(cur)
 		f.dirIndex++
 	}
-	*id = f.names[0] + f.base
+	name := f.names[0]
+	ext := filepath.Ext(name)
+	*id = name[:len(name)-len(ext)] + f.base + ext
 	f.names = f.names[1:]
 	return true
 }
@@ -52,6 +52,11 @@ func readLegacyFile(r *os.File) (*legacyFile, error) {
 		return nil, err
 	}
 	if metadataLength > 0 {
+		// Avoid allocating huge buffers for files which
+		// are not in the legacy format.
+		if st, err := r.Stat(); err != nil || metadataLength > uint64(st.Size()) {
+			return nil, fmt.Errorf("invalid metadata length %d", metadataLength)
+		}
 		file.meta = make([]byte, int(metadataLength))
 		if _, err = io.ReadFull(r, file.meta); err != nil {
 			return nil, err
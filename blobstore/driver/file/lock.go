@@ -0,0 +1,42 @@
+package file
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// lockDir is skipped by the iterators, since it
+	// starts with a dot.
+	lockDir          = ".locks"
+	lockPollInterval = 10 * time.Millisecond
+	// Locks older than this are assumed to be left
+	// by a process which crashed while holding them.
+	lockStaleAfter = time.Minute
+)
+
+// Lock implements driver.Locker using lock files, so locks
+// are shared by all the processes using the same directory.
+func (f *fsDriver) Lock(name string) (func() error, error) {
+	dir := filepath.Join(f.dir, lockDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	p := filepath.Join(dir, name)
+	for {
+		fp, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			fp.Close()
+			return func() error { return os.Remove(p) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if st, err := os.Stat(p); err == nil && time.Since(st.ModTime()) > lockStaleAfter {
+			os.Remove(p)
+			continue
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
@@ -31,3 +31,10 @@ func (f *wfile) Close() error {
 	}
 	return nil
 }
+
+// Abort implements driver.Aborter by removing the
+// temporary file.
+func (f *wfile) Abort() error {
+	f.File.Close()
+	return os.Remove(f.Name())
+}
@@ -86,6 +86,11 @@ func (d *gridfsDriver) Open(id string) (driver.RFile, error) {
 	return (*rfile)(r), err
 }
 
+// IsNotExist implements driver.NotExistChecker.
+func (d *gridfsDriver) IsNotExist(err error) bool {
+	return err == mgo.ErrNotFound
+}
+
 func (d *gridfsDriver) Remove(id string) error {
 	return d.fs.RemoveId(bson.ObjectIdHex(id))
 }
@@ -4,6 +4,7 @@ import (
 	"crypto/sha1"
 	"encoding/hex"
 	"fmt"
+	"os"
 	"path/filepath"
 
 	"gnd.la/blobstore/driver"
@@ -36,7 +37,7 @@ func (d *leveldbDriver) Open(id string) (driver.RFile, error) {
 	value, err := d.files.Get(internal.StringToBytes(id), nil)
 	if err != nil {
 		if err == leveldb.ErrNotFound {
-			return nil, fmt.Errorf("file %s not found", id)
+			return nil, &os.PathError{Op: "open", Path: id, Err: os.ErrNotExist}
 		}
 		return nil, err
 	}
@@ -0,0 +1,27 @@
+// Package mirror implements a blobstore driver which replicates
+// the files into two other blobstore drivers.
+//
+// Files are written to both the primary and the secondary driver and
+// writing fails if any of them fails. Reads are performed from the
+// primary driver, falling back to the secondary one when the file
+// can't be opened from the former. Removing a file removes it from
+// both drivers. Iteration, locking and serving files directly from the
+// driver (e.g. redirecting to S3) are delegated to the primary driver.
+//
+// The URL format for this driver is:
+//
+//  mirror://?primary={url}&secondary={url}
+//
+// Both URLs must be query escaped (e.g. using url.QueryEscape) and their
+// drivers must be imported by the application. For example, to mirror
+// files stored in /var/data into an S3 bucket:
+//
+//  mirror://?primary=file%3A%2F%2F%2Fvar%2Fdata&secondary=s3%3A%2F%2Fbucket%23access_key%3D...%26secret_key%3D...
+//
+// Note that when the underlying drivers differ in their metadata handling
+// (e.g. gridfs handles it while s3 does not), the blobstore stores it as
+// .meta files in both drivers. In that case, files previously stored by the
+// driver which handles metadata can't be read through the mirror. Use
+// gnd.la/blobstore.Copy to populate the secondary store before setting up
+// the mirror.
+package mirror
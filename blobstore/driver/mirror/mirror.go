@@ -0,0 +1,182 @@
+package mirror
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"gnd.la/blobstore/driver"
+	"gnd.la/config"
+)
+
+var (
+	errNotIterable = errors.New("the primary driver does not support iteration")
+)
+
+type mirrorDriver struct {
+	primary   driver.Driver
+	secondary driver.Driver
+}
+
+func (d *mirrorDriver) Create(id string) (driver.WFile, error) {
+	p, err := d.primary.Create(id)
+	if err != nil {
+		return nil, err
+	}
+	s, err := d.secondary.Create(id)
+	if err != nil {
+		driver.Abort(p)
+		return nil, fmt.Errorf("error creating %s in secondary driver: %s", id, err)
+	}
+	return &wfile{primary: p, secondary: s}, nil
+}
+
+func (d *mirrorDriver) Open(id string) (driver.RFile, error) {
+	f, err := d.primary.Open(id)
+	if err != nil {
+		if sf, serr := d.secondary.Open(id); serr == nil {
+			return sf, nil
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+func (d *mirrorDriver) Remove(id string) error {
+	// The file might have been stored only in one of the
+	// drivers (e.g. before setting up the mirror), so removing
+	// it only fails when it can't be removed from any of them.
+	perr := d.primary.Remove(id)
+	serr := d.secondary.Remove(id)
+	if perr != nil && serr != nil {
+		return perr
+	}
+	return nil
+}
+
+func (d *mirrorDriver) Close() error {
+	perr := d.primary.Close()
+	serr := d.secondary.Close()
+	if perr != nil {
+		return perr
+	}
+	return serr
+}
+
+func (d *mirrorDriver) Iter() (driver.Iter, error) {
+	if iterable, ok := d.primary.(driver.Iterable); ok {
+		return iterable.Iter()
+	}
+	return nil, errNotIterable
+}
+
+func (d *mirrorDriver) Serve(w http.ResponseWriter, id string, rng driver.Range) (bool, error) {
+	if srv, ok := d.primary.(driver.Server); ok {
+		return srv.Serve(w, id, rng)
+	}
+	return false, nil
+}
+
+// IsNotExist implements driver.NotExistChecker. Since Open returns
+// the error from the primary driver, it's checked by the latter.
+func (d *mirrorDriver) IsNotExist(err error) bool {
+	return driver.IsNotExist(d.primary, err)
+}
+
+// Lock implements driver.Locker by acquiring the lock from the
+// primary driver.
+func (d *mirrorDriver) Lock(name string) (func() error, error) {
+	if locker, ok := d.primary.(driver.Locker); ok {
+		return locker.Lock(name)
+	}
+	return nil, driver.ErrLockNotHandled
+}
+
+type wfile struct {
+	primary   driver.WFile
+	secondary driver.WFile
+}
+
+func (w *wfile) Write(p []byte) (int, error) {
+	n, err := w.primary.Write(p)
+	if err != nil {
+		return n, err
+	}
+	if _, err := w.secondary.Write(p); err != nil {
+		return 0, fmt.Errorf("error writing to secondary driver: %s", err)
+	}
+	return n, nil
+}
+
+func (w *wfile) SetMetadata(meta []byte) error {
+	perr := w.primary.SetMetadata(meta)
+	serr := w.secondary.SetMetadata(meta)
+	// If any of the drivers doesn't handle metadata, the
+	// blobstore must store it in .meta files for both.
+	if perr == driver.ErrMetadataNotHandled || serr == driver.ErrMetadataNotHandled {
+		return driver.ErrMetadataNotHandled
+	}
+	if perr != nil {
+		return perr
+	}
+	return serr
+}
+
+func (w *wfile) Close() error {
+	perr := w.primary.Close()
+	serr := w.secondary.Close()
+	if perr != nil {
+		return perr
+	}
+	return serr
+}
+
+// Abort implements driver.Aborter by aborting the
+// file in both drivers.
+func (w *wfile) Abort() error {
+	perr := driver.Abort(w.primary)
+	serr := driver.Abort(w.secondary)
+	if perr != nil {
+		return perr
+	}
+	return serr
+}
+
+func openDriver(name string, u string) (driver.Driver, error) {
+	if u == "" {
+		return nil, fmt.Errorf("missing %s driver URL", name)
+	}
+	cfg, err := config.ParseURL(u)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s driver URL: %s", name, err)
+	}
+	if cfg.Scheme == "mirror" {
+		return nil, fmt.Errorf("%s driver can't be another mirror", name)
+	}
+	opener := driver.Get(cfg.Scheme)
+	if opener == nil {
+		return nil, fmt.Errorf("unknown %s driver %q. Perhaps you forgot an import?", name, cfg.Scheme)
+	}
+	drv, err := opener(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("error opening %s driver %q: %s", name, cfg.Scheme, err)
+	}
+	return drv, nil
+}
+
+func mirrorOpener(url *config.URL) (driver.Driver, error) {
+	primary, err := openDriver("primary", url.Query.Get("primary"))
+	if err != nil {
+		return nil, err
+	}
+	secondary, err := openDriver("secondary", url.Query.Get("secondary"))
+	if err != nil {
+		primary.Close()
+		return nil, err
+	}
+	return &mirrorDriver{primary: primary, secondary: secondary}, nil
+}
+
+func init() {
+	driver.Register("mirror", mirrorOpener)
+}
@@ -0,0 +1,163 @@
+package mirror
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"gnd.la/blobstore/driver"
+	_ "gnd.la/blobstore/driver/file"
+	"gnd.la/config"
+)
+
+func newTestDriver(t *testing.T) (*mirrorDriver, []driver.Driver, func()) {
+	var dirs []string
+	var drvs []driver.Driver
+	for ii := 0; ii < 2; ii++ {
+		dir, err := ioutil.TempDir("", "mirror-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dirs = append(dirs, dir)
+		drv, err := driver.Get("file")(config.MustParseURL("file://" + dir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		drvs = append(drvs, drv)
+	}
+	u := "mirror://?primary=" + url.QueryEscape("file://"+dirs[0]) + "&secondary=" + url.QueryEscape("file://"+dirs[1])
+	drv, err := mirrorOpener(config.MustParseURL(u))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return drv.(*mirrorDriver), drvs, func() {
+		drv.Close()
+		for _, v := range drvs {
+			v.Close()
+		}
+		for _, v := range dirs {
+			os.RemoveAll(v)
+		}
+	}
+}
+
+func writeFile(t *testing.T, drv driver.Driver, id string, data string) {
+	w, err := drv.Create(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(drv driver.Driver, id string) (string, error) {
+	f, err := drv.Open(id)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	b, err := ioutil.ReadAll(f)
+	return string(b), err
+}
+
+func TestMirror(t *testing.T) {
+	drv, drvs, done := newTestDriver(t)
+	defer done()
+	writeFile(t, drv, "mirrored", "gondola")
+	for ii, v := range drvs {
+		if s, err := readFile(v, "mirrored"); err != nil || s != "gondola" {
+			t.Errorf("expecting file in driver %d, got %q (error %v)", ii, s, err)
+		}
+	}
+	// Only in the secondary driver
+	writeFile(t, drvs[1], "secondary", "only")
+	if s, err := readFile(drv, "secondary"); err != nil || s != "only" {
+		t.Errorf("expecting fallback to secondary driver, got %q (error %v)", s, err)
+	}
+	_, err := drv.Open("missing")
+	if err == nil || !driver.IsNotExist(drv, err) {
+		t.Errorf("expecting not exist error, got %v", err)
+	}
+	for _, v := range []string{"mirrored", "secondary"} {
+		if err := drv.Remove(v); err != nil {
+			t.Errorf("error removing %s: %s", v, err)
+		}
+		for ii, d := range drvs {
+			if _, err := d.Open(v); err == nil {
+				t.Errorf("%s not removed from driver %d", v, ii)
+			}
+		}
+	}
+	if err := drv.Remove("missing"); err == nil {
+		t.Error("expecting an error removing a missing file")
+	}
+}
+
+func TestMirrorAbort(t *testing.T) {
+	drv, drvs, done := newTestDriver(t)
+	defer done()
+	writeFile(t, drv, "aborted", "previous")
+	w, err := drv.Create("aborted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("partial")); err != nil {
+		t.Fatal(err)
+	}
+	if err := driver.Abort(w); err != nil {
+		t.Fatal(err)
+	}
+	for ii, v := range drvs {
+		if s, err := readFile(v, "aborted"); err != nil || s != "previous" {
+			t.Errorf("expecting previous file in driver %d, got %q (error %v)", ii, s, err)
+		}
+	}
+}
+
+func TestMirrorLock(t *testing.T) {
+	drv, _, done := newTestDriver(t)
+	defer done()
+	unlock, err := drv.Lock("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	acquired := make(chan struct{})
+	go func() {
+		unlock, err := drv.Lock("test")
+		if err == nil {
+			unlock()
+		}
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("lock acquired twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := unlock(); err != nil {
+		t.Fatal(err)
+	}
+	<-acquired
+}
+
+func TestMirrorURL(t *testing.T) {
+	file := url.QueryEscape("file:///tmp")
+	invalid := []string{
+		"mirror://",
+		"mirror://?primary=" + file,
+		"mirror://?primary=" + file + "&secondary=" + url.QueryEscape("unknown:///tmp"),
+		"mirror://?primary=" + file + "&secondary=" + url.QueryEscape("mirror://"),
+	}
+	for _, v := range invalid {
+		if drv, err := mirrorOpener(config.MustParseURL(v)); err == nil {
+			drv.Close()
+			t.Errorf("expecting an error opening %s", v)
+		}
+	}
+}
@@ -14,6 +14,7 @@ import (
 	"gnd.la/config"
 	"launchpad.net/goamz/aws"
 	"launchpad.net/goamz/s3"
+	"net/http"
 	"strings"
 	"sync"
 )
@@ -82,6 +83,12 @@ func (d *s3Driver) Open(id string) (driver.RFile, error) {
 	return (*rfile)(bytes.NewReader(data)), nil
 }
 
+// IsNotExist implements driver.NotExistChecker.
+func (d *s3Driver) IsNotExist(err error) bool {
+	e, ok := err.(*s3.Error)
+	return ok && e.StatusCode == http.StatusNotFound
+}
+
 func (d *s3Driver) Remove(id string) error {
 	return d.bucket.Del(id)
 }
@@ -7,6 +7,7 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"time"
 
 	"gnd.la/blobstore/driver"
 )
@@ -20,6 +21,10 @@ var (
 	// does not match the expected value and the file is likely
 	// to be corrupted.
 	ErrInvalidDataHash = errors.New("the data hash is invalid")
+	// ErrInvalidDataLength indicates that the data length
+	// does not match the expected value and the file is likely
+	// to be corrupted.
+	ErrInvalidDataLength = errors.New("the data length is invalid")
 )
 
 // RFile represents a blobstore file opened
@@ -29,10 +34,12 @@ type RFile struct {
 	file         driver.RFile
 	store        *Blobstore
 	hasMeta      bool
+	flags        uint64
 	metadataData []byte
 	metadataHash uint64
 	dataLength   uint64
 	dataHash     uint64
+	created      time.Time
 }
 
 // Id returns the unique file identifier as a string.
@@ -100,10 +107,13 @@ func (r *RFile) Check() error {
 		return err
 	}
 	dh := newHash()
-	_, err = io.Copy(dh, r)
+	n, err := io.Copy(dh, r)
 	if err != nil {
 		return err
 	}
+	if uint64(n) != r.dataLength {
+		return ErrInvalidDataLength
+	}
 	if dh.Sum64() != r.dataHash {
 		return ErrInvalidDataHash
 	}
@@ -118,6 +128,17 @@ func (r *RFile) Size() (uint64, error) {
 	return r.dataLength, nil
 }
 
+// Created returns the time when the file was created. For files
+// created by older versions of Gondola, which didn't record it, the
+// time is derived from the id when it was automatically generated
+// (otherwise, the zero time.Time is returned).
+func (r *RFile) Created() (time.Time, error) {
+	if err := r.decodeMeta(); err != nil {
+		return time.Time{}, err
+	}
+	return r.created, nil
+}
+
 func (r *RFile) decodeMeta() error {
 	if !r.hasMeta {
 		if !r.store.drvNoMeta {
@@ -148,20 +169,42 @@ func (r *RFile) decodeMeta() error {
 	return nil
 }
 
+// openManifest replaces the underlying file with a manifestFile
+// if the file is stored as a manifest.
+func (r *RFile) openManifest() error {
+	if err := r.decodeMeta(); err != nil {
+		return err
+	}
+	if r.flags&flagManifest == 0 {
+		return nil
+	}
+	entries, err := readManifest(r.file)
+	if err != nil {
+		return err
+	}
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+	r.file = newManifestFile(r.store, entries)
+	return nil
+}
+
 func (r *RFile) readMeta(f io.Reader) error {
 	var err error
 	var version uint8
 	if err = bread(f, &version); err != nil {
 		return err
 	}
-	if version != 1 {
+	if version != 1 && version != metaVersion {
 		return fmt.Errorf("can't read metadata files with version %d", version)
 	}
-	// Skip over the flags for now
-	var flags uint64
-	if err = bread(f, &flags); err != nil {
+	if err = bread(f, &r.flags); err != nil {
 		return err
 	}
+	if version == 1 {
+		// Version 1 didn't include the creation time
+		r.flags &^= flagCreated
+	}
 	var metadataLength uint64
 	if err = bread(f, &metadataLength); err != nil {
 		return err
@@ -175,6 +218,15 @@ func (r *RFile) readMeta(f io.Reader) error {
 	if err = bread(f, &r.dataHash); err != nil {
 		return err
 	}
+	if r.flags&flagCreated != 0 {
+		var created int64
+		if err = bread(f, &created); err != nil {
+			return err
+		}
+		r.created = time.Unix(0, created)
+	} else {
+		r.created = idTime(r.id)
+	}
 	if metadataLength > 0 {
 		r.metadataData = make([]byte, int(metadataLength))
 		if _, err = io.ReadFull(f, r.metadataData); err != nil {
@@ -0,0 +1,146 @@
+package blobstore
+
+import (
+	"strings"
+	"time"
+)
+
+// FileInfo contains the information about a file stored
+// in the blobstore. Use Blobstore.Stat to obtain it.
+type FileInfo struct {
+	// Id is the file id.
+	Id string
+	// Size is the file data size, in bytes.
+	Size uint64
+	// Checksum is the FNV-1a 64 bit hash of the file data.
+	Checksum uint64
+	// Created is the time when the file was created. See
+	// RFile.Created for the files created by older versions
+	// of Gondola.
+	Created  time.Time
+	metadata []byte
+}
+
+// HasMeta returns true iff the file was stored
+// with non-empty metadata.
+func (f *FileInfo) HasMeta() bool {
+	return len(f.metadata) > 0
+}
+
+// GetMeta decodes the file metadata into the meta
+// argument, which must be a pointer. See RFile.GetMeta.
+func (f *FileInfo) GetMeta(meta interface{}) error {
+	if len(f.metadata) > 0 {
+		return unmarshal(f.metadata, meta)
+	}
+	return nil
+}
+
+// Stat returns the information about the file with the given id, including
+// its metadata. Its data is not read. Note that some drivers might need to
+// open the file in order to retrieve its metadata, but most of them (e.g.
+// the file driver) only need to read the small .meta file.
+func (s *Blobstore) Stat(id string) (*FileInfo, error) {
+	f, err := s.drv.Open(id)
+	if err != nil {
+		return nil, err
+	}
+	r := &RFile{id: id, file: f, store: s}
+	defer r.Close()
+	if err := r.decodeMeta(); err != nil {
+		return nil, err
+	}
+	return &FileInfo{
+		Id:       id,
+		Size:     r.dataLength,
+		Checksum: r.dataHash,
+		Created:  r.created,
+		metadata: r.metadataData,
+	}, nil
+}
+
+// Filter specifies the files returned by Blobstore.IterFilter. Zero
+// fields are ignored, so an empty Filter matches all the files.
+type Filter struct {
+	// Prefix restricts the files to the ones with
+	// ids starting with the given string.
+	Prefix string
+	// Start restricts the files to the ones with ids
+	// greater or equal than Start.
+	Start string
+	// End restricts the files to the ones with
+	// ids lower than End.
+	End string
+	// CreatedAfter restricts the files to the ones
+	// created at or after the given time.
+	CreatedAfter time.Time
+	// CreatedBefore restricts the files to the ones
+	// created before the given time.
+	CreatedBefore time.Time
+}
+
+func (f *Filter) matchesId(id string) bool {
+	return strings.HasPrefix(id, f.Prefix) &&
+		(f.Start == "" || id >= f.Start) &&
+		(f.End == "" || id < f.End)
+}
+
+func (f *Filter) hasTime() bool {
+	return !f.CreatedAfter.IsZero() || !f.CreatedBefore.IsZero()
+}
+
+func (f *Filter) matchesTime(t time.Time) bool {
+	return (f.CreatedAfter.IsZero() || !t.Before(f.CreatedAfter)) &&
+		(f.CreatedBefore.IsZero() || t.Before(f.CreatedBefore))
+}
+
+// IterFilter works like Iter, but only returns the files matched by the
+// given Filter (which might be nil, to return all of them). Files are
+// filtered by id without accessing them, while filtering by creation time
+// requires calling Stat for the files which match the id criteria. As with
+// Iter, iteration order is undefined.
+func (s *Blobstore) IterFilter(filter *Filter) (Iter, error) {
+	iter, err := s.Iter()
+	if err != nil || filter == nil {
+		return iter, err
+	}
+	return &filterIter{Iter: iter, store: s, filter: *filter}, nil
+}
+
+type filterIter struct {
+	Iter
+	store  *Blobstore
+	filter Filter
+	err    error
+}
+
+func (i *filterIter) Next(id *string) bool {
+	var cur string
+	for i.err == nil && i.Iter.Next(&cur) {
+		if !i.filter.matchesId(cur) {
+			continue
+		}
+		if i.filter.hasTime() {
+			info, err := i.store.Stat(cur)
+			if err != nil {
+				i.err = err
+				return false
+			}
+			if !i.filter.matchesTime(info.Created) {
+				continue
+			}
+		}
+		if id != nil {
+			*id = cur
+		}
+		return true
+	}
+	return false
+}
+
+func (i *filterIter) Err() error {
+	if i.err != nil {
+		return i.err
+	}
+	return i.Iter.Err()
+}
@@ -1,20 +1,24 @@
 package blobstore
 
 import (
+	"bytes"
 	"fmt"
 	"hash/adler32"
 	"io"
 	"io/ioutil"
 	"math/rand"
 	"net"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	_ "gnd.la/blobstore/driver/file"
 	_ "gnd.la/blobstore/driver/gridfs"
 	_ "gnd.la/blobstore/driver/leveldb"
+	_ "gnd.la/blobstore/driver/mirror"
 	_ "gnd.la/blobstore/driver/s3"
 	"gnd.la/config"
 )
@@ -267,3 +271,731 @@ func benchmarkDriver(b *testing.B, drv string, size int, mode int, f func(int) [
 		}
 	}
 }
+
+func TestDedup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pool-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := New(config.MustParseURL("file://" + dir + "#dedup=1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	data := make([]byte, 4*dataSize)
+	rand.Read(data)
+	// Same data with a few bytes inserted in the middle
+	mid := len(data) / 2
+	similar := append(append(append([]byte(nil), data[:mid]...), "gondola"...), data[mid:]...)
+	id1, err := store.Store(data, &Meta{Foo: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks := countChunks(t, dir)
+	id2, err := store.Store(similar, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	added := countChunks(t, dir) - chunks
+	if added == 0 || added > 3 {
+		t.Errorf("expecting 1-3 new chunks for similar data, got %d", added)
+	}
+	for _, v := range []struct {
+		id   string
+		data []byte
+	}{{id1, data}, {id2, similar}} {
+		f, err := store.Open(v.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Check(); err != nil {
+			t.Errorf("error checking %s: %s", v.id, err)
+		}
+		b, err := f.ReadAll()
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, v.data) {
+			t.Errorf("invalid data read from %s", v.id)
+		}
+	}
+	iter, err := store.Iter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var id string
+	var ids []string
+	for iter.Next(&id) {
+		ids = append(ids, id)
+	}
+	iter.Close()
+	if len(ids) != 2 {
+		t.Errorf("expecting 2 files from Iter, got %v", ids)
+	}
+	if err := store.Remove(id1); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := store.ReadAll(id2); err != nil || !bytes.Equal(b, similar) {
+		t.Errorf("error reading %s after removing %s: %v", id2, id1, err)
+	}
+	if err := store.Remove(id2); err != nil {
+		t.Fatal(err)
+	}
+	if c := countChunks(t, dir); c != 0 {
+		t.Errorf("expecting no chunks after removing all files, got %d", c)
+	}
+}
+
+func TestDedupAbandoned(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pool-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := New(config.MustParseURL("file://" + dir + "#dedup=1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	data := make([]byte, 4*dataSize)
+	rand.Read(data)
+	id, err := store.Store(data, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks := countChunks(t, dir)
+	// Shares all the chunks with id
+	w, err := store.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.chunker.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// Simulate the finalizer running for a WFile which
+	// was never closed.
+	w.abandon()
+	if c := countChunks(t, dir); c != chunks {
+		t.Errorf("expecting %d chunks after abandoning a file, got %d", chunks, c)
+	}
+	if err := store.Remove(id); err != nil {
+		t.Fatal(err)
+	}
+	if c := countChunks(t, dir); c != 0 {
+		t.Errorf("expecting no chunks after removing all files, got %d", c)
+	}
+}
+
+func TestDedupConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pool-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := make([]byte, 2*dataSize)
+	rand.Read(data)
+	// Use a Blobstore per goroutine, so only the
+	// driver lock protects the reference counts.
+	const count = 4
+	ids := make(chan string, count)
+	errs := make(chan error, count)
+	for ii := 0; ii < count; ii++ {
+		store, err := New(config.MustParseURL("file://" + dir + "#dedup=1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer store.Close()
+		go func() {
+			id, err := store.Store(data, nil)
+			ids <- id
+			errs <- err
+		}()
+	}
+	store, err := New(config.MustParseURL("file://" + dir + "#dedup=1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	for ii := 0; ii < count; ii++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Remove(<-ids); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if c := countChunks(t, dir); c != 0 {
+		t.Errorf("expecting no chunks after removing all files, got %d", c)
+	}
+}
+
+func TestReadManifest(t *testing.T) {
+	entries := []manifestEntry{{Size: 1}, {Size: 2}}
+	var buf bytes.Buffer
+	if err := writeManifest(&buf, entries); err != nil {
+		t.Fatal(err)
+	}
+	read, err := readManifest(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != len(entries) {
+		t.Fatalf("expecting %d entries, got %d", len(entries), len(read))
+	}
+	// Corrupt the entry count
+	b := buf.Bytes()
+	for ii := 1; ii < 9; ii++ {
+		b[ii] = 0xff
+	}
+	if _, err := readManifest(bytes.NewReader(b)); err == nil {
+		t.Error("expecting an error when reading a manifest with an invalid entry count")
+	}
+}
+
+func countChunks(t *testing.T, dir string) int {
+	count := 0
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(info.Name(), chunkPrefix) && filepath.Ext(path) != ".meta" {
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestStat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pool-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := New(config.MustParseURL("file://" + dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	before := time.Now()
+	data := []byte("gondola blobstore")
+	for _, v := range []string{"user-1-avatar", "user-2-avatar", "user-2-upload"} {
+		if _, err := store.StoreId(v, data, &Meta{Foo: len(v)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	info, err := store.Stat("user-1-avatar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newHash()
+	h.Write(data)
+	if info.Size != uint64(len(data)) || info.Checksum != h.Sum64() {
+		t.Errorf("invalid size or checksum %d/%d, want %d/%d", info.Size, info.Checksum, len(data), h.Sum64())
+	}
+	if info.Created.Before(before) || info.Created.After(time.Now()) {
+		t.Errorf("invalid creation time %v", info.Created)
+	}
+	var m Meta
+	if err := info.GetMeta(&m); err != nil || m.Foo != len("user-1-avatar") {
+		t.Errorf("invalid metadata %+v (error %v)", m, err)
+	}
+	filters := []struct {
+		filter   *Filter
+		expected int
+	}{
+		{nil, 3},
+		{&Filter{Prefix: "user-2-"}, 2},
+		{&Filter{Start: "user-1-avatar", End: "user-2-upload"}, 2},
+		{&Filter{CreatedAfter: before}, 3},
+		{&Filter{Prefix: "user-1-", CreatedBefore: before}, 0},
+	}
+	for _, v := range filters {
+		iter, err := store.IterFilter(v.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		count := 0
+		for iter.Next(nil) {
+			count++
+		}
+		if err := iter.Err(); err != nil {
+			t.Error(err)
+		}
+		iter.Close()
+		if count != v.expected {
+			t.Errorf("expecting %d files with filter %+v, got %d", v.expected, v.filter, count)
+		}
+	}
+}
+
+func TestReadMetaVersion1(t *testing.T) {
+	// Version 1 files might have bit 1 set in flags, since
+	// it was reserved, but they don't include the creation time.
+	var buf bytes.Buffer
+	for _, v := range []interface{}{uint8(1), uint64(flagCreated), uint64(0), uint64(0), uint64(3), uint64(42)} {
+		if err := bwrite(&buf, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := &RFile{id: "not-a-bson-id"}
+	if err := r.readMeta(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if r.dataLength != 3 || r.dataHash != 42 {
+		t.Errorf("expecting data length 3 and hash 42, got %d and %d", r.dataLength, r.dataHash)
+	}
+	if !r.created.IsZero() {
+		t.Errorf("expecting zero creation time for version 1 file, got %v", r.created)
+	}
+	buf.Reset()
+	buf.WriteByte(metaVersion + 1)
+	if err := r.readMeta(&buf); err == nil {
+		t.Errorf("expecting an error when reading metadata with version %d", metaVersion+1)
+	}
+}
+
+func fileStorePath(dir string, id string) string {
+	ext := filepath.Ext(id)
+	id = id[:len(id)-len(ext)]
+	return filepath.Join(dir, id[len(id)-2:], id[:len(id)-2]+ext)
+}
+
+func TestCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pool-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := New(config.MustParseURL("file://" + dir + "#dedup=1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	data := randData(dataSize)
+	var ids []string
+	contents := make(map[string][]byte)
+	for ii := 0; ii < 4; ii++ {
+		b := append(append([]byte(nil), data...), byte(ii))
+		id, err := store.Store(b, &Meta{Foo: ii})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+		contents[id] = b
+	}
+	for _, v := range ids {
+		if err := store.Verify(v); err != nil {
+			t.Errorf("error verifying %s: %s", v, err)
+		}
+	}
+	if issues, err := store.Check(); err != nil || len(issues) != 0 {
+		t.Fatalf("expecting no issues, got %v (error %v)", issues, err)
+	}
+	// Corrupt ids[0], remove the .meta for ids[1], remove the data for
+	// ids[2] (leaving its .meta and chunks orphaned)
+	p := fileStorePath(dir, ids[0])
+	manifest, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest[len(manifest)-1]++
+	if err := ioutil.WriteFile(p, manifest, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Verify(ids[0]); err == nil {
+		t.Errorf("expecting an error verifying corrupted file %s", ids[0])
+	}
+	if err := os.Remove(fileStorePath(dir, ids[1]+".meta")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(fileStorePath(dir, ids[2])); err != nil {
+		t.Fatal(err)
+	}
+	issues, err := store.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := make(map[IssueType][]string)
+	for _, v := range issues {
+		t.Log(v)
+		found[v.Type] = append(found[v.Type], v.Id)
+	}
+	if c := found[IssueCorrupted]; len(c) != 1 || c[0] != ids[0] {
+		t.Errorf("expecting %s as corrupted, got %v", ids[0], c)
+	}
+	if m := found[IssueMissingMeta]; len(m) != 1 || m[0] != ids[1] {
+		t.Errorf("expecting %s with missing meta, got %v", ids[1], m)
+	}
+	if o := found[IssueOrphanedMeta]; len(o) != 1 || o[0] != ids[2]+".meta" {
+		t.Errorf("expecting %s.meta as orphaned, got %v", ids[2], o)
+	}
+	// ids[2] should have its last chunk orphaned and the
+	// rest of them should have wrong reference counts.
+	if len(found[IssueOrphanedChunk]) == 0 || len(found[IssueInvalidRefCount]) == 0 {
+		t.Errorf("expecting orphaned chunks and invalid reference counts, got %v", issues)
+	}
+	quarantine, err := ioutil.TempDir("", "pool-quarantine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(quarantine)
+	for _, v := range issues {
+		if v.Repairable() {
+			if err := store.Repair(v); err != nil {
+				t.Errorf("error repairing %s: %s", v, err)
+			}
+		} else if err := store.Quarantine(v.Id, quarantine); err != nil {
+			t.Errorf("error quarantining %s: %s", v, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(quarantine, ids[0])); err != nil {
+		t.Errorf("quarantined file not found: %s", err)
+	}
+	// Quarantining ids[0] left its chunks with wrong
+	// counts, so fix them and check again.
+	issues, err = store.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range issues {
+		if v.Type == IssueCorrupted || v.Type == IssueMissingMeta || v.Type == IssueOrphanedMeta {
+			t.Errorf("unexpected issue after repair: %s", v)
+		}
+		if err := store.Repair(v); err != nil {
+			t.Errorf("error repairing %s: %s", v, err)
+		}
+	}
+	if issues, err := store.Check(); err != nil || len(issues) != 0 {
+		t.Errorf("expecting no issues after repair, got %v (error %v)", issues, err)
+	}
+	if err := store.Verify(ids[1]); err != nil {
+		t.Errorf("error verifying repaired file %s: %s", ids[1], err)
+	}
+	// Files which were not corrupted must preserve their data. The
+	// metadata of ids[1] was lost with its .meta file.
+	for _, v := range ids[1:] {
+		if v == ids[2] {
+			if _, err := store.Open(v); err == nil {
+				t.Errorf("expecting an error opening removed file %s", v)
+			}
+			continue
+		}
+		f, err := store.Open(v)
+		if err != nil {
+			t.Errorf("error opening %s after repair: %s", v, err)
+			continue
+		}
+		b, err := f.ReadAll()
+		f.Close()
+		if err != nil || !bytes.Equal(b, contents[v]) {
+			t.Errorf("invalid data for %s after repair (error %v)", v, err)
+		}
+	}
+}
+
+func TestRepairChanged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pool-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := New(config.MustParseURL("file://" + dir + "#dedup=1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	data := randData(dataSize)
+	id, err := store.Store(data, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Leave the chunks orphaned
+	if err := os.Remove(fileStorePath(dir, id)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(fileStorePath(dir, id+".meta")); err != nil {
+		t.Fatal(err)
+	}
+	issues, err := store.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(issues) == 0 {
+		t.Fatal("expecting orphaned chunks")
+	}
+	for _, v := range issues {
+		if v.Type != IssueOrphanedChunk {
+			t.Fatalf("expecting only orphaned chunks, got %s", v)
+		}
+	}
+	// Storing the same data again reuses the orphaned
+	// chunks, so the issues don't apply anymore.
+	id2, err := store.Store(data, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range issues {
+		if err := store.Repair(v); err != nil {
+			t.Errorf("error repairing %s: %s", v, err)
+		}
+	}
+	if err := store.Verify(id2); err != nil {
+		t.Errorf("chunks removed while being used by %s: %s", id2, err)
+	}
+	// Now the stored reference counts are too high
+	issues, err = store.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(issues) == 0 {
+		t.Fatal("expecting invalid reference counts")
+	}
+	// Reference counts change when the file is removed
+	if err := store.Remove(id2); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range issues {
+		if v.Type != IssueInvalidRefCount {
+			t.Fatalf("expecting only invalid reference counts, got %s", v)
+		}
+		if err := store.Repair(v); err != nil {
+			t.Errorf("error repairing %s: %s", v, err)
+		}
+	}
+	// The chunks are still orphaned, since the stale
+	// issues were not repaired.
+	issues, err = store.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range issues {
+		if v.Type != IssueOrphanedChunk {
+			t.Errorf("expecting only orphaned chunks, got %s", v)
+		}
+		if err := store.Repair(v); err != nil {
+			t.Errorf("error repairing %s: %s", v, err)
+		}
+	}
+	if issues, err := store.Check(); err != nil || len(issues) != 0 {
+		t.Errorf("expecting no issues after repair, got %v (error %v)", issues, err)
+	}
+}
+
+func TestCopy(t *testing.T) {
+	srcDir, err := ioutil.TempDir("", "pool-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+	dstDir, err := ioutil.TempDir("", "pool-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dstDir)
+	src, err := New(config.MustParseURL("file://" + srcDir + "#dedup=1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	dst, err := New(config.MustParseURL("file://" + dstDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	data := randData(dataSize)
+	var ids []string
+	for ii := 0; ii < 4; ii++ {
+		id, err := src.Store(append(data, byte(ii)), &Meta{Foo: ii})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	// Simulate an interrupted copy by copying one file first
+	res, err := Copy(src, dst, &CopyOptions{Filter: &Filter{Prefix: ids[0]}})
+	if err != nil || res.Copied != 1 {
+		t.Fatalf("expecting 1 copied file, got %+v (error %v)", res, err)
+	}
+	res, err = Copy(src, dst, &CopyOptions{Verify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Copied != len(ids)-1 || res.Skipped != 1 {
+		t.Errorf("expecting %d copied and 1 skipped, got %+v", len(ids)-1, res)
+	}
+	for ii, v := range ids {
+		srcInfo, err := src.Stat(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := dst.Stat(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var m Meta
+		if err := info.GetMeta(&m); err != nil || m.Foo != ii {
+			t.Errorf("invalid metadata for %s %+v (error %v)", v, m, err)
+		}
+		if info.Checksum != srcInfo.Checksum || !info.Created.Equal(srcInfo.Created) {
+			t.Errorf("copied file %s has different checksum or creation time", v)
+		}
+	}
+	// Corrupted files must not be copied
+	for _, v := range []string{ids[1], ids[1] + ".meta"} {
+		if err := os.Remove(fileStorePath(dstDir, v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p := fileStorePath(srcDir, ids[1])
+	manifest, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest[len(manifest)-1]++
+	if err := ioutil.WriteFile(p, manifest, 0644); err != nil {
+		t.Fatal(err)
+	}
+	res, err = Copy(src, dst, &CopyOptions{KeepGoing: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Copied != 0 || res.Skipped != len(ids)-1 || res.Failed[ids[1]] == nil {
+		t.Errorf("expecting %s to fail, got %+v", ids[1], res)
+	}
+	if _, err := dst.Stat(ids[1]); err == nil {
+		t.Errorf("corrupted file %s was copied", ids[1])
+	}
+}
+
+func TestCopyOverwrite(t *testing.T) {
+	srcDir, err := ioutil.TempDir("", "pool-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+	dstDir, err := ioutil.TempDir("", "pool-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dstDir)
+	src, err := New(config.MustParseURL("file://" + srcDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	dst, err := New(config.MustParseURL("file://" + dstDir + "#dedup=1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	const id = "copy-overwrite"
+	data := make([]byte, 2*dataSize)
+	rand.Read(data)
+	prev := make([]byte, 2*dataSize)
+	rand.Read(prev)
+	if _, err := src.StoreId(id, data, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dst.StoreId(id, prev, nil); err != nil {
+		t.Fatal(err)
+	}
+	chunks := countChunks(t, dstDir)
+	// Corrupt the source data, so the copy fails
+	// after writing it to the destination.
+	p := fileStorePath(srcDir, id)
+	corrupted := append([]byte(nil), data...)
+	corrupted[len(corrupted)/2]++
+	if err := ioutil.WriteFile(p, corrupted, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Copy(src, dst, nil); err == nil {
+		t.Fatal("expecting an error copying a corrupted file")
+	}
+	if b, err := dst.ReadAll(id); err != nil || !bytes.Equal(b, prev) {
+		t.Errorf("failed copy modified the destination file (error %v)", err)
+	}
+	if c := countChunks(t, dstDir); c != chunks {
+		t.Errorf("expecting %d chunks after a failed copy, got %d", chunks, c)
+	}
+	if err := ioutil.WriteFile(p, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := Copy(src, dst, nil); err != nil || res.Copied != 1 {
+		t.Fatalf("expecting 1 copied file, got %+v (error %v)", res, err)
+	}
+	if b, err := dst.ReadAll(id); err != nil || !bytes.Equal(b, data) {
+		t.Errorf("invalid data after overwriting %s (error %v)", id, err)
+	}
+	// The chunks from the overwritten file must be released
+	if err := dst.Remove(id); err != nil {
+		t.Fatal(err)
+	}
+	if c := countChunks(t, dstDir); c != 0 {
+		t.Errorf("expecting no chunks after removing all files, got %d", c)
+	}
+}
+
+func TestMirror(t *testing.T) {
+	var dirs []string
+	for ii := 0; ii < 2; ii++ {
+		dir, err := ioutil.TempDir("", "pool-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		dirs = append(dirs, dir)
+	}
+	u := fmt.Sprintf("mirror://?primary=%s&secondary=%s", url.QueryEscape("file://"+dirs[0]), url.QueryEscape("file://"+dirs[1]))
+	store, err := New(config.MustParseURL(u))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	data := []byte("gondola blobstore")
+	id, err := store.Store(data, &Meta{Foo: 42})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range dirs {
+		for _, v := range []string{id, id + ".meta"} {
+			if _, err := os.Stat(fileStorePath(dir, v)); err != nil {
+				t.Errorf("file not mirrored: %s", err)
+			}
+		}
+	}
+	// Remove the file from the primary, it should be
+	// read from the secondary.
+	for _, v := range []string{id, id + ".meta"} {
+		if err := os.Remove(fileStorePath(dirs[0], v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, err := store.Open(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m Meta
+	if err := f.GetMeta(&m); err != nil || m.Foo != 42 {
+		t.Errorf("invalid metadata %+v (error %v)", m, err)
+	}
+	b, err := f.ReadAll()
+	f.Close()
+	if err != nil || !bytes.Equal(b, data) {
+		t.Errorf("invalid data %q (error %v)", b, err)
+	}
+	if err := store.Remove(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(fileStorePath(dirs[1], id)); !os.IsNotExist(err) {
+		t.Errorf("file not removed from the secondary store")
+	}
+}
@@ -4,7 +4,10 @@ import (
 	"bytes"
 	"hash"
 	"io"
+	"runtime"
+	"time"
 
+	"gnd.la/blobstore/chunk"
 	"gnd.la/blobstore/driver"
 )
 
@@ -18,6 +21,15 @@ type WFile struct {
 	dataLength uint64
 	store      *Blobstore
 	closed     bool
+	flags      uint64
+	created    time.Time
+	// Encoded metadata, used by Copy for
+	// preserving it without decoding it.
+	rawMeta []byte
+	// Only used in deduplicating mode
+	chunker chunk.Chunker
+	chunks  *chunkWriter
+	prev    []manifestEntry
 }
 
 // Id returns the unique file identifier as a string.
@@ -30,6 +42,9 @@ func (w *WFile) Id() string {
 func (w *WFile) Write(p []byte) (int, error) {
 	w.dataHash.Write(p)
 	w.dataLength += uint64(len(p))
+	if w.chunker != nil {
+		return w.chunker.Write(p)
+	}
 	return w.file.Write(p)
 }
 
@@ -41,13 +56,78 @@ func (w *WFile) SetMeta(meta interface{}) error {
 // Close closes the file. Once the file is closed, it
 // might not be used again.
 func (w *WFile) Close() error {
-	if !w.closed {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	if w.chunker == nil {
 		if err := w.putMeta(); err != nil {
 			return err
 		}
 		return w.file.Close()
 	}
-	return nil
+	runtime.SetFinalizer(w, nil)
+	if err := w.finish(); err != nil {
+		// The file was not written, so the chunks it
+		// referenced won't be used. Note that the previous
+		// version of the file, if any, is kept by the driver,
+		// so its chunks must not be released.
+		w.releaseChunks()
+		return err
+	}
+	// The file was overwritten, release
+	// the chunks used by its previous version.
+	return w.store.releaseChunks(w.prev)
+}
+
+func (w *WFile) finish() error {
+	if err := w.writeManifest(); err != nil {
+		return err
+	}
+	if err := w.putMeta(); err != nil {
+		return err
+	}
+	return w.file.Close()
+}
+
+// releaseChunks releases the chunks stored by this file
+// when it's not going to be written. Chunks which can't be
+// released are reported as orphaned by Blobstore.Check.
+func (w *WFile) releaseChunks() {
+	w.store.releaseChunks(w.chunks.manifest)
+	w.chunks.manifest = nil
+}
+
+// abort discards the file without storing it, releasing the
+// chunks it stored in deduplicating mode.
+func (w *WFile) abort() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	if w.chunker != nil {
+		runtime.SetFinalizer(w, nil)
+		w.releaseChunks()
+	}
+	return driver.Abort(w.file)
+}
+
+// abandon is used as a finalizer for the WFile instances
+// in deduplicating mode which are never closed (e.g. because
+// there was an error while writing them).
+func (w *WFile) abandon() {
+	if !w.closed {
+		w.closed = true
+		w.releaseChunks()
+	}
+}
+
+func (w *WFile) writeManifest() error {
+	if err := w.chunker.Flush(); err != nil {
+		return err
+	}
+	w.flags |= flagManifest
+	return writeManifest(w.file, w.chunks.manifest)
 }
 
 func (w *WFile) putMeta() error {
@@ -78,21 +158,25 @@ func (w *WFile) putMeta() error {
 func (w *WFile) writeMeta(out io.Writer) error {
 	var err error
 	// Write version number
-	if err = bwrite(out, uint8(1)); err != nil {
+	if err = bwrite(out, uint8(metaVersion)); err != nil {
 		return err
 	}
 	// Write flags
-	if err = bwrite(out, uint64(0)); err != nil {
+	if err = bwrite(out, w.flags|flagCreated); err != nil {
 		return err
 	}
 	var metadata []byte
 	metadataLength := uint64(0)
 	metadataHash := uint64(0)
-	if w.meta != nil && !isNil(w.meta) {
+	if w.rawMeta != nil {
+		metadata = w.rawMeta
+	} else if w.meta != nil && !isNil(w.meta) {
 		metadata, err = marshal(w.meta)
 		if err != nil {
 			return err
 		}
+	}
+	if len(metadata) > 0 {
 		metadataLength = uint64(len(metadata))
 		h := newHash()
 		h.Write(metadata)
@@ -112,6 +196,10 @@ func (w *WFile) writeMeta(out io.Writer) error {
 	if err := bwrite(out, w.dataHash.Sum64()); err != nil {
 		return err
 	}
+	// Creation time
+	if err := bwrite(out, w.created.UnixNano()); err != nil {
+		return err
+	}
 	if len(metadata) > 0 {
 		if _, err := out.Write(metadata); err != nil {
 			return err
@@ -6,6 +6,7 @@ import (
 	"reflect"
 	"strings"
 
+	"gnd.la/app/metrics"
 	"gnd.la/app/profile"
 	"gnd.la/cache/driver"
 	"gnd.la/config"
@@ -16,6 +17,7 @@ import (
 
 var (
 	ErrNotFound = errors.New("item not found in cache")
+	cacheGets   = metrics.Default.NewCounter("gondola_cache_gets_total", "Number of cache lookups, by result (hit or miss)", "result")
 	imports     = map[string]string{
 		"memcache": "gnd.la/cache/driver/memcache",
 		"redis":    "gnd.la/cache/driver/redis",
@@ -33,6 +35,7 @@ type Cache struct {
 	driver    driver.Driver
 	codec     *codec.Codec
 	pipe      *pipe.Pipe
+	flight    flightGroup
 }
 
 func (c *Cache) backendKey(key string) string {
@@ -75,13 +78,16 @@ func (c *Cache) Get(key string, obj interface{}) error {
 	if err != nil {
 		return err
 	}
-	cerr := c.codec.Decode(b, obj)
-	if cerr != nil {
+	return c.decode(key, b, obj)
+}
+
+func (c *Cache) decode(key string, b []byte, obj interface{}) error {
+	if err := c.codec.Decode(b, obj); err != nil {
 		derr := &cacheError{
 			op:    "decoding object",
 			key:   key,
 			codec: true,
-			err:   cerr,
+			err:   err,
 		}
 		c.error(derr)
 		return derr
@@ -139,12 +145,18 @@ func (c *Cache) GetMulti(out map[string]interface{}, typer Typer) error {
 	if typer == nil {
 		typer = mapTyper(out)
 	}
-	for ii, k := range keys {
-		value := data[qkeys[ii]]
+	values, err := c.decodeMulti(keys, qkeys, data)
+	if err != nil {
+		return err
+	}
+	hits := 0
+	for _, k := range keys {
+		value := values[k]
 		if value == nil {
 			delete(out, k)
 			continue
 		}
+		hits++
 		typ := typer.Type(k)
 		if typ == nil {
 			derr := &cacheError{
@@ -168,6 +180,8 @@ func (c *Cache) GetMulti(out map[string]interface{}, typer Typer) error {
 		}
 		out[k] = val.Elem().Interface()
 	}
+	cacheGets.Add(float64(hits), "hit")
+	cacheGets.Add(float64(len(keys)-hits), "miss")
 	return nil
 }
 
@@ -206,6 +220,282 @@ func (c *Cache) SetBytes(key string, b []byte, timeout int) error {
 	return nil
 }
 
+// Add stores the given object in the cache only if there's no
+// item associated with the given key, atomically. The returned
+// boolean indicates if the object was stored. If the cache driver
+// doesn't support this operation, an error wrapping
+// driver.ErrNotImplemented is returned. See the documentation for
+// Set for an explanation of the timeout parameter.
+func (c *Cache) Add(key string, object interface{}, timeout int) (bool, error) {
+	if profile.On && profile.Profiling() {
+		defer profile.Start(cache).Note("ADD", key).End()
+	}
+	adder, ok := c.driver.(driver.Adder)
+	if !ok {
+		return false, c.notImplemented("adding key", key)
+	}
+	b, err := c.encode(key, object)
+	if err != nil {
+		return false, err
+	}
+	added, err := adder.Add(c.backendKey(key), b, timeout)
+	if err != nil {
+		return false, c.opError("adding key", key, err)
+	}
+	return added, nil
+}
+
+// Replace stores the given object in the cache only if there's
+// already an item associated with the given key, atomically. The
+// returned boolean indicates if the object was stored. If the cache
+// driver doesn't support this operation, an error wrapping
+// driver.ErrNotImplemented is returned.
+func (c *Cache) Replace(key string, object interface{}, timeout int) (bool, error) {
+	if profile.On && profile.Profiling() {
+		defer profile.Start(cache).Note("REPLACE", key).End()
+	}
+	replacer, ok := c.driver.(driver.Replacer)
+	if !ok {
+		return false, c.notImplemented("replacing key", key)
+	}
+	b, err := c.encode(key, object)
+	if err != nil {
+		return false, err
+	}
+	replaced, err := replacer.Replace(c.backendKey(key), b, timeout)
+	if err != nil {
+		return false, c.opError("replacing key", key, err)
+	}
+	return replaced, nil
+}
+
+// Increment atomically increments the counter associated with the given key
+// by delta, returning its new value. If the counter doesn't exist, it's
+// created with an initial value of zero and the given timeout, which is
+// ignored for existing counters. Counters are stored as their decimal
+// representation, without using the codec nor the pipe, so they can't
+// be retrieved with Get. Use Increment with a zero delta to retrieve the
+// current value. Note that some drivers (e.g. memcache) don't support
+// negative values and clamp them to zero. If the cache driver doesn't
+// support this operation, an error wrapping driver.ErrNotImplemented is
+// returned.
+func (c *Cache) Increment(key string, delta int64, timeout int) (int64, error) {
+	if profile.On && profile.Profiling() {
+		defer profile.Start(cache).Note("INCREMENT", key).End()
+	}
+	counter, ok := c.driver.(driver.Counter)
+	if !ok {
+		return 0, c.notImplemented("incrementing key", key)
+	}
+	val, err := counter.Increment(c.backendKey(key), delta, timeout)
+	if err != nil {
+		return 0, c.opError("incrementing key", key, err)
+	}
+	return val, nil
+}
+
+// Decrement works like Increment, but decrements the
+// counter by delta. See Increment for more details.
+func (c *Cache) Decrement(key string, delta int64, timeout int) (int64, error) {
+	if profile.On && profile.Profiling() {
+		defer profile.Start(cache).Note("DECREMENT", key).End()
+	}
+	counter, ok := c.driver.(driver.Counter)
+	if !ok {
+		return 0, c.notImplemented("decrementing key", key)
+	}
+	val, err := counter.Decrement(c.backendKey(key), delta, timeout)
+	if err != nil {
+		return 0, c.opError("decrementing key", key, err)
+	}
+	return val, nil
+}
+
+// CASToken represents the version of an item
+// retrieved with GetCAS. See CompareAndSwap.
+type CASToken struct {
+	key   string
+	token driver.CASToken
+}
+
+// GetCAS works like Get, but also returns a token which might be
+// passed to CompareAndSwap to update the item only if it hasn't
+// been modified since it was retrieved. If the cache driver
+// doesn't support this operation, an error wrapping
+// driver.ErrNotImplemented is returned.
+func (c *Cache) GetCAS(key string, obj interface{}) (*CASToken, error) {
+	if profile.On && profile.Profiling() {
+		defer profile.Start(cache).Note("GET CAS", key).End()
+	}
+	caser, ok := c.driver.(driver.CASer)
+	if !ok {
+		return nil, c.notImplemented("getting key", key)
+	}
+	b, token, err := caser.GetCAS(c.backendKey(key))
+	if err != nil {
+		return nil, c.opError("getting key", key, err)
+	}
+	if b != nil {
+		if b, err = c.decodeBytes(key, b); err != nil {
+			return nil, err
+		}
+	}
+	if b == nil {
+		cacheGets.Inc("miss")
+		return nil, ErrNotFound
+	}
+	cacheGets.Inc("hit")
+	if err := c.decode(key, b, obj); err != nil {
+		return nil, err
+	}
+	return &CASToken{key: key, token: token}, nil
+}
+
+// CompareAndSwap stores the given object associated with the given key
+// only if the item hasn't been modified since the token was obtained
+// using GetCAS. The returned boolean indicates if the object was stored.
+// Callers usually retry the GetCAS and CompareAndSwap sequence until
+// the latter succeeds.
+func (c *Cache) CompareAndSwap(key string, object interface{}, token *CASToken, timeout int) (bool, error) {
+	if profile.On && profile.Profiling() {
+		defer profile.Start(cache).Note("CAS", key).End()
+	}
+	caser, ok := c.driver.(driver.CASer)
+	if !ok {
+		return false, c.notImplemented("swapping key", key)
+	}
+	if token == nil || token.key != key {
+		return false, c.opError("swapping key", key, errors.New("invalid CAS token"))
+	}
+	b, err := c.encode(key, object)
+	if err != nil {
+		return false, err
+	}
+	swapped, err := caser.CompareAndSwap(c.backendKey(key), b, token.token, timeout)
+	if err != nil {
+		return false, c.opError("swapping key", key, err)
+	}
+	return swapped, nil
+}
+
+// SetMulti stores all the given objects, associated with their keys,
+// with only one trip to the cache when the driver supports it. Otherwise,
+// the objects are stored one by one. See Set for an explanation of the
+// timeout parameter.
+func (c *Cache) SetMulti(items map[string]interface{}, timeout int) error {
+	if len(items) == 0 {
+		return nil
+	}
+	if profile.On && profile.Profiling() {
+		defer profile.Start(cache).Note("SET MULTI", fmt.Sprintf("%d keys", len(items))).End()
+	}
+	data := make(map[string][]byte, len(items))
+	for k, v := range items {
+		b, err := c.encode(k, v)
+		if err != nil {
+			return err
+		}
+		data[c.backendKey(k)] = b
+	}
+	if setter, ok := c.driver.(driver.MultiSetter); ok {
+		err := setter.SetMulti(data, timeout)
+		if err != driver.ErrNotImplemented {
+			if err != nil {
+				return c.opError("setting multiple keys", joinKeys(items), err)
+			}
+			return nil
+		}
+	}
+	for k, v := range data {
+		if err := c.driver.Set(k, v, timeout); err != nil {
+			return c.opError("setting key", c.frontendKey(k), err)
+		}
+	}
+	return nil
+}
+
+// DeleteMulti removes all the given keys from the cache, with only one
+// trip to the cache when the driver supports it. Otherwise, the keys
+// are deleted one by one. As in Delete, deleting non-existant items
+// is always successful.
+func (c *Cache) DeleteMulti(keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	if profile.On && profile.Profiling() {
+		defer profile.Start(cache).Note("DELETE MULTI", strings.Join(keys, ", ")).End()
+	}
+	qkeys := make([]string, len(keys))
+	for ii, v := range keys {
+		qkeys[ii] = c.backendKey(v)
+	}
+	if deleter, ok := c.driver.(driver.MultiDeleter); ok {
+		err := deleter.DeleteMulti(qkeys)
+		if err != driver.ErrNotImplemented {
+			if err != nil {
+				return c.opError("deleting multiple keys", strings.Join(keys, ", "), err)
+			}
+			return nil
+		}
+	}
+	for ii, v := range qkeys {
+		if err := c.driver.Delete(v); err != nil {
+			return c.opError("deleting", keys[ii], err)
+		}
+	}
+	return nil
+}
+
+// encode encodes the given object using the codec
+// and the pipe, logging any errors.
+func (c *Cache) encode(key string, object interface{}) ([]byte, error) {
+	b, err := c.codec.Encode(object)
+	if err != nil {
+		eerr := &cacheError{
+			op:    "encoding object",
+			key:   key,
+			codec: true,
+			err:   err,
+		}
+		c.error(eerr)
+		return nil, eerr
+	}
+	if c.pipe != nil {
+		if b, err = c.pipe.Encode(b); err != nil {
+			perr := &cacheError{
+				op:  "encoding data with pipe",
+				key: key,
+				err: err,
+			}
+			c.error(perr)
+			return nil, perr
+		}
+	}
+	return b, nil
+}
+
+func (c *Cache) opError(op string, key string, err error) error {
+	oerr := &cacheError{
+		op:  op,
+		key: key,
+		err: err,
+	}
+	c.error(oerr)
+	return oerr
+}
+
+func (c *Cache) notImplemented(op string, key string) error {
+	return c.opError(op, key, driver.ErrNotImplemented)
+}
+
+func joinKeys(items map[string]interface{}) string {
+	keys := make([]string, 0, len(items))
+	for k := range items {
+		keys = append(keys, k)
+	}
+	return strings.Join(keys, ", ")
+}
+
 // GetBytes returns the byte array assocciated with the given key
 func (c *Cache) GetBytes(key string) ([]byte, error) {
 	if profile.On && profile.Profiling() {
@@ -221,24 +511,107 @@ func (c *Cache) GetBytes(key string) ([]byte, error) {
 		c.error(gerr)
 		return nil, gerr
 	}
+	if b != nil {
+		if b, err = c.decodeBytes(key, b); err != nil {
+			return nil, err
+		}
+	}
 	if b == nil {
+		cacheGets.Inc("miss")
 		return nil, ErrNotFound
 	}
-	if c.pipe != nil {
-		b, err = c.pipe.Decode(b)
+	cacheGets.Inc("hit")
+	return b, nil
+}
+
+// decodeBytes decodes the data retrieved from the driver using the
+// pipe, if any. If the data belongs to a tagged item which has been
+// invalidated, it returns nil.
+func (c *Cache) decodeBytes(key string, b []byte) ([]byte, error) {
+	b, err := c.decodePipe(key, b)
+	if err != nil {
+		return nil, err
+	}
+	if b, err = c.untag(b); err != nil {
+		return nil, c.tagsError(key, err)
+	}
+	return b, nil
+}
+
+// decodeMulti works like decodeBytes, but decodes all the items
+// retrieved by GetMulti, checking all their tags at once. The
+// returned map is keyed by the keys in the Cache, rather than
+// their backend keys.
+func (c *Cache) decodeMulti(keys []string, qkeys []string, data map[string][]byte) (map[string][]byte, error) {
+	values := make(map[string][]byte, len(data))
+	tagged := make(map[string]map[string][]byte)
+	var tagKeys []string
+	seen := make(map[string]bool)
+	for ii, k := range keys {
+		value := data[qkeys[ii]]
+		if value == nil {
+			continue
+		}
+		value, err := c.decodePipe(k, value)
 		if err != nil {
-			perr := &cacheError{
-				op:  "decoding data with pipe",
-				key: key,
-				err: err,
+			return nil, err
+		}
+		value, expected, err := c.parseTagged(value)
+		if err != nil {
+			return nil, c.tagsError(k, err)
+		}
+		if len(expected) > 0 {
+			tagged[k] = expected
+			for tk := range expected {
+				if !seen[tk] {
+					seen[tk] = true
+					tagKeys = append(tagKeys, tk)
+				}
 			}
-			c.error(perr)
-			return nil, perr
 		}
+		values[k] = value
+	}
+	if len(tagKeys) > 0 {
+		versions, err := c.driver.GetMulti(tagKeys)
+		if err != nil {
+			return nil, c.tagsError(strings.Join(keys, ", "), err)
+		}
+		for k, expected := range tagged {
+			if !tagsMatch(expected, versions) {
+				delete(values, k)
+			}
+		}
+	}
+	return values, nil
+}
+
+func (c *Cache) decodePipe(key string, b []byte) ([]byte, error) {
+	if c.pipe == nil {
+		return b, nil
+	}
+	b, err := c.pipe.Decode(b)
+	if err != nil {
+		perr := &cacheError{
+			op:  "decoding data with pipe",
+			key: key,
+			err: err,
+		}
+		c.error(perr)
+		return nil, perr
 	}
 	return b, nil
 }
 
+func (c *Cache) tagsError(key string, err error) error {
+	terr := &cacheError{
+		op:  "checking tags",
+		key: key,
+		err: err,
+	}
+	c.error(terr)
+	return terr
+}
+
 // Delete removes the key from the cache. An error is returned only
 // if the item was found but couldn't be deleted. Deleting a non-existant
 // item is always successful.
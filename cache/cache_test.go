@@ -3,11 +3,16 @@ package cache
 import (
 	"encoding/gob"
 	"fmt"
+	"io/ioutil"
 	"net"
+	"os"
 	"reflect"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"gnd.la/cache/driver"
 	_ "gnd.la/cache/driver/memcache"
 	_ "gnd.la/cache/driver/redis"
 	"gnd.la/config"
@@ -30,6 +35,11 @@ var (
 		testSetExpires,
 		testDelete,
 		testBytes,
+		testAdd,
+		testGetOrCompute,
+		testComputeLock,
+		testTags,
+		testAtomic,
 	}
 	benchmarks = []func(T, *Cache){
 		testSetGet,
@@ -274,6 +284,294 @@ func testBytes(t T, c *Cache) {
 	}
 }
 
+func testAdd(t T, c *Cache) {
+	c.Delete("a")
+	added, err := c.Add("a", 1, 0)
+	if err != nil {
+		t.Error(err)
+	} else if !added {
+		t.Error("expecting Add to store missing key")
+	}
+	added, err = c.Add("a", 2, 0)
+	if err != nil {
+		t.Error(err)
+	} else if added {
+		t.Error("expecting Add to not store existing key")
+	}
+	var v int
+	if err := c.Get("a", &v); err != nil {
+		t.Error(err)
+	} else if v != 1 {
+		t.Errorf("expecting value 1 after Add, got %d", v)
+	}
+}
+
+func testGetOrCompute(t T, c *Cache) {
+	c.Delete("computed")
+	var calls int32
+	compute := func() (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(50 * time.Millisecond)
+		return "computed", nil
+	}
+	var wg sync.WaitGroup
+	for ii := 0; ii < 10; ii++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var v string
+			if err := c.GetOrCompute("computed", &v, 60, compute); err != nil {
+				t.Error(err)
+			} else if v != "computed" {
+				t.Errorf("expecting computed value, got %q", v)
+			}
+		}()
+	}
+	wg.Wait()
+	if calls != 1 {
+		t.Errorf("expecting 1 call to compute, got %d", calls)
+	}
+	var v string
+	// A huge Beta forces an early refresh
+	if err := c.GetOrComputeOptions("computed", &v, 60, compute, &ComputeOptions{Beta: 1e9}); err != nil {
+		t.Error(err)
+	}
+	if calls != 2 {
+		t.Errorf("expecting early refresh, got %d calls", calls)
+	}
+	// Disabling early refresh must return the cached value
+	if err := c.GetOrComputeOptions("computed", &v, 60, compute, &ComputeOptions{Beta: -1}); err != nil {
+		t.Error(err)
+	}
+	if calls != 2 {
+		t.Errorf("expecting cached value, got %d calls", calls)
+	}
+}
+
+func testComputeLock(t T, c *Cache) {
+	c.Delete("locked")
+	lockKey := c.backendKey("locked" + lockSuffix)
+	var v string
+	compute := func() (interface{}, error) {
+		if b, _ := c.driver.Get(lockKey); b == nil {
+			t.Error("expecting lock to be held while computing")
+		}
+		return "computed", nil
+	}
+	if err := c.GetOrComputeOptions("locked", &v, 60, compute, &ComputeOptions{Lock: 5}); err != nil {
+		t.Error(err)
+	}
+	if b, err := c.driver.Get(lockKey); err != nil || b != nil {
+		t.Errorf("expecting lock to be released, got %q (error %v)", b, err)
+	}
+	// A lock acquired by another holder must not be released
+	if err := c.driver.Set(lockKey, []byte("other"), 60); err != nil {
+		t.Error(err)
+	}
+	c.unlock("locked", []byte("mine"))
+	if b, err := c.driver.Get(lockKey); err != nil || string(b) != "other" {
+		t.Errorf("expecting lock held by other, got %q (error %v)", b, err)
+	}
+	c.unlock("locked", []byte("other"))
+	if b, err := c.driver.Get(lockKey); err != nil || b != nil {
+		t.Errorf("expecting lock to be released by its holder, got %q (error %v)", b, err)
+	}
+}
+
+func testTags(t T, c *Cache) {
+	if err := c.SetTagged("article-1", "article", 0, "articles", "article:1"); err != nil {
+		t.Error(err)
+	}
+	if err := c.SetTagged("article-2", "article", 0, "articles", "article:2"); err != nil {
+		t.Error(err)
+	}
+	var v string
+	if err := c.Get("article-1", &v); err != nil || v != "article" {
+		t.Errorf("expecting tagged value, got %q (error %v)", v, err)
+	}
+	if err := c.InvalidateTag("article:1"); err != nil {
+		t.Error(err)
+	}
+	if err := c.Get("article-1", &v); err != ErrNotFound {
+		t.Errorf("expecting ErrNotFound for invalidated item, got %v", err)
+	}
+	out := map[string]interface{}{"article-1": "", "article-2": ""}
+	if err := c.GetMulti(out, nil); err != nil {
+		t.Error(err)
+	} else if len(out) != 1 || out["article-2"] != "article" {
+		t.Errorf("expecting only article-2, got %v", out)
+	}
+	if err := c.InvalidateTag("articles"); err != nil {
+		t.Error(err)
+	}
+	if err := c.Get("article-2", &v); err != ErrNotFound {
+		t.Errorf("expecting ErrNotFound for invalidated item, got %v", err)
+	}
+}
+
+func testAtomic(t T, c *Cache) {
+	c.DeleteMulti([]string{"r", "counter", "cas"})
+	if replaced, err := c.Replace("r", 1, 0); err != nil || replaced {
+		t.Errorf("expecting Replace to not store missing key (error %v)", err)
+	}
+	c.Set("r", 1, 0)
+	if replaced, err := c.Replace("r", 2, 0); err != nil || !replaced {
+		t.Errorf("expecting Replace to store existing key (error %v)", err)
+	}
+	var v int
+	if err := c.Get("r", &v); err != nil || v != 2 {
+		t.Errorf("expecting value 2 after Replace, got %d (error %v)", v, err)
+	}
+	if val, err := c.Increment("counter", 5, 60); err != nil || val != 5 {
+		t.Errorf("expecting counter = 5, got %d (error %v)", val, err)
+	}
+	if val, err := c.Decrement("counter", 2, 60); err != nil || val != 3 {
+		t.Errorf("expecting counter = 3, got %d (error %v)", val, err)
+	}
+	c.Set("cas", 1, 0)
+	token, err := c.GetCAS("cas", &v)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	other, err := c.GetCAS("cas", &v)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if swapped, err := c.CompareAndSwap("cas", 2, token, 0); err != nil || !swapped {
+		t.Errorf("expecting CompareAndSwap to succeed (error %v)", err)
+	}
+	if swapped, err := c.CompareAndSwap("cas", 3, other, 0); err != nil || swapped {
+		t.Errorf("expecting CompareAndSwap with stale token to fail (error %v)", err)
+	}
+	if err := c.Get("cas", &v); err != nil || v != 2 {
+		t.Errorf("expecting value 2 after CompareAndSwap, got %d (error %v)", v, err)
+	}
+	if err := c.SetMulti(map[string]interface{}{"m1": 1, "m2": 2}, 0); err != nil {
+		t.Error(err)
+	}
+	out := map[string]interface{}{"m1": 0, "m2": 0}
+	if err := c.GetMulti(out, nil); err != nil || len(out) != 2 || out["m2"] != 2 {
+		t.Errorf("unexpected GetMulti result after SetMulti %v (error %v)", out, err)
+	}
+	if err := c.DeleteMulti([]string{"m1", "m2"}); err != nil {
+		t.Error(err)
+	}
+	if err := c.GetMulti(out, nil); err != nil || len(out) != 0 {
+		t.Errorf("expecting no items after DeleteMulti, got %v (error %v)", out, err)
+	}
+}
+
+func TestFlightPanic(t *testing.T) {
+	var g flightGroup
+	started := make(chan struct{})
+	release := make(chan struct{})
+	waited := make(chan error)
+	go func() {
+		defer func() { recover() }()
+		g.do("key", func() ([]byte, error) {
+			close(started)
+			<-release
+			panic("compute")
+		})
+	}()
+	<-started
+	go func() {
+		_, err := g.do("key", func() ([]byte, error) {
+			return nil, nil
+		})
+		waited <- err
+	}()
+	// Give the second call time to start waiting
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	if err := <-waited; err != nil && err != errComputePanicked {
+		t.Errorf("expecting nil or errComputePanicked, got %v", err)
+	}
+	// The key must be usable again
+	data, err := g.do("key", func() ([]byte, error) {
+		return []byte("ok"), nil
+	})
+	if err != nil || string(data) != "ok" {
+		t.Errorf("expecting call after panic to run, got %q (error %v)", data, err)
+	}
+}
+
+type getMultiCounter struct {
+	driver.Driver
+	calls int
+}
+
+func (d *getMultiCounter) GetMulti(keys []string) (map[string][]byte, error) {
+	d.calls++
+	return d.Driver.GetMulti(keys)
+}
+
+func TestTagsGetMulti(t *testing.T) {
+	c, err := newCache("memory://")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Don't fill the shared memory store
+	c.driver = driver.NewMemoryDriver(0)
+	out := make(map[string]interface{})
+	for ii := 0; ii < 10; ii++ {
+		key := fmt.Sprintf("item-%d", ii)
+		if err := c.SetTagged(key, ii, 0, "items", key); err != nil {
+			t.Fatal(err)
+		}
+		out[key] = 0
+	}
+	c.InvalidateTag("item-3")
+	counter := &getMultiCounter{Driver: c.driver}
+	c.driver = counter
+	if err := c.GetMulti(out, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 9 || out["item-3"] != nil {
+		t.Errorf("expecting 9 items without item-3, got %v", out)
+	}
+	// One call for the items and another one for their tags
+	if counter.calls != 2 {
+		t.Errorf("expecting 2 calls to GetMulti, got %d", counter.calls)
+	}
+}
+
+func TestTagVersionRace(t *testing.T) {
+	c, err := newCache("memory://")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Don't fill the shared memory store
+	c.driver = driver.NewMemoryDriver(0)
+	key := c.tagKey("race")
+	// Created by another process after we found it missing
+	other := []byte("other")
+	if err := c.driver.Set(key, other, 0); err != nil {
+		t.Fatal(err)
+	}
+	version, err := c.createTagVersion(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(version) != string(other) {
+		t.Errorf("expecting existing tag version %q, got %q", other, version)
+	}
+}
+
+func TestUntagInvalid(t *testing.T) {
+	c, err := newCache("memory://")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Huge tag count without data for the tags
+	b := append(append([]byte(nil), taggedPrefix...), 0xff, 0xff, 0xff, 0xff, 0)
+	if _, err := c.untag(b); err != errInvalidTagged {
+		t.Errorf("expecting errInvalidTagged, got %v", err)
+	}
+}
+
 func testCache(t *testing.T, url string) {
 	if testing.Verbose() {
 		log.SetLevel(log.LDebug)
@@ -330,6 +628,19 @@ func TestPrefix(t *testing.T) {
 	}
 }
 
+func TestTiered(t *testing.T) {
+	testCache(t, "tiered://?remote=memory%3A%2F%2F#l1_size=1M&negative_ttl=1")
+}
+
+func TestFileSystem(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	testCache(t, "file://"+dir)
+}
+
 func TestMemcache(t *testing.T) {
 	if !testPort(11211) {
 		t.Skip("memcache is not running. start memcache on localhost to run this test")
@@ -0,0 +1,275 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"gnd.la/app/profile"
+	"gnd.la/cache/driver"
+	"gnd.la/util/stringutil"
+)
+
+const (
+	// DefaultBeta is the Beta used by GetOrCompute. See ComputeOptions.
+	DefaultBeta = 1.0
+
+	computedHeaderSize = 16
+	lockSuffix         = ".lock"
+	lockPollInterval   = 50 * time.Millisecond
+	lockTokenLength    = 16
+)
+
+var (
+	errComputePanicked = errors.New("computing the value panicked")
+)
+
+// ComputeFunc is the function called by GetOrCompute to produce
+// the value for a key when it's missing from the cache.
+type ComputeFunc func() (interface{}, error)
+
+// ComputeOptions specify the options for GetOrComputeOptions.
+type ComputeOptions struct {
+	// Beta controls the probabilistic early refresh. Items are
+	// recomputed before they expire with a probability which increases
+	// as they get closer to their expiration and with the time it took
+	// to compute them. Higher values favor earlier refreshes. Zero means
+	// DefaultBeta, while a negative value disables early refreshes.
+	Beta float64
+	// Lock is the number of seconds a distributed lock is held while
+	// computing the value, so only one process (possibly in a different
+	// machine) recomputes it. Other processes serve the stale value
+	// if there's one or wait up to Lock seconds for the value to be
+	// available, computing it themselves if it isn't. Zero disables the
+	// lock. The lock is ignored if the driver doesn't implement driver.Adder.
+	Lock int
+}
+
+// computed items are stored with an additional header, containing
+// their expiration and the time it took to compute them.
+type computed struct {
+	expires int64 // UnixNano, zero for no expiration
+	delta   int64 // in nanoseconds
+	data    []byte
+}
+
+func (c *computed) encode() []byte {
+	b := make([]byte, computedHeaderSize+len(c.data))
+	binary.BigEndian.PutUint64(b, uint64(c.expires))
+	binary.BigEndian.PutUint64(b[8:], uint64(c.delta))
+	copy(b[computedHeaderSize:], c.data)
+	return b
+}
+
+func decodeComputed(b []byte) *computed {
+	if len(b) < computedHeaderSize {
+		return nil
+	}
+	return &computed{
+		expires: int64(binary.BigEndian.Uint64(b)),
+		delta:   int64(binary.BigEndian.Uint64(b[8:])),
+		data:    b[computedHeaderSize:],
+	}
+}
+
+// needsRefresh implements the XFetch algorithm for
+// determining if an item should be recomputed early.
+func (c *computed) needsRefresh(beta float64) bool {
+	if c.expires == 0 || beta < 0 {
+		return false
+	}
+	if beta == 0 {
+		beta = DefaultBeta
+	}
+	early := -float64(c.delta) * beta * math.Log(rand.Float64())
+	return float64(time.Now().UnixNano())+early >= float64(c.expires)
+}
+
+type flightCall struct {
+	wg   sync.WaitGroup
+	data []byte
+	err  error
+}
+
+// flightGroup coalesces concurrent calls for
+// the same key into a single one.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+func (g *flightGroup) do(key string, fn func() ([]byte, error)) ([]byte, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	if c := g.calls[key]; c != nil {
+		g.mu.Unlock()
+		c.wg.Wait()
+		return c.data, c.err
+	}
+	c := new(flightCall)
+	c.wg.Add(1)
+	g.calls[key] = c
+	g.mu.Unlock()
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		c.wg.Done()
+	}()
+	// Returned to the waiting callers if fn panics
+	c.err = errComputePanicked
+	c.data, c.err = fn()
+	return c.data, c.err
+}
+
+// GetOrCompute retrieves the item with the given key and decodes it
+// into obj, like Get does. If the item is not found, f is called to
+// compute it and its result is stored with the given timeout (see Set)
+// and decoded into obj. Concurrent calls for the same key on the same
+// Cache are coalesced, so f is only called once for all of them. Items
+// might also be recomputed a bit before they expire, to prevent all
+// the processes sharing the cache from recomputing them at the same time.
+//
+// Note that items stored by GetOrCompute include additional information
+// used for early refreshes, so they must be only retrieved using
+// GetOrCompute. Use GetOrComputeOptions to adjust the early refreshes
+// or to use a distributed lock while computing the items.
+func (c *Cache) GetOrCompute(key string, obj interface{}, timeout int, f ComputeFunc) error {
+	return c.GetOrComputeOptions(key, obj, timeout, f, nil)
+}
+
+// GetOrComputeOptions works like GetOrCompute, but accepts a
+// *ComputeOptions (which might be nil) to control its behavior.
+func (c *Cache) GetOrComputeOptions(key string, obj interface{}, timeout int, f ComputeFunc, opts *ComputeOptions) error {
+	if opts == nil {
+		opts = &ComputeOptions{}
+	}
+	var stale *computed
+	if b, err := c.GetBytes(key); err == nil {
+		if item := decodeComputed(b); item != nil {
+			if !item.needsRefresh(opts.Beta) {
+				return c.decode(key, item.data, obj)
+			}
+			stale = item
+		}
+	}
+	data, err := c.flight.do(key, func() ([]byte, error) {
+		return c.compute(key, timeout, f, opts, stale)
+	})
+	if err != nil {
+		if stale == nil {
+			return err
+		}
+		c.warningf("error recomputing key %s, using stale value: %s", key, err)
+		data = stale.data
+	}
+	return c.decode(key, data, obj)
+}
+
+func (c *Cache) compute(key string, timeout int, f ComputeFunc, opts *ComputeOptions, stale *computed) ([]byte, error) {
+	if opts.Lock > 0 {
+		// Identifies this holder, so the lock is
+		// only released by it.
+		token := []byte(stringutil.Random(lockTokenLength))
+		locked, err := c.lock(key, token, opts.Lock)
+		if err != nil {
+			// Compute the value anyway, an unavailable
+			// lock shouldn't make the value unavailable too.
+			c.warningf("error locking key %s: %s", key, err)
+		} else if !locked {
+			if stale != nil {
+				// Another process is already refreshing it
+				return stale.data, nil
+			}
+			if item := c.waitComputed(key, opts.Lock); item != nil {
+				return item.data, nil
+			}
+		} else {
+			defer c.unlock(key, token)
+		}
+	}
+	if profile.On && profile.Profiling() {
+		defer profile.Start(cache).Note("COMPUTE", key).End()
+	}
+	start := time.Now()
+	value, err := f()
+	if err != nil {
+		return nil, err
+	}
+	data, err := c.codec.Encode(value)
+	if err != nil {
+		eerr := &cacheError{
+			op:    "encoding object",
+			key:   key,
+			codec: true,
+			err:   err,
+		}
+		c.error(eerr)
+		return nil, eerr
+	}
+	item := &computed{delta: int64(time.Since(start)), data: data}
+	if timeout > 0 {
+		item.expires = start.Add(time.Duration(timeout) * time.Second).UnixNano()
+	}
+	// Errors are already logged by SetBytes and the
+	// value is still usable, so don't return them.
+	c.SetBytes(key, item.encode(), timeout)
+	return data, nil
+}
+
+func (c *Cache) lock(key string, token []byte, timeout int) (bool, error) {
+	adder, ok := c.driver.(driver.Adder)
+	if !ok {
+		return false, driver.ErrNotImplemented
+	}
+	return adder.Add(c.backendKey(key+lockSuffix), token, timeout)
+}
+
+// unlock releases the lock for the given key, but only if it's
+// still held with the given token. Otherwise, it expired and it
+// might have been acquired by another process.
+func (c *Cache) unlock(key string, token []byte) {
+	k := c.backendKey(key + lockSuffix)
+	if deleter, ok := c.driver.(driver.CompareAndDeleter); ok {
+		if _, err := deleter.CompareAndDelete(k, token); err != driver.ErrNotImplemented {
+			if err != nil {
+				c.warningf("error unlocking key %s: %s", key, err)
+			}
+			return
+		}
+	}
+	// Not atomic, but the lock can only be released by
+	// another holder between the Get and the Delete when
+	// it expires in that interval.
+	b, err := c.driver.Get(k)
+	if err != nil {
+		c.warningf("error unlocking key %s: %s", key, err)
+		return
+	}
+	if bytes.Equal(b, token) {
+		if err := c.driver.Delete(k); err != nil {
+			c.warningf("error unlocking key %s: %s", key, err)
+		}
+	}
+}
+
+// waitComputed waits up to timeout seconds for another process to
+// store the value for the given key, returning nil if it doesn't.
+func (c *Cache) waitComputed(key string, timeout int) *computed {
+	deadline := time.Now().Add(time.Duration(timeout) * time.Second)
+	for time.Now().Before(deadline) {
+		time.Sleep(lockPollInterval)
+		if b, err := c.GetBytes(key); err == nil {
+			if item := decodeComputed(b); item != nil {
+				return item
+			}
+		}
+	}
+	return nil
+}
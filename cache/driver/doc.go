@@ -10,6 +10,7 @@
 //  - dummy:// - a dummy driver which does not cache data, useful for development
 //  - memory://[#max_size={size} - a memory driver with an optional maximum size
 //  - file://path[#max_size={size} a file based driver with an optional maximum size
+//  - tiered://?remote={url}[#l1_size={size}&l1_ttl={seconds}&negative_ttl={seconds}&channel={name}] - a two-tier driver, see below
 //
 // Sizes admit the K, M, G and T suffixes to represent Kilobytes, Megabytes, Gigabytes and
 // Terabytes, respectivelly. When there's no prefix, the value is assumed to be in bytes. Note
@@ -19,4 +20,15 @@
 // (using gnd.la/util/pathutil.Relative), while paths starting by / are interpreted as absolute.
 // Note that paths should aways use forward slashes, even in platforms which use the backslash
 // by default (e.g. /C:/Documents/my_cache_path).
+//
+// The tiered driver keeps the most recently used items in memory (L1), in
+// front of any other driver (L2), specified by the query escaped remote URL
+// (e.g. tiered://?remote=redis%3A%2F%2Flocalhost#l1_size=128M). The L1 size
+// defaults to DefaultL1Size and items are kept in memory for at most l1_ttl
+// seconds. When the remote driver implements PubSub (like the redis driver),
+// keys set or deleted by a process are also removed from the L1 of the other
+// processes and l1_ttl defaults to DefaultL1TTL. Otherwise, processes might
+// see stale items for up to l1_ttl seconds, which defaults to the shorter
+// DefaultL1TTLNoInvalidation. When negative_ttl is non-zero, missing items
+// are also remembered for that many seconds. See TieredDriver for more details.
 package driver
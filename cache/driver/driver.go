@@ -2,6 +2,8 @@ package driver
 
 import (
 	"errors"
+	"io"
+	"time"
 
 	"gnd.la/config"
 )
@@ -52,6 +54,94 @@ type Driver interface {
 	Flush() error
 }
 
+// Adder is implemented by drivers which can atomically store
+// a value only when its key is not already present. Add must
+// return true iff the value was stored. See Driver.Set for the
+// interpretation of the timeout parameter.
+type Adder interface {
+	Add(key string, b []byte, timeout int) (bool, error)
+}
+
+// Replacer is implemented by drivers which can atomically store
+// a value only when its key is already present. Replace must
+// return true iff the value was stored.
+type Replacer interface {
+	Replace(key string, b []byte, timeout int) (bool, error)
+}
+
+// Counter is implemented by drivers which can atomically increment
+// and decrement integer values, stored as their decimal representation.
+// When the key is not present, it must be created with a zero value
+// and the given timeout before applying the delta. The timeout is
+// ignored for existing keys. Both functions return the new value.
+// Note that some drivers (e.g. memcache) don't support negative values,
+// and clamp them to zero.
+type Counter interface {
+	Increment(key string, delta int64, timeout int) (int64, error)
+	Decrement(key string, delta int64, timeout int) (int64, error)
+}
+
+// CASToken is an opaque token returned by GetCAS, which must
+// be passed to CompareAndSwap. Its contents are driver dependent.
+type CASToken interface{}
+
+// CASer is implemented by drivers which support compare-and-swap
+// operations. GetCAS works like Driver.Get, but also returns a token
+// representing the current value. CompareAndSwap stores the value
+// only if the item hasn't been modified since the token was obtained,
+// returning true iff the value was stored.
+type CASer interface {
+	GetCAS(key string) ([]byte, CASToken, error)
+	CompareAndSwap(key string, b []byte, token CASToken, timeout int) (bool, error)
+}
+
+// CompareAndDeleter is implemented by drivers which can atomically
+// delete an item only when its value is equal to the given one.
+// CompareAndDelete must return true iff the item was deleted.
+type CompareAndDeleter interface {
+	CompareAndDelete(key string, b []byte) (bool, error)
+}
+
+// MultiSetter is implemented by drivers which can store
+// several items in a single operation.
+type MultiSetter interface {
+	SetMulti(items map[string][]byte, timeout int) error
+}
+
+// MultiDeleter is implemented by drivers which can delete
+// several items in a single operation. As with Driver.Delete,
+// missing keys must not produce an error.
+type MultiDeleter interface {
+	DeleteMulti(keys []string) error
+}
+
+// TTLGetter is implemented by drivers which can retrieve the remaining
+// lifetime of the items along with their values. The returned durations
+// are zero for items without an expiration. As in Driver, missing
+// items are returned as nil values and omitted from the maps returned
+// by GetMultiTTL. It's used by the tiered driver for not keeping items
+// in memory after they expire in the remote driver.
+type TTLGetter interface {
+	GetTTL(key string) ([]byte, time.Duration, error)
+	GetMultiTTL(keys []string) (map[string][]byte, map[string]time.Duration, error)
+}
+
+// PubSub is implemented by drivers which can broadcast messages to
+// all the processes connected to the same cache server. It's used by
+// the tiered driver for invalidating the items cached in memory by
+// other processes.
+type PubSub interface {
+	// Publish sends the given message to all the
+	// subscribers of the given channel.
+	Publish(channel string, msg []byte) error
+	// Subscribe calls f with every message received on the
+	// given channel, until the returned io.Closer is closed.
+	// If the subscription is interrupted (e.g. the connection
+	// is lost) and then reestablished, f is called with a nil
+	// msg, since messages might have been lost.
+	Subscribe(channel string, f func(msg []byte)) (io.Closer, error)
+}
+
 // Register registers a new cache driver with the
 // given protocol and opener function. This function
 // is not thread safe, as it's only intended to be
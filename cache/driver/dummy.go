@@ -15,6 +15,46 @@ func (d *DummyDriver) Set(key string, b []byte, timeout int) error {
 	return nil
 }
 
+// Add always reports the value as stored, since there are
+// no other processes sharing the DummyDriver.
+func (d *DummyDriver) Add(key string, b []byte, timeout int) (bool, error) {
+	return true, nil
+}
+
+// Replace always reports the value as not stored,
+// since the DummyDriver never has any items.
+func (d *DummyDriver) Replace(key string, b []byte, timeout int) (bool, error) {
+	return false, nil
+}
+
+// Increment always returns delta, as if
+// the counter had just been created.
+func (d *DummyDriver) Increment(key string, delta int64, timeout int) (int64, error) {
+	return delta, nil
+}
+
+// Decrement always returns -delta, as if
+// the counter had just been created.
+func (d *DummyDriver) Decrement(key string, delta int64, timeout int) (int64, error) {
+	return -delta, nil
+}
+
+func (d *DummyDriver) GetCAS(key string) ([]byte, CASToken, error) {
+	return nil, nil, nil
+}
+
+func (d *DummyDriver) CompareAndSwap(key string, b []byte, token CASToken, timeout int) (bool, error) {
+	return false, nil
+}
+
+func (d *DummyDriver) SetMulti(items map[string][]byte, timeout int) error {
+	return nil
+}
+
+func (d *DummyDriver) DeleteMulti(keys []string) error {
+	return nil
+}
+
 func (d *DummyDriver) Get(key string) ([]byte, error) {
 	return nil, nil
 }
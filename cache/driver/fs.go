@@ -1,7 +1,9 @@
 package driver
 
 import (
+	"bytes"
 	"encoding/binary"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -12,6 +14,14 @@ import (
 	"gnd.la/util/pathutil"
 )
 
+const (
+	fsLockTimeout  = 10 * time.Second
+	fsLockInterval = 5 * time.Millisecond
+	// Items are stored in directories named after
+	// hexadecimal digits, so this can't collide.
+	fsLockDir = "locks"
+)
+
 type FileSystemDriver struct {
 	Root string
 }
@@ -21,52 +31,105 @@ func (f *FileSystemDriver) keyPath(key string) string {
 	return filepath.Join(f.Root, fileKey[:2], fileKey[2:4], fileKey[4:])
 }
 
+func (f *FileSystemDriver) lockPath(key string) string {
+	return filepath.Join(f.Root, fsLockDir, hashutil.Md5(key))
+}
+
+// Set stores the item while holding the key lock, so it doesn't
+// interfere with the atomic operations (e.g. Increment).
 func (f *FileSystemDriver) Set(key string, b []byte, timeout int) error {
-	p := f.keyPath(key)
-	err := os.MkdirAll(filepath.Dir(p), 0755)
+	unlock, err := f.lock(key)
 	if err != nil {
 		return err
 	}
-	fd, err := os.OpenFile(p, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
-	if err != nil {
+	defer unlock()
+	return f.write(key, b, expiration(timeout))
+}
+
+// write stores the item by writing it into a temporary file and
+// then renaming it, so readers never see a partially written item.
+// It must be called with the key lock held.
+func (f *FileSystemDriver) write(key string, b []byte, expiration int64) error {
+	p := f.keyPath(key)
+	dir := filepath.Dir(p)
+	if err := os.MkdirAll(dir, 0755); err != nil {
 		return err
 	}
-	defer fd.Close()
-	expiration := int64(timeout)
-	if expiration > 0 {
-		expiration += time.Now().Unix()
+	fd, err := ioutil.TempFile(dir, "."+filepath.Base(p)+".")
+	if err != nil {
+		return err
 	}
 	binary.Write(fd, binary.LittleEndian, expiration)
-	total := len(b)
-	for t := 0; t < total; {
-		n, err := fd.Write(b)
-		if err != nil {
-			f.Delete(key)
-			return err
-		}
-		t += n
+	_, err = fd.Write(b)
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(fd.Name(), p)
+	}
+	if err != nil {
+		os.Remove(fd.Name())
+		return err
 	}
 	return nil
 }
 
+// Add stores the item while holding the key lock, so it's atomic
+// even among several processes sharing the same directory.
+func (f *FileSystemDriver) Add(key string, b []byte, timeout int) (bool, error) {
+	unlock, err := f.lock(key)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+	prev, _, err := f.read(key)
+	if err != nil || prev != nil {
+		return false, err
+	}
+	return true, f.write(key, b, expiration(timeout))
+}
+
 func (f *FileSystemDriver) Get(key string) ([]byte, error) {
+	data, expires, err := f.read(key)
+	if err == nil && data == nil && expires > 0 {
+		f.removeExpired(key)
+	}
+	return data, err
+}
+
+// removeExpired removes the file for the given key if
+// it's still expired once the key lock is acquired.
+func (f *FileSystemDriver) removeExpired(key string) {
+	unlock, err := f.lock(key)
+	if err != nil {
+		return
+	}
+	defer unlock()
+	if data, expires, err := f.read(key); err == nil && data == nil && expires > 0 {
+		os.Remove(f.keyPath(key))
+	}
+}
+
+// read returns the data for the given key and its expiration. If
+// the item is not present or it has expired, it returns nil data
+// (with its expiration, in the latter case).
+func (f *FileSystemDriver) read(key string) ([]byte, int64, error) {
 	fd, err := os.Open(f.keyPath(key))
 	if err != nil {
 		/* Cache miss */
-		return nil, nil
+		return nil, 0, nil
 	}
 	defer fd.Close()
 	var expiration int64
 	binary.Read(fd, binary.LittleEndian, &expiration)
 	if expiration > 0 && expiration < time.Now().Unix() {
-		f.Delete(key)
-		return nil, nil
+		return nil, expiration, nil
 	}
 	data, err := ioutil.ReadAll(fd)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
-	return data, nil
+	return data, expiration, nil
 }
 
 func (f *FileSystemDriver) GetMulti(keys []string) (map[string][]byte, error) {
@@ -81,10 +144,123 @@ func (f *FileSystemDriver) GetMulti(keys []string) (map[string][]byte, error) {
 }
 
 func (f *FileSystemDriver) Delete(key string) error {
-	err := os.Remove(f.keyPath(key))
+	unlock, err := f.lock(key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	err = os.Remove(f.keyPath(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
 	return err
 }
 
+// lock acquires a lock for the given key, which works across
+// processes sharing the same directory. Locks held for longer than
+// fsLockTimeout are considered stale and broken. Lock files are
+// stored in their own directory, so they can't collide with items.
+func (f *FileSystemDriver) lock(key string) (func(), error) {
+	p := f.lockPath(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(fsLockTimeout)
+	for {
+		fd, err := os.OpenFile(p, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+		if err == nil {
+			fd.Close()
+			return func() { os.Remove(p) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if time.Now().After(deadline) {
+			if st, err := os.Stat(p); err == nil && time.Since(st.ModTime()) > fsLockTimeout {
+				os.Remove(p)
+				deadline = time.Now().Add(fsLockTimeout)
+				continue
+			}
+			return nil, fmt.Errorf("timeout acquiring lock for key %q", key)
+		}
+		time.Sleep(fsLockInterval)
+	}
+}
+
+// Replace replaces the item while holding the key lock, so it's
+// atomic even among several processes sharing the same directory.
+// The same applies to Increment, Decrement and CompareAndSwap.
+func (f *FileSystemDriver) Replace(key string, b []byte, timeout int) (bool, error) {
+	unlock, err := f.lock(key)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+	prev, _, err := f.read(key)
+	if err != nil || prev == nil {
+		return false, err
+	}
+	return true, f.write(key, b, expiration(timeout))
+}
+
+func (f *FileSystemDriver) Increment(key string, delta int64, timeout int) (int64, error) {
+	unlock, err := f.lock(key)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	prev, expires, err := f.read(key)
+	if err != nil {
+		return 0, err
+	}
+	var value int64
+	if prev != nil {
+		if value, err = parseCounter(prev); err != nil {
+			return 0, err
+		}
+	} else {
+		expires = expiration(timeout)
+	}
+	value += delta
+	return value, f.write(key, formatCounter(value), expires)
+}
+
+func (f *FileSystemDriver) Decrement(key string, delta int64, timeout int) (int64, error) {
+	return f.Increment(key, -delta, timeout)
+}
+
+type fsCASToken struct {
+	data []byte
+}
+
+// GetCAS implements the CASer interface. Since files don't have
+// a version, CompareAndSwap compares the stored data with the data
+// returned by GetCAS.
+func (f *FileSystemDriver) GetCAS(key string) ([]byte, CASToken, error) {
+	data, _, err := f.read(key)
+	if err != nil || data == nil {
+		return nil, nil, err
+	}
+	return data, &fsCASToken{data: data}, nil
+}
+
+func (f *FileSystemDriver) CompareAndSwap(key string, b []byte, token CASToken, timeout int) (bool, error) {
+	tok, ok := token.(*fsCASToken)
+	if !ok {
+		return false, fmt.Errorf("invalid CAS token %v", token)
+	}
+	unlock, err := f.lock(key)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+	cur, _, err := f.read(key)
+	if err != nil || cur == nil || !bytes.Equal(cur, tok.data) {
+		return false, err
+	}
+	return true, f.write(key, b, expiration(timeout))
+}
+
 func (f *FileSystemDriver) Close() error {
 	return nil
 }
@@ -0,0 +1,109 @@
+package driver
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func newTestFileSystemDriver(t *testing.T) (*FileSystemDriver, func()) {
+	dir, err := ioutil.TempDir("", "cache-fs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &FileSystemDriver{Root: dir}, func() { os.RemoveAll(dir) }
+}
+
+func TestFileSystemAtomicWrites(t *testing.T) {
+	d, done := newTestFileSystemDriver(t)
+	defer done()
+	values := [][]byte{
+		bytes.Repeat([]byte{'a'}, 1<<20),
+		bytes.Repeat([]byte{'b'}, 1<<19),
+	}
+	if err := d.Set("key", values[0], 0); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for ii := 0; ; ii++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err := d.Set("key", values[ii%2], 0); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for ii := 0; ii < 200; ii++ {
+		b, err := d.Get("key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, values[0]) && !bytes.Equal(b, values[1]) {
+			t.Fatalf("read partially written item with %d bytes", len(b))
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestFileSystemConcurrentIncrement(t *testing.T) {
+	d, done := newTestFileSystemDriver(t)
+	defer done()
+	const count = 20
+	var wg sync.WaitGroup
+	for ii := 0; ii < count; ii++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := d.Increment("counter", 1, 0); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	b, err := d.Get("counter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := parseCounter(b); err != nil || v != count {
+		t.Errorf("expecting counter = %d, got %q (error %v)", count, b, err)
+	}
+}
+
+func TestFileSystemLocks(t *testing.T) {
+	d, done := newTestFileSystemDriver(t)
+	defer done()
+	unlock, err := d.lock("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := d.lockPath("key")
+	if filepath.Dir(p) != filepath.Join(d.Root, fsLockDir) {
+		t.Errorf("expecting lock in %s, got %s", fsLockDir, p)
+	}
+	if _, err := os.Stat(p); err != nil {
+		t.Errorf("lock file not found: %s", err)
+	}
+	unlock()
+	// Deleting missing items must not fail
+	if err := d.Delete("missing"); err != nil {
+		t.Errorf("expecting no error deleting a missing key, got %s", err)
+	}
+	if added, err := d.Add("added", []byte("1"), 0); err != nil || !added {
+		t.Errorf("expecting Add to store missing key (error %v)", err)
+	}
+	if added, err := d.Add("added", []byte("2"), 0); err != nil || added {
+		t.Errorf("expecting Add to not store existing key (error %v)", err)
+	}
+}
@@ -3,7 +3,9 @@
 package memcache
 
 import (
+	"fmt"
 	"net"
+	"strconv"
 	"strings"
 	"time"
 
@@ -22,6 +24,89 @@ func (c *memcacheDriver) Set(key string, b []byte, timeout int) error {
 	return c.error(c.Client.Set(&item))
 }
 
+func (c *memcacheDriver) Add(key string, b []byte, timeout int) (bool, error) {
+	item := memcache.Item{Key: key, Value: b, Expiration: int32(timeout)}
+	if err := c.Client.Add(&item); err != nil {
+		if err == memcache.ErrNotStored {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (c *memcacheDriver) Replace(key string, b []byte, timeout int) (bool, error) {
+	item := memcache.Item{Key: key, Value: b, Expiration: int32(timeout)}
+	if err := c.Client.Replace(&item); err != nil {
+		if err == memcache.ErrNotStored {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// Increment implements driver.Counter. Note that memcache
+// doesn't support negative values, they're clamped to zero.
+func (c *memcacheDriver) Increment(key string, delta int64, timeout int) (int64, error) {
+	for ii := 0; ii < 2; ii++ {
+		var val uint64
+		var err error
+		if delta >= 0 {
+			val, err = c.Client.Increment(key, uint64(delta))
+		} else {
+			val, err = c.Client.Decrement(key, uint64(-delta))
+		}
+		if err != memcache.ErrCacheMiss {
+			return int64(val), err
+		}
+		initial := delta
+		if initial < 0 {
+			initial = 0
+		}
+		item := memcache.Item{Key: key, Value: []byte(strconv.FormatInt(initial, 10)), Expiration: int32(timeout)}
+		if err := c.Client.Add(&item); err != memcache.ErrNotStored {
+			return initial, err
+		}
+		// Created by someone else in the meantime, try again
+	}
+	return 0, fmt.Errorf("could not increment key %q", key)
+}
+
+func (c *memcacheDriver) Decrement(key string, delta int64, timeout int) (int64, error) {
+	return c.Increment(key, -delta, timeout)
+}
+
+// GetCAS implements driver.CASer. The
+// token is the *memcache.Item.
+func (c *memcacheDriver) GetCAS(key string) ([]byte, driver.CASToken, error) {
+	item, err := c.Client.Get(key)
+	if err != nil {
+		return nil, nil, c.error(err)
+	}
+	if item == nil {
+		return nil, nil, nil
+	}
+	return item.Value, item, nil
+}
+
+func (c *memcacheDriver) CompareAndSwap(key string, b []byte, token driver.CASToken, timeout int) (bool, error) {
+	tok, ok := token.(*memcache.Item)
+	if !ok {
+		return false, fmt.Errorf("invalid CAS token %v", token)
+	}
+	item := *tok
+	item.Value = b
+	item.Expiration = int32(timeout)
+	if err := c.Client.CompareAndSwap(&item); err != nil {
+		if err == memcache.ErrCASConflict || err == memcache.ErrNotStored || err == memcache.ErrCacheMiss {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
 func (c *memcacheDriver) Get(key string) ([]byte, error) {
 	item, err := c.Client.Get(key)
 	if err != nil {
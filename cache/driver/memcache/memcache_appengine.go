@@ -3,6 +3,8 @@
 package memcache
 
 import (
+	"fmt"
+	"strconv"
 	"time"
 
 	"appengine"
@@ -21,6 +23,17 @@ func (c *memcacheDriver) Set(key string, b []byte, timeout int) error {
 	return memcache.Set(c.c, item)
 }
 
+func (c *memcacheDriver) Add(key string, b []byte, timeout int) (bool, error) {
+	item := &memcache.Item{Key: key, Value: b, Expiration: time.Duration(timeout) * time.Second}
+	if err := memcache.Add(c.c, item); err != nil {
+		if err == memcache.ErrNotStored {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
 func (c *memcacheDriver) Get(key string) ([]byte, error) {
 	item, err := memcache.Get(c.c, key)
 	if err != nil && err != memcache.ErrCacheMiss {
@@ -52,6 +65,82 @@ func (c *memcacheDriver) Delete(key string) error {
 	return nil
 }
 
+// Increment implements driver.Counter. Note that memcache
+// doesn't support negative values, they're clamped to zero.
+func (c *memcacheDriver) Increment(key string, delta int64, timeout int) (int64, error) {
+	for ii := 0; ii < 2; ii++ {
+		val, err := memcache.IncrementExisting(c.c, key, delta)
+		if err != memcache.ErrCacheMiss {
+			return int64(val), err
+		}
+		initial := delta
+		if initial < 0 {
+			initial = 0
+		}
+		item := &memcache.Item{Key: key, Value: []byte(strconv.FormatInt(initial, 10)), Expiration: time.Duration(timeout) * time.Second}
+		if err := memcache.Add(c.c, item); err != memcache.ErrNotStored {
+			return initial, err
+		}
+		// Created by someone else in the meantime, try again
+	}
+	return 0, fmt.Errorf("could not increment key %q", key)
+}
+
+func (c *memcacheDriver) Decrement(key string, delta int64, timeout int) (int64, error) {
+	return c.Increment(key, -delta, timeout)
+}
+
+// GetCAS implements driver.CASer. The
+// token is the *memcache.Item.
+func (c *memcacheDriver) GetCAS(key string) ([]byte, driver.CASToken, error) {
+	item, err := memcache.Get(c.c, key)
+	if err != nil {
+		if err == memcache.ErrCacheMiss {
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+	return item.Value, item, nil
+}
+
+func (c *memcacheDriver) CompareAndSwap(key string, b []byte, token driver.CASToken, timeout int) (bool, error) {
+	tok, ok := token.(*memcache.Item)
+	if !ok {
+		return false, fmt.Errorf("invalid CAS token %v", token)
+	}
+	item := *tok
+	item.Value = b
+	item.Expiration = time.Duration(timeout) * time.Second
+	if err := memcache.CompareAndSwap(c.c, &item); err != nil {
+		if err == memcache.ErrCASConflict || err == memcache.ErrNotStored {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (c *memcacheDriver) SetMulti(items map[string][]byte, timeout int) error {
+	mitems := make([]*memcache.Item, 0, len(items))
+	for k, v := range items {
+		mitems = append(mitems, &memcache.Item{Key: k, Value: v, Expiration: time.Duration(timeout) * time.Second})
+	}
+	return memcache.SetMulti(c.c, mitems)
+}
+
+func (c *memcacheDriver) DeleteMulti(keys []string) error {
+	err := memcache.DeleteMulti(c.c, keys)
+	if merr, ok := err.(appengine.MultiError); ok {
+		for _, v := range merr {
+			if v != nil && v != memcache.ErrCacheMiss {
+				return v
+			}
+		}
+		return nil
+	}
+	return err
+}
+
 func (c *memcacheDriver) Connection() interface{} {
 	return c
 }
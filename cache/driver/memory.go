@@ -1,6 +1,7 @@
 package driver
 
 import (
+	"bytes"
 	"fmt"
 	"runtime"
 	"sort"
@@ -16,6 +17,15 @@ type item struct {
 	expires int64
 }
 
+// ttl returns the remaining lifetime of the item, which
+// lives until the end of the second it expires at.
+func (i *item) ttl(now time.Time) time.Duration {
+	if i.expires == 0 {
+		return 0
+	}
+	return time.Unix(i.expires+1, 0).Sub(now)
+}
+
 type keyedItem struct {
 	key  string
 	item *item
@@ -46,53 +56,181 @@ func (e byExpirationAndSize) Swap(i, j int) {
 	e[i], e[j] = e[j], e[i]
 }
 
-var cache struct {
+type memoryStore struct {
 	sync.RWMutex
 	items map[string]*item
 	size  uint64
 }
 
+func newMemoryStore() *memoryStore {
+	return &memoryStore{items: make(map[string]*item)}
+}
+
+// shared is the store used by all the drivers
+// opened with the memory:// scheme.
+var shared = newMemoryStore()
+
+// MemoryDriver implements a Driver which stores the
+// items in memory. Drivers opened using the memory://
+// scheme share their storage, while drivers returned
+// by NewMemoryDriver have their own.
 type MemoryDriver struct {
+	store   *memoryStore
 	maxSize uint64
 	prune   chan struct{}
 	mu      sync.Mutex
 }
 
 func (d *MemoryDriver) Set(key string, b []byte, timeout int) error {
-	var expires int64
-	if timeout != 0 {
-		expires = time.Now().Unix() + int64(timeout)
+	d.store.Lock()
+	d.storeLocked(key, b, timeout)
+	return nil
+}
+
+// Add stores the item only if it's not present or
+// it has already expired.
+func (d *MemoryDriver) Add(key string, b []byte, timeout int) (bool, error) {
+	d.store.Lock()
+	if d.liveLocked(key) != nil {
+		d.store.Unlock()
+		return false, nil
+	}
+	d.storeLocked(key, b, timeout)
+	return true, nil
+}
+
+// Replace stores the item only if it's present
+// and it hasn't expired.
+func (d *MemoryDriver) Replace(key string, b []byte, timeout int) (bool, error) {
+	d.store.Lock()
+	if d.liveLocked(key) == nil {
+		d.store.Unlock()
+		return false, nil
+	}
+	d.storeLocked(key, b, timeout)
+	return true, nil
+}
+
+func (d *MemoryDriver) Increment(key string, delta int64, timeout int) (int64, error) {
+	d.store.Lock()
+	var value int64
+	expires := expiration(timeout)
+	if prev := d.liveLocked(key); prev != nil {
+		var err error
+		if value, err = parseCounter(prev.data); err != nil {
+			d.store.Unlock()
+			return 0, err
+		}
+		expires = prev.expires
+	}
+	value += delta
+	d.storeExpiresLocked(key, formatCounter(value), expires)
+	return value, nil
+}
+
+func (d *MemoryDriver) Decrement(key string, delta int64, timeout int) (int64, error) {
+	return d.Increment(key, -delta, timeout)
+}
+
+// GetCAS implements the CASer interface. The
+// token is the stored item itself.
+func (d *MemoryDriver) GetCAS(key string) ([]byte, CASToken, error) {
+	d.store.RLock()
+	item := d.liveLocked(key)
+	d.store.RUnlock()
+	if item == nil {
+		return nil, nil, nil
+	}
+	return item.data, item, nil
+}
+
+func (d *MemoryDriver) CompareAndSwap(key string, b []byte, token CASToken, timeout int) (bool, error) {
+	d.store.Lock()
+	if cur := d.liveLocked(key); cur == nil || cur != token {
+		d.store.Unlock()
+		return false, nil
+	}
+	d.storeLocked(key, b, timeout)
+	return true, nil
+}
+
+// CompareAndDelete implements the CompareAndDeleter interface.
+func (d *MemoryDriver) CompareAndDelete(key string, b []byte) (bool, error) {
+	d.store.Lock()
+	defer d.store.Unlock()
+	cur := d.liveLocked(key)
+	if cur == nil || !bytes.Equal(cur.data, b) {
+		return false, nil
+	}
+	delete(d.store.items, key)
+	d.store.size -= uint64(len(cur.data))
+	return true, nil
+}
+
+func (d *MemoryDriver) SetMulti(items map[string][]byte, timeout int) error {
+	for k, v := range items {
+		d.store.Lock()
+		d.storeLocked(k, v, timeout)
 	}
+	return nil
+}
+
+func (d *MemoryDriver) DeleteMulti(keys []string) error {
+	for _, v := range keys {
+		d.Delete(v)
+	}
+	return nil
+}
+
+// liveLocked returns the item for the given key if it's present
+// and not expired. It must be called with the store lock held.
+func (d *MemoryDriver) liveLocked(key string) *item {
+	if item := d.store.items[key]; item != nil {
+		if item.expires == 0 || item.expires >= time.Now().Unix() {
+			return item
+		}
+	}
+	return nil
+}
+
+// storeLocked stores the item in the cache. It must be
+// called with the store lock held and it releases it
+// before returning.
+func (d *MemoryDriver) storeLocked(key string, b []byte, timeout int) {
+	d.storeExpiresLocked(key, b, expiration(timeout))
+}
+
+// storeExpiresLocked works like storeLocked, but receives
+// the expiration time as a Unix timestamp.
+func (d *MemoryDriver) storeExpiresLocked(key string, b []byte, expires int64) {
 	prevSize := uint64(0)
-	cache.Lock()
-	if prev := cache.items[key]; prev != nil {
+	if prev := d.store.items[key]; prev != nil {
 		prevSize = uint64(len(prev.data))
 	}
-	cache.items[key] = &item{
+	d.store.items[key] = &item{
 		data:    b,
 		expires: expires,
 	}
-	cache.size += uint64(len(b)) - prevSize
-	if d.maxSize > 0 && cache.size > d.maxSize {
+	d.store.size += uint64(len(b)) - prevSize
+	if d.maxSize > 0 && d.store.size > d.maxSize {
 		d.mu.Lock()
 		// Unlock before sending over the channel,
 		// otherwise we might cause a deadlock since
 		// the pruneWorker might be waiting for the
-		// cache lock to be released while the send
+		// store lock to be released while the send
 		// might be blocking waiting for the pruneWorker.
-		cache.Unlock()
+		d.store.Unlock()
 		d.prune <- struct{}{}
 		d.mu.Unlock()
-		return nil
+		return
 	}
-	cache.Unlock()
-	return nil
+	d.store.Unlock()
 }
 
 func (d *MemoryDriver) Get(key string) ([]byte, error) {
-	cache.RLock()
-	item := cache.items[key]
-	cache.RUnlock()
+	d.store.RLock()
+	item := d.store.items[key]
+	d.store.RUnlock()
 	if item == nil {
 		return nil, nil
 	}
@@ -103,13 +241,40 @@ func (d *MemoryDriver) Get(key string) ([]byte, error) {
 	return item.data, nil
 }
 
+// GetTTL implements the TTLGetter interface.
+func (d *MemoryDriver) GetTTL(key string) ([]byte, time.Duration, error) {
+	d.store.RLock()
+	item := d.liveLocked(key)
+	d.store.RUnlock()
+	if item == nil {
+		return nil, 0, nil
+	}
+	return item.data, item.ttl(time.Now()), nil
+}
+
+// GetMultiTTL implements the TTLGetter interface.
+func (d *MemoryDriver) GetMultiTTL(keys []string) (map[string][]byte, map[string]time.Duration, error) {
+	results := make(map[string][]byte, len(keys))
+	ttls := make(map[string]time.Duration, len(keys))
+	now := time.Now()
+	d.store.RLock()
+	for _, v := range keys {
+		if item := d.liveLocked(v); item != nil {
+			results[v] = item.data
+			ttls[v] = item.ttl(now)
+		}
+	}
+	d.store.RUnlock()
+	return results, ttls, nil
+}
+
 func (d *MemoryDriver) GetMulti(keys []string) (map[string][]byte, error) {
 	items := make(map[string]*item, len(keys))
-	cache.RLock()
+	d.store.RLock()
 	for _, v := range keys {
-		items[v] = cache.items[v]
+		items[v] = d.store.items[v]
 	}
-	cache.RUnlock()
+	d.store.RUnlock()
 	results := make(map[string][]byte, len(keys))
 	now := time.Now().Unix()
 	for k, v := range items {
@@ -125,9 +290,9 @@ func (d *MemoryDriver) GetMulti(keys []string) (map[string][]byte, error) {
 }
 
 func (d *MemoryDriver) Delete(key string) error {
-	cache.RLock()
-	item := cache.items[key]
-	cache.RUnlock()
+	d.store.RLock()
+	item := d.store.items[key]
+	d.store.RUnlock()
 	if item == nil {
 		return nil
 	}
@@ -136,10 +301,10 @@ func (d *MemoryDriver) Delete(key string) error {
 }
 
 func (d *MemoryDriver) deleteItem(key string, i *item) {
-	cache.Lock()
-	delete(cache.items, key)
-	cache.size -= uint64(len(i.data))
-	cache.Unlock()
+	d.store.Lock()
+	delete(d.store.items, key)
+	d.store.size -= uint64(len(i.data))
+	d.store.Unlock()
 }
 
 func (d *MemoryDriver) Close() error {
@@ -157,10 +322,10 @@ func (d *MemoryDriver) Connection() interface{} {
 }
 
 func (d *MemoryDriver) Flush() error {
-	cache.Lock()
-	defer cache.Unlock()
-	cache.size = 0
-	cache.items = make(map[string]*item)
+	d.store.Lock()
+	defer d.store.Unlock()
+	d.store.size = 0
+	d.store.items = make(map[string]*item)
 	return nil
 }
 
@@ -171,13 +336,13 @@ func (d *MemoryDriver) pruneWorker(ch <-chan struct{}) {
 }
 
 func (d *MemoryDriver) pruneCache() {
-	cache.Lock()
-	defer cache.Unlock()
-	if cache.size < d.maxSize {
+	d.store.Lock()
+	defer d.store.Unlock()
+	if d.store.size < d.maxSize {
 		return
 	}
-	items := make([]*keyedItem, 0, len(cache.items))
-	for k, v := range cache.items {
+	items := make([]*keyedItem, 0, len(d.store.items))
+	for k, v := range d.store.items {
 		items = append(items, &keyedItem{
 			key:  k,
 			item: v,
@@ -186,29 +351,42 @@ func (d *MemoryDriver) pruneCache() {
 	sort.Sort(byExpirationAndSize(items))
 	threshold := uint64(float64(d.maxSize) * 0.9)
 	for _, v := range items {
-		delete(cache.items, v.key)
-		cache.size -= uint64(len(v.item.data))
-		if cache.size < threshold {
+		delete(d.store.items, v.key)
+		d.store.size -= uint64(len(v.item.data))
+		if d.store.size < threshold {
 			break
 		}
 	}
 }
 
+// NewMemoryDriver returns a new MemoryDriver with its own storage, not
+// shared with any other driver. If maxSize is non-zero, items are purged
+// when the total size of the stored data exceeds it.
+func NewMemoryDriver(maxSize uint64) *MemoryDriver {
+	return newMemoryDriver(newMemoryStore(), maxSize)
+}
+
+func newMemoryDriver(store *memoryStore, maxSize uint64) *MemoryDriver {
+	mdrv := &MemoryDriver{store: store}
+	if maxSize > 0 {
+		mdrv.maxSize = maxSize
+		mdrv.prune = make(chan struct{}, runtime.GOMAXPROCS(0))
+		go mdrv.pruneWorker(mdrv.prune)
+	}
+	return mdrv
+}
+
 func openMemoryDriver(url *config.URL) (Driver, error) {
-	mdrv := &MemoryDriver{}
+	var maxSize uint64
 	if ms := url.Fragment.Get("max_size"); ms != "" {
-		maxSize, err := parseutil.Size(ms)
-		if err != nil {
+		var err error
+		if maxSize, err = parseutil.Size(ms); err != nil {
 			return nil, fmt.Errorf("invalid max_size %q", ms)
 		}
-		mdrv.maxSize = maxSize
-		mdrv.prune = make(chan struct{}, runtime.GOMAXPROCS(0))
-		go mdrv.pruneWorker(mdrv.prune)
 	}
-	return mdrv, nil
+	return newMemoryDriver(shared, maxSize), nil
 }
 
 func init() {
-	cache.items = make(map[string]*item)
 	Register("memory", openMemoryDriver)
 }
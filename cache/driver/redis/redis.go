@@ -7,10 +7,17 @@
 // If no db is provided, it defaults to -1.
 // For the defaults and the explanation for the rest of the parameters,
 // see DefaultMaxIdle, DefaultMaxActive and DefaultIdleTimeout.
+//
+// This driver implements gnd.la/cache/driver.PubSub, so it can
+// be used as the remote driver of a tiered cache with invalidations.
+// It also implements gnd.la/cache/driver.TTLGetter, so the tiered
+// cache doesn't keep items in memory after they expire in redis.
 package redis
 
 import (
 	"fmt"
+	"io"
+	"sync"
 	"time"
 
 	"gnd.la/cache/driver"
@@ -48,6 +55,152 @@ func (r *redisDriver) Set(key string, b []byte, timeout int) error {
 	return err
 }
 
+func (r *redisDriver) Add(key string, b []byte, timeout int) (bool, error) {
+	conn := r.pool.Get()
+	var reply interface{}
+	var err error
+	if timeout == 0 {
+		reply, err = conn.Do("SET", key, b, "NX")
+	} else {
+		reply, err = conn.Do("SET", key, b, "EX", int32(timeout), "NX")
+	}
+	conn.Close()
+	if err != nil {
+		return false, err
+	}
+	if e, ok := reply.(redis.Error); ok {
+		return false, e
+	}
+	// SET with NX returns nil when the key was not set
+	return reply != nil, nil
+}
+
+func (r *redisDriver) Replace(key string, b []byte, timeout int) (bool, error) {
+	conn := r.pool.Get()
+	var reply interface{}
+	var err error
+	if timeout == 0 {
+		reply, err = conn.Do("SET", key, b, "XX")
+	} else {
+		reply, err = conn.Do("SET", key, b, "EX", int32(timeout), "XX")
+	}
+	conn.Close()
+	if err != nil {
+		return false, err
+	}
+	if e, ok := reply.(redis.Error); ok {
+		return false, e
+	}
+	// SET with XX returns nil when the key was not set
+	return reply != nil, nil
+}
+
+func (r *redisDriver) Increment(key string, delta int64, timeout int) (int64, error) {
+	conn := r.pool.Get()
+	defer conn.Close()
+	if timeout == 0 {
+		return redis.Int64(conn.Do("INCRBY", key, delta))
+	}
+	// Create the key with the timeout if it doesn't exist, so
+	// the expiration is only set when the counter is created.
+	conn.Send("MULTI")
+	conn.Send("SET", key, "0", "EX", int32(timeout), "NX")
+	conn.Send("INCRBY", key, delta)
+	values, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return 0, err
+	}
+	if len(values) != 2 {
+		return 0, fmt.Errorf("unexpected reply %v", values)
+	}
+	return redis.Int64(values[1], nil)
+}
+
+func (r *redisDriver) Decrement(key string, delta int64, timeout int) (int64, error) {
+	return r.Increment(key, -delta, timeout)
+}
+
+// casToken is the previous value, compareAndSwapScript sets
+// the new one only if the current value is equal to it.
+type casToken struct {
+	value []byte
+}
+
+var compareAndSwapScript = redis.NewScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	if ARGV[3] == "0" then
+		redis.call("SET", KEYS[1], ARGV[2])
+	else
+		redis.call("SET", KEYS[1], ARGV[2], "EX", ARGV[3])
+	end
+	return 1
+end
+return 0
+`)
+
+func (r *redisDriver) GetCAS(key string) ([]byte, driver.CASToken, error) {
+	b, err := r.Get(key)
+	if err != nil || b == nil {
+		return nil, nil, err
+	}
+	return b, &casToken{value: b}, nil
+}
+
+func (r *redisDriver) CompareAndSwap(key string, b []byte, token driver.CASToken, timeout int) (bool, error) {
+	tok, ok := token.(*casToken)
+	if !ok {
+		return false, fmt.Errorf("invalid CAS token %v", token)
+	}
+	conn := r.pool.Get()
+	swapped, err := redis.Int(compareAndSwapScript.Do(conn, key, tok.value, b, timeout))
+	conn.Close()
+	return swapped == 1, err
+}
+
+var compareAndDeleteScript = redis.NewScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+func (r *redisDriver) CompareAndDelete(key string, b []byte) (bool, error) {
+	conn := r.pool.Get()
+	deleted, err := redis.Int(compareAndDeleteScript.Do(conn, key, b))
+	conn.Close()
+	return deleted == 1, err
+}
+
+func (r *redisDriver) SetMulti(items map[string][]byte, timeout int) error {
+	conn := r.pool.Get()
+	defer conn.Close()
+	if timeout == 0 {
+		args := make([]interface{}, 0, len(items)*2)
+		for k, v := range items {
+			args = append(args, k, v)
+		}
+		_, err := conn.Do("MSET", args...)
+		return err
+	}
+	conn.Send("MULTI")
+	for k, v := range items {
+		conn.Send("SETEX", k, int32(timeout), v)
+	}
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+func (r *redisDriver) DeleteMulti(keys []string) error {
+	args := make([]interface{}, len(keys))
+	for ii, v := range keys {
+		args[ii] = v
+	}
+	conn := r.pool.Get()
+	_, err := conn.Do("DEL", args...)
+	conn.Close()
+	return err
+}
+
 func (r *redisDriver) Get(key string) ([]byte, error) {
 	conn := r.pool.Get()
 	reply, err := conn.Do("GET", key)
@@ -93,6 +246,53 @@ func (r *redisDriver) GetMulti(keys []string) (map[string][]byte, error) {
 	return ret, nil
 }
 
+// GetTTL implements the driver.TTLGetter interface.
+func (r *redisDriver) GetTTL(key string) ([]byte, time.Duration, error) {
+	values, ttls, err := r.GetMultiTTL([]string{key})
+	if err != nil {
+		return nil, 0, err
+	}
+	return values[key], ttls[key], nil
+}
+
+// GetMultiTTL implements the driver.TTLGetter interface.
+func (r *redisDriver) GetMultiTTL(keys []string) (map[string][]byte, map[string]time.Duration, error) {
+	conn := r.pool.Get()
+	defer conn.Close()
+	conn.Send("MULTI")
+	for _, v := range keys {
+		conn.Send("GET", v)
+		conn.Send("PTTL", v)
+	}
+	replies, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return nil, nil, err
+	}
+	values := make(map[string][]byte, len(keys))
+	ttls := make(map[string]time.Duration, len(keys))
+	for ii, k := range keys {
+		b, ok := replies[ii*2].([]byte)
+		if !ok {
+			// Missing item
+			continue
+		}
+		values[k] = b
+		// PTTL returns -1 for keys without an expiration, while
+		// 0 means the key is about to expire.
+		ms, err := redis.Int64(replies[ii*2+1], nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		switch {
+		case ms > 0:
+			ttls[k] = time.Duration(ms) * time.Millisecond
+		case ms == 0:
+			ttls[k] = time.Millisecond
+		}
+	}
+	return values, ttls, nil
+}
+
 func (r *redisDriver) Delete(key string) error {
 	conn := r.pool.Get()
 	_, err := conn.Do("DEL", key)
@@ -115,6 +315,93 @@ func (r *redisDriver) Flush() error {
 	return err
 }
 
+// Publish implements the driver.PubSub interface.
+func (r *redisDriver) Publish(channel string, msg []byte) error {
+	conn := r.pool.Get()
+	_, err := conn.Do("PUBLISH", channel, msg)
+	conn.Close()
+	return err
+}
+
+// Subscribe implements the driver.PubSub interface. Subscriptions
+// use their own connection, which is reestablished if it's lost.
+func (r *redisDriver) Subscribe(channel string, f func(msg []byte)) (io.Closer, error) {
+	s := &subscription{dial: r.pool.Dial, channel: channel}
+	conn, err := s.subscribe()
+	if err != nil {
+		return nil, err
+	}
+	go s.receive(conn, f)
+	return s, nil
+}
+
+type subscription struct {
+	mu      sync.Mutex
+	dial    func() (redis.Conn, error)
+	channel string
+	conn    redis.Conn
+	closed  bool
+}
+
+func (s *subscription) subscribe() (redis.PubSubConn, error) {
+	c, err := s.dial()
+	if err != nil {
+		return redis.PubSubConn{}, err
+	}
+	conn := redis.PubSubConn{Conn: c}
+	if err := conn.Subscribe(s.channel); err != nil {
+		c.Close()
+		return redis.PubSubConn{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		c.Close()
+		return redis.PubSubConn{}, io.ErrClosedPipe
+	}
+	s.conn = c
+	return conn, nil
+}
+
+func (s *subscription) receive(conn redis.PubSubConn, f func(msg []byte)) {
+	for {
+		switch v := conn.Receive().(type) {
+		case redis.Message:
+			f(v.Data)
+		case error:
+			// Connection lost or closed, reconnect
+			// unless the subscription was closed.
+			conn.Conn.Close()
+			for {
+				s.mu.Lock()
+				closed := s.closed
+				s.mu.Unlock()
+				if closed {
+					return
+				}
+				var err error
+				if conn, err = s.subscribe(); err == nil {
+					break
+				}
+				time.Sleep(time.Second)
+			}
+			// Notify about the messages which
+			// might have been lost.
+			f(nil)
+		}
+	}
+}
+
+func (s *subscription) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.conn != nil {
+		return s.conn.Close()
+	}
+	return nil
+}
+
 func redisOpener(url *config.URL) (driver.Driver, error) {
 	password := url.Fragment.Get("password")
 	db := -1
@@ -0,0 +1,547 @@
+package driver
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"gnd.la/config"
+	"gnd.la/util/parseutil"
+	"gnd.la/util/stringutil"
+)
+
+const (
+	// DefaultL1Size is the default maximum size of the
+	// in-memory cache used by the tiered driver.
+	DefaultL1Size = 64 * 1024 * 1024 // 64MiB
+	// DefaultL1TTL is the default maximum number of seconds an
+	// item is kept in memory by the tiered driver when the remote
+	// driver supports invalidations (see PubSub).
+	DefaultL1TTL = 60
+	// DefaultL1TTLNoInvalidation is the default maximum number of
+	// seconds an item is kept in memory by the tiered driver when
+	// the remote driver doesn't support invalidations.
+	DefaultL1TTLNoInvalidation = 5
+	// DefaultInvalidationChannel is the default channel used by
+	// the tiered driver for broadcasting invalidations.
+	DefaultInvalidationChannel = "gondola-cache-invalidations"
+
+	// Items stored in the L1 are prefixed with one of these
+	l1Negative = 0
+	l1Value    = 1
+
+	// Invalidation message types
+	invalidateKey   = 'k'
+	invalidateFlush = 'f'
+
+	tieredNodeIdLength = 16
+	tieredStripes      = 64
+)
+
+// TieredDriver implements a two-tier cache, which stores the items
+// both in a bounded in-memory cache (L1) and in a remote cache (L2).
+// Items are retrieved from the L1 when present, avoiding a roundtrip
+// to the remote cache. Missing items might also be cached in the L1
+// (negative caching), so frequent lookups of missing keys don't reach
+// the L2 either.
+//
+// Since each process has its own L1, items are only kept there for a
+// limited time. Additionally, when the remote driver implements PubSub
+// (e.g. redis), the keys set or deleted by a process are removed from
+// the L1 of the rest of them. Since invalidations might be lost while
+// the subscription is interrupted, the L1 is flushed when it's
+// reestablished.
+//
+// Items retrieved from the L2 are kept in the L1 for no longer than
+// their remaining lifetime in the L2 when the remote driver implements
+// TTLGetter. Items expiring in less than a second are not kept in the
+// L1 at all. Otherwise, items might be served from the L1 for up to
+// the L1 TTL after they expire in the L2.
+//
+// See the package documentation for the URL format.
+type TieredDriver struct {
+	l1          *MemoryDriver
+	l2          Driver
+	ttl         int
+	negativeTTL int
+	pubsub      PubSub
+	channel     string
+	node        string
+	sub         io.Closer
+	stripes     [tieredStripes]tieredStripe
+}
+
+// NewTieredDriver returns a new TieredDriver which uses l2 as its remote
+// driver and keeps up to l1Size bytes in memory for up to l1TTL seconds.
+// If negativeTTL is non-zero, missing items are remembered for that many
+// seconds. If l2 implements PubSub, invalidations are broadcast using it
+// in the given channel.
+func NewTieredDriver(l2 Driver, l1Size uint64, l1TTL int, negativeTTL int, channel string) (*TieredDriver, error) {
+	d := &TieredDriver{
+		l1:          NewMemoryDriver(l1Size),
+		l2:          l2,
+		ttl:         l1TTL,
+		negativeTTL: negativeTTL,
+		node:        stringutil.Random(tieredNodeIdLength),
+	}
+	if ps, ok := l2.(PubSub); ok {
+		sub, err := ps.Subscribe(channel, d.invalidated)
+		if err != nil {
+			d.l1.Close()
+			return nil, err
+		}
+		d.pubsub = ps
+		d.channel = channel
+		d.sub = sub
+	}
+	return d, nil
+}
+
+func (d *TieredDriver) l1Timeout(timeout int) int {
+	if timeout == 0 || timeout > d.ttl {
+		return d.ttl
+	}
+	return timeout
+}
+
+func (d *TieredDriver) setL1(key string, b []byte, timeout int) {
+	if b == nil {
+		if d.negativeTTL > 0 {
+			d.l1.Set(key, []byte{l1Negative}, d.negativeTTL)
+		}
+		return
+	}
+	data := make([]byte, len(b)+1)
+	data[0] = l1Value
+	copy(data[1:], b)
+	d.l1.Set(key, data, d.l1Timeout(timeout))
+}
+
+// tieredStripe protects the L1 items whose keys hash to it
+// and counts their invalidations, so values retrieved from
+// the L2 are not stored in the L1 if any of them happens while
+// they're being retrieved.
+type tieredStripe struct {
+	sync.Mutex
+	gen uint64
+}
+
+func (d *TieredDriver) stripe(key string) *tieredStripe {
+	h := fnv.New32a()
+	io.WriteString(h, key)
+	return &d.stripes[h.Sum32()%tieredStripes]
+}
+
+// generation returns the invalidation generation for the given key,
+// which must be passed to fillL1 after retrieving it from the L2.
+func (d *TieredDriver) generation(key string) uint64 {
+	s := d.stripe(key)
+	s.Lock()
+	gen := s.gen
+	s.Unlock()
+	return gen
+}
+
+// fillL1 stores an item retrieved from the L2 in the L1, unless it
+// has been invalidated since gen was obtained from generation. ttl
+// is the remaining lifetime of the item in the L2, zero if it doesn't
+// expire or it's unknown.
+func (d *TieredDriver) fillL1(key string, b []byte, ttl time.Duration, gen uint64) {
+	timeout := 0
+	if ttl != 0 {
+		// Round down, so the item expires from the L1 first
+		timeout = int(ttl / time.Second)
+		if timeout <= 0 {
+			return
+		}
+	}
+	s := d.stripe(key)
+	s.Lock()
+	if s.gen == gen {
+		d.setL1(key, b, timeout)
+	}
+	s.Unlock()
+}
+
+// storeL1 stores an item written by this process in the L1.
+func (d *TieredDriver) storeL1(key string, b []byte, timeout int) {
+	s := d.stripe(key)
+	s.Lock()
+	s.gen++
+	d.setL1(key, b, timeout)
+	s.Unlock()
+}
+
+// evictL1 removes the given key from the L1.
+func (d *TieredDriver) evictL1(key string) {
+	s := d.stripe(key)
+	s.Lock()
+	s.gen++
+	d.l1.Delete(key)
+	s.Unlock()
+}
+
+// flushL1 removes all the items from the L1.
+func (d *TieredDriver) flushL1() {
+	for ii := range d.stripes {
+		d.stripes[ii].Lock()
+		d.stripes[ii].gen++
+	}
+	d.l1.Flush()
+	for ii := range d.stripes {
+		d.stripes[ii].Unlock()
+	}
+}
+
+// getL1 returns the data for the item in the L1 and
+// true if it was found, even if it's a negative item.
+func (d *TieredDriver) getL1(b []byte) ([]byte, bool) {
+	if len(b) == 0 {
+		return nil, false
+	}
+	if b[0] == l1Negative {
+		return nil, true
+	}
+	return b[1:], true
+}
+
+func (d *TieredDriver) Set(key string, b []byte, timeout int) error {
+	if err := d.l2.Set(key, b, timeout); err != nil {
+		return err
+	}
+	d.storeL1(key, b, timeout)
+	return d.invalidate(invalidateKey, key)
+}
+
+// Add implements the Adder interface. It returns ErrNotImplemented
+// if the remote driver doesn't implement it.
+func (d *TieredDriver) Add(key string, b []byte, timeout int) (bool, error) {
+	adder, ok := d.l2.(Adder)
+	if !ok {
+		return false, ErrNotImplemented
+	}
+	added, err := adder.Add(key, b, timeout)
+	if err != nil || !added {
+		return added, err
+	}
+	d.storeL1(key, b, timeout)
+	return true, d.invalidate(invalidateKey, key)
+}
+
+// Replace implements the Replacer interface. It returns
+// ErrNotImplemented if the remote driver doesn't implement it.
+func (d *TieredDriver) Replace(key string, b []byte, timeout int) (bool, error) {
+	replacer, ok := d.l2.(Replacer)
+	if !ok {
+		return false, ErrNotImplemented
+	}
+	replaced, err := replacer.Replace(key, b, timeout)
+	if err != nil || !replaced {
+		return replaced, err
+	}
+	d.storeL1(key, b, timeout)
+	return true, d.invalidate(invalidateKey, key)
+}
+
+// CompareAndDelete implements the CompareAndDeleter interface. It
+// returns ErrNotImplemented if the remote driver doesn't implement it.
+func (d *TieredDriver) CompareAndDelete(key string, b []byte) (bool, error) {
+	deleter, ok := d.l2.(CompareAndDeleter)
+	if !ok {
+		return false, ErrNotImplemented
+	}
+	deleted, err := deleter.CompareAndDelete(key, b)
+	if err != nil || !deleted {
+		return deleted, err
+	}
+	d.evictL1(key)
+	return true, d.invalidate(invalidateKey, key)
+}
+
+// Increment implements the Counter interface. It returns
+// ErrNotImplemented if the remote driver doesn't implement it.
+// Counters are not stored in the L1.
+func (d *TieredDriver) Increment(key string, delta int64, timeout int) (int64, error) {
+	counter, ok := d.l2.(Counter)
+	if !ok {
+		return 0, ErrNotImplemented
+	}
+	val, err := counter.Increment(key, delta, timeout)
+	if err != nil {
+		return 0, err
+	}
+	d.evictL1(key)
+	return val, d.invalidate(invalidateKey, key)
+}
+
+// Decrement implements the Counter interface. See Increment.
+func (d *TieredDriver) Decrement(key string, delta int64, timeout int) (int64, error) {
+	return d.Increment(key, -delta, timeout)
+}
+
+// GetCAS implements the CASer interface, always retrieving the item
+// from the remote driver. It returns ErrNotImplemented if the remote
+// driver doesn't implement it.
+func (d *TieredDriver) GetCAS(key string) ([]byte, CASToken, error) {
+	caser, ok := d.l2.(CASer)
+	if !ok {
+		return nil, nil, ErrNotImplemented
+	}
+	return caser.GetCAS(key)
+}
+
+// CompareAndSwap implements the CASer interface. See GetCAS.
+func (d *TieredDriver) CompareAndSwap(key string, b []byte, token CASToken, timeout int) (bool, error) {
+	caser, ok := d.l2.(CASer)
+	if !ok {
+		return false, ErrNotImplemented
+	}
+	swapped, err := caser.CompareAndSwap(key, b, token, timeout)
+	if err != nil || !swapped {
+		return swapped, err
+	}
+	d.storeL1(key, b, timeout)
+	return true, d.invalidate(invalidateKey, key)
+}
+
+// SetMulti implements the MultiSetter interface. It returns
+// ErrNotImplemented if the remote driver doesn't implement it.
+func (d *TieredDriver) SetMulti(items map[string][]byte, timeout int) error {
+	setter, ok := d.l2.(MultiSetter)
+	if !ok {
+		return ErrNotImplemented
+	}
+	if err := setter.SetMulti(items, timeout); err != nil {
+		return err
+	}
+	for k, v := range items {
+		d.storeL1(k, v, timeout)
+		if err := d.invalidate(invalidateKey, k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteMulti implements the MultiDeleter interface. It returns
+// ErrNotImplemented if the remote driver doesn't implement it.
+func (d *TieredDriver) DeleteMulti(keys []string) error {
+	deleter, ok := d.l2.(MultiDeleter)
+	if !ok {
+		return ErrNotImplemented
+	}
+	if err := deleter.DeleteMulti(keys); err != nil {
+		return err
+	}
+	for _, k := range keys {
+		d.evictL1(k)
+		if err := d.invalidate(invalidateKey, k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *TieredDriver) Get(key string) ([]byte, error) {
+	cached, _ := d.l1.Get(key)
+	if b, found := d.getL1(cached); found {
+		return b, nil
+	}
+	gen := d.generation(key)
+	var b []byte
+	var ttl time.Duration
+	var err error
+	if tg, ok := d.l2.(TTLGetter); ok {
+		b, ttl, err = tg.GetTTL(key)
+	} else {
+		b, err = d.l2.Get(key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	d.fillL1(key, b, ttl, gen)
+	return b, nil
+}
+
+func (d *TieredDriver) GetMulti(keys []string) (map[string][]byte, error) {
+	cached, _ := d.l1.GetMulti(keys)
+	results := make(map[string][]byte, len(keys))
+	var missing []string
+	for _, k := range keys {
+		if b, found := d.getL1(cached[k]); found {
+			if b != nil {
+				results[k] = b
+			}
+			continue
+		}
+		missing = append(missing, k)
+	}
+	if len(missing) > 0 {
+		gens := make([]uint64, len(missing))
+		for ii, k := range missing {
+			gens[ii] = d.generation(k)
+		}
+		var values map[string][]byte
+		var ttls map[string]time.Duration
+		var err error
+		if tg, ok := d.l2.(TTLGetter); ok {
+			values, ttls, err = tg.GetMultiTTL(missing)
+		} else {
+			values, err = d.l2.GetMulti(missing)
+		}
+		if err != nil {
+			return nil, err
+		}
+		for ii, k := range missing {
+			b := values[k]
+			if b != nil {
+				results[k] = b
+			}
+			d.fillL1(k, b, ttls[k], gens[ii])
+		}
+	}
+	return results, nil
+}
+
+func (d *TieredDriver) Delete(key string) error {
+	if err := d.l2.Delete(key); err != nil {
+		return err
+	}
+	d.evictL1(key)
+	return d.invalidate(invalidateKey, key)
+}
+
+func (d *TieredDriver) Flush() error {
+	if err := d.l2.Flush(); err != nil {
+		return err
+	}
+	d.flushL1()
+	return d.invalidate(invalidateFlush, "")
+}
+
+func (d *TieredDriver) Close() error {
+	if d.sub != nil {
+		d.sub.Close()
+	}
+	d.l1.Close()
+	return d.l2.Close()
+}
+
+// Connection returns the connection of the remote driver.
+func (d *TieredDriver) Connection() interface{} {
+	return d.l2.Connection()
+}
+
+// L1 returns the in-memory driver.
+func (d *TieredDriver) L1() *MemoryDriver {
+	return d.l1
+}
+
+// L2 returns the remote driver.
+func (d *TieredDriver) L2() Driver {
+	return d.l2
+}
+
+// invalidate broadcasts the invalidation to the other processes. Messages
+// include the node id, so each process can ignore its own messages.
+func (d *TieredDriver) invalidate(typ byte, key string) error {
+	if d.pubsub == nil {
+		return nil
+	}
+	var buf bytes.Buffer
+	buf.WriteByte(typ)
+	buf.WriteString(d.node)
+	buf.WriteString(key)
+	return d.pubsub.Publish(d.channel, buf.Bytes())
+}
+
+func (d *TieredDriver) invalidated(msg []byte) {
+	if msg == nil {
+		// Subscription reconnected, invalidations
+		// might have been lost.
+		d.flushL1()
+		return
+	}
+	if len(msg) < tieredNodeIdLength+1 || string(msg[1:tieredNodeIdLength+1]) == d.node {
+		return
+	}
+	switch msg[0] {
+	case invalidateKey:
+		d.evictL1(string(msg[tieredNodeIdLength+1:]))
+	case invalidateFlush:
+		d.flushL1()
+	}
+}
+
+func openTieredDriver(url *config.URL) (Driver, error) {
+	remote := url.Query.Get("remote")
+	if remote == "" {
+		return nil, fmt.Errorf("missing remote driver URL")
+	}
+	remoteURL, err := config.ParseURL(remote)
+	if err != nil {
+		return nil, fmt.Errorf("invalid remote driver URL: %s", err)
+	}
+	if remoteURL.Scheme == "tiered" {
+		return nil, fmt.Errorf("remote driver can't be another tiered driver")
+	}
+	opener := Get(remoteURL.Scheme)
+	if opener == nil {
+		return nil, fmt.Errorf("unknown remote cache driver %q, maybe you forgot an import?", remoteURL.Scheme)
+	}
+	size := uint64(DefaultL1Size)
+	if s := url.Fragment.Get("l1_size"); s != "" {
+		if size, err = parseutil.Size(s); err != nil {
+			return nil, fmt.Errorf("invalid l1_size %q", s)
+		}
+	}
+	intOption := func(name string, def int) (int, error) {
+		s := url.Fragment.Get(name)
+		if s == "" {
+			return def, nil
+		}
+		val, err := strconv.Atoi(s)
+		if err != nil || val < 0 {
+			return 0, fmt.Errorf("invalid %s %q", name, s)
+		}
+		return val, nil
+	}
+	negativeTTL, err := intOption("negative_ttl", 0)
+	if err != nil {
+		return nil, err
+	}
+	l2, err := opener(remoteURL)
+	if err != nil {
+		return nil, err
+	}
+	defTTL := DefaultL1TTLNoInvalidation
+	if _, ok := l2.(PubSub); ok {
+		defTTL = DefaultL1TTL
+	}
+	ttl, err := intOption("l1_ttl", defTTL)
+	if err == nil && ttl == 0 {
+		err = fmt.Errorf("l1_ttl can't be zero")
+	}
+	if err != nil {
+		l2.Close()
+		return nil, err
+	}
+	channel := url.Fragment.Get("channel")
+	if channel == "" {
+		channel = DefaultInvalidationChannel
+	}
+	d, err := NewTieredDriver(l2, size, ttl, negativeTTL, channel)
+	if err != nil {
+		l2.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+func init() {
+	Register("tiered", openTieredDriver)
+}
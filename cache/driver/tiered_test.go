@@ -0,0 +1,230 @@
+package driver
+
+import (
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryPubSub wraps a MemoryDriver, implementing
+// PubSub with an in-process broadcast.
+type memoryPubSub struct {
+	*MemoryDriver
+	mu   sync.Mutex
+	subs []func([]byte)
+}
+
+func (m *memoryPubSub) Publish(channel string, msg []byte) error {
+	m.mu.Lock()
+	subs := m.subs
+	m.mu.Unlock()
+	for _, v := range subs {
+		v(msg)
+	}
+	return nil
+}
+
+func (m *memoryPubSub) Subscribe(channel string, f func([]byte)) (io.Closer, error) {
+	m.mu.Lock()
+	m.subs = append(m.subs, f)
+	m.mu.Unlock()
+	return nopCloser{}, nil
+}
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
+
+func TestTiered(t *testing.T) {
+	l2 := &memoryPubSub{MemoryDriver: NewMemoryDriver(0)}
+	d1, err := NewTieredDriver(l2, 1024, DefaultL1TTL, 60, DefaultInvalidationChannel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d2, err := NewTieredDriver(l2, 1024, DefaultL1TTL, 60, DefaultInvalidationChannel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(d *TieredDriver, key string) string {
+		b, err := d.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	// Negative caching
+	if v := get(d2, "a"); v != "" {
+		t.Fatalf("expecting missing key, got %q", v)
+	}
+	l2.MemoryDriver.Set("a", []byte("remote"), 0)
+	if v := get(d2, "a"); v != "" {
+		t.Errorf("expecting negatively cached key, got %q", v)
+	}
+	// Invalidation from another process
+	if err := d1.Set("a", []byte("1"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if v := get(d2, "a"); v != "1" {
+		t.Errorf("expecting invalidated key with value 1, got %q", v)
+	}
+	// L1 is used when present
+	l2.MemoryDriver.Set("a", []byte("remote"), 0)
+	if v := get(d2, "a"); v != "1" {
+		t.Errorf("expecting value 1 from L1, got %q", v)
+	}
+	if err := d1.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if v := get(d2, "a"); v != "" {
+		t.Errorf("expecting deleted key, got %q", v)
+	}
+	d1.Set("b", []byte("2"), 0)
+	res, err := d2.GetMulti([]string{"a", "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || string(res["b"]) != "2" {
+		t.Errorf("unexpected GetMulti result %v", res)
+	}
+}
+
+// blockingGet wraps a memoryPubSub, blocking Get and
+// GetTTL until release is closed.
+type blockingGet struct {
+	*memoryPubSub
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingGet) Get(key string) ([]byte, error) {
+	data, _, err := b.GetTTL(key)
+	return data, err
+}
+
+func (b *blockingGet) GetTTL(key string) ([]byte, time.Duration, error) {
+	data, ttl, err := b.memoryPubSub.GetTTL(key)
+	close(b.started)
+	<-b.release
+	return data, ttl, err
+}
+
+func TestTieredFillAfterInvalidation(t *testing.T) {
+	ps := &memoryPubSub{MemoryDriver: NewMemoryDriver(0)}
+	l2 := &blockingGet{memoryPubSub: ps, started: make(chan struct{}), release: make(chan struct{})}
+	d1, err := NewTieredDriver(l2, 1024, DefaultL1TTL, 60, DefaultInvalidationChannel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d2, err := NewTieredDriver(ps, 1024, DefaultL1TTL, 60, DefaultInvalidationChannel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps.MemoryDriver.Set("a", []byte("old"), 0)
+	done := make(chan []byte)
+	go func() {
+		b, _ := d1.Get("a")
+		done <- b
+	}()
+	// Update the key from another process while d1
+	// is retrieving the old value from the L2.
+	<-l2.started
+	if err := d2.Set("a", []byte("new"), 0); err != nil {
+		t.Fatal(err)
+	}
+	close(l2.release)
+	if b := <-done; string(b) != "old" {
+		t.Errorf("expecting old value from the L2, got %q", b)
+	}
+	// The old value must not be stored in the L1
+	cached, _ := d1.l1.Get("a")
+	if b, found := d1.getL1(cached); found {
+		t.Errorf("expecting no value in the L1 after invalidation, got %q", b)
+	}
+}
+
+func TestTieredReconnect(t *testing.T) {
+	l2 := &memoryPubSub{MemoryDriver: NewMemoryDriver(0)}
+	d, err := NewTieredDriver(l2, 1024, DefaultL1TTL, 60, DefaultInvalidationChannel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Set("a", []byte("1"), 0); err != nil {
+		t.Fatal(err)
+	}
+	// Changed while the subscription was down
+	l2.MemoryDriver.Set("a", []byte("2"), 0)
+	l2.Publish(DefaultInvalidationChannel, nil)
+	if b, err := d.Get("a"); err != nil || string(b) != "2" {
+		t.Errorf("expecting L1 to be flushed after reconnecting, got %q (error %v)", b, err)
+	}
+}
+
+// fixedTTL wraps a memoryPubSub, returning the
+// same TTL for all the items.
+type fixedTTL struct {
+	*memoryPubSub
+	ttl time.Duration
+}
+
+func (f *fixedTTL) GetTTL(key string) ([]byte, time.Duration, error) {
+	b, err := f.Get(key)
+	return b, f.ttl, err
+}
+
+func (f *fixedTTL) GetMultiTTL(keys []string) (map[string][]byte, map[string]time.Duration, error) {
+	values, err := f.GetMulti(keys)
+	ttls := make(map[string]time.Duration)
+	for k := range values {
+		ttls[k] = f.ttl
+	}
+	return values, ttls, err
+}
+
+func TestTieredRemoteTTL(t *testing.T) {
+	l2 := &fixedTTL{memoryPubSub: &memoryPubSub{MemoryDriver: NewMemoryDriver(0)}}
+	d, err := NewTieredDriver(l2, 1024, DefaultL1TTL, 0, DefaultInvalidationChannel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ttl     time.Duration
+		cached  bool
+		timeout int64
+	}{
+		{0, true, DefaultL1TTL},
+		{500 * time.Millisecond, false, 0},
+		{3500 * time.Millisecond, true, 3},
+		{time.Hour, true, DefaultL1TTL},
+	}
+	for ii, v := range tests {
+		l2.ttl = v.ttl
+		for _, multi := range []bool{false, true} {
+			d.Flush()
+			l2.MemoryDriver.Set("a", []byte("1"), 0)
+			now := time.Now().Unix()
+			if multi {
+				_, err = d.GetMulti([]string{"a"})
+			} else {
+				_, err = d.Get("a")
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			d.l1.store.RLock()
+			item := d.l1.store.items["a"]
+			d.l1.store.RUnlock()
+			if (item != nil) != v.cached {
+				t.Errorf("%d: expecting item cached in L1 = %v with remote TTL %v", ii, v.cached, v.ttl)
+				continue
+			}
+			if item == nil {
+				continue
+			}
+			// Allow for a second boundary between now and the L1 fill
+			if timeout := item.expires - now; timeout != v.timeout && timeout != v.timeout+1 {
+				t.Errorf("%d: expecting L1 timeout %d with remote TTL %v, got %d", ii, v.timeout, v.ttl, timeout)
+			}
+		}
+	}
+}
@@ -2,7 +2,9 @@ package driver
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // DefaultPort adds port to the addr passed in
@@ -42,3 +44,24 @@ func DefaultPort(addr string, port int) string {
 	}
 	return addr
 }
+
+// expiration returns the Unix timestamp when an item
+// with the given timeout expires, or zero if it doesn't.
+func expiration(timeout int) int64 {
+	if timeout == 0 {
+		return 0
+	}
+	return time.Now().Unix() + int64(timeout)
+}
+
+func parseCounter(b []byte) (int64, error) {
+	val, err := strconv.ParseInt(string(b), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("value %q is not an integer", string(b))
+	}
+	return val, nil
+}
+
+func formatCounter(val int64) []byte {
+	return []byte(strconv.FormatInt(val, 10))
+}
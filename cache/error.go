@@ -2,6 +2,8 @@ package cache
 
 import (
 	"fmt"
+
+	"gnd.la/cache/driver"
 )
 
 // cError is the interface implemented by some errors returned by the cache
@@ -39,3 +41,13 @@ func (c *cacheError) Codec() bool {
 func (c *cacheError) Err() error {
 	return c.err
 }
+
+// IsNotImplemented returns true iff the error was returned
+// by a Cache method because its driver doesn't implement
+// the requested operation (see gnd.la/cache/driver.ErrNotImplemented).
+func IsNotImplemented(err error) bool {
+	if cerr, ok := err.(cError); ok {
+		err = cerr.Err()
+	}
+	return err == driver.ErrNotImplemented
+}
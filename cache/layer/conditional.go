@@ -0,0 +1,120 @@
+package layer
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// notModifiedHeaders are the headers sent
+// with a 304 response (see RFC 7232, section 4.1).
+var notModifiedHeaders = []string{
+	"Cache-Control",
+	"Content-Location",
+	"Date",
+	"Etag",
+	"Expires",
+	"Last-Modified",
+	"Vary",
+}
+
+// validatorHeaders are the headers added by the
+// Layer to the responses it caches.
+var validatorHeaders = []string{
+	"Etag",
+	"Last-Modified",
+}
+
+// notModified returns true iff the request r is a conditional
+// request which can be answered with a 304 for a response with
+// the given headers. As specified by RFC 7232, If-Modified-Since
+// is ignored when If-None-Match is present.
+func notModified(r *http.Request, header http.Header) bool {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := header.Get("ETag")
+		return etag != "" && etagMatches(inm, etag)
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+		since, err := http.ParseTime(ims)
+		if err != nil {
+			return false
+		}
+		modified, err := http.ParseTime(header.Get("Last-Modified"))
+		if err != nil {
+			return false
+		}
+		return !modified.After(since)
+	}
+	return false
+}
+
+// etagMatches returns true iff the If-None-Match value
+// matches the given etag, using the weak comparison.
+func etagMatches(ifNoneMatch string, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, v := range strings.Split(ifNoneMatch, ",") {
+		v = strings.TrimSpace(v)
+		if v == "*" || strings.TrimPrefix(v, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheControl contains the directives in a Cache-Control
+// header, mapped to their values (empty for directives
+// without a value).
+type cacheControl map[string]string
+
+func parseCacheControl(header http.Header) cacheControl {
+	cc := make(cacheControl)
+	for _, h := range header["Cache-Control"] {
+		for _, v := range strings.Split(h, ",") {
+			v = strings.TrimSpace(v)
+			if v == "" {
+				continue
+			}
+			var value string
+			if eq := strings.IndexByte(v, '='); eq >= 0 {
+				v, value = v[:eq], strings.Trim(v[eq+1:], "\"")
+			}
+			cc[strings.ToLower(v)] = value
+		}
+	}
+	return cc
+}
+
+// cacheable returns false if the directives forbid
+// storing the response in a shared cache.
+func (cc cacheControl) cacheable() bool {
+	for _, v := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := cc[v]; ok {
+			return false
+		}
+	}
+	return true
+}
+
+// maxAge returns the expiration indicated by s-maxage
+// or max-age, in that order of preference.
+func (cc cacheControl) maxAge() (int, bool) {
+	if v, ok := cc.seconds("s-maxage"); ok {
+		return v, true
+	}
+	return cc.seconds("max-age")
+}
+
+func (cc cacheControl) seconds(directive string) (int, bool) {
+	v, ok := cc[directive]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return n, true
+}
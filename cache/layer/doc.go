@@ -20,4 +20,40 @@
 //  }
 //  layer := layer.New(cache.Cache, &layer.SimpleMediator{Expiration:600})
 //  myapp.Handle("/something/", layer.Wrap(MyHandler))
+//
+// Cached responses might be associated with tags, either by calling Tag
+// from the handler or by implementing the Tagger interface in the Mediator.
+// Invalidating a tag with gnd.la/cache.Cache.InvalidateTag invalidates all
+// the responses associated with it.
+//
+//  func ArticleHandler(ctx *app.Context) {
+//	article := ...
+//	layer.Tag(ctx, fmt.Sprintf("article-%d", article.Id))
+//	...
+//  }
+//
+//  // After updating the article
+//  cache.InvalidateTag(fmt.Sprintf("article-%d", article.Id))
+//
+// Responses served from the cache include an ETag and a Last-Modified
+// header (generated by the Layer when the handler doesn't set them), and
+// conditional requests using If-None-Match or If-Modified-Since are
+// answered with a 304 when the cached response hasn't changed.
+//
+// Handlers might also control caching with the Cache-Control header.
+// Responses with no-store, no-cache or private are never cached, while
+// s-maxage and max-age (in that order of preference) override the
+// expiration returned by the Mediator.
+//
+// Finally, the Layer might serve stale responses for some time after
+// they expire, while a single goroutine refreshes them in the background,
+// avoiding making all the requests wait for the handler. Use
+// Layer.SetStaleWhileRevalidate to enable this behavior for all responses
+// or the stale-while-revalidate directive in the Cache-Control header to
+// enable it for a given response.
+//
+//  func ArticleHandler(ctx *app.Context) {
+//	ctx.Header().Set("Cache-Control", "public, max-age=60, stale-while-revalidate=600")
+//	...
+//  }
 package layer
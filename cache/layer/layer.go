@@ -5,9 +5,13 @@ import (
 	"errors"
 	"net/http"
 	"os"
+	"strconv"
+	"sync"
+	"time"
 
 	"gnd.la/app"
 	"gnd.la/cache"
+	"gnd.la/crypto/hashutil"
 	"gnd.la/encoding/codec"
 	"gnd.la/internal"
 	"gnd.la/log"
@@ -21,17 +25,42 @@ var (
 	noCacheLayer  = os.Getenv("GONDOLA_NO_CACHE_LAYER") != ""
 )
 
+const (
+	tagsKey            = "___gondola_layer_tags"
+	refreshLockSuffix  = ".refresh"
+	refreshLockTimeout = 30
+)
+
 type cachedResponse struct {
 	Header     http.Header
 	StatusCode int
 	Data       []byte
+	// Created is the Unix time when the response was cached.
+	Created int64
+	// Expires is the Unix time when the response becomes
+	// stale, zero if it never does.
+	Expires int64
+	// StaleUntil is the Unix time until which the response
+	// might be served while it's being refreshed.
+	StaleUntil int64
+}
+
+func (r *cachedResponse) stale(now int64) bool {
+	return r.Expires > 0 && now >= r.Expires
+}
+
+func (r *cachedResponse) expired(now int64) bool {
+	return r.StaleUntil > 0 && now >= r.StaleUntil
 }
 
 // Layer allows caching complete responses to requests.
 // Use New to initialize a Layer.
 type Layer struct {
-	cache    *cache.Cache
-	mediator Mediator
+	cache                *cache.Cache
+	mediator             Mediator
+	staleWhileRevalidate int
+	mu                   sync.Mutex
+	refreshing           map[string]bool
 }
 
 // New returns a new layer, returning only errors if
@@ -56,9 +85,30 @@ func (la *Layer) Mediator() Mediator {
 	return la.mediator
 }
 
+// StaleWhileRevalidate returns the number of seconds a stale
+// response might be served while it's being refreshed. See
+// SetStaleWhileRevalidate.
+func (la *Layer) StaleWhileRevalidate() int {
+	return la.staleWhileRevalidate
+}
+
+// SetStaleWhileRevalidate sets the number of seconds a response
+// might be served after it expires. During that time, the stale
+// response is served while a single goroutine refreshes it in the
+// background. Handlers might override this value for their responses
+// with the stale-while-revalidate directive in the Cache-Control
+// header. The default value is zero, which disables serving stale
+// responses.
+func (la *Layer) SetStaleWhileRevalidate(seconds int) {
+	la.staleWhileRevalidate = seconds
+}
+
 // Wrap takes a app.Handler and returns a new app.Handler
 // wrapped by the Layer. Responses will be cached according
-// to what the Layer's Mediator indicates. Note that when
+// to what the Layer's Mediator indicates and to the Cache-Control
+// header set by the handler. Cached responses are served
+// with an ETag and a Last-Modified header and conditional
+// requests are answered with 304 when possible. Note that when
 // the environment variable GONDOLA_NO_CACHE_LAYER is non
 // empty, Wrap returns the same app.Handler that was
 // received (id est, it does nothing). This is done in
@@ -74,41 +124,196 @@ func (la *Layer) Wrap(handler app.Handler) app.Handler {
 			return
 		}
 		key := la.mediator.Key(ctx)
-		data, _ := la.cache.GetBytes(key)
-		if data != nil {
-			// has cached data
-			var response *cachedResponse
-			err := layerCodec.Decode(data, &response)
-			if err == nil {
-				ctx.Set(internal.LayerServedFromCacheKey, true)
-				header := ctx.Header()
-				for k, v := range response.Header {
-					header[k] = v
-				}
-				header["X-Gondola-From-Layer"] = fromLayer
-				ctx.WriteHeader(response.StatusCode)
-				ctx.Write(response.Data)
-				return
+		if response := la.cached(key); response != nil {
+			if response.stale(time.Now().Unix()) {
+				la.refresh(ctx, key, handler)
 			}
+			la.serve(ctx, response)
+			return
 		}
-
 		rw := ctx.ResponseWriter
 		w := newWriter(rw)
 		ctx.ResponseWriter = w
 		handler(ctx)
 		ctx.ResponseWriter = rw
-		if la.mediator.Cache(ctx, w.statusCode, w.header) {
-			response := &cachedResponse{w.header, w.statusCode, w.buf.Bytes()}
-			data, err := layerCodec.Encode(response)
-			if err == nil {
-				ctx.Set(internal.LayerCachedKey, true)
-				expiration := la.mediator.Expires(ctx, w.statusCode, w.header)
-				la.cache.SetBytes(key, data, expiration)
-			} else {
-				log.Errorf("Error encoding cached response: %v", err)
+		// The response is buffered by w, so the validators
+		// can be added before sending it.
+		response, timeout := la.response(ctx, w)
+		if response == nil {
+			w.flush()
+			return
+		}
+		header := rw.Header()
+		for _, k := range validatorHeaders {
+			header[k] = response.Header[k]
+		}
+		la.store(ctx, key, response, timeout)
+		if response.StatusCode == http.StatusOK && notModified(ctx.R, response.Header) {
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.flush()
+	}
+}
+
+// cached returns the cached response for the given key, or
+// nil if there's no response or it can't be served anymore.
+func (la *Layer) cached(key string) *cachedResponse {
+	data, _ := la.cache.GetBytes(key)
+	if data == nil {
+		return nil
+	}
+	var response *cachedResponse
+	if err := layerCodec.Decode(data, &response); err != nil || response == nil {
+		return nil
+	}
+	if response.expired(time.Now().Unix()) {
+		return nil
+	}
+	return response
+}
+
+func (la *Layer) serve(ctx *app.Context, response *cachedResponse) {
+	ctx.Set(internal.LayerServedFromCacheKey, true)
+	header := ctx.Header()
+	if response.StatusCode == http.StatusOK && notModified(ctx.R, response.Header) {
+		for _, k := range notModifiedHeaders {
+			if v := response.Header[k]; v != nil {
+				header[k] = v
 			}
 		}
+		header["X-Gondola-From-Layer"] = fromLayer
+		ctx.WriteHeader(http.StatusNotModified)
+		return
+	}
+	for k, v := range response.Header {
+		header[k] = v
+	}
+	header["X-Gondola-From-Layer"] = fromLayer
+	if response.Created > 0 {
+		if age := time.Now().Unix() - response.Created; age > 0 {
+			header.Set("Age", strconv.FormatInt(age, 10))
+		}
 	}
+	ctx.WriteHeader(response.StatusCode)
+	ctx.Write(response.Data)
+}
+
+// response returns the response recorded by w, including its
+// validators, and the timeout for caching it. If the Mediator or
+// the response headers don't allow caching it, it returns nil.
+func (la *Layer) response(ctx *app.Context, w *writer) (*cachedResponse, int) {
+	w.copyHeaders()
+	if !la.mediator.Cache(ctx, w.statusCode, w.header) {
+		return nil, 0
+	}
+	cc := parseCacheControl(w.header)
+	if !cc.cacheable() {
+		return nil, 0
+	}
+	expiration := la.mediator.Expires(ctx, w.statusCode, w.header)
+	if maxAge, ok := cc.maxAge(); ok {
+		if maxAge <= 0 {
+			return nil, 0
+		}
+		expiration = maxAge
+	}
+	stale := la.staleWhileRevalidate
+	if v, ok := cc.seconds("stale-while-revalidate"); ok {
+		stale = v
+	}
+	now := time.Now()
+	response := &cachedResponse{
+		Header:     w.header,
+		StatusCode: w.statusCode,
+		Data:       w.buf.Bytes(),
+		Created:    now.Unix(),
+	}
+	if response.Header.Get("ETag") == "" {
+		response.Header.Set("ETag", strconv.Quote(hashutil.Md5(response.Data)))
+	}
+	if response.Header.Get("Last-Modified") == "" {
+		response.Header.Set("Last-Modified", now.UTC().Format(http.TimeFormat))
+	}
+	timeout := expiration
+	if expiration > 0 {
+		response.Expires = response.Created + int64(expiration)
+		response.StaleUntil = response.Expires
+		if stale > 0 {
+			response.StaleUntil += int64(stale)
+			timeout += stale
+		}
+	}
+	return response, timeout
+}
+
+// store caches the given response with the given timeout.
+func (la *Layer) store(ctx *app.Context, key string, response *cachedResponse, timeout int) {
+	data, err := layerCodec.Encode(response)
+	if err != nil {
+		log.Errorf("Error encoding cached response: %v", err)
+		return
+	}
+	ctx.Set(internal.LayerCachedKey, true)
+	tags := Tags(ctx)
+	if tagger, ok := la.mediator.(Tagger); ok {
+		tags = append(tags, tagger.Tags(ctx, response.StatusCode, response.Header)...)
+	}
+	la.cache.SetBytesTagged(key, data, timeout, tags...)
+}
+
+// refresh runs the handler in the background to refresh a
+// stale response. Only a goroutine per process refreshes a
+// given key and, if the cache driver supports adding items,
+// only a process among all the ones sharing the cache.
+func (la *Layer) refresh(ctx *app.Context, key string, handler app.Handler) {
+	la.mu.Lock()
+	if la.refreshing[key] {
+		la.mu.Unlock()
+		return
+	}
+	if la.refreshing == nil {
+		la.refreshing = make(map[string]bool)
+	}
+	la.refreshing[key] = true
+	la.mu.Unlock()
+	ctx.Go(func(bg *app.Context) {
+		defer func() {
+			la.mu.Lock()
+			delete(la.refreshing, key)
+			la.mu.Unlock()
+		}()
+		lockKey := key + refreshLockSuffix
+		locked, err := la.cache.Add(lockKey, true, refreshLockTimeout)
+		if err == nil {
+			if !locked {
+				// Another process is refreshing it
+				return
+			}
+			defer la.cache.Delete(lockKey)
+		}
+		w := newWriter(newRecorder())
+		bg.ResponseWriter = w
+		handler(bg)
+		if response, timeout := la.response(bg, w); response != nil {
+			la.store(bg, key, response, timeout)
+		}
+	})
+}
+
+// Tag associates the given tags with the response to the request
+// in the given context, if it's cached by a Layer. Use
+// gnd.la/cache.Cache.InvalidateTag to invalidate all the
+// responses with a given tag.
+func Tag(ctx *app.Context, tags ...string) {
+	ctx.Set(tagsKey, append(Tags(ctx), tags...))
+}
+
+// Tags returns the tags associated with the response to the
+// request in the given context using Tag.
+func Tags(ctx *app.Context) []string {
+	tags, _ := ctx.Get(tagsKey).([]string)
+	return tags
 }
 
 func init() {
@@ -0,0 +1,289 @@
+package layer
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gnd.la/app"
+	"gnd.la/cache"
+	"gnd.la/config"
+	"gnd.la/crypto/hashutil"
+)
+
+type taggingMediator struct {
+	SimpleMediator
+	tags []string
+}
+
+func (m *taggingMediator) Tags(ctx *app.Context, responseCode int, outgoingHeaders http.Header) []string {
+	return m.tags
+}
+
+func newTestLayer(t *testing.T, m Mediator) *Layer {
+	c, err := cache.New(config.MustParseURL("memory://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	la, err := New(c, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return la
+}
+
+func newTestApp(pattern string, handler app.Handler) *app.App {
+	a := app.New()
+	a.Logger = nil
+	a.Handle(pattern, handler)
+	return a
+}
+
+func request(a *app.App, path string, header http.Header) *httptest.ResponseRecorder {
+	r, _ := http.NewRequest("GET", "http://example.com"+path, nil)
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	a.ServeHTTP(w, r)
+	return w
+}
+
+func TestTags(t *testing.T) {
+	la := newTestLayer(t, &taggingMediator{
+		SimpleMediator: SimpleMediator{Expiration: 60},
+		tags:           []string{"articles"},
+	})
+	calls := 0
+	a := newTestApp("^/layer/tags$", la.Wrap(func(ctx *app.Context) {
+		calls++
+		Tag(ctx, "article-1")
+		ctx.WriteString("article")
+	}))
+	steps := []struct {
+		invalidate string
+		calls      int
+	}{
+		{"", 1},
+		// Cached
+		{"", 1},
+		// Tag added with Tag
+		{"article-1", 2},
+		{"", 2},
+		// Tag added by the Tagger
+		{"articles", 3},
+		{"", 3},
+		// Unrelated tag
+		{"article-2", 3},
+	}
+	for ii, v := range steps {
+		if v.invalidate != "" {
+			if err := la.Cache().InvalidateTag(v.invalidate); err != nil {
+				t.Fatal(err)
+			}
+		}
+		w := request(a, "/layer/tags", nil)
+		if s := w.Body.String(); s != "article" {
+			t.Errorf("%d: expecting body %q, got %q", ii, "article", s)
+		}
+		if calls != v.calls {
+			t.Errorf("%d: expecting %d calls to the handler, got %d", ii, v.calls, calls)
+		}
+	}
+}
+
+func cachedKey(path string) string {
+	return hashutil.Md5("GET" + "http://example.com" + path)
+}
+
+// age modifies the cached response for the given path
+// as if it had been cached the given number of seconds ago.
+func age(t *testing.T, la *Layer, path string, seconds int64) {
+	key := cachedKey(path)
+	response := la.cached(key)
+	if response == nil {
+		t.Fatalf("response for %s is not cached", path)
+	}
+	response.Created -= seconds
+	if response.Expires > 0 {
+		response.Expires -= seconds
+		response.StaleUntil -= seconds
+	}
+	data, err := layerCodec.Encode(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := la.Cache().SetBytes(key, data, 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidators(t *testing.T) {
+	la := newTestLayer(t, &SimpleMediator{Expiration: 60})
+	calls := 0
+	a := newTestApp("^/layer/validators$", la.Wrap(func(ctx *app.Context) {
+		calls++
+		ctx.WriteString("validated")
+	}))
+	w := request(a, "/layer/validators", nil)
+	etag := w.Header().Get("ETag")
+	lastModified := w.Header().Get("Last-Modified")
+	if etag == "" || lastModified == "" {
+		t.Fatalf("first response has no validators, ETag = %q, Last-Modified = %q", etag, lastModified)
+	}
+	if s := w.Body.String(); s != "validated" {
+		t.Errorf("expecting body %q, got %q", "validated", s)
+	}
+	w = request(a, "/layer/validators", nil)
+	if h := w.Header().Get("ETag"); h != etag {
+		t.Errorf("expecting cached ETag %q, got %q", etag, h)
+	}
+	if h := w.Header().Get("Last-Modified"); h != lastModified {
+		t.Errorf("expecting cached Last-Modified %q, got %q", lastModified, h)
+	}
+	if calls != 1 {
+		t.Errorf("expecting 1 call to the handler, got %d", calls)
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	la := newTestLayer(t, &SimpleMediator{Expiration: 60})
+	etag := `"` + hashutil.Md5("conditional") + `"`
+	a := newTestApp("^/layer/conditional/\\d+$", la.Wrap(func(ctx *app.Context) {
+		ctx.WriteString("conditional")
+	}))
+	future := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	past := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+	tests := []struct {
+		header http.Header
+		code   int
+	}{
+		{http.Header{"If-None-Match": {etag}}, http.StatusNotModified},
+		{http.Header{"If-None-Match": {"W/" + etag}}, http.StatusNotModified},
+		{http.Header{"If-None-Match": {`"other", ` + etag}}, http.StatusNotModified},
+		{http.Header{"If-None-Match": {"*"}}, http.StatusNotModified},
+		{http.Header{"If-None-Match": {`"other"`}}, http.StatusOK},
+		{http.Header{"If-Modified-Since": {future}}, http.StatusNotModified},
+		{http.Header{"If-Modified-Since": {past}}, http.StatusOK},
+		// If-Modified-Since is ignored when If-None-Match is present
+		{http.Header{"If-None-Match": {`"other"`}, "If-Modified-Since": {future}}, http.StatusOK},
+		{nil, http.StatusOK},
+	}
+	for ii, v := range tests {
+		path := fmt.Sprintf("/layer/conditional/%d", ii)
+		// First request is served by the handler, second one
+		// from the cache.
+		for _, from := range []string{"handler", "cache"} {
+			w := request(a, path, v.header)
+			if w.Code != v.code {
+				t.Errorf("%d: expecting code %d from %s, got %d", ii, v.code, from, w.Code)
+				continue
+			}
+			body := w.Body.String()
+			if v.code == http.StatusNotModified {
+				if body != "" {
+					t.Errorf("%d: expecting no body with 304 from %s, got %q", ii, from, body)
+				}
+			} else if body != "conditional" {
+				t.Errorf("%d: expecting body %q from %s, got %q", ii, "conditional", from, body)
+			}
+		}
+	}
+}
+
+func TestCacheControl(t *testing.T) {
+	la := newTestLayer(t, &SimpleMediator{Expiration: 60})
+	calls := 0
+	cacheControl := ""
+	a := newTestApp("^/layer/cache-control/\\d+$", la.Wrap(func(ctx *app.Context) {
+		calls++
+		if cacheControl != "" {
+			ctx.Header().Set("Cache-Control", cacheControl)
+		}
+		ctx.WriteString("cache-control")
+	}))
+	tests := []struct {
+		cacheControl string
+		cached       bool
+		expiration   int64
+	}{
+		{"", true, 60},
+		{"no-store", false, 0},
+		{"no-cache", false, 0},
+		{"private", false, 0},
+		{"max-age=0", false, 0},
+		{"public, max-age=30", true, 30},
+		{"s-maxage=10, max-age=30", true, 10},
+	}
+	for ii, v := range tests {
+		calls = 0
+		cacheControl = v.cacheControl
+		path := fmt.Sprintf("/layer/cache-control/%d", ii)
+		request(a, path, nil)
+		request(a, path, nil)
+		expected := 2
+		if v.cached {
+			expected = 1
+		}
+		if calls != expected {
+			t.Errorf("%d: expecting %d calls to the handler with Cache-Control %q, got %d", ii, expected, v.cacheControl, calls)
+		}
+		if v.cached {
+			response := la.cached(cachedKey(path))
+			if response == nil {
+				t.Errorf("%d: response with Cache-Control %q not cached", ii, v.cacheControl)
+				continue
+			}
+			if exp := response.Expires - response.Created; exp != v.expiration {
+				t.Errorf("%d: expecting expiration %d with Cache-Control %q, got %d", ii, v.expiration, v.cacheControl, exp)
+			}
+		}
+	}
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	la := newTestLayer(t, &SimpleMediator{Expiration: 60})
+	la.SetStaleWhileRevalidate(30)
+	var version int32
+	refreshed := make(chan struct{}, 1)
+	a := newTestApp("^/layer/stale$", la.Wrap(func(ctx *app.Context) {
+		v := atomic.AddInt32(&version, 1)
+		ctx.WriteString(fmt.Sprintf("version %d", v))
+		if v > 1 {
+			refreshed <- struct{}{}
+		}
+	}))
+	const path = "/layer/stale"
+	if s := request(a, path, nil).Body.String(); s != "version 1" {
+		t.Fatalf("expecting %q, got %q", "version 1", s)
+	}
+	// Stale, but within stale-while-revalidate
+	age(t, la, path, 70)
+	if s := request(a, path, nil).Body.String(); s != "version 1" {
+		t.Errorf("expecting stale response %q, got %q", "version 1", s)
+	}
+	select {
+	case <-refreshed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stale response was not refreshed")
+	}
+	// Wait for the refreshed response to be stored
+	for ii := 0; ii < 100; ii++ {
+		if r := la.cached(cachedKey(path)); r != nil && string(r.Data) == "version 2" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s := request(a, path, nil).Body.String(); s != "version 2" {
+		t.Errorf("expecting refreshed response %q, got %q", "version 2", s)
+	}
+	// Past stale-while-revalidate, must be served by the handler
+	age(t, la, path, 100)
+	if s := request(a, path, nil).Body.String(); s != "version 3" {
+		t.Errorf("expecting %q, got %q", "version 3", s)
+	}
+	<-refreshed
+}
@@ -21,6 +21,17 @@ type Mediator interface {
 	Expires(ctx *app.Context, responseCode int, outgoingHeaders http.Header) int
 }
 
+// Tagger is an optional interface which might be implemented by
+// a Mediator to associate tags with the cached responses. Responses
+// are invalidated when any of their tags is invalidated using
+// gnd.la/cache.Cache.InvalidateTag. Handlers might also add tags to
+// their responses using the Tag function.
+type Tagger interface {
+	// Tags returns the tags for the response with the given
+	// code and headers.
+	Tags(ctx *app.Context, responseCode int, outgoingHeaders http.Header) []string
+}
+
 // SimpleMediator implements a Mediator which caches GET and HEAD
 // request with a 200 response code for a fixed time and skips
 // the cache if any of the indicated cookies are present. Cache keys
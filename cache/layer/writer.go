@@ -5,6 +5,8 @@ import (
 	"net/http"
 )
 
+// writer buffers the response written by the handler, so
+// the Layer can add its validators before sending it.
 type writer struct {
 	http.ResponseWriter
 	buf        *bytes.Buffer
@@ -25,19 +27,27 @@ func (w *writer) copyHeaders() {
 }
 
 func (w *writer) WriteHeader(code int) {
-	w.statusCode = code
-	w.ResponseWriter.WriteHeader(code)
+	if w.statusCode == 0 {
+		w.statusCode = code
+	}
 }
 
 func (w *writer) Write(data []byte) (int, error) {
-	n, err := w.ResponseWriter.Write(data)
-	if err == nil && n > 0 {
-		w.buf.Write(data)
-		if w.header == nil {
-			w.copyHeaders()
-		}
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusOK
+	}
+	return w.buf.Write(data)
+}
+
+// flush sends the buffered response to the
+// underlying http.ResponseWriter.
+func (w *writer) flush() {
+	if w.statusCode != 0 {
+		w.ResponseWriter.WriteHeader(w.statusCode)
+	}
+	if w.buf.Len() > 0 {
+		w.ResponseWriter.Write(w.buf.Bytes())
 	}
-	return n, err
 }
 
 func newWriter(rw http.ResponseWriter) *writer {
@@ -46,3 +56,24 @@ func newWriter(rw http.ResponseWriter) *writer {
 		buf:            bytes.NewBuffer(nil),
 	}
 }
+
+// recorder is used as the underlying http.ResponseWriter
+// when refreshing responses in the background.
+type recorder struct {
+	header http.Header
+}
+
+func (r *recorder) Header() http.Header {
+	return r.header
+}
+
+func (r *recorder) Write(data []byte) (int, error) {
+	return len(data), nil
+}
+
+func (r *recorder) WriteHeader(_ int) {
+}
+
+func newRecorder() *recorder {
+	return &recorder{header: make(http.Header)}
+}
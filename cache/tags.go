@@ -0,0 +1,244 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"gnd.la/app/profile"
+	"gnd.la/cache/driver"
+)
+
+const (
+	tagKeyPrefix = "gondola-tag:"
+)
+
+var (
+	// Tagged items start with this prefix, which is not
+	// produced by any of the available codecs.
+	taggedPrefix     = []byte("\x00\xffgondola-tags\x00")
+	errInvalidTagged = errors.New("invalid tagged item")
+	tagVersionSeq    uint32
+)
+
+func (c *Cache) tagKey(tag string) string {
+	return c.backendKey(tagKeyPrefix + tag)
+}
+
+func newTagVersion() []byte {
+	seq := atomic.AddUint32(&tagVersionSeq, 1)
+	return []byte(strconv.FormatInt(time.Now().UnixNano(), 36) + "." + strconv.FormatUint(uint64(seq), 36))
+}
+
+// tagVersions returns the current versions for the given tags. If
+// create is true, versions are created for the tags without one.
+func (c *Cache) tagVersions(tags []string, create bool) (map[string][]byte, error) {
+	keys := make([]string, len(tags))
+	for ii, v := range tags {
+		keys[ii] = c.tagKey(v)
+	}
+	versions, err := c.driver.GetMulti(keys)
+	if err != nil {
+		return nil, err
+	}
+	if create {
+		for _, k := range keys {
+			if versions[k] == nil {
+				version, err := c.createTagVersion(k)
+				if err != nil {
+					return nil, err
+				}
+				versions[k] = version
+			}
+		}
+	}
+	return versions, nil
+}
+
+// createTagVersion creates the version for the tag with the given
+// key. If another process creates it concurrently, its version is
+// used, so items stored by both of them remain valid.
+func (c *Cache) createTagVersion(key string) ([]byte, error) {
+	version := newTagVersion()
+	adder, ok := c.driver.(driver.Adder)
+	if !ok {
+		return version, c.driver.Set(key, version, 0)
+	}
+	added, err := adder.Add(key, version, 0)
+	if err == driver.ErrNotImplemented {
+		return version, c.driver.Set(key, version, 0)
+	}
+	if err != nil || added {
+		return version, err
+	}
+	current, err := c.driver.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if current == nil {
+		// Removed since Add was called (e.g. purged by
+		// the driver), the previous version is lost anyway.
+		return version, c.driver.Set(key, version, 0)
+	}
+	return current, nil
+}
+
+// SetTagged works like Set, but associates the item with the given
+// tags. Calling InvalidateTag with any of them invalidates the item,
+// causing subsequent calls to Get (and the rest of the functions for
+// retrieving items) to return ErrNotFound for it.
+//
+// Tags are implemented by storing a version for each tag and checking
+// them when the item is retrieved, so they work with any driver, at
+// the cost of an additional roundtrip to the cache for retrieving
+// tagged items. Since tag versions are stored without an expiration,
+// drivers which purge items when running out of space might remove
+// them. In that case, the items using those tags are invalidated.
+func (c *Cache) SetTagged(key string, object interface{}, timeout int, tags ...string) error {
+	b, err := c.codec.Encode(object)
+	if err != nil {
+		eerr := &cacheError{
+			op:    "encoding object",
+			key:   key,
+			codec: true,
+			err:   err,
+		}
+		c.error(eerr)
+		return eerr
+	}
+	return c.SetBytesTagged(key, b, timeout, tags...)
+}
+
+// SetBytesTagged works like SetBytes, but associates the item
+// with the given tags. See SetTagged for more details.
+func (c *Cache) SetBytesTagged(key string, b []byte, timeout int, tags ...string) error {
+	if len(tags) == 0 {
+		return c.SetBytes(key, b, timeout)
+	}
+	versions, err := c.tagVersions(tags, true)
+	if err != nil {
+		terr := &cacheError{
+			op:  "setting tag versions",
+			key: key,
+			err: err,
+		}
+		c.error(terr)
+		return terr
+	}
+	var buf bytes.Buffer
+	buf.Write(taggedPrefix)
+	binary.Write(&buf, binary.BigEndian, uint32(len(tags)))
+	for _, v := range tags {
+		writeTaggedBytes(&buf, []byte(v))
+		writeTaggedBytes(&buf, versions[c.tagKey(v)])
+	}
+	buf.Write(b)
+	return c.SetBytes(key, buf.Bytes(), timeout)
+}
+
+// InvalidateTag invalidates all the items associated with the
+// given tag. See SetTagged.
+func (c *Cache) InvalidateTag(tag string) error {
+	if profile.On && profile.Profiling() {
+		defer profile.Start(cache).Note("INVALIDATE TAG", tag).End()
+	}
+	if err := c.driver.Set(c.tagKey(tag), newTagVersion(), 0); err != nil {
+		ierr := &cacheError{
+			op:  "invalidating tag",
+			key: tag,
+			err: err,
+		}
+		c.error(ierr)
+		return ierr
+	}
+	c.debugf("Invalidated tag %s", tag)
+	return nil
+}
+
+func writeTaggedBytes(buf *bytes.Buffer, b []byte) {
+	var l [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(l[:], uint64(len(b)))
+	buf.Write(l[:n])
+	buf.Write(b)
+}
+
+func readTaggedBytes(r *bytes.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(r.Len()) {
+		return nil, errInvalidTagged
+	}
+	b := make([]byte, int(n))
+	r.Read(b)
+	return b, nil
+}
+
+// parseTagged parses the given data, returning the item data and
+// the tag versions it was stored with, keyed by their tag key. If the
+// data doesn't belong to a tagged item, the returned versions are nil.
+func (c *Cache) parseTagged(b []byte) ([]byte, map[string][]byte, error) {
+	if !bytes.HasPrefix(b, taggedPrefix) {
+		return b, nil, nil
+	}
+	r := bytes.NewReader(b[len(taggedPrefix):])
+	var count uint32
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return nil, nil, err
+	}
+	// Each tag uses at least 2 bytes, for the lengths
+	// of its name and its version.
+	if uint64(count) > uint64(r.Len()/2) {
+		return nil, nil, errInvalidTagged
+	}
+	expected := make(map[string][]byte, int(count))
+	for ii := 0; ii < int(count); ii++ {
+		tag, err := readTaggedBytes(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		version, err := readTaggedBytes(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		expected[c.tagKey(string(tag))] = version
+	}
+	return b[len(b)-r.Len():], expected, nil
+}
+
+// tagsMatch returns true iff all the expected
+// tag versions match the current ones.
+func tagsMatch(expected map[string][]byte, versions map[string][]byte) bool {
+	for k, v := range expected {
+		if !bytes.Equal(versions[k], v) {
+			return false
+		}
+	}
+	return true
+}
+
+// untag checks if the given data belongs to a tagged item and, in
+// that case, verifies the tag versions. It returns the item data or
+// nil if any of its tags has been invalidated.
+func (c *Cache) untag(b []byte) ([]byte, error) {
+	data, expected, err := c.parseTagged(b)
+	if err != nil || len(expected) == 0 {
+		return data, err
+	}
+	keys := make([]string, 0, len(expected))
+	for k := range expected {
+		keys = append(keys, k)
+	}
+	versions, err := c.driver.GetMulti(keys)
+	if err != nil {
+		return nil, err
+	}
+	if !tagsMatch(expected, versions) {
+		return nil, nil
+	}
+	return data, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+
+	"gnd.la/blobstore"
+	_ "gnd.la/blobstore/driver/file"
+	_ "gnd.la/blobstore/driver/gridfs"
+	_ "gnd.la/blobstore/driver/mirror"
+	_ "gnd.la/blobstore/driver/s3"
+	"gnd.la/config"
+	"gnd.la/log"
+)
+
+type blobstoreCheckOptions struct {
+	Repair     bool   `help:"Repair missing and orphaned .meta files, orphaned chunks and invalid reference counts"`
+	Quarantine string `help:"Move corrupted files (and files with missing .meta files, when not repairing) to this directory"`
+}
+
+type blobstoreCopyOptions struct {
+	Prefix    string `help:"Only copy the files with ids starting with this prefix"`
+	Verify    bool   `help:"Read back each copied file and verify its checksums"`
+	KeepGoing bool   `name:"keep-going" help:"Continue copying the remaining files when a file can't be copied"`
+}
+
+func openBlobstore(s string) (*blobstore.Blobstore, error) {
+	u, err := config.ParseURL(s)
+	if err != nil {
+		return nil, err
+	}
+	return blobstore.New(u)
+}
+
+func blobstoreCheckCommand(args []string, opts *blobstoreCheckOptions) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: gondola blobstore-check <blobstore-url>")
+	}
+	bs, err := openBlobstore(args[0])
+	if err != nil {
+		return err
+	}
+	defer bs.Close()
+	log.Debugf("checking blobstore %s", args[0])
+	issues, err := bs.Check()
+	if err != nil {
+		return err
+	}
+	unresolved := 0
+	for _, v := range issues {
+		log.Warningf("%s", v)
+		switch {
+		case opts.Repair && v.Repairable():
+			if err := bs.Repair(v); err != nil {
+				log.Errorf("error repairing %s: %s", v.Id, err)
+				unresolved++
+				continue
+			}
+			log.Infof("repaired %s", v.Id)
+		case opts.Quarantine != "" && (v.Type == blobstore.IssueCorrupted || v.Type == blobstore.IssueMissingMeta):
+			if err := bs.Quarantine(v.Id, opts.Quarantine); err != nil {
+				log.Errorf("error quarantining %s: %s", v.Id, err)
+				unresolved++
+				continue
+			}
+			log.Infof("moved %s to quarantine", v.Id)
+		default:
+			unresolved++
+		}
+	}
+	if unresolved > 0 {
+		return fmt.Errorf("found %d issues (%d unresolved)", len(issues), unresolved)
+	}
+	log.Infof("found %d issues (0 unresolved)", len(issues))
+	return nil
+}
+
+func blobstoreCopyCommand(args []string, opts *blobstoreCopyOptions) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: gondola blobstore-copy <src-blobstore-url> <dst-blobstore-url>")
+	}
+	src, err := openBlobstore(args[0])
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := openBlobstore(args[1])
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	copyOpts := &blobstore.CopyOptions{
+		Verify:    opts.Verify,
+		KeepGoing: opts.KeepGoing,
+		Progress: func(id string, skipped bool, err error) {
+			switch {
+			case err != nil:
+				// Without KeepGoing, the error is
+				// returned by Copy.
+				if opts.KeepGoing {
+					log.Errorf("error copying %s: %s", id, err)
+				}
+			case skipped:
+				log.Debugf("skipped %s, already copied", id)
+			default:
+				log.Debugf("copied %s", id)
+			}
+		},
+	}
+	if opts.Prefix != "" {
+		copyOpts.Filter = &blobstore.Filter{Prefix: opts.Prefix}
+	}
+	res, err := blobstore.Copy(src, dst, copyOpts)
+	if res != nil {
+		log.Infof("copied %d files, skipped %d already copied", res.Copied, res.Skipped)
+	}
+	if err != nil {
+		return err
+	}
+	if len(res.Failed) > 0 {
+		return fmt.Errorf("%d files couldn't be copied", len(res.Failed))
+	}
+	return nil
+}
@@ -91,6 +91,27 @@ var (
 			Func:    genCommand,
 			Options: &genOptions{Genfile: "genfile.yaml"},
 		},
+		{
+			Name:    "migrate",
+			Help:    "Build the app in the current directory and apply, revert or show the status of its ORM migrations (requires importing gnd.la/orm/migrate)",
+			Usage:   "up|down|status",
+			Func:    migrateCommand,
+			Options: &migrateOptions{Go: "go"},
+		},
+		{
+			Name:    "blobstore-check",
+			Help:    "Verify the integrity of all the files in a blobstore, optionally repairing or quarantining the ones with issues",
+			Usage:   "<blobstore-url>",
+			Func:    blobstoreCheckCommand,
+			Options: &blobstoreCheckOptions{},
+		},
+		{
+			Name:    "blobstore-copy",
+			Help:    "Copy all the files from a blobstore into another one, preserving their ids and metadata. Interrupted copies can be resumed by running it again",
+			Usage:   "<src-blobstore-url> <dst-blobstore-url>",
+			Func:    blobstoreCopyCommand,
+			Options: &blobstoreCopyOptions{},
+		},
 		{
 			Name:    "gae-dev",
 			Help:    "Start the Gondola App Engine development server",
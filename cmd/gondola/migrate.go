@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+
+	"gnd.la/log"
+)
+
+type migrateOptions struct {
+	N      int    `name:"n" help:"Number of migrations to apply or revert. For up, 0 means all the pending ones. For down, 0 means just the last one"`
+	DryRun bool   `name:"dry-run" help:"Print the SQL statements instead of executing them"`
+	Go     string `help:"Go command to use for building the app"`
+}
+
+func migrateCommand(args []string, opts *migrateOptions) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: gondola migrate up|down|status")
+	}
+	if opts.Go == "" {
+		opts.Go = "go"
+	}
+	dir, err := ioutil.TempDir("", "gondola-migrate")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, "app")
+	log.Debugf("building app")
+	if err := runCmd(exec.Command(opts.Go, "build", "-o", p)); err != nil {
+		return fmt.Errorf("error building app: %s", err)
+	}
+	cmdArgs := []string{"migrate", "-n", strconv.Itoa(opts.N)}
+	if opts.DryRun {
+		cmdArgs = append(cmdArgs, "-dry-run")
+	}
+	cmdArgs = append(cmdArgs, args[0])
+	return runCmd(exec.Command(p, cmdArgs...))
+}
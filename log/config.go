@@ -1,16 +1,23 @@
 package log
 
 import (
+	"os"
+
 	"gnd.la/config"
 	"gnd.la/net/mail"
 )
 
 var logConfig struct {
 	LogDebug bool
+	LogJSON  bool `help:"Write log messages to stderr as JSON objects, one per line"`
 }
 
 func init() {
 	config.RegisterFunc(&logConfig, func() {
+		if logConfig.LogJSON {
+			Std.RemoveWriters()
+			Std.AddWriter(NewJSONWriter(os.Stderr, LDebug))
+		}
 		if logConfig.LogDebug {
 			Std.SetLevel(LDebug)
 		} else {
@@ -0,0 +1,70 @@
+package log
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Field is a key-value pair attached to all the messages
+// logged by a Logger. See Logger.With.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// With returns a new Logger which adds the given fields to every
+// message it logs. Fields are specified as alternating keys and
+// values, where keys must be strings, e.g.
+//
+//  logger.With("user", 42, "handler", "index").Info("hello")
+//
+// The returned Logger shares the writers with l and inherits its
+// flags, level and fields, but changing any of them in either
+// Logger won't affect the other one. Text writers receive the fields
+// appended to the message as key=value pairs, while EntryWriters
+// (like JSONWriter) receive them in Entry.Fields.
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+	if len(keyvals)%2 != 0 {
+		panic(fmt.Errorf("odd number of arguments passed to With: %v", keyvals))
+	}
+	fields := make([]Field, len(l.fields), len(l.fields)+len(keyvals)/2)
+	copy(fields, l.fields)
+	for ii := 0; ii < len(keyvals); ii += 2 {
+		key, ok := keyvals[ii].(string)
+		if !ok {
+			panic(fmt.Errorf("field key must be a string, not %T", keyvals[ii]))
+		}
+		fields = append(fields, Field{Key: key, Value: keyvals[ii+1]})
+	}
+	writers := make([]Writer, len(l.writers))
+	copy(writers, l.writers)
+	return &Logger{
+		flags:   l.flags,
+		level:   l.level,
+		writers: writers,
+		fields:  fields,
+	}
+}
+
+// Fields returns the fields attached to the Logger.
+func (l *Logger) Fields() []Field {
+	return l.fields
+}
+
+func appendFields(buf []byte, fields []Field) []byte {
+	for _, v := range fields {
+		buf = append(buf, ' ')
+		buf = append(buf, v.Key...)
+		buf = append(buf, '=')
+		buf = append(buf, quoteValue(fmt.Sprint(v.Value))...)
+	}
+	return buf
+}
+
+func quoteValue(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\r\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
@@ -0,0 +1,78 @@
+package log
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWith(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(NewIOWriter(&buf, LDebug), 0, LDebug)
+	w := l.With("user", 42, "handler", "index")
+	ww := w.With("path", "/a b")
+	if len(l.Fields()) != 0 {
+		t.Errorf("With modified the parent fields: %v", l.Fields())
+	}
+	if len(w.Fields()) != 2 || len(ww.Fields()) != 3 {
+		t.Errorf("expecting 2 and 3 fields, got %v and %v", w.Fields(), ww.Fields())
+	}
+	tests := []struct {
+		logger *Logger
+		expect string
+	}{
+		{l, "hello\n"},
+		{w, "hello user=42 handler=index\n"},
+		{ww, "hello user=42 handler=index path=\"/a b\"\n"},
+	}
+	for _, v := range tests {
+		buf.Reset()
+		v.logger.Info("hello")
+		if s := buf.String(); !strings.HasSuffix(s, v.expect) {
+			t.Errorf("expecting message ending with %q, got %q", v.expect, s)
+		}
+	}
+	// Changing the level in the child must not affect the parent
+	w.SetLevel(LError)
+	buf.Reset()
+	l.Info("hello")
+	if buf.Len() == 0 {
+		t.Error("changing the level in the child Logger affected the parent")
+	}
+}
+
+func TestWithPanics(t *testing.T) {
+	l := New(NewIOWriter(&bytes.Buffer{}, LDebug), 0, LDebug)
+	for _, v := range [][]interface{}{
+		{"odd"},
+		{42, "value"},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expecting a panic with fields %v", v)
+				}
+			}()
+			l.With(v...)
+		}()
+	}
+}
+
+func TestQuoteValue(t *testing.T) {
+	tests := []struct {
+		value  string
+		expect string
+	}{
+		{"plain", "plain"},
+		{"", `""`},
+		{"with space", `"with space"`},
+		{"a=b", `"a=b"`},
+		{"quo\"te", `"quo\"te"`},
+		{"new\nline", `"new\nline"`},
+	}
+	for _, v := range tests {
+		if q := quoteValue(v.value); q != v.expect {
+			t.Errorf("expecting %q quoted as %s, got %s", v.value, v.expect, q)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JSONWriter writes each message as a JSON object in its own
+// line, which is suitable for log aggregation systems. Objects
+// contain the following keys:
+//
+//  time: message time, using RFC3339 with nanoseconds.
+//  level: message level name, in lowercase.
+//  msg: the message.
+//  caller: file and line which logged the message, only present
+//  when the Logger has the Lshortfile or Llongfile flags.
+//
+// Fields attached to the Logger (see Logger.With) are added as
+// additional keys. Fields which collide with the previous keys
+// are prefixed with "fields.".
+type JSONWriter struct {
+	mutex sync.Mutex
+	out   io.Writer
+	level LLevel
+}
+
+// NewJSONWriter returns a new JSONWriter which writes to out
+// all the messages with a level greater or equal than level.
+func NewJSONWriter(out io.Writer, level LLevel) *JSONWriter {
+	return &JSONWriter{out: out, level: level}
+}
+
+func (w *JSONWriter) Level() LLevel {
+	return w.level
+}
+
+// Write implements the Writer interface. It's only called
+// when the JSONWriter is used directly rather than added
+// to a Logger, so the whole message is written as is
+// in the msg key.
+func (w *JSONWriter) Write(level LLevel, flags int, b []byte) (int, error) {
+	err := w.WriteEntry(&Entry{
+		Time:    time.Now(),
+		Level:   level,
+		Message: strings.TrimSuffix(string(b), "\n"),
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// WriteEntry implements the EntryWriter interface.
+func (w *JSONWriter) WriteEntry(e *Entry) error {
+	buf := make([]byte, 0, 256)
+	buf = append(buf, `{"time":`...)
+	buf = strconv.AppendQuote(buf, e.Time.Format(time.RFC3339Nano))
+	buf = append(buf, `,"level":`...)
+	buf = strconv.AppendQuote(buf, strings.ToLower(e.Level.String()))
+	buf = append(buf, `,"msg":`...)
+	buf = appendJSON(buf, e.Message)
+	if e.File != "" {
+		buf = append(buf, `,"caller":`...)
+		buf = appendJSON(buf, e.File+":"+strconv.Itoa(e.Line))
+	}
+	for _, v := range e.Fields {
+		key := v.Key
+		switch key {
+		case "time", "level", "msg", "caller":
+			key = "fields." + key
+		}
+		buf = append(buf, ',')
+		buf = appendJSON(buf, key)
+		buf = append(buf, ':')
+		buf = appendJSON(buf, jsonValue(v.Value))
+	}
+	buf = append(buf, "}\n"...)
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	_, err := w.out.Write(buf)
+	return err
+}
+
+// jsonValue returns the value to be encoded for the given field
+// value. Errors and fmt.Stringers are encoded as strings, since
+// otherwise most of them would be encoded as empty objects.
+func jsonValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case error:
+		return x.Error()
+	case json.Marshaler:
+		return x
+	case fmt.Stringer:
+		return x.String()
+	}
+	return v
+}
+
+func appendJSON(buf []byte, v interface{}) []byte {
+	data, err := json.Marshal(v)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(v))
+	}
+	return append(buf, data...)
+}
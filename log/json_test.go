@@ -0,0 +1,80 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+type jsonStringer struct{}
+
+func (jsonStringer) String() string { return "stringer" }
+
+func decodeJSONLines(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	var res []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var m map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &m); err != nil {
+			t.Fatalf("invalid JSON line %q: %s", line, err)
+		}
+		res = append(res, m)
+	}
+	return res
+}
+
+func TestJSONWriter(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(NewJSONWriter(&buf, LInfo), Lshortfile, LDebug)
+	l.Debug("not written")
+	l.With("user", 42, "err", errors.New("failed"), "str", jsonStringer{}, "msg", "collides").Warningf("hello %s", "\"world\"\n")
+	lines := decodeJSONLines(t, &buf)
+	if len(lines) != 1 {
+		t.Fatalf("expecting 1 line, got %d: %s", len(lines), buf.String())
+	}
+	m := lines[0]
+	expect := map[string]interface{}{
+		"level":      "warning",
+		"msg":        "hello \"world\"",
+		"user":       float64(42),
+		"err":        "failed",
+		"str":        "stringer",
+		"fields.msg": "collides",
+	}
+	for k, v := range expect {
+		if m[k] != v {
+			t.Errorf("expecting %s = %v, got %v", k, v, m[k])
+		}
+	}
+	if caller, _ := m["caller"].(string); !strings.HasPrefix(caller, "json_test.go:") {
+		t.Errorf("expecting caller in json_test.go, got %v", m["caller"])
+	}
+	ts, _ := m["time"].(string)
+	if _, err := time.Parse(time.RFC3339Nano, ts); err != nil {
+		t.Errorf("invalid time %q: %s", ts, err)
+	}
+}
+
+func TestJSONWriterWithoutCaller(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(NewJSONWriter(&buf, LDebug), 0, LDebug)
+	l.Info("hello")
+	m := decodeJSONLines(t, &buf)[0]
+	if _, ok := m["caller"]; ok {
+		t.Errorf("expecting no caller without Lshortfile nor Llongfile, got %v", m["caller"])
+	}
+}
+
+func TestJSONWriterWrite(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewJSONWriter(&buf, LDebug)
+	if n, err := w.Write(LError, 0, []byte("direct\n")); err != nil || n != 7 {
+		t.Fatalf("expecting 7 bytes written, got %d (error %v)", n, err)
+	}
+	m := decodeJSONLines(t, &buf)[0]
+	if m["msg"] != "direct" || m["level"] != "error" {
+		t.Errorf("unexpected entry %v", m)
+	}
+}
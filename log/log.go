@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"runtime"
+	"strings"
 	"time"
 )
 
@@ -38,6 +39,7 @@ type Logger struct {
 	flags   int // properties
 	level   LLevel
 	writers []Writer // destination for output
+	fields  []Field  // attached to every message, see With
 }
 
 // New creates a new Logger.   The out variable sets the
@@ -142,10 +144,39 @@ func (l *Logger) FormatMessage(level LLevel, calldepth int, s string) []byte {
 		buf = make([]byte, 0, maxPoolCap)
 	}
 	l.formatHeader(level, &buf, now, file, line)
-	buf = append(buf, s...)
+	if len(l.fields) > 0 {
+		buf = append(buf, strings.TrimSuffix(s, "\n")...)
+		buf = appendFields(buf, l.fields)
+	} else {
+		buf = append(buf, s...)
+	}
 	return buf
 }
 
+// entry returns the Entry passed to the EntryWriters. See FormatMessage
+// for the meaning of the parameters.
+func (l *Logger) entry(level LLevel, calldepth int, s string) *Entry {
+	e := &Entry{
+		Time:    time.Now(),
+		Level:   level,
+		Message: strings.TrimSuffix(s, "\n"),
+		Fields:  l.fields,
+	}
+	if l.flags&(Lshortfile|Llongfile) != 0 {
+		var ok bool
+		_, e.File, e.Line, ok = runtime.Caller(calldepth)
+		if !ok {
+			e.File = "???"
+			e.Line = 0
+		} else if l.flags&Lshortfile != 0 {
+			if idx := strings.LastIndexByte(e.File, '/'); idx >= 0 {
+				e.File = e.File[idx+1:]
+			}
+		}
+	}
+	return e
+}
+
 func (l *Logger) AddWriter(w Writer) {
 	l.writers = append(l.writers, w)
 }
@@ -174,13 +205,25 @@ func (l *Logger) Writeln(level LLevel, calldepth int, v ...interface{}) {
 func (l *Logger) write(level LLevel, calldepth int, v ...interface{}) {
 	if level >= l.level {
 		s := fmt.Sprint(v...)
-		msg := l.FormatMessage(level, calldepth, s)
+		var msg []byte
+		var e *Entry
 		for _, w := range l.writers {
-			if level >= w.Level() {
-				w.Write(level, l.flags, msg)
+			if level < w.Level() {
+				continue
+			}
+			if ew, ok := w.(EntryWriter); ok {
+				if e == nil {
+					e = l.entry(level, calldepth, s)
+				}
+				ew.WriteEntry(e)
+				continue
+			}
+			if msg == nil {
+				msg = l.FormatMessage(level, calldepth, s)
 			}
+			w.Write(level, l.flags, msg)
 		}
-		if cap(msg) <= maxPoolCap {
+		if msg != nil && cap(msg) <= maxPoolCap {
 			select {
 			case pool <- msg:
 			default:
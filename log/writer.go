@@ -1,6 +1,38 @@
 package log
 
+import (
+	"time"
+)
+
 type Writer interface {
 	Write(LLevel, int, []byte) (int, error)
 	Level() LLevel
 }
+
+// Entry represents a log message with its associated
+// information, before being formatted.
+type Entry struct {
+	// Time is the time when the message was logged.
+	Time time.Time
+	// Level is the message level.
+	Level LLevel
+	// File and Line indicate the caller which logged the
+	// message. They're only set when the Logger has the
+	// Lshortfile or Llongfile flags.
+	File string
+	Line int
+	// Message is the formatted message, without
+	// the trailing newline.
+	Message string
+	// Fields are the fields attached to the Logger
+	// (see Logger.With). They must not be modified.
+	Fields []Field
+}
+
+// EntryWriter is implemented by Writers which format the messages
+// themselves (e.g. JSONWriter). When a Writer implements EntryWriter,
+// the Logger calls WriteEntry rather than Write.
+type EntryWriter interface {
+	Writer
+	WriteEntry(e *Entry) error
+}
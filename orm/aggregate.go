@@ -0,0 +1,84 @@
+package orm
+
+import (
+	"gnd.la/orm/driver"
+	"gnd.la/orm/query"
+)
+
+// Sum returns an aggregate which adds the values of the
+// given field. See Query.Aggregate for more information.
+func Sum(field string) *query.Aggregate {
+	return &query.Aggregate{Func: query.Sum, Field: field}
+}
+
+// Avg returns an aggregate which averages the values of the
+// given field. See Query.Aggregate for more information.
+func Avg(field string) *query.Aggregate {
+	return &query.Aggregate{Func: query.Avg, Field: field}
+}
+
+// Min returns an aggregate which computes the minimum value
+// of the given field. See Query.Aggregate for more information.
+func Min(field string) *query.Aggregate {
+	return &query.Aggregate{Func: query.Min, Field: field}
+}
+
+// Max returns an aggregate which computes the maximum value
+// of the given field. See Query.Aggregate for more information.
+func Max(field string) *query.Aggregate {
+	return &query.Aggregate{Func: query.Max, Field: field}
+}
+
+// CountOf returns an aggregate which counts the non-NULL values
+// of the given field. If field is empty, it counts the number of
+// results in each group. See Query.Aggregate for more information.
+func CountOf(field string) *query.Aggregate {
+	return &query.Aggregate{Func: query.Count, Field: field}
+}
+
+// AggregateIter iterates over the results of Query.Aggregate.
+type AggregateIter struct {
+	driver.Iter
+	err error
+}
+
+// Next advances the iter to the next group, storing the values
+// of the grouping fields followed by the values of the aggregates
+// in the out parameters, which must be pointers to basic
+// types (e.g. *int64, *float64 or *string). It returns true
+// iff there was a result.
+func (i *AggregateIter) Next(out ...interface{}) bool {
+	if i.err != nil || i.Iter == nil {
+		return false
+	}
+	return i.Iter.Next(out...)
+}
+
+// Err returns the first error returned by the iterator. Once
+// there's an error, Next() will return false.
+func (i *AggregateIter) Err() error {
+	if i.err != nil {
+		return i.err
+	}
+	if i.Iter != nil {
+		return i.Iter.Err()
+	}
+	return nil
+}
+
+// Close closes the iter. It's only required to call Close
+// when the iter is not exhausted.
+func (i *AggregateIter) Close() error {
+	if i.Iter != nil {
+		return i.Iter.Close()
+	}
+	return nil
+}
+
+// Assert panics if the iter has an error. See Iter.Assert
+// for an example.
+func (i *AggregateIter) Assert() {
+	if err := i.Err(); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,15 @@
+package driver
+
+import (
+	"gnd.la/orm/query"
+)
+
+// Aggregator is implemented by drivers which have the CAP_AGGREGATE
+// capability. Aggregate returns an Iter which yields a row for each
+// group, containing the values of the groupBy fields followed by the
+// values of the aggregates, in the same order they were provided. Rows
+// are scanned into basic types (e.g. *int64, *float64 or *string)
+// rather than into models.
+type Aggregator interface {
+	Aggregate(m Model, q query.Q, aggs []*query.Aggregate, groupBy []string, having query.Q, sort []Sort, limit int, offset int) Iter
+}
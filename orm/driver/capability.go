@@ -31,4 +31,7 @@ const (
 	CAP_DEFAULTS
 	// Can have database level defaults for TEXT fields (unbounded strings).
 	CAP_DEFAULTS_TEXT
+	// Can compute aggregates (SUM, AVG, MIN, MAX and COUNT) over groups
+	// of results. Drivers with this capability must implement Aggregator.
+	CAP_AGGREGATE
 )
@@ -19,3 +19,140 @@ func checkMethod(typ reflect.Type, m reflect.Method) error {
 	}
 	return nil
 }
+
+// Hook identifies a model lifecycle hook. Hooks are methods
+// declared on the model type with the same name as the hook
+// (e.g. BeforeInsert), which might optionally receive one argument
+// (the ORM in use, which is validated by the ORM itself) and might
+// optionally return an error.
+type Hook int
+
+const (
+	// BeforeInsert is called before inserting an object.
+	BeforeInsert Hook = iota
+	// AfterInsert is called after an object has been inserted.
+	AfterInsert
+	// BeforeUpdate is called before updating an object.
+	BeforeUpdate
+	// AfterUpdate is called after an object has been updated.
+	AfterUpdate
+	// BeforeDelete is called before deleting an object.
+	BeforeDelete
+	// AfterDelete is called after an object has been deleted.
+	AfterDelete
+	// AfterLoad is called after an object has been loaded
+	// from the database.
+	AfterLoad
+	hookCount
+)
+
+var hookNames = [...]string{
+	BeforeInsert: "BeforeInsert",
+	AfterInsert:  "AfterInsert",
+	BeforeUpdate: "BeforeUpdate",
+	AfterUpdate:  "AfterUpdate",
+	BeforeDelete: "BeforeDelete",
+	AfterDelete:  "AfterDelete",
+	AfterLoad:    "AfterLoad",
+}
+
+func (h Hook) String() string {
+	if h >= 0 && h < hookCount {
+		return hookNames[h]
+	}
+	return fmt.Sprintf("Hook(%d)", int(h))
+}
+
+type hookMethod struct {
+	index   int
+	arg     reflect.Type
+	returns bool
+}
+
+type hooks [hookCount]*hookMethod
+
+func makeHooks(typ reflect.Type) (*hooks, error) {
+	var h *hooks
+	for ii := Hook(0); ii < hookCount; ii++ {
+		m, ok := typ.MethodByName(ii.String())
+		if !ok {
+			continue
+		}
+		hm := &hookMethod{index: m.Index}
+		switch m.Type.NumIn() {
+		case 1:
+		case 2:
+			hm.arg = m.Type.In(1)
+		default:
+			return nil, fmt.Errorf("method %q on type %v may receive only 1 or 0 arguments", m.Name, typ)
+		}
+		if out := m.Type.NumOut(); out > 0 {
+			if out > 1 {
+				return nil, fmt.Errorf("method %q on type %v may return only 1 or 0 arguments", m.Name, typ)
+			}
+			if m.Type.Out(0) != reflect.TypeOf((*error)(nil)).Elem() {
+				return nil, fmt.Errorf("method %q on type %v can only return error (it returns %v)", m.Name, typ, m.Type.Out(0))
+			}
+			hm.returns = true
+		}
+		if h == nil {
+			h = new(hooks)
+		}
+		h[ii] = hm
+	}
+	return h, nil
+}
+
+// HasHook returns true iff the model declares the given hook.
+func (m *Methods) HasHook(h Hook) bool {
+	return m.hooks != nil && m.hooks[h] != nil
+}
+
+// CheckHooks returns an error if any hook receiving an argument can't
+// accept a value of type arg.
+func (m *Methods) CheckHooks(typ reflect.Type, arg reflect.Type) error {
+	if m.hooks == nil {
+		return nil
+	}
+	for ii, v := range m.hooks {
+		if v != nil && v.arg != nil && !arg.AssignableTo(v.arg) {
+			return fmt.Errorf("method %q on type %v must receive %v (it receives %v)", Hook(ii), typ, arg, v.arg)
+		}
+	}
+	return nil
+}
+
+// Hook calls the given hook on obj if the model declares it. If the
+// hook method receives an argument, arg is passed to it. Since hooks
+// might modify the object, an error is returned if obj is not a pointer.
+func (m *Methods) Hook(h Hook, obj interface{}, arg interface{}) error {
+	if m.hooks == nil || m.hooks[h] == nil {
+		return nil
+	}
+	hm := m.hooks[h]
+	val := reflect.ValueOf(obj)
+	if !val.IsValid() {
+		return nil
+	}
+	for val.Kind() == reflect.Ptr && val.Elem().Kind() == reflect.Ptr {
+		val = val.Elem()
+	}
+	if val.Kind() == reflect.Ptr && val.IsNil() {
+		return nil
+	}
+	if val.Kind() != reflect.Ptr {
+		// Hooks are declared on the pointer type and calling
+		// them on a copy would lose any changes they make.
+		return fmt.Errorf("can't call %s on non-pointer %v, pass a %v instead", h, val.Type(), reflect.PtrTo(val.Type()))
+	}
+	var in []reflect.Value
+	if hm.arg != nil {
+		in = []reflect.Value{reflect.ValueOf(arg)}
+	}
+	out := val.Method(hm.index).Call(in)
+	if hm.returns {
+		err, _ := out[0].Interface().(error)
+		return err
+	}
+	return nil
+}
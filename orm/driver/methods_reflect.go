@@ -11,6 +11,7 @@ type Methods struct {
 	LoadIndex int
 	// The index for the Save method. -1 if there's no Save method
 	SaveIndex int
+	hooks     *hooks
 }
 
 func (m *Methods) Load(obj interface{}) error {
@@ -37,7 +38,7 @@ func (m *Methods) method(idx int, obj interface{}) error {
 }
 
 func MakeMethods(typ reflect.Type) (m *Methods, err error) {
-	m = &Methods{-1, -1}
+	m = &Methods{LoadIndex: -1, SaveIndex: -1}
 	// Get pointer methods
 	if typ.Kind() != reflect.Ptr {
 		typ = reflect.PtrTo(typ)
@@ -55,5 +56,6 @@ func MakeMethods(typ reflect.Type) (m *Methods, err error) {
 		}
 		m.SaveIndex = save.Index
 	}
+	m.hooks, err = makeHooks(typ)
 	return
 }
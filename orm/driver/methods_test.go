@@ -0,0 +1,68 @@
+package driver
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+var errHook = errors.New("hook error")
+
+type hooked struct {
+	calls []string
+	arg   interface{}
+}
+
+func (h *hooked) BeforeInsert(arg *int) error {
+	h.calls = append(h.calls, "BeforeInsert")
+	h.arg = arg
+	return errHook
+}
+
+func (h *hooked) AfterLoad() {
+	h.calls = append(h.calls, "AfterLoad")
+}
+
+type badHook struct{}
+
+func (b *badHook) AfterLoad() int {
+	return 0
+}
+
+func TestHooks(t *testing.T) {
+	m, err := MakeMethods(reflect.TypeOf(hooked{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.HasHook(BeforeInsert) || !m.HasHook(AfterLoad) || m.HasHook(AfterInsert) {
+		t.Error("invalid hooks detected")
+	}
+	intPtr := reflect.TypeOf((*int)(nil))
+	if err := m.CheckHooks(reflect.TypeOf(&hooked{}), intPtr); err != nil {
+		t.Error(err)
+	}
+	if err := m.CheckHooks(reflect.TypeOf(&hooked{}), reflect.TypeOf("")); err == nil {
+		t.Error("expecting an error when checking hooks with the wrong argument")
+	}
+	h := &hooked{}
+	arg := new(int)
+	if err := m.Hook(BeforeInsert, h, arg); err != errHook {
+		t.Errorf("expecting error %v, got %v", errHook, err)
+	}
+	if h.arg != arg {
+		t.Error("hook did not receive the argument")
+	}
+	// Hooks are also called through pointers to pointers
+	if err := m.Hook(AfterLoad, &h, arg); err != nil {
+		t.Error(err)
+	}
+	if err := m.Hook(AfterInsert, h, arg); err != nil {
+		t.Error(err)
+	}
+	if exp := []string{"BeforeInsert", "AfterLoad"}; !reflect.DeepEqual(h.calls, exp) {
+		t.Errorf("expecting calls %v, got %v", exp, h.calls)
+	}
+	if _, err := MakeMethods(reflect.TypeOf(badHook{})); err == nil {
+		t.Error("expecting an error for hook returning int")
+	}
+}
@@ -18,6 +18,7 @@ type Methods struct {
 	SavePointer unsafe.Pointer
 	// Wheter Save returns an error
 	SaveReturns bool
+	hooks       *hooks
 }
 
 func (m *Methods) Load(obj interface{}) error {
@@ -64,6 +65,7 @@ func MakeMethods(typ reflect.Type) (m *Methods, err error) {
 		m.SavePointer = pointer(typ, save.Index)
 		m.SaveReturns = returns(save)
 	}
+	m.hooks, err = makeHooks(typ)
 	return
 }
 
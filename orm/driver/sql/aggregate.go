@@ -0,0 +1,144 @@
+package sql
+
+import (
+	"database/sql"
+	"fmt"
+	"reflect"
+
+	"gnd.la/orm/driver"
+	"gnd.la/orm/query"
+)
+
+// aggregateModel wraps a driver.Model, mapping aggregates
+// in the form FUNC(Field) (e.g. SUM(Price)) to their SQL
+// expressions, so they can be used in HAVING and ORDER BY
+// clauses.
+type aggregateModel struct {
+	driver.Model
+}
+
+func (m *aggregateModel) Map(qname string) (string, reflect.Type, error) {
+	if agg := query.ParseAggregate(qname); agg != nil {
+		return m.expr(agg)
+	}
+	return m.Model.Map(qname)
+}
+
+func (m *aggregateModel) expr(agg *query.Aggregate) (string, reflect.Type, error) {
+	switch agg.Func {
+	case query.Sum, query.Avg, query.Min, query.Max, query.Count:
+	default:
+		return "", nil, fmt.Errorf("unknown aggregate function %q", agg.Func)
+	}
+	if agg.Field == "" {
+		if agg.Func != query.Count {
+			return "", nil, fmt.Errorf("aggregate function %s requires a field", agg.Func)
+		}
+		return "COUNT(*)", reflect.TypeOf(int64(0)), nil
+	}
+	dbName, typ, err := m.Model.Map(agg.Field)
+	if err != nil {
+		return "", nil, err
+	}
+	switch agg.Func {
+	case query.Avg:
+		typ = reflect.TypeOf(float64(0))
+	case query.Count:
+		typ = reflect.TypeOf(int64(0))
+	}
+	return string(agg.Func) + "(" + dbName + ")", typ, nil
+}
+
+func (d *Driver) Aggregate(m driver.Model, q query.Q, aggs []*query.Aggregate, groupBy []string, having query.Q, sort []driver.Sort, limit int, offset int) driver.Iter {
+	if len(aggs) == 0 {
+		return &aggregateIter{err: fmt.Errorf("no aggregates provided")}
+	}
+	am := &aggregateModel{m}
+	var groups []string
+	for _, v := range groupBy {
+		dbName, _, err := m.Map(v)
+		if err != nil {
+			return &aggregateIter{err: err}
+		}
+		groups = append(groups, dbName)
+	}
+	fields := make([]string, len(groups), len(groups)+len(aggs))
+	copy(fields, groups)
+	for _, v := range aggs {
+		expr, _, err := am.expr(v)
+		if err != nil {
+			return &aggregateIter{err: err}
+		}
+		fields = append(fields, expr)
+	}
+	buf := getBuffer()
+	defer putBuffer(buf)
+	var params []interface{}
+	if err := d.SelectStmt(buf, &params, fields, false, m); err != nil {
+		return &aggregateIter{err: err}
+	}
+	qParams, err := d.where(buf, m, q, len(params))
+	if err != nil {
+		return &aggregateIter{err: err}
+	}
+	params = append(params, qParams...)
+	if len(groups) > 0 {
+		buf.WriteString(" GROUP BY ")
+		for ii, v := range groups {
+			if ii > 0 {
+				buf.WriteByte(',')
+			}
+			buf.WriteString(v)
+		}
+	}
+	if !isNil(having) {
+		buf.WriteString(" HAVING ")
+		if err := d.condition(buf, &params, am, having, 0); err != nil {
+			return &aggregateIter{err: err}
+		}
+	}
+	if err := d.orderLimit(buf, am, sort, limit, offset); err != nil {
+		return &aggregateIter{err: err}
+	}
+	rows, err := d.db.Query(buf.String(), params...)
+	if err != nil {
+		return &aggregateIter{err: err}
+	}
+	return &aggregateIter{rows: rows}
+}
+
+type aggregateIter struct {
+	rows *sql.Rows
+	err  error
+}
+
+func (i *aggregateIter) Next(out ...interface{}) bool {
+	if i.err == nil && i.rows != nil && i.rows.Next() {
+		i.err = i.rows.Scan(out...)
+		return i.err == nil
+	}
+	i.Close()
+	return false
+}
+
+func (i *aggregateIter) Err() error {
+	if i.err != nil {
+		return i.err
+	}
+	if i.rows != nil {
+		return i.rows.Err()
+	}
+	return nil
+}
+
+func (i *aggregateIter) Close() error {
+	if i.rows != nil {
+		err := i.rows.Close()
+		if i.err == nil {
+			i.err = i.rows.Err()
+		}
+		i.rows = nil
+		return err
+	}
+	return nil
+}
@@ -847,12 +847,19 @@ func (d *Driver) Select(fields []string, quote bool, m driver.Model, q query.Q,
 		return nil, nil, err
 	}
 	params = append(params, qParams...)
+	if err := d.orderLimit(buf, m, sort, limit, offset); err != nil {
+		return nil, nil, err
+	}
+	return buf, params, nil
+}
+
+func (d *Driver) orderLimit(buf *bytes.Buffer, m driver.Model, sort []driver.Sort, limit int, offset int) error {
 	if len(sort) > 0 {
 		buf.WriteString(" ORDER BY ")
 		for _, v := range sort {
 			dbName, _, err := m.Map(v.Field())
 			if err != nil {
-				return nil, nil, err
+				return err
 			}
 			buf.WriteString(dbName)
 			if v.Direction() == driver.DESC {
@@ -870,7 +877,7 @@ func (d *Driver) Select(fields []string, quote bool, m driver.Model, q query.Q,
 		buf.WriteString(" OFFSET ")
 		buf.WriteString(strconv.Itoa(offset))
 	}
-	return buf, params, nil
+	return nil
 }
 
 func (d *Driver) Begin() (driver.Tx, error) {
@@ -900,7 +907,7 @@ func (d *Driver) Capabilities() driver.Capability {
 	return driver.CAP_JOIN | driver.CAP_OR | driver.CAP_TRANSACTION | driver.CAP_BEGIN |
 		driver.CAP_AUTO_ID | driver.CAP_AUTO_INCREMENT | driver.CAP_PK |
 		driver.CAP_COMPOSITE_PK | driver.CAP_UNIQUE | driver.CAP_DEFAULTS |
-		d.backend.Capabilities()
+		driver.CAP_AGGREGATE | d.backend.Capabilities()
 }
 
 func (d *Driver) HasFunc(fname string, retType reflect.Type) bool {
@@ -38,6 +38,9 @@ func (i *Iter) Next(out ...interface{}) bool {
 			if i.err = i.q.methods[ii].Load(v); i.err != nil {
 				break
 			}
+			if i.err = i.q.methods[ii].Hook(driver.AfterLoad, v, i.q.orm); i.err != nil {
+				break
+			}
 		}
 	} else {
 		i.Close()
@@ -2,12 +2,16 @@ package orm
 
 import (
 	"errors"
+	"reflect"
 	"testing"
+
+	"gnd.la/orm/driver"
 )
 
 var (
 	loadError = errors.New("no load")
 	saveError = errors.New("no save")
+	hookError = errors.New("rejected by hook")
 )
 
 type LoadError struct {
@@ -74,6 +78,128 @@ func testLoadSaveMethodsErrors(t *testing.T, o *Orm) {
 	}
 }
 
+type Audit struct {
+	Id     int64 `orm:",primary_key,auto_increment"`
+	Action string
+}
+
+type Hooked struct {
+	Id     int64 `orm:",primary_key,auto_increment"`
+	Value  string
+	calls  []string `orm:"-"`
+	orms   []*Orm   `orm:"-"`
+	reject bool     `orm:"-"`
+}
+
+func (h *Hooked) hook(name string, o *Orm) error {
+	h.calls = append(h.calls, name)
+	h.orms = append(h.orms, o)
+	_, err := o.Insert(&Audit{Action: name})
+	return err
+}
+
+func (h *Hooked) BeforeInsert(o *Orm) error {
+	if h.reject {
+		return hookError
+	}
+	return h.hook("BeforeInsert", o)
+}
+
+func (h *Hooked) AfterInsert(o *Orm) error {
+	return h.hook("AfterInsert", o)
+}
+
+func (h *Hooked) BeforeUpdate(o *Orm) error {
+	return h.hook("BeforeUpdate", o)
+}
+
+func (h *Hooked) AfterUpdate(o *Orm) error {
+	return h.hook("AfterUpdate", o)
+}
+
+func (h *Hooked) AfterDelete(o *Orm) error {
+	return h.hook("AfterDelete", o)
+}
+
+func (h *Hooked) AfterLoad() {
+	h.calls = append(h.calls, "AfterLoad")
+}
+
+type BadHook struct {
+	Id int64 `orm:",primary_key,auto_increment"`
+}
+
+func (b *BadHook) BeforeInsert(s string) error {
+	return nil
+}
+
+func testHooks(t *testing.T, o *Orm) {
+	o.mustRegister((*Hooked)(nil), nil)
+	auditTable := o.mustRegister((*Audit)(nil), nil)
+	o.mustInitialize()
+	if _, err := o.Register((*BadHook)(nil), nil); err == nil {
+		t.Error("expecting an error when registering BadHook")
+	}
+	expectCalls := func(h *Hooked, calls ...string) {
+		if !reflect.DeepEqual(h.calls, calls) {
+			t.Errorf("expecting hook calls %v, got %v", calls, h.calls)
+		}
+		h.calls = nil
+	}
+	h := &Hooked{Value: "foo"}
+	o.MustInsert(h)
+	expectCalls(h, "BeforeInsert", "AfterInsert")
+	if h.orms[0] != o {
+		t.Error("hook did not receive the ORM performing the operation")
+	}
+	h.orms = nil
+	o.MustSave(h)
+	expectCalls(h, "BeforeUpdate", "AfterUpdate")
+	var loaded *Hooked
+	if _, err := o.One(Eq("Id", h.Id), &loaded); err != nil {
+		t.Fatal(err)
+	}
+	expectCalls(loaded, "AfterLoad")
+	o.MustDelete(h)
+	expectCalls(h, "AfterDelete")
+	// The update affects no rows, so AfterUpdate must not run
+	o.MustSave(h)
+	expectCalls(h, "BeforeUpdate", "BeforeInsert", "AfterInsert")
+	if c, err := o.Count(auditTable, nil); err != nil || c != 8 {
+		t.Errorf("expecting 8 audit rows, got %d (error %v)", c, err)
+	}
+	if _, err := o.Insert(Hooked{Value: "qux"}); err == nil {
+		t.Error("expecting an error when inserting a non-pointer with hooks")
+	}
+	rejected := &Hooked{Value: "bar", reject: true}
+	if _, err := o.Insert(rejected); err != hookError {
+		t.Errorf("expecting error %v from BeforeInsert, got %v", hookError, err)
+	}
+	if rejected.Id != 0 {
+		t.Error("rejected object was inserted")
+	}
+	if o.Driver().Capabilities()&driver.CAP_TRANSACTION == 0 {
+		return
+	}
+	// Audit rows written by the hooks must be rolled back with the transaction
+	h = &Hooked{Value: "baz"}
+	err := o.Transaction(func(tx *Orm) error {
+		if _, err := tx.Insert(h); err != nil {
+			return err
+		}
+		if len(h.orms) == 0 || h.orms[0] != tx {
+			t.Error("hook did not receive the transaction ORM")
+		}
+		return Rollback
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, err := o.Count(auditTable, nil); err != nil || c != 8 {
+		t.Errorf("expecting 8 audit rows after rollback, got %d (error %v)", c, err)
+	}
+}
+
 func benchmarkLoadSaveMethods(b *testing.B, o *Orm) {
 	tbl := o.mustRegister((*Object)(nil), &Options{
 		Table: "test_load_save_benchmark",
@@ -0,0 +1,14 @@
+package orm
+
+import (
+	"time"
+
+	"gnd.la/app/metrics"
+)
+
+var operationDuration = metrics.Default.NewHistogram("gondola_orm_operation_duration_seconds",
+	"Duration of the ORM operations, by operation and model", nil, "operation", "model")
+
+func observeOperation(op string, model string, started time.Time) {
+	operationDuration.Since(started, op, model)
+}
@@ -0,0 +1,89 @@
+package migrate
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"gnd.la/app"
+	"gnd.la/commands"
+)
+
+const commandName = "migrate"
+
+// runningCommand returns true iff the process
+// was started for running the migrate command.
+func runningCommand() bool {
+	return flag.Parsed() && strings.ToLower(flag.Arg(0)) == commandName
+}
+
+func migrateCommand(ctx *app.Context) {
+	var action string
+	ctx.MustParseIndexValue(0, &action)
+	m, err := New(ctx.Orm().Orm)
+	if err != nil {
+		panic(err)
+	}
+	var dryRun bool
+	ctx.ParseParamValue("dry-run", &dryRun)
+	if dryRun {
+		m.SetDryRun(os.Stdout)
+	}
+	var n int
+	ctx.ParseParamValue("n", &n)
+	switch action {
+	case "up":
+		applied, err := m.Up(n)
+		if !dryRun {
+			for _, v := range applied {
+				fmt.Printf("applied %s\n", v.Name)
+			}
+		}
+		if err != nil {
+			panic(err)
+		}
+	case "down":
+		reverted, err := m.Down(n)
+		if !dryRun {
+			for _, v := range reverted {
+				fmt.Printf("reverted %s\n", v.Name)
+			}
+		}
+		if err != nil {
+			panic(err)
+		}
+	case "status":
+		status, err := m.Status()
+		if err != nil {
+			panic(err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		for _, v := range status {
+			state := "pending"
+			if v.IsApplied() {
+				state = "applied " + v.Applied.Format("2006-01-02 15:04:05")
+			}
+			if v.Migration == nil {
+				state += " (not registered)"
+			}
+			fmt.Fprintf(w, "%s\t%s\n", v.Name, state)
+		}
+		w.Flush()
+	default:
+		commands.UsageErrorf("unknown action %q", action)
+	}
+}
+
+func init() {
+	commands.Register(migrateCommand, &commands.Options{
+		Name:  commandName,
+		Help:  "Apply, revert or show the status of the ORM migrations",
+		Usage: "up|down|status",
+		Flags: commands.Flags(
+			commands.IntFlag("n", 0, "Number of migrations to apply or revert. For up, 0 means all the pending ones. For down, 0 means just the last one"),
+			commands.BoolFlag("dry-run", false, "Print the SQL statements instead of executing them"),
+		),
+	})
+}
@@ -0,0 +1,441 @@
+// Package migrate implements schema migrations for the ORM
+// when using a database/sql based driver.
+//
+// While the ORM automatically creates tables and adds new columns
+// when models change, some changes (like renaming or dropping
+// columns, changing their types or creating indexes on existing
+// tables with data) can't be performed automatically. This package
+// allows declaring them as an ordered list of named migrations:
+//
+//	func init() {
+//		migrate.Register(&migrate.Migration{
+//			Name: "0001-rename-user-email",
+//			Up:   []migrate.Operation{migrate.RenameField("user", "mail", "email")},
+//		})
+//		migrate.Register(&migrate.Migration{
+//			Name: "0002-index-user-email",
+//			Up:   []migrate.Operation{migrate.AddIndex("user", index.NewUnique("email"))},
+//		})
+//	}
+//
+// Migrations are applied in the same order they were registered and
+// the applied ones are recorded in a table named gondola_migrations.
+// Each migration runs inside a transaction when the backend supports
+// it. Note that MySQL commits implicitly after every schema change, so
+// a failing migration might be partially applied with that backend.
+//
+// The pending migrations are applied automatically when the ORM is
+// initialized (e.g. by gnd.la/app.App.Prepare), before it creates
+// the missing tables and columns. In the previous example, this means
+// the mail column is renamed before the ORM would add an email column
+// for the Email field. Migrations which only act on tables which don't
+// exist yet (e.g. in a new database) are recorded as applied without
+// running them, since the ORM creates those tables from the current
+// definition of their models.
+//
+// Importing this package also registers the migrate command, which can
+// be run as:
+//
+//	myapp migrate up|down|status
+//
+// or, from the app directory, using gondola migrate up|down|status.
+// Use -dry-run to print the SQL statements instead of executing them.
+// Migrations are not applied automatically when running the migrate
+// command, so the pending ones can be inspected before applying them.
+// Note that reverted migrations will be applied again the next time
+// the ORM is initialized, unless they're removed from the registered
+// ones.
+package migrate
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+	"time"
+
+	"gnd.la/log"
+	"gnd.la/orm"
+	"gnd.la/orm/driver/sql"
+	"gnd.la/util/structs"
+)
+
+const (
+	// Table is the name of the table used to keep track
+	// of the applied migrations.
+	Table = "gondola_migrations"
+)
+
+var (
+	// ErrNoSQL is returned when trying to run migrations with
+	// an ORM driver which doesn't use database/sql.
+	ErrNoSQL = errors.New("migrations require a database/sql based ORM driver")
+
+	registry struct {
+		sync.RWMutex
+		migrations []*Migration
+	}
+)
+
+// Migration is a named set of operations which are applied
+// together.
+type Migration struct {
+	// Name identifies the migration and must be unique. It's
+	// stored in the database once the migration has been applied.
+	Name string
+	// Up contains the operations performed when applying the
+	// migration, in order.
+	Up []Operation
+	// Down contains the operations performed when reverting the
+	// migration, in order. If it's empty, the operations are derived
+	// by reversing the Up operations, which must then implement
+	// Reversible.
+	Down []Operation
+}
+
+func (m *Migration) down() ([]Operation, error) {
+	if len(m.Down) > 0 {
+		return m.Down, nil
+	}
+	ops := make([]Operation, len(m.Up))
+	for ii, v := range m.Up {
+		r, ok := v.(Reversible)
+		if !ok {
+			return nil, fmt.Errorf("migration %q can't be reverted: operation %d (%T) is not reversible and no Down operations were provided", m.Name, ii, v)
+		}
+		ops[len(ops)-ii-1] = r.Reverse()
+	}
+	return ops, nil
+}
+
+// Register adds a new migration to the list of registered ones. Migrations
+// are applied in the same order they're registered, so this function is
+// usually called from init() functions. Registering two migrations with
+// the same name will cause a panic.
+func Register(m *Migration) {
+	if m.Name == "" {
+		panic(errors.New("migrations must have a name"))
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	for _, v := range registry.migrations {
+		if v.Name == m.Name {
+			panic(fmt.Errorf("duplicate migration %q", m.Name))
+		}
+	}
+	registry.migrations = append(registry.migrations, m)
+}
+
+// Migrations returns the registered migrations, in order.
+func Migrations() []*Migration {
+	registry.RLock()
+	defer registry.RUnlock()
+	migrations := make([]*Migration, len(registry.migrations))
+	copy(migrations, registry.migrations)
+	return migrations
+}
+
+// Status represents the state of a migration in the database.
+type Status struct {
+	// Name is the name of the migration.
+	Name string
+	// Migration is the registered migration or nil if the
+	// migration has been applied but it's not registered
+	// anymore.
+	Migration *Migration
+	// Applied is the time when the migration was applied or
+	// the zero time if it hasn't been applied yet.
+	Applied time.Time
+}
+
+// IsApplied returns true iff the migration has been applied.
+func (s *Status) IsApplied() bool {
+	return !s.Applied.IsZero()
+}
+
+// Migrator applies and reverts migrations on an ORM. Use
+// New to initialize a Migrator.
+type Migrator struct {
+	o          *orm.Orm
+	db         *sql.DB
+	migrations []*Migration
+	dryRun     io.Writer
+}
+
+// New returns a new Migrator for the given ORM, using the registered
+// migrations. The ORM must use a database/sql based driver, otherwise
+// ErrNoSQL is returned.
+func New(o *orm.Orm) (*Migrator, error) {
+	db := o.SqlDB()
+	if db == nil {
+		return nil, ErrNoSQL
+	}
+	return &Migrator{
+		o:          o,
+		db:         db,
+		migrations: Migrations(),
+	}, nil
+}
+
+// SetDryRun enables dry-run mode when w is non-nil. In dry-run mode
+// the SQL statements for each migration are written to w rather
+// than executed and no changes are made to the database.
+func (m *Migrator) SetDryRun(w io.Writer) {
+	m.dryRun = w
+}
+
+func (m *Migrator) backend() sql.Backend {
+	return m.db.Backend()
+}
+
+func (m *Migrator) ensureTable() error {
+	b := m.backend()
+	nameType, err := b.FieldType(reflect.TypeOf(""), structs.MustParseTag(",max_length=255"))
+	if err != nil {
+		return err
+	}
+	appliedType, err := b.FieldType(reflect.TypeOf(int64(0)), structs.MustParseTag(""))
+	if err != nil {
+		return err
+	}
+	_, err = m.db.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s %s NOT NULL PRIMARY KEY, %s %s NOT NULL)",
+		quote(b, Table), quote(b, "name"), nameType, quote(b, "applied"), appliedType))
+	return err
+}
+
+func (m *Migrator) applied() (map[string]time.Time, []string, error) {
+	if m.dryRun == nil {
+		if err := m.ensureTable(); err != nil {
+			return nil, nil, err
+		}
+	}
+	b := m.backend()
+	rows, err := m.db.Query(fmt.Sprintf("SELECT %s, %s FROM %s ORDER BY %s, %s", quote(b, "name"), quote(b, "applied"),
+		quote(b, Table), quote(b, "applied"), quote(b, "name")))
+	if err != nil {
+		if m.dryRun != nil {
+			// The table hasn't been created yet
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+	defer rows.Close()
+	applied := make(map[string]time.Time)
+	var names []string
+	for rows.Next() {
+		var name string
+		var ts int64
+		if err := rows.Scan(&name, &ts); err != nil {
+			return nil, nil, err
+		}
+		applied[name] = time.Unix(ts, 0)
+		names = append(names, name)
+	}
+	return applied, names, rows.Err()
+}
+
+// Status returns the status of all the migrations. Registered
+// migrations are returned first, in order, followed by any
+// migration found in the database which is not registered.
+func (m *Migrator) Status() ([]*Status, error) {
+	applied, names, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+	var status []*Status
+	registered := make(map[string]bool)
+	for _, v := range m.migrations {
+		registered[v.Name] = true
+		status = append(status, &Status{Name: v.Name, Migration: v, Applied: applied[v.Name]})
+	}
+	for _, v := range names {
+		if !registered[v] {
+			status = append(status, &Status{Name: v, Applied: applied[v]})
+		}
+	}
+	return status, nil
+}
+
+// Up applies up to n pending migrations, in order. If n <= 0, all
+// the pending migrations are applied. It returns the migrations which
+// were applied. If there's an error, the migrations applied before it
+// are returned too. Migrations which only act on tables which don't
+// exist are recorded as applied without running their operations.
+func (m *Migrator) Up(n int) ([]*Migration, error) {
+	applied, _, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+	var done []*Migration
+	for _, v := range m.migrations {
+		if n > 0 && len(done) == n {
+			break
+		}
+		if _, ok := applied[v.Name]; ok {
+			continue
+		}
+		ops := v.Up
+		missing, err := m.missingTables(ops)
+		if err != nil {
+			return done, err
+		}
+		if missing {
+			// The ORM will create the tables using the
+			// current definition of their models.
+			ops = nil
+		}
+		if err := m.run(v, ops, true); err != nil {
+			return done, err
+		}
+		done = append(done, v)
+	}
+	return done, nil
+}
+
+// missingTables returns true iff every operation in ops
+// acts on a table which doesn't exist in the database.
+func (m *Migrator) missingTables(ops []Operation) (bool, error) {
+	if len(ops) == 0 {
+		return false, nil
+	}
+	for _, v := range ops {
+		op, ok := v.(tableOperation)
+		if !ok {
+			return false, nil
+		}
+		exists, err := m.tableExists(op.tableName())
+		if err != nil || exists {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (m *Migrator) tableExists(table string) (bool, error) {
+	var query string
+	switch m.backend().Name() {
+	case "sqlite3":
+		query = "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?"
+	case "mysql":
+		query = "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = DATABASE() AND table_name = ?"
+	default:
+		query = "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = ?"
+	}
+	var count int
+	if err := m.db.QueryRow(query, table).Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// Down reverts the last n applied migrations, in reverse order. If
+// n <= 0, only the last migration is reverted. It returns the
+// migrations which were reverted. Migrations which have been applied
+// but are not registered anymore are ignored.
+func (m *Migrator) Down(n int) ([]*Migration, error) {
+	if n <= 0 {
+		n = 1
+	}
+	applied, _, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+	var done []*Migration
+	for ii := len(m.migrations) - 1; ii >= 0 && len(done) < n; ii-- {
+		mig := m.migrations[ii]
+		if _, ok := applied[mig.Name]; !ok {
+			continue
+		}
+		ops, err := mig.down()
+		if err != nil {
+			return done, err
+		}
+		if err := m.run(mig, ops, false); err != nil {
+			return done, err
+		}
+		done = append(done, mig)
+	}
+	return done, nil
+}
+
+func (m *Migrator) run(mig *Migration, ops []Operation, up bool) error {
+	b := m.backend()
+	if m.dryRun != nil {
+		direction := "up"
+		if !up {
+			direction = "down"
+		}
+		fmt.Fprintf(m.dryRun, "-- migration %s (%s)\n", mig.Name, direction)
+		for _, op := range ops {
+			if _, ok := op.(Func); ok {
+				fmt.Fprintf(m.dryRun, "-- Go function, can't be printed\n")
+				continue
+			}
+			stmts, err := op.SQL(b)
+			if err != nil {
+				return fmt.Errorf("error in migration %q: %s", mig.Name, err)
+			}
+			for _, s := range stmts {
+				fmt.Fprintf(m.dryRun, "%s;\n", s)
+			}
+		}
+		return nil
+	}
+	err := m.o.Transaction(func(o *orm.Orm) error {
+		db := o.SqlDB()
+		for _, op := range ops {
+			if f, ok := op.(Func); ok {
+				if err := f(o); err != nil {
+					return err
+				}
+				continue
+			}
+			stmts, err := op.SQL(b)
+			if err != nil {
+				return err
+			}
+			for _, s := range stmts {
+				if _, err := db.Exec(s); err != nil {
+					return err
+				}
+			}
+		}
+		var err error
+		if up {
+			_, err = db.Exec(fmt.Sprintf("INSERT INTO %s (%s, %s) VALUES (?, ?)", quote(b, Table), quote(b, "name"), quote(b, "applied")),
+				mig.Name, time.Now().Unix())
+		} else {
+			_, err = db.Exec(fmt.Sprintf("DELETE FROM %s WHERE %s = ?", quote(b, Table), quote(b, "name")), mig.Name)
+		}
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("error in migration %q: %s", mig.Name, err)
+	}
+	return nil
+}
+
+// applyPending applies the pending migrations before the ORM
+// creates or updates its tables.
+func applyPending(o *orm.Orm) error {
+	if len(Migrations()) == 0 || runningCommand() {
+		return nil
+	}
+	m, err := New(o)
+	if err != nil {
+		if err == ErrNoSQL {
+			return nil
+		}
+		return err
+	}
+	applied, err := m.Up(0)
+	for _, v := range applied {
+		log.Infof("applied migration %s", v.Name)
+	}
+	return err
+}
+
+func init() {
+	orm.BeforeInitialize(applyPending)
+}
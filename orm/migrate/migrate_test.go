@@ -0,0 +1,318 @@
+package migrate
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"gnd.la/config"
+	"gnd.la/orm"
+	"gnd.la/orm/driver/mysql"
+	"gnd.la/orm/driver/postgres"
+	"gnd.la/orm/driver/sql"
+	"gnd.la/orm/driver/sqlite"
+	"gnd.la/orm/index"
+)
+
+type sqlTest struct {
+	op       Operation
+	sqlite   []string
+	postgres []string
+	mysql    []string
+}
+
+var sqlTests = []sqlTest{
+	{
+		op:       RenameField("user", "mail", "email"),
+		sqlite:   []string{`ALTER TABLE "user" RENAME COLUMN "mail" TO "email"`},
+		postgres: []string{`ALTER TABLE "user" RENAME COLUMN "mail" TO "email"`},
+		mysql:    []string{`ALTER TABLE "user" RENAME COLUMN "mail" TO "email"`},
+	},
+	{
+		op:       DropField("user", "email"),
+		sqlite:   []string{`ALTER TABLE "user" DROP COLUMN "email"`},
+		postgres: []string{`ALTER TABLE "user" DROP COLUMN "email"`},
+		mysql:    []string{`ALTER TABLE "user" DROP COLUMN "email"`},
+	},
+	{
+		op:       AddField("user", "age", int64(0), ",notnull,default=0"),
+		sqlite:   []string{`ALTER TABLE "user" ADD COLUMN "age" INTEGER NOT NULL DEFAULT 0`},
+		postgres: []string{`ALTER TABLE "user" ADD COLUMN "age" INT8 NOT NULL DEFAULT 0`},
+		mysql:    []string{`ALTER TABLE "user" ADD COLUMN "age" BIGINT NOT NULL DEFAULT 0`},
+	},
+	{
+		op:       AddIndex("user", index.New("email", "created").Set(index.DESC, "created")),
+		sqlite:   []string{`CREATE INDEX "user_email_created_desc" ON "user" ("email", "created" DESC)`},
+		postgres: []string{`CREATE INDEX "user_email_created_desc" ON "user" ("email", "created" DESC)`},
+		mysql:    []string{`CREATE INDEX "user_email_created_desc" ON "user" ("email", "created" DESC)`},
+	},
+	{
+		op:       DropIndex("user", "user_email"),
+		sqlite:   []string{`DROP INDEX IF EXISTS "user_email"`},
+		postgres: []string{`DROP INDEX IF EXISTS "user_email"`},
+		mysql:    []string{`DROP INDEX "user_email" ON "user"`},
+	},
+	{
+		op:     AlterField("user", "age", int32(0), ""),
+		sqlite: nil,
+		postgres: []string{
+			`ALTER TABLE "user" ALTER COLUMN "age" TYPE INT4`,
+			`ALTER TABLE "user" ALTER COLUMN "age" DROP NOT NULL`,
+		},
+		mysql: []string{`ALTER TABLE "user" MODIFY COLUMN "age" INT`},
+	},
+}
+
+func TestSQL(t *testing.T) {
+	backends := []struct {
+		backend  sql.Backend
+		expected func(sqlTest) []string
+	}{
+		{&sqlite.Backend{}, func(t sqlTest) []string { return t.sqlite }},
+		{&postgres.Backend{}, func(t sqlTest) []string { return t.postgres }},
+		{&mysql.Backend{}, func(t sqlTest) []string { return t.mysql }},
+	}
+	for _, b := range backends {
+		for _, v := range sqlTests {
+			expected := b.expected(v)
+			stmts, err := v.op.SQL(b.backend)
+			if expected == nil {
+				if err == nil {
+					t.Errorf("expecting an error from %T with backend %s, got %v", v.op, b.backend.Name(), stmts)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("error generating SQL for %T with backend %s: %s", v.op, b.backend.Name(), err)
+				continue
+			}
+			if !reflect.DeepEqual(stmts, expected) {
+				t.Errorf("expecting %q from %T with backend %s, got %q", expected, v.op, b.backend.Name(), stmts)
+			}
+		}
+	}
+}
+
+func TestReverse(t *testing.T) {
+	m := &Migration{
+		Name: "test",
+		Up: []Operation{
+			AddField("user", "age", int64(0), ""),
+			RenameField("user", "mail", "email"),
+		},
+	}
+	down, err := m.down()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &sqlite.Backend{}
+	var stmts []string
+	for _, v := range down {
+		s, err := v.SQL(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stmts = append(stmts, s...)
+	}
+	expected := []string{
+		`ALTER TABLE "user" RENAME COLUMN "email" TO "mail"`,
+		`ALTER TABLE "user" DROP COLUMN "age"`,
+	}
+	if !reflect.DeepEqual(stmts, expected) {
+		t.Errorf("expecting reversed statements %q, got %q", expected, stmts)
+	}
+	m.Up = append(m.Up, DropField("user", "age"))
+	if _, err := m.down(); err == nil {
+		t.Error("expecting an error when reversing DropField")
+	}
+}
+
+func countMigrations(t *testing.T, db *sql.DB) int {
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM "` + Table + `"`).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+// columns returns the columns in the given sqlite table. Note that
+// selecting a missing column can't be used for checking if it exists,
+// because sqlite interprets unknown quoted identifiers as strings.
+func columns(t *testing.T, db *sql.DB, table string) map[string]bool {
+	rows, err := db.Query(`PRAGMA table_info("` + table + `")`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	cols := make(map[string]bool)
+	for rows.Next() {
+		var cid, notnull, pk int
+		var name, typ string
+		var def *string
+		if err := rows.Scan(&cid, &name, &typ, &notnull, &def, &pk); err != nil {
+			t.Fatal(err)
+		}
+		cols[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return cols
+}
+
+func expectColumns(t *testing.T, db *sql.DB, table string, present []string, missing []string) {
+	cols := columns(t, db, table)
+	for _, v := range present {
+		if !cols[v] {
+			t.Errorf("expecting column %s in table %s, got %v", v, table, cols)
+		}
+	}
+	for _, v := range missing {
+		if cols[v] {
+			t.Errorf("expecting no column %s in table %s, got %v", v, table, cols)
+		}
+	}
+}
+
+func openSqlite(t *testing.T) (*orm.Orm, func()) {
+	f, err := ioutil.TempFile("", "migrate-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	o, err := orm.New(config.MustParseURL("sqlite://" + f.Name()))
+	if err != nil {
+		os.Remove(f.Name())
+		t.Skipf("cannot open sqlite database, skipping test: %s", err)
+	}
+	return o, func() {
+		o.Close()
+		os.Remove(f.Name())
+	}
+}
+
+func TestApplySqlite(t *testing.T) {
+	o, cleanup := openSqlite(t)
+	defer cleanup()
+	db := o.SqlDB()
+	if _, err := db.Exec(`CREATE TABLE "user" ("id" INTEGER PRIMARY KEY, "mail" TEXT)`); err != nil {
+		t.Skipf("cannot create sqlite table, skipping test: %s", err)
+	}
+	m, err := New(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.migrations = []*Migration{
+		{Name: "0001-rename-mail", Up: []Operation{RenameField("user", "mail", "email")}},
+		{Name: "0002-add-age", Up: []Operation{
+			AddField("user", "age", int64(0), ",notnull,default=0"),
+			AddIndex("user", index.New("email")),
+		}},
+	}
+	done, err := m.Up(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(done) != 2 {
+		t.Fatalf("expecting 2 applied migrations, got %d", len(done))
+	}
+	expectColumns(t, db, "user", []string{"email", "age"}, []string{"mail"})
+	if _, err := db.Exec(`INSERT INTO "user" ("email", "age") VALUES ('foo@example.com', 3)`); err != nil {
+		t.Fatalf("migrated columns not available: %s", err)
+	}
+	if c := countMigrations(t, db); c != 2 {
+		t.Errorf("expecting 2 rows in %s, got %d", Table, c)
+	}
+	status, err := m.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range status {
+		if !v.IsApplied() {
+			t.Errorf("migration %s is not marked as applied", v.Name)
+		}
+	}
+	// Nothing pending
+	if done, err := m.Up(0); err != nil || len(done) != 0 {
+		t.Errorf("expecting no pending migrations, got %d (%v)", len(done), err)
+	}
+	done, err = m.Down(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(done) != 1 || done[0].Name != "0002-add-age" {
+		t.Fatalf("expecting 0002-add-age to be reverted, got %v", done)
+	}
+	expectColumns(t, db, "user", []string{"email"}, []string{"age"})
+	if c := countMigrations(t, db); c != 1 {
+		t.Errorf("expecting 1 row in %s after reverting, got %d", Table, c)
+	}
+	if _, err := m.Down(1); err != nil {
+		t.Fatal(err)
+	}
+	expectColumns(t, db, "user", []string{"mail"}, []string{"email"})
+	var mail string
+	if err := db.QueryRow(`SELECT "mail" FROM "user"`).Scan(&mail); err != nil || mail != "foo@example.com" {
+		t.Errorf("expecting mail foo@example.com after reverting, got %q (%v)", mail, err)
+	}
+	if c := countMigrations(t, db); c != 0 {
+		t.Errorf("expecting no rows in %s after reverting everything, got %d", Table, c)
+	}
+}
+
+type migrateUser struct {
+	Id    int64 `orm:",primary_key,auto_increment"`
+	Email string
+}
+
+type migratePost struct {
+	Id   int64 `orm:",primary_key,auto_increment"`
+	Body string
+}
+
+func TestInitializeSqlite(t *testing.T) {
+	o, cleanup := openSqlite(t)
+	defer cleanup()
+	db := o.SqlDB()
+	// migrate_user exists from a previous version of the app,
+	// while migrate_post is created by the ORM.
+	if _, err := db.Exec(`CREATE TABLE "migrate_user" ("id" INTEGER PRIMARY KEY, "mail" TEXT)`); err != nil {
+		t.Skipf("cannot create sqlite table, skipping test: %s", err)
+	}
+	if _, err := db.Exec(`INSERT INTO "migrate_user" ("mail") VALUES ('foo@example.com')`); err != nil {
+		t.Fatal(err)
+	}
+	registry.Lock()
+	saved := registry.migrations
+	registry.migrations = []*Migration{
+		{Name: "0001-rename-user-mail", Up: []Operation{RenameField("migrate_user", "mail", "email")}},
+		{Name: "0002-rename-post-text", Up: []Operation{RenameField("migrate_post", "text", "body")}},
+	}
+	registry.Unlock()
+	defer func() {
+		registry.Lock()
+		registry.migrations = saved
+		registry.Unlock()
+	}()
+	if _, err := o.Register((*migrateUser)(nil), &orm.Options{Table: "migrate_user"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := o.Register((*migratePost)(nil), &orm.Options{Table: "migrate_post"}); err != nil {
+		t.Fatal(err)
+	}
+	// The column must be renamed before the ORM adds the
+	// email column, otherwise the migration would fail.
+	if err := o.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	expectColumns(t, db, "migrate_user", []string{"email"}, []string{"mail"})
+	expectColumns(t, db, "migrate_post", []string{"body"}, []string{"text"})
+	var email string
+	if err := db.QueryRow(`SELECT "email" FROM "migrate_user"`).Scan(&email); err != nil || email != "foo@example.com" {
+		t.Errorf("expecting email foo@example.com after migrating, got %q (%v)", email, err)
+	}
+	if c := countMigrations(t, db); c != 2 {
+		t.Errorf("expecting 2 rows in %s, got %d", Table, c)
+	}
+}
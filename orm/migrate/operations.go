@@ -0,0 +1,300 @@
+package migrate
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"gnd.la/orm"
+	"gnd.la/orm/driver/sql"
+	"gnd.la/orm/index"
+	"gnd.la/util/structs"
+)
+
+// Operation is the interface implemented by the steps
+// of a migration. Besides the declarative operations provided
+// by this package, arbitrary Go code can be run during a
+// migration using Func.
+type Operation interface {
+	// SQL returns the statements required to perform the
+	// operation with the given backend, in order.
+	SQL(b sql.Backend) ([]string, error)
+}
+
+// Reversible is implemented by the operations which
+// can be undone automatically. When a Migration does not
+// declare its Down operations, they're derived by reversing
+// its Up operations, which must all implement Reversible.
+type Reversible interface {
+	Operation
+	// Reverse returns the Operation which undoes this one.
+	Reverse() Operation
+}
+
+// Func is an Operation implemented as a Go function. It receives
+// the ORM in the transaction used for running the migration, if
+// the driver supports transactions. Func operations can't be
+// printed in dry-run mode. Since migrations are applied before the
+// ORM initializes its models (see the package documentation), Func
+// should use the database connection returned by Orm.SqlDB rather
+// than the methods which use the models.
+type Func func(o *orm.Orm) error
+
+// SQL returns no statements, since a Func runs Go code.
+func (f Func) SQL(b sql.Backend) ([]string, error) {
+	return nil, nil
+}
+
+// tableOperation is implemented by the operations
+// which act on a single table.
+type tableOperation interface {
+	tableName() string
+}
+
+type execOp struct {
+	stmts []string
+}
+
+func (op *execOp) SQL(b sql.Backend) ([]string, error) {
+	return op.stmts, nil
+}
+
+// Exec returns an Operation which executes the given SQL statements
+// verbatim. Note that the statements are not adapted to the database
+// backend, so they should be valid for all the backends the
+// migration is going to be run with.
+func Exec(stmts ...string) Operation {
+	return &execOp{stmts: stmts}
+}
+
+type renameFieldOp struct {
+	table string
+	from  string
+	to    string
+}
+
+func (op *renameFieldOp) SQL(b sql.Backend) ([]string, error) {
+	return []string{fmt.Sprintf("ALTER TABLE %s RENAME COLUMN %s TO %s",
+		quote(b, op.table), quote(b, op.from), quote(b, op.to))}, nil
+}
+
+func (op *renameFieldOp) tableName() string {
+	return op.table
+}
+
+func (op *renameFieldOp) Reverse() Operation {
+	return RenameField(op.table, op.to, op.from)
+}
+
+// RenameField returns an Operation which renames the column from to
+// the given name in the given table. Note that both names refer to
+// the database columns (e.g. user_id, not UserId). Renaming columns
+// requires SQLite 3.25 or MySQL 8.0 or later.
+func RenameField(table string, from string, to string) Reversible {
+	return &renameFieldOp{table: table, from: from, to: to}
+}
+
+type dropFieldOp struct {
+	table string
+	field string
+}
+
+func (op *dropFieldOp) SQL(b sql.Backend) ([]string, error) {
+	return []string{fmt.Sprintf("ALTER TABLE %s DROP COLUMN %s",
+		quote(b, op.table), quote(b, op.field))}, nil
+}
+
+func (op *dropFieldOp) tableName() string {
+	return op.table
+}
+
+// DropField returns an Operation which removes the given column from
+// the table. Since the column type and its data can't be recovered,
+// this operation is not reversible. Dropping columns requires SQLite
+// 3.35 or later.
+func DropField(table string, field string) Operation {
+	return &dropFieldOp{table: table, field: field}
+}
+
+type addFieldOp struct {
+	table string
+	field string
+	typ   reflect.Type
+	tag   string
+}
+
+func (op *addFieldOp) definition(b sql.Backend) (string, error) {
+	tag, err := structs.ParseTag(op.tag)
+	if err != nil {
+		return "", err
+	}
+	dbType, err := b.FieldType(op.typ, tag)
+	if err != nil {
+		return "", err
+	}
+	def := quote(b, op.field) + " " + dbType
+	if tag.Has("notnull") {
+		def += " NOT NULL"
+	}
+	if value := tag.Value("default"); value != "" {
+		if op.typ.Kind() == reflect.String {
+			value = quoteString(b, value)
+		}
+		def += " DEFAULT " + value
+	}
+	return def, nil
+}
+
+func (op *addFieldOp) SQL(b sql.Backend) ([]string, error) {
+	def, err := op.definition(b)
+	if err != nil {
+		return nil, err
+	}
+	return []string{fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s", quote(b, op.table), def)}, nil
+}
+
+func (op *addFieldOp) tableName() string {
+	return op.table
+}
+
+func (op *addFieldOp) Reverse() Operation {
+	return DropField(op.table, op.field)
+}
+
+// AddField returns an Operation which adds a new column to the
+// given table. The column type is determined by the backend from the
+// type of typ (e.g. pass int64(0) or "" for an integer or a text
+// column) and tag, which uses the same format as the orm struct tags
+// (e.g. ",notnull,default=0,max_length=255").
+func AddField(table string, field string, typ interface{}, tag string) Reversible {
+	return &addFieldOp{table: table, field: field, typ: reflect.TypeOf(typ), tag: tag}
+}
+
+type alterFieldOp struct {
+	addFieldOp
+}
+
+func (op *alterFieldOp) SQL(b sql.Backend) ([]string, error) {
+	switch b.Name() {
+	case "postgres":
+		tag, err := structs.ParseTag(op.tag)
+		if err != nil {
+			return nil, err
+		}
+		dbType, err := b.FieldType(op.typ, tag)
+		if err != nil {
+			return nil, err
+		}
+		table := quote(b, op.table)
+		field := quote(b, op.field)
+		stmts := []string{fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s TYPE %s", table, field, dbType)}
+		if tag.Has("notnull") {
+			stmts = append(stmts, fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s SET NOT NULL", table, field))
+		} else {
+			stmts = append(stmts, fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s DROP NOT NULL", table, field))
+		}
+		return stmts, nil
+	case "mysql":
+		def, err := op.definition(b)
+		if err != nil {
+			return nil, err
+		}
+		return []string{fmt.Sprintf("ALTER TABLE %s MODIFY COLUMN %s", quote(b, op.table), def)}, nil
+	}
+	return nil, fmt.Errorf("backend %s can't alter columns", b.Name())
+}
+
+// AlterField returns an Operation which changes the type and
+// the NULL constraint of the given column. The parameters are
+// interpreted in the same way as in AddField. Note that SQLite
+// does not support altering columns, so this Operation will
+// always fail with the SQLite backend.
+func AlterField(table string, field string, typ interface{}, tag string) Operation {
+	return &alterFieldOp{addFieldOp{table: table, field: field, typ: reflect.TypeOf(typ), tag: tag}}
+}
+
+type addIndexOp struct {
+	table string
+	idx   *index.Index
+}
+
+func (op *addIndexOp) name() string {
+	parts := []string{op.table}
+	for _, v := range op.idx.Fields {
+		if sql.DescField(op.idx, v) {
+			v += "_desc"
+		}
+		parts = append(parts, v)
+	}
+	return strings.Join(parts, "_")
+}
+
+func (op *addIndexOp) SQL(b sql.Backend) ([]string, error) {
+	if len(op.idx.Fields) == 0 {
+		return nil, fmt.Errorf("index on %s has no fields", op.table)
+	}
+	var fields []string
+	for _, v := range op.idx.Fields {
+		f := quote(b, v)
+		if sql.DescField(op.idx, v) {
+			f += " DESC"
+		}
+		fields = append(fields, f)
+	}
+	create := "CREATE INDEX"
+	if op.idx.Unique {
+		create = "CREATE UNIQUE INDEX"
+	}
+	return []string{fmt.Sprintf("%s %s ON %s (%s)", create, quote(b, op.name()),
+		quote(b, op.table), strings.Join(fields, ", "))}, nil
+}
+
+func (op *addIndexOp) tableName() string {
+	return op.table
+}
+
+func (op *addIndexOp) Reverse() Operation {
+	return DropIndex(op.table, op.name())
+}
+
+// AddIndex returns an Operation which creates the given index
+// on the table. Unlike indexes declared when registering a
+// model, the index fields must be the names of the database
+// columns (e.g. user_id, not UserId). The index name is
+// generated in the same way the ORM does, by joining the table
+// and field names.
+func AddIndex(table string, idx *index.Index) Reversible {
+	return &addIndexOp{table: table, idx: idx}
+}
+
+type dropIndexOp struct {
+	table string
+	name  string
+}
+
+func (op *dropIndexOp) SQL(b sql.Backend) ([]string, error) {
+	if b.Name() == "mysql" {
+		return []string{fmt.Sprintf("DROP INDEX %s ON %s", quote(b, op.name), quote(b, op.table))}, nil
+	}
+	return []string{fmt.Sprintf("DROP INDEX IF EXISTS %s", quote(b, op.name))}, nil
+}
+
+func (op *dropIndexOp) tableName() string {
+	return op.table
+}
+
+// DropIndex returns an Operation which removes the index with
+// the given name from the table.
+func DropIndex(table string, name string) Operation {
+	return &dropIndexOp{table: table, name: name}
+}
+
+func quote(b sql.Backend, s string) string {
+	q := string(b.IdentifierQuote())
+	return q + strings.Replace(s, q, q+q, -1) + q
+}
+
+func quoteString(b sql.Backend, s string) string {
+	q := string(b.StringQuote())
+	return q + strings.Replace(s, q, q+q, -1) + q
+}
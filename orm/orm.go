@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"reflect"
 	"strings"
+	"time"
 
 	"gnd.la/app/profile"
 	"gnd.la/config"
@@ -136,9 +137,14 @@ func (o *Orm) insert(m *model, obj interface{}) (Result, error) {
 	if profile.On && profile.Profiling() {
 		defer profile.Start(orm).Note("insert", m.name).End()
 	}
+	defer observeOperation("insert", m.name, time.Now())
+	f := m.fields
+	if err := f.Methods.Hook(driver.BeforeInsert, obj, o); err != nil {
+		return nil, err
+	}
+	orig := obj
 	var pkName string
 	var pkVal reflect.Value
-	f := m.fields
 	if f.AutoincrementPk {
 		pkName, pkVal = o.primaryKey(f, obj)
 		if pkVal.Int() == 0 && !pkVal.CanSet() {
@@ -182,6 +188,9 @@ func (o *Orm) insert(m *model, obj interface{}) (Result, error) {
 			o.logger.Errorf("could not obtain last insert id: %s", err)
 		}
 	}
+	if err == nil {
+		err = f.Methods.Hook(driver.AfterInsert, orig, o)
+	}
 	return res, err
 }
 
@@ -210,7 +219,20 @@ func (o *Orm) update(m *model, q query.Q, obj interface{}) (Result, error) {
 	if profile.On && profile.Profiling() {
 		defer profile.Start(orm).Note("update", m.name).End()
 	}
-	return o.conn.Update(m, q, obj)
+	defer observeOperation("update", m.name, time.Now())
+	if err := m.fields.Methods.Hook(driver.BeforeUpdate, obj, o); err != nil {
+		return nil, err
+	}
+	res, err := o.conn.Update(m, q, obj)
+	if err != nil {
+		return res, err
+	}
+	// Don't run AfterUpdate when nothing was updated, since
+	// Save and Upsert will insert the object afterwards.
+	if aff, aerr := res.RowsAffected(); aerr == nil && aff == 0 {
+		return res, nil
+	}
+	return res, m.fields.Methods.Hook(driver.AfterUpdate, obj, o)
 }
 
 // Upsert tries to perform an update with the given query
@@ -230,7 +252,15 @@ func (o *Orm) Upsert(q query.Q, obj interface{}) (Result, error) {
 		if profile.On && profile.Profiling() {
 			defer profile.Start(orm).Note("upsert", "").End()
 		}
-		return o.conn.Upsert(m, q, obj)
+		defer observeOperation("upsert", m.name, time.Now())
+		if err := m.fields.Methods.Hook(driver.BeforeUpdate, obj, o); err != nil {
+			return nil, err
+		}
+		res, err := o.conn.Upsert(m, q, obj)
+		if err == nil {
+			err = m.fields.Methods.Hook(driver.AfterUpdate, obj, o)
+		}
+		return res, err
 	}
 	res, err := o.update(m, q, obj)
 	if err != nil {
@@ -289,6 +319,7 @@ func (o *Orm) save(m *model, obj interface{}) (Result, error) {
 	if profile.On && profile.Profiling() {
 		defer profile.Start(orm).Note("save", m.name).End()
 	}
+	defer observeOperation("save", m.name, time.Now())
 	var res Result
 	var err error
 	if m.fields.PrimaryKey >= 0 {
@@ -374,14 +405,20 @@ func (o *Orm) deleteByPk(m *model, obj interface{}) error {
 	if q == nil {
 		return fmt.Errorf("type %T does not have a primary key", obj)
 	}
-	_, err := o.delete(m, q)
-	return err
+	if err := m.fields.Methods.Hook(driver.BeforeDelete, obj, o); err != nil {
+		return err
+	}
+	if _, err := o.delete(m, q); err != nil {
+		return err
+	}
+	return m.fields.Methods.Hook(driver.AfterDelete, obj, o)
 }
 
 func (o *Orm) delete(m *model, q query.Q) (Result, error) {
 	if profile.On && profile.Profiling() {
 		defer profile.Start(orm).Note("delete", m.name).End()
 	}
+	defer observeOperation("delete", m.name, time.Now())
 	return o.conn.Delete(m, q)
 }
 
@@ -405,6 +442,9 @@ func (o *Orm) Begin() (*Tx, error) {
 	}
 	cpy := *o
 	cpy.conn = tx
+	if db, ok := tx.Connection().(*sql.DB); ok {
+		cpy.db = db
+	}
 	return &Tx{
 		Orm: cpy,
 		o:   o,
@@ -486,6 +526,9 @@ func (o *Orm) Driver() driver.Driver {
 // a small compatibility wrapper around the former. See the
 // gnd.la/orm/driver/sql.DB documentation for further
 // information.
+//
+// When called on a transaction, the returned DB
+// executes its statements inside the transaction.
 func (o *Orm) SqlDB() *sql.DB {
 	return o.db
 }
@@ -3,6 +3,7 @@ package orm
 import (
 	"bytes"
 	"flag"
+	"reflect"
 	"testing"
 	"time"
 
@@ -125,6 +126,12 @@ type Defaulter struct {
 	Val3 time.Time `orm:",default=today()"`
 }
 
+type Sale struct {
+	Id       int64  `orm:",primary_key,auto_increment"`
+	Category string `mysql:",max_length=255"`
+	Amount   int64
+}
+
 func equalTimes(t1, t2 time.Time) bool {
 	// Compare seconds, since some backends (like sqlite) loss subsecond precission
 	return t1.Truncate(time.Second).Equal(t2.Truncate(time.Second))
@@ -660,6 +667,67 @@ func runAllTests(t *testing.T, o opener) {
 	testOrm(t, orm)
 }
 
+func testAggregate(t *testing.T, o *Orm) {
+	table := o.mustRegister((*Sale)(nil), nil)
+	o.mustInitialize()
+	if o.Driver().Capabilities()&driver.CAP_AGGREGATE == 0 {
+		iter := o.Table(table).Aggregate(Sum("Amount"))
+		if iter.Next() || iter.Err() == nil {
+			t.Error("expecting an error from a driver without CAP_AGGREGATE")
+		}
+		return
+	}
+	sales := []*Sale{
+		{Category: "a", Amount: 1},
+		{Category: "a", Amount: 3},
+		{Category: "b", Amount: 10},
+		{Category: "c", Amount: 5},
+		{Category: "c", Amount: 7},
+	}
+	for _, v := range sales {
+		o.MustInsert(v)
+	}
+	var total, max int64
+	iter := o.Table(table).Filter(Neq("Category", "b")).Aggregate(Sum("Amount"), Max("Amount"))
+	if !iter.Next(&total, &max) {
+		t.Fatalf("no results from aggregate: %v", iter.Err())
+	}
+	iter.Close()
+	if total != 16 || max != 7 {
+		t.Errorf("expecting SUM = 16 and MAX = 7, got %d and %d", total, max)
+	}
+	iter = o.Table(table).GroupBy("Category").Having(Gt("COUNT(Id)", 1)).Sort("SUM(Amount)", DESC).
+		Aggregate(Sum("Amount"), Avg("Amount"), CountOf(""))
+	var categories []string
+	var sums []int64
+	var avgs []float64
+	var counts []int64
+	var category string
+	var sum, count int64
+	var avg float64
+	for iter.Next(&category, &sum, &avg, &count) {
+		categories = append(categories, category)
+		sums = append(sums, sum)
+		avgs = append(avgs, avg)
+		counts = append(counts, count)
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(categories, []string{"c", "a"}) {
+		t.Errorf("expecting categories [c a], got %v", categories)
+	}
+	if !reflect.DeepEqual(sums, []int64{12, 4}) {
+		t.Errorf("expecting sums [12 4], got %v", sums)
+	}
+	if !reflect.DeepEqual(avgs, []float64{6, 2}) {
+		t.Errorf("expecting averages [6 2], got %v", avgs)
+	}
+	if !reflect.DeepEqual(counts, []int64{2, 2}) {
+		t.Errorf("expecting counts [2 2], got %v", counts)
+	}
+}
+
 func testOrm(t *testing.T, o *Orm) {
 	tests := []func(*testing.T, *Orm){
 		testCodecs,
@@ -678,6 +746,8 @@ func testOrm(t *testing.T, o *Orm) {
 		testDefaults,
 		testMigrations,
 		testSaveUnchanged,
+		testAggregate,
+		testHooks,
 	}
 	for _, v := range tests {
 		clearRegistry(o)
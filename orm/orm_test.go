@@ -72,6 +72,26 @@ func TestSaveUnchanged(t *testing.T) {
 	runTest(t, testSaveUnchanged)
 }
 
+func TestHooks(t *testing.T) {
+	runTest(t, testHooks)
+}
+
+func TestAggregate(t *testing.T) {
+	runTest(t, testAggregate)
+}
+
+func TestQueryCloneGroupBy(t *testing.T) {
+	q := (&Query{}).GroupBy("Category")
+	c := q.Clone().GroupBy("Amount")
+	q.GroupBy("Id")
+	if len(c.groupBy) != 2 || c.groupBy[1] != "Amount" {
+		t.Errorf("expecting clone to group by [Category Amount], got %v", c.groupBy)
+	}
+	if len(q.groupBy) != 2 || q.groupBy[1] != "Id" {
+		t.Errorf("expecting original to group by [Category Id], got %v", q.groupBy)
+	}
+}
+
 func BenchmarkLoadSaveMethods(b *testing.B) {
 	runBenchmark(b, benchmarkLoadSaveMethods)
 }
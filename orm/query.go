@@ -6,6 +6,7 @@ import (
 	"gnd.la/orm/driver"
 	"gnd.la/orm/query"
 	"reflect"
+	"time"
 )
 
 type Query struct {
@@ -15,6 +16,8 @@ type Query struct {
 	jtype   JoinType
 	q       query.Q
 	sort    []driver.Sort
+	groupBy []string
+	having  query.Q
 	limit   int
 	offset  int
 	err     error
@@ -22,7 +25,7 @@ type Query struct {
 
 func (q *Query) ensureTable(f string) error {
 	if q.model == nil {
-		fmt.Errorf("no table selected, set one with Table() before calling %s()", f)
+		return fmt.Errorf("no table selected, set one with Table() before calling %s()", f)
 	}
 	return nil
 }
@@ -88,6 +91,69 @@ func (q *Query) Sort(field string, dir Sort) *Query {
 	return q
 }
 
+// GroupBy sets the fields used for grouping the results
+// when calling Aggregate. To group by multiple fields, either
+// pass them all at once or call GroupBy multiple times.
+func (q *Query) GroupBy(fields ...string) *Query {
+	q.groupBy = append(q.groupBy, fields...)
+	return q
+}
+
+// Having adds a condition which is applied to each group of
+// results when calling Aggregate. Like Filter, calling
+// Having multiple times ANDs the conditions. Aggregates are
+// referenced in the conditions using the form FUNC(Field)
+// (e.g. Gt("SUM(Price)", 100)).
+func (q *Query) Having(qu query.Q) *Query {
+	if qu != nil {
+		if q.having == nil {
+			q.having = qu
+		} else {
+			q.having = And(q.having, qu)
+		}
+	}
+	return q
+}
+
+// Aggregate computes the given aggregates over the results of the
+// query, grouped by the fields set with GroupBy (or over all the
+// results, if there are no grouping fields). The returned iter yields
+// a row for each group with the values of the grouping fields followed
+// by the values of the aggregates. Sort, Limit and Offset are applied
+// to the groups, and aggregates might be used as sorting fields too
+// (e.g. Sort("SUM(Price)", DESC)). e.g.
+//
+//  iter := o.Table(orderTable).GroupBy("Customer").Having(orm.Gt("COUNT(Id)", 1)).
+//	Aggregate(orm.Sum("Total"), orm.Avg("Total"))
+//  var customer int64
+//  var sum, avg float64
+//  for iter.Next(&customer, &sum, &avg) {
+//	...
+//  }
+//  err := iter.Err()
+//
+// Note that you have to set the table manually before calling Aggregate().
+// Drivers without the CAP_AGGREGATE capability return an error.
+func (q *Query) Aggregate(aggs ...*query.Aggregate) *AggregateIter {
+	if err := q.ensureTable("Aggregate"); err != nil {
+		return &AggregateIter{err: err}
+	}
+	if q.err != nil {
+		return &AggregateIter{err: q.err}
+	}
+	aggregator, ok := q.orm.conn.(driver.Aggregator)
+	if !ok || q.orm.driver.Capabilities()&driver.CAP_AGGREGATE == 0 {
+		return &AggregateIter{err: fmt.Errorf("ORM driver %T does not support aggregates", q.orm.driver)}
+	}
+	if profile.On && profile.Profiling() {
+		defer profile.Start(orm).Note("aggregate", q.model.String()).End()
+	}
+	defer observeOperation("aggregate", q.model.model.name, time.Now())
+	return &AggregateIter{
+		Iter: aggregator.Aggregate(q.model, q.q, aggs, q.groupBy, q.having, q.sort, q.limit, q.offset),
+	}
+}
+
 // One fetches the first result for this query. The first
 // return value indicates if a result was found.
 func (q *Query) One(out ...interface{}) (bool, error) {
@@ -122,6 +188,7 @@ func (q *Query) Exists() (bool, error) {
 	if profile.On && profile.Profiling() {
 		defer profile.Start(orm).Note("exists", q.model.String()).End()
 	}
+	defer observeOperation("exists", q.model.model.name, time.Now())
 	return q.orm.driver.Exists(q.model, q.q)
 }
 
@@ -193,6 +260,7 @@ func (q *Query) Count() (uint64, error) {
 	if profile.On && profile.Profiling() {
 		defer profile.Start(orm).Note("count", q.model.String()).End()
 	}
+	defer observeOperation("count", q.model.model.name, time.Now())
 	return q.orm.driver.Count(q.model, q.q, q.limit, q.offset)
 }
 
@@ -207,14 +275,20 @@ func (q *Query) MustCount() uint64 {
 
 // Clone returns a copy of the query.
 func (q *Query) Clone() *Query {
+	var groupBy []string
+	if q.groupBy != nil {
+		groupBy = append([]string(nil), q.groupBy...)
+	}
 	return &Query{
-		orm:    q.orm,
-		model:  q.model,
-		q:      q.q,
-		sort:   q.sort,
-		limit:  q.limit,
-		offset: q.offset,
-		err:    q.err,
+		orm:     q.orm,
+		model:   q.model,
+		q:       q.q,
+		sort:    q.sort,
+		groupBy: groupBy,
+		having:  q.having,
+		limit:   q.limit,
+		offset:  q.offset,
+		err:     q.err,
 	}
 }
 
@@ -230,6 +304,7 @@ func (q *Query) exec(limit int) driver.Iter {
 	if profile.On && profile.Profiling() {
 		defer profile.Start(orm).Note("query", q.model.String()).End()
 	}
+	defer observeOperation("query", q.model.model.name, time.Now())
 	return q.orm.conn.Query(q.model, q.q, q.sort, limit, q.offset)
 }
 
@@ -0,0 +1,59 @@
+package query
+
+import (
+	"regexp"
+	"strings"
+)
+
+// AggregateFunc is the function used by an Aggregate.
+type AggregateFunc string
+
+const (
+	// Sum adds all the values of the field.
+	Sum AggregateFunc = "SUM"
+	// Avg returns the average of the values of the field.
+	Avg AggregateFunc = "AVG"
+	// Min returns the minimum value of the field.
+	Min AggregateFunc = "MIN"
+	// Max returns the maximum value of the field.
+	Max AggregateFunc = "MAX"
+	// Count returns the number of non-NULL values of the field
+	// or, when the field is empty, the number of rows.
+	Count AggregateFunc = "COUNT"
+)
+
+var (
+	aggregateRe = regexp.MustCompile("(?i)^(SUM|AVG|MIN|MAX|COUNT)\\(([^\\)]*)\\)$")
+)
+
+// Aggregate represents an aggregate function applied to a field
+// over a group of results.
+type Aggregate struct {
+	Func  AggregateFunc
+	Field string
+}
+
+// String returns the aggregate in the form FUNC(Field) (e.g. SUM(Price)).
+// This format can be used as the field name in conditions passed to
+// Having (e.g. orm.Gt("SUM(Price)", 100)).
+func (a *Aggregate) String() string {
+	return string(a.Func) + "(" + a.Field + ")"
+}
+
+// ParseAggregate parses an aggregate in the form returned by
+// Aggregate.String. The function name is case insensitive. If
+// s does not represent an aggregate, it returns nil.
+func ParseAggregate(s string) *Aggregate {
+	m := aggregateRe.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return nil
+	}
+	field := strings.TrimSpace(m[2])
+	if field == "*" {
+		field = ""
+	}
+	return &Aggregate{
+		Func:  AggregateFunc(strings.ToUpper(m[1])),
+		Field: field,
+	}
+}
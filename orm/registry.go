@@ -39,6 +39,7 @@ type pending struct {
 
 var (
 	timeType     = reflect.TypeOf(time.Time{})
+	ormType      = reflect.TypeOf((*Orm)(nil))
 	referencesRe = regexp.MustCompile("([\\w\\.]+)(\\((\\w+)\\))?")
 
 	globalRegistry struct {
@@ -55,11 +56,33 @@ var (
 		sync.RWMutex
 		pending []*pending
 	}
+
+	// functions registered via BeforeInitialize
+	initializeHooks struct {
+		sync.RWMutex
+		hooks []func(*Orm) error
+	}
 )
 
 // Register registers a new type for all ORMs instantiated after
 // this point. This is the preferred way to register structs and
 // it generally should be called from an init() function.
+//
+// Models might declare lifecycle hooks as methods on their pointer
+// type named BeforeInsert, AfterInsert, BeforeUpdate, AfterUpdate,
+// BeforeDelete, AfterDelete and AfterLoad. Hooks might receive the
+// *Orm performing the operation (which is the transaction's Orm when
+// using a Tx or Orm.Transaction) and might return an error. An error
+// returned from a Before hook aborts the operation, while an error
+// returned from an After hook is returned to the caller, which
+// should roll back the transaction if required. Note that Save and
+// Upsert might run BeforeUpdate followed by the insert hooks, since
+// they try an update before inserting (AfterUpdate only runs when the
+// update affected any rows), while drivers which upsert in one query
+// run just the update hooks. Delete runs the delete hooks but DeleteFrom
+// does not, since it doesn't receive an object. Since hooks might
+// modify the object, models declaring hooks must always be passed
+// as pointers to Insert, Update, Save, Upsert and Delete.
 func Register(t interface{}, opts *Options) {
 	pendingRegistry.Lock()
 	defer pendingRegistry.Unlock()
@@ -175,6 +198,20 @@ func (o *Orm) initializePending() error {
 	return nil
 }
 
+// BeforeInitialize registers a function which is called by
+// Initialize before creating or updating any tables, so changes
+// to the database which can't be performed automatically (e.g.
+// renaming columns) are done before the ORM tries to make the
+// tables match the models. If f returns an error, Initialize
+// returns it without touching the tables. Note that the models
+// are not ready to be used when f is called. See gnd.la/orm/migrate
+// for an example.
+func BeforeInitialize(f func(o *Orm) error) {
+	initializeHooks.Lock()
+	defer initializeHooks.Unlock()
+	initializeHooks.hooks = append(initializeHooks.hooks, f)
+}
+
 // Initialize is a low level function and should only be used
 // when dealing with multiple ORM types. If you're only using the
 // default ORM as returned by gnd.la/app.App.Orm() or
@@ -184,8 +221,17 @@ func (o *Orm) initializePending() error {
 // Initialize resolves model references and creates tables and
 // indexes required by the registered models. You MUST call it
 // AFTER all the models have been registered and BEFORE starting
-// to use the ORM for queries for each ORM type.
+// to use the ORM for queries for each ORM type. The functions
+// registered with BeforeInitialize are called first.
 func (o *Orm) Initialize() error {
+	initializeHooks.RLock()
+	hooks := initializeHooks.hooks
+	initializeHooks.RUnlock()
+	for _, v := range hooks {
+		if err := v(o); err != nil {
+			return err
+		}
+	}
 	globalRegistry.Lock()
 	defer globalRegistry.Unlock()
 	signal.Emit(WILL_INITIALIZE, o)
@@ -277,6 +323,9 @@ func (o *Orm) fields(table string, s *structs.Struct) (*driver.Fields, map[strin
 	if err != nil {
 		return nil, nil, err
 	}
+	if err := methods.CheckHooks(reflect.PtrTo(s.Type), ormType); err != nil {
+		return nil, nil, err
+	}
 	fields := &driver.Fields{
 		Struct:     s,
 		PrimaryKey: -1,
@@ -0,0 +1,502 @@
+package signal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gnd.la/internal/runtimeutil"
+	"gnd.la/log"
+)
+
+const (
+	// DefaultWorkers is the number of goroutines used by a Bus
+	// for running asynchronous listeners, unless changed with
+	// Bus.SetWorkers.
+	DefaultWorkers = 4
+
+	asyncQueueSize = 1024
+)
+
+var (
+	// DefaultBus is the Bus used by the package level functions
+	// On, OnAsync, Off, Dispatch and DispatchWait.
+	DefaultBus = NewBus()
+
+	// ErrUnknownEvent is returned by Bus.Decode when there
+	// are no listeners for the given event name.
+	ErrUnknownEvent = errors.New("unknown event")
+
+	errorType = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// ListenerError represents an error returned by a listener, or
+// a panic which happened while running it.
+type ListenerError struct {
+	// Listener is the name of the listener function.
+	Listener string
+	// Event is the event which was being handled.
+	Event interface{}
+	// Err is the error returned by the listener or
+	// created from its panic.
+	Err error
+}
+
+func (e *ListenerError) Error() string {
+	return fmt.Sprintf("listener %s failed handling %T: %s", e.Listener, e.Event, e.Err)
+}
+
+// Errors is returned by Dispatch when one or more
+// synchronous listeners fail.
+type Errors []*ListenerError
+
+func (e Errors) Error() string {
+	msgs := make([]string, len(e))
+	for ii, v := range e {
+		msgs[ii] = v.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+type listener struct {
+	fn     reflect.Value
+	name   string
+	async  bool
+	hasErr bool
+}
+
+func (l *listener) call(event reflect.Value) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v\n%s", r, runtimeutil.FormatStack(2))
+		}
+	}()
+	out := l.fn.Call([]reflect.Value{event})
+	if l.hasErr && !out[0].IsNil() {
+		err = out[0].Interface().(error)
+	}
+	return err
+}
+
+type delivery struct {
+	listener *listener
+	event    reflect.Value
+	// done, if non-nil, is called after running the listener
+	done func(*ListenerError)
+}
+
+// workerPool runs the asynchronous listeners of a Bus.
+type workerPool struct {
+	queue   chan *delivery
+	stopped sync.WaitGroup
+}
+
+// goroutineId returns the id of the calling goroutine,
+// parsed from the first line of its stack trace (e.g.
+// goroutine 42 [running]:).
+func goroutineId() int64 {
+	var buf [64]byte
+	b := buf[:runtime.Stack(buf[:], false)]
+	b = bytes.TrimPrefix(b, []byte("goroutine "))
+	if p := bytes.IndexByte(b, ' '); p > 0 {
+		b = b[:p]
+	}
+	id, _ := strconv.ParseInt(string(b), 10, 64)
+	return id
+}
+
+// Bus dispatches events to the listeners registered for their
+// type. Listeners might run synchronously, in the goroutine which
+// dispatches the event, or asynchronously, in a pool of worker
+// goroutines. All Bus methods are safe to call from multiple
+// goroutines. Use NewBus to initialize a Bus.
+type Bus struct {
+	mu           sync.RWMutex
+	listeners    map[reflect.Type][]*listener
+	names        map[string]reflect.Type
+	workers      int
+	errorHandler func(*ListenerError)
+	// poolMu is held for reading while sending to the pool
+	// queue, so Close can safely close it.
+	poolMu      sync.RWMutex
+	pool        *workerPool
+	pendingMu   sync.Mutex
+	pendingDone *sync.Cond
+	pending     int
+	// ids of the worker goroutines, see DispatchWait
+	workerMu  sync.Mutex
+	workerIds map[int64]bool
+}
+
+// NewBus returns a new Bus with no listeners.
+func NewBus() *Bus {
+	b := &Bus{
+		listeners: make(map[reflect.Type][]*listener),
+		names:     make(map[string]reflect.Type),
+		workers:   DefaultWorkers,
+		workerIds: make(map[int64]bool),
+	}
+	b.pendingDone = sync.NewCond(&b.pendingMu)
+	return b
+}
+
+// SetWorkers sets the number of goroutines used for running the
+// asynchronous listeners. It only takes effect the next time the
+// workers are started, either when the first event is dispatched
+// to an asynchronous listener or after calling Close.
+func (b *Bus) SetWorkers(workers int) {
+	b.mu.Lock()
+	b.workers = workers
+	b.mu.Unlock()
+}
+
+// SetErrorHandler sets a function which is called with every error
+// returned by a listener, as well as with any panic recovered while
+// running one. If no handler is set, errors are logged using
+// gnd.la/log.
+func (b *Bus) SetErrorHandler(handler func(*ListenerError)) {
+	b.mu.Lock()
+	b.errorHandler = handler
+	b.mu.Unlock()
+}
+
+// On registers a synchronous listener, which will be called in the
+// goroutine calling Dispatch. The listener must be a function which
+// receives exactly one argument, the event, and returns either nothing
+// or an error. The event type is the type of its argument, so a listener
+// declared as func(*UserCreated) error will be called with every event
+// of type *UserCreated. If the listener is not valid, On will panic.
+//
+// The returned value is the token, which is required for removing
+// the listener with Off. If you don't need to remove it, you can
+// safely ignore it.
+func (b *Bus) On(f interface{}) *Token {
+	return b.on(f, false)
+}
+
+// OnAsync works like On, but the listener is run in the worker pool,
+// so Dispatch doesn't wait for it. Asynchronous listeners might run
+// concurrently and in any order.
+func (b *Bus) OnAsync(f interface{}) *Token {
+	return b.on(f, true)
+}
+
+func (b *Bus) on(f interface{}, async bool) *Token {
+	l, typ, err := newListener(f, async)
+	if err != nil {
+		panic(err)
+	}
+	b.mu.Lock()
+	b.listeners[typ] = append(b.listeners[typ], l)
+	b.names[typeName(typ)] = typ
+	b.mu.Unlock()
+	return &Token{bus: b, listener: l, typ: typ}
+}
+
+// Off removes a listener previously registered with On
+// or OnAsync.
+func (b *Bus) Off(t *Token) {
+	if t == nil || t.bus != b {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var listeners []*listener
+	for _, v := range b.listeners[t.typ] {
+		if v != t.listener {
+			listeners = append(listeners, v)
+		}
+	}
+	if len(listeners) == 0 {
+		delete(b.listeners, t.typ)
+		delete(b.names, typeName(t.typ))
+		return
+	}
+	b.listeners[t.typ] = listeners
+}
+
+// Dispatch sends the event to all the listeners registered for its
+// type. Synchronous listeners are called in the order they were
+// registered before Dispatch returns, while asynchronous ones are
+// sent to the worker pool. Errors and panics from the listeners are
+// captured and passed to the error handler (see SetErrorHandler), so
+// a failing listener doesn't prevent the rest from running. Additionally,
+// if any synchronous listener fails, Dispatch returns an Errors.
+func (b *Bus) Dispatch(event interface{}) error {
+	return b.dispatch(event, false)
+}
+
+// DispatchWait works like Dispatch, but it also waits for the
+// asynchronous listeners to finish. If any listener fails, either
+// synchronous or asynchronous, DispatchWait returns an Errors.
+//
+// When DispatchWait is called from an asynchronous listener, the
+// asynchronous listeners for the event are run in the calling
+// goroutine, one after another. Otherwise, the worker running the
+// caller would wait for a delivery which might need that same worker
+// (e.g. when there's only one), deadlocking the Bus.
+func (b *Bus) DispatchWait(event interface{}) error {
+	return b.dispatch(event, true)
+}
+
+func (b *Bus) dispatch(event interface{}, wait bool) error {
+	if event == nil {
+		return errors.New("can't dispatch a nil event")
+	}
+	val := reflect.ValueOf(event)
+	b.mu.RLock()
+	listeners := b.listeners[val.Type()]
+	b.mu.RUnlock()
+	log.Debugf("Dispatching %T event to %d listeners", event, len(listeners))
+	var errs Errors
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	inWorker := wait && b.inWorker()
+	for _, v := range listeners {
+		if v.async && !inWorker {
+			d := &delivery{listener: v, event: val}
+			if wait {
+				wg.Add(1)
+				d.done = func(err *ListenerError) {
+					if err != nil {
+						mu.Lock()
+						errs = append(errs, err)
+						mu.Unlock()
+					}
+					wg.Done()
+				}
+			}
+			b.enqueue(d)
+			continue
+		}
+		if err := b.run(v, val); err != nil {
+			mu.Lock()
+			errs = append(errs, err)
+			mu.Unlock()
+		}
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Wait blocks until all the events sent to asynchronous
+// listeners have been handled.
+func (b *Bus) Wait() {
+	b.pendingMu.Lock()
+	for b.pending > 0 {
+		b.pendingDone.Wait()
+	}
+	b.pendingMu.Unlock()
+}
+
+// Close waits for the asynchronous listeners to handle all the
+// events already dispatched and then stops the worker goroutines.
+// Dispatching an event to an asynchronous listener after Close
+// starts the workers again, so it's safe to close a Bus shared by
+// several users (like DefaultBus).
+func (b *Bus) Close() {
+	b.poolMu.Lock()
+	pool := b.pool
+	b.pool = nil
+	b.poolMu.Unlock()
+	if pool != nil {
+		// No goroutine is sending to the queue at this point,
+		// since poolMu was held for writing.
+		close(pool.queue)
+		pool.stopped.Wait()
+	}
+}
+
+// Decode returns a new event for the type with the given name (see
+// EventName), using the decode function to initialize it. The function
+// receives a pointer to a zero event and it's usually a call to
+// an Unmarshal function. Only types with registered listeners are
+// known to the Bus, otherwise ErrUnknownEvent is returned.
+func (b *Bus) Decode(name string, decode func(v interface{}) error) (interface{}, error) {
+	b.mu.RLock()
+	typ := b.names[name]
+	b.mu.RUnlock()
+	if typ == nil {
+		return nil, ErrUnknownEvent
+	}
+	val := reflect.New(typ)
+	if err := decode(val.Interface()); err != nil {
+		return nil, err
+	}
+	return val.Elem().Interface(), nil
+}
+
+func (b *Bus) enqueue(d *delivery) {
+	b.pendingMu.Lock()
+	b.pending++
+	b.pendingMu.Unlock()
+	b.poolMu.RLock()
+	for b.pool == nil {
+		b.poolMu.RUnlock()
+		b.poolMu.Lock()
+		if b.pool == nil {
+			b.pool = b.startWorkers()
+		}
+		b.poolMu.Unlock()
+		b.poolMu.RLock()
+	}
+	b.pool.queue <- d
+	b.poolMu.RUnlock()
+}
+
+func (b *Bus) startWorkers() *workerPool {
+	b.mu.RLock()
+	workers := b.workers
+	b.mu.RUnlock()
+	if workers <= 0 {
+		workers = 1
+	}
+	pool := &workerPool{queue: make(chan *delivery, asyncQueueSize)}
+	pool.stopped.Add(workers)
+	for ii := 0; ii < workers; ii++ {
+		go b.worker(pool)
+	}
+	return pool
+}
+
+// inWorker returns true iff it's called from one
+// of the worker goroutines.
+func (b *Bus) inWorker() bool {
+	id := goroutineId()
+	b.workerMu.Lock()
+	defer b.workerMu.Unlock()
+	return b.workerIds[id]
+}
+
+func (b *Bus) worker(pool *workerPool) {
+	defer pool.stopped.Done()
+	id := goroutineId()
+	b.workerMu.Lock()
+	b.workerIds[id] = true
+	b.workerMu.Unlock()
+	defer func() {
+		b.workerMu.Lock()
+		delete(b.workerIds, id)
+		b.workerMu.Unlock()
+	}()
+	for d := range pool.queue {
+		err := b.run(d.listener, d.event)
+		if d.done != nil {
+			d.done(err)
+		}
+		b.pendingMu.Lock()
+		b.pending--
+		if b.pending == 0 {
+			b.pendingDone.Broadcast()
+		}
+		b.pendingMu.Unlock()
+	}
+}
+
+func (b *Bus) run(l *listener, event reflect.Value) *ListenerError {
+	err := l.call(event)
+	if err == nil {
+		return nil
+	}
+	lerr := &ListenerError{
+		Listener: l.name,
+		Event:    event.Interface(),
+		Err:      err,
+	}
+	b.mu.RLock()
+	handler := b.errorHandler
+	b.mu.RUnlock()
+	if handler != nil {
+		handler(lerr)
+	} else {
+		log.Error(lerr)
+	}
+	return lerr
+}
+
+func newListener(f interface{}, async bool) (*listener, reflect.Type, error) {
+	val := reflect.ValueOf(f)
+	if !val.IsValid() {
+		return nil, nil, errors.New("listener is not a valid value - probably nil")
+	}
+	if val.Kind() != reflect.Func {
+		return nil, nil, fmt.Errorf("listener is of type %s, not function", val.Type())
+	}
+	name := runtimeutil.FuncName(f)
+	vt := val.Type()
+	if vt.NumIn() != 1 {
+		return nil, nil, fmt.Errorf("listeners must accept 1 argument, %s accepts %d", name, vt.NumIn())
+	}
+	hasErr := false
+	switch vt.NumOut() {
+	case 0:
+	case 1:
+		if vt.Out(0) != errorType {
+			return nil, nil, fmt.Errorf("listeners can only return error, %s returns %s", name, vt.Out(0))
+		}
+		hasErr = true
+	default:
+		return nil, nil, fmt.Errorf("listeners can return at most 1 value, %s returns %d", name, vt.NumOut())
+	}
+	typ := vt.In(0)
+	if typ.Kind() == reflect.Interface {
+		return nil, nil, fmt.Errorf("listeners must accept a concrete event type, %s accepts %s", name, typ)
+	}
+	return &listener{fn: val, name: name, async: async, hasErr: hasErr}, typ, nil
+}
+
+// EventName returns the name which identifies the type of the given
+// event, formed by its package path and its type name (e.g.
+// *example.com/users.Created). It's used for encoding events, since
+// their type can't be serialized.
+func EventName(event interface{}) string {
+	return typeName(reflect.TypeOf(event))
+}
+
+func typeName(typ reflect.Type) string {
+	prefix := ""
+	for typ.Kind() == reflect.Ptr {
+		prefix += "*"
+		typ = typ.Elem()
+	}
+	if typ.PkgPath() == "" {
+		return prefix + typ.String()
+	}
+	return prefix + typ.PkgPath() + "." + typ.Name()
+}
+
+// On registers a synchronous listener in the DefaultBus. See Bus.On.
+func On(f interface{}) *Token {
+	return DefaultBus.On(f)
+}
+
+// OnAsync registers an asynchronous listener in the DefaultBus. See
+// Bus.OnAsync.
+func OnAsync(f interface{}) *Token {
+	return DefaultBus.OnAsync(f)
+}
+
+// Off removes a listener from the DefaultBus. See Bus.Off.
+func Off(t *Token) {
+	DefaultBus.Off(t)
+}
+
+// Dispatch sends an event to the listeners in the DefaultBus. See
+// Bus.Dispatch.
+func Dispatch(event interface{}) error {
+	return DefaultBus.Dispatch(event)
+}
+
+// DispatchWait sends an event to the listeners in the DefaultBus and
+// waits for all of them to finish. See Bus.DispatchWait.
+func DispatchWait(event interface{}) error {
+	return DefaultBus.DispatchWait(event)
+}
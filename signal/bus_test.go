@@ -0,0 +1,244 @@
+package signal
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testEvent struct {
+	Value int
+}
+
+type otherEvent struct{}
+
+var errTestListener = errors.New("listener failed")
+
+func TestDispatch(t *testing.T) {
+	b := NewBus()
+	b.SetErrorHandler(func(*ListenerError) {})
+	var calls []string
+	b.On(func(e *testEvent) { calls = append(calls, "first") })
+	b.On(func(e *testEvent) error {
+		calls = append(calls, "second")
+		return errTestListener
+	})
+	b.On(func(e *testEvent) { panic("listener panicked") })
+	b.On(func(e *testEvent) { calls = append(calls, "fourth") })
+	b.On(func(e *otherEvent) { calls = append(calls, "other") })
+	err := b.Dispatch(&testEvent{})
+	errs, ok := err.(Errors)
+	if !ok || len(errs) != 2 {
+		t.Fatalf("expecting 2 errors, got %v", err)
+	}
+	if errs[0].Err != errTestListener {
+		t.Errorf("expecting error %v, got %v", errTestListener, errs[0].Err)
+	}
+	if exp := []string{"first", "second", "fourth"}; len(calls) != len(exp) {
+		t.Errorf("expecting calls %v, got %v", exp, calls)
+	} else {
+		for ii, v := range exp {
+			if calls[ii] != v {
+				t.Errorf("expecting calls %v, got %v", exp, calls)
+				break
+			}
+		}
+	}
+	if err := b.Dispatch(nil); err == nil {
+		t.Error("expecting an error dispatching a nil event")
+	}
+}
+
+func TestOff(t *testing.T) {
+	b := NewBus()
+	calls := 0
+	tok := b.On(func(e *testEvent) { calls++ })
+	b.Dispatch(&testEvent{})
+	b.Off(tok)
+	b.Dispatch(&testEvent{})
+	if calls != 1 {
+		t.Errorf("expecting 1 call, got %d", calls)
+	}
+	if _, err := b.Decode(EventName(&testEvent{}), nil); err != ErrUnknownEvent {
+		t.Errorf("expecting ErrUnknownEvent after removing the listener, got %v", err)
+	}
+}
+
+func TestInvalidListeners(t *testing.T) {
+	invalid := []interface{}{
+		nil,
+		1,
+		func() {},
+		func(a, b *testEvent) {},
+		func(e *testEvent) int { return 0 },
+		func(e *testEvent) (error, error) { return nil, nil },
+		func(e interface{}) {},
+	}
+	for _, v := range invalid {
+		if _, _, err := newListener(v, false); err == nil {
+			t.Errorf("expecting an error for listener %T", v)
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+	b := NewBus()
+	b.On(func(e *testEvent) {})
+	name := EventName(&testEvent{})
+	if name != "*gnd.la/signal.testEvent" {
+		t.Errorf("unexpected event name %q", name)
+	}
+	event, err := b.Decode(name, func(v interface{}) error {
+		*(v.(**testEvent)) = &testEvent{Value: 42}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := event.(*testEvent); !ok || e.Value != 42 {
+		t.Errorf("expecting decoded *testEvent with value 42, got %#v", event)
+	}
+	if _, err := b.Decode(EventName(&otherEvent{}), nil); err != ErrUnknownEvent {
+		t.Errorf("expecting ErrUnknownEvent, got %v", err)
+	}
+}
+
+func TestDispatchWait(t *testing.T) {
+	b := NewBus()
+	b.SetErrorHandler(func(*ListenerError) {})
+	release := make(chan struct{})
+	b.OnAsync(func(e *testEvent) error {
+		<-release
+		return errTestListener
+	})
+	b.OnAsync(func(e *testEvent) {})
+	done := make(chan error)
+	go func() {
+		done <- b.DispatchWait(&testEvent{})
+	}()
+	select {
+	case <-done:
+		t.Fatal("DispatchWait returned before the asynchronous listeners finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	err := <-done
+	if errs, ok := err.(Errors); !ok || len(errs) != 1 || errs[0].Err != errTestListener {
+		t.Errorf("expecting error from asynchronous listener, got %v", err)
+	}
+	// Dispatch doesn't report errors from asynchronous listeners
+	if err := b.Dispatch(&testEvent{}); err != nil {
+		t.Errorf("expecting no error from Dispatch, got %v", err)
+	}
+	b.Close()
+}
+
+func TestDispatchWaitFromListener(t *testing.T) {
+	b := NewBus()
+	b.SetWorkers(1)
+	var handled int32
+	b.OnAsync(func(e *otherEvent) {
+		atomic.AddInt32(&handled, 1)
+	})
+	done := make(chan error, 1)
+	b.OnAsync(func(e *testEvent) {
+		// The only worker is running this listener
+		done <- b.DispatchWait(&otherEvent{})
+	})
+	if err := b.Dispatch(&testEvent{}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("DispatchWait from an asynchronous listener deadlocked")
+	}
+	if h := atomic.LoadInt32(&handled); h != 1 {
+		t.Errorf("expecting 1 handled event, got %d", h)
+	}
+	b.Close()
+}
+
+func TestWait(t *testing.T) {
+	b := NewBus()
+	b.SetWorkers(2)
+	var handled int32
+	b.OnAsync(func(e *testEvent) { atomic.AddInt32(&handled, 1) })
+	const dispatchers = 8
+	const events = 100
+	var wg sync.WaitGroup
+	for ii := 0; ii < dispatchers; ii++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for jj := 0; jj < events; jj++ {
+				b.Dispatch(&testEvent{})
+				// Wait might be called while other goroutines
+				// are dispatching events.
+				if jj%10 == 0 {
+					b.Wait()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	b.Wait()
+	if h := atomic.LoadInt32(&handled); h != dispatchers*events {
+		t.Errorf("expecting %d handled events, got %d", dispatchers*events, h)
+	}
+	b.Close()
+}
+
+func TestClose(t *testing.T) {
+	b := NewBus()
+	var handled int32
+	b.OnAsync(func(e *testEvent) {
+		time.Sleep(time.Millisecond)
+		atomic.AddInt32(&handled, 1)
+	})
+	for ii := 0; ii < 10; ii++ {
+		b.Dispatch(&testEvent{})
+	}
+	b.Close()
+	if h := atomic.LoadInt32(&handled); h != 10 {
+		t.Errorf("expecting 10 handled events after Close, got %d", h)
+	}
+	// Closing again is a no-op
+	b.Close()
+	// Workers are started again after Close
+	b.Dispatch(&testEvent{})
+	b.Wait()
+	if h := atomic.LoadInt32(&handled); h != 11 {
+		t.Errorf("expecting 11 handled events, got %d", h)
+	}
+	b.Close()
+}
+
+func TestCloseConcurrent(t *testing.T) {
+	b := NewBus()
+	var handled int32
+	b.OnAsync(func(e *testEvent) { atomic.AddInt32(&handled, 1) })
+	var wg sync.WaitGroup
+	for ii := 0; ii < 4; ii++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for jj := 0; jj < 100; jj++ {
+				b.Dispatch(&testEvent{})
+			}
+		}()
+	}
+	for ii := 0; ii < 10; ii++ {
+		b.Close()
+	}
+	wg.Wait()
+	b.Close()
+	if h := atomic.LoadInt32(&handled); h != 400 {
+		t.Errorf("expecting 400 handled events, got %d", h)
+	}
+}
@@ -1,4 +1,26 @@
 // Package signal implements functions for emitting and receiving
 // signals on events. Gondola provides some builtin signals, but
 // users can define additional ones
+//
+// Besides the named signals (see Listen and Emit), this package
+// implements a typed event bus (see Bus), where events are identified
+// by their type and listeners might run synchronously or in a worker
+// pool, with any errors or panics from them being captured and logged.
+//
+//  type UserCreated struct {
+//	UserId int64
+//  }
+//
+//  func init() {
+//	signal.On(func(e *UserCreated) error {
+//	    return sendWelcomeEmail(e.UserId)
+//	})
+//  }
+//
+//  // After creating the user
+//  signal.Dispatch(&UserCreated{UserId: user.Id})
+//
+// Events might also be dispatched through the persistent job queue
+// in gnd.la/tasks (see gnd.la/tasks.DispatchQueued), so they're not
+// lost if the process crashes before the listeners run.
 package signal
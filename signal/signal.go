@@ -4,17 +4,25 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
+	"sync"
 
 	"gnd.la/internal/runtimeutil"
 	"gnd.la/log"
 )
 
 var (
-	signals = map[string][]*reflect.Value{}
+	signals   = map[string][]*reflect.Value{}
+	signalsMu sync.RWMutex
 )
 
+// Token identifies a listener, either registered with
+// Listen or with a Bus. It's required for removing the
+// listener.
 type Token struct {
-	val *reflect.Value
+	val      *reflect.Value
+	bus      *Bus
+	listener *listener
+	typ      reflect.Type
 }
 
 // Listen adds a new listener for the given signal name. The
@@ -47,8 +55,10 @@ func listen(name string, f interface{}) (*Token, error) {
 	if err := checkListener(val); err != nil {
 		return nil, err
 	}
+	signalsMu.Lock()
 	signals[name] = append(signals[name], &val)
-	return &Token{&val}, nil
+	signalsMu.Unlock()
+	return &Token{val: &val}, nil
 }
 
 // Stop removes a listener, previously registered using Listen. The
@@ -57,6 +67,8 @@ func listen(name string, f interface{}) (*Token, error) {
 // Listen(). If it's empty, all the listeners for the given signals will be
 // removed.
 func Stop(name string, t *Token) {
+	signalsMu.Lock()
+	defer signalsMu.Unlock()
 	if name == "" {
 		for k := range signals {
 			removeToken(signals, k, t)
@@ -69,7 +81,10 @@ func Stop(name string, t *Token) {
 // Emit calls all the listeners for the given signal.
 func Emit(name string, object interface{}) {
 	log.Debugf("Emitting signal %s with %T object", name, object)
-	if rec := signals[name]; rec != nil {
+	signalsMu.RLock()
+	rec := signals[name]
+	signalsMu.RUnlock()
+	if rec != nil {
 		params := []reflect.Value{reflect.ValueOf(name), reflect.ValueOf(object)}
 		for _, v := range rec {
 			v.Call(params[:v.Type().NumIn()])
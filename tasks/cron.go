@@ -0,0 +1,280 @@
+package tasks
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	cronDescriptors = map[string]string{
+		"@yearly":   "0 0 1 1 *",
+		"@annually": "0 0 1 1 *",
+		"@monthly":  "0 0 1 * *",
+		"@weekly":   "0 0 * * 0",
+		"@daily":    "0 0 * * *",
+		"@midnight": "0 0 * * *",
+		"@hourly":   "0 * * * *",
+	}
+	cronMonths = map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}
+	cronDays = map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}
+)
+
+type cronField struct {
+	name  string
+	min   int
+	max   int
+	names map[string]int
+}
+
+var cronFields = [...]cronField{
+	{"minute", 0, 59, nil},
+	{"hour", 0, 23, nil},
+	{"day of month", 1, 31, nil},
+	{"month", 1, 12, cronMonths},
+	// 7 is also accepted as Sunday
+	{"day of week", 0, 7, cronDays},
+}
+
+// Cron represents a cron-style schedule. Use ParseCron to
+// create a Cron.
+type Cron struct {
+	spec    string
+	loc     *time.Location
+	minute  uint64
+	hour    uint64
+	dom     uint64
+	month   uint64
+	dow     uint64
+	anyDom  bool
+	anyDow  bool
+	anyHour bool
+}
+
+// ParseCron parses a cron specification with the 5 standard fields
+// (minute, hour, day of month, month and day of week), separated by
+// spaces. e.g. "0 3 * * *" means every day at 03:00. Each field might
+// be a "*", a number, a range (1-5), a list (1,3,5) or any of them
+// followed by a step (*/15, 0-30/10). Months and days of week might
+// also be specified by their 3 letter English names (jan, mon...).
+// As in most cron implementations, when both the day of month and the
+// day of week are restricted, the schedule matches days satisfying any
+// of them. The descriptors @yearly (or @annually), @monthly, @weekly,
+// @daily (or @midnight) and @hourly are also supported.
+//
+// The schedule is interpreted in the given location. If loc is nil,
+// time.Local is used. Alternatively, the specification might be
+// prefixed by TZ=<zone> or CRON_TZ=<zone> (e.g. "TZ=Europe/Madrid 0 3 * * *"),
+// which takes precedence over loc.
+func ParseCron(spec string, loc *time.Location) (*Cron, error) {
+	c := &Cron{spec: spec, loc: loc}
+	fields := strings.Fields(spec)
+	if len(fields) > 0 {
+		f := fields[0]
+		var zone string
+		if strings.HasPrefix(f, "TZ=") {
+			zone = f[3:]
+		} else if strings.HasPrefix(f, "CRON_TZ=") {
+			zone = f[8:]
+		}
+		if zone != "" {
+			zl, err := time.LoadLocation(zone)
+			if err != nil {
+				return nil, fmt.Errorf("invalid time zone in cron specification %q: %s", spec, err)
+			}
+			c.loc = zl
+			fields = fields[1:]
+		}
+	}
+	if c.loc == nil {
+		c.loc = time.Local
+	}
+	if len(fields) == 1 && strings.HasPrefix(fields[0], "@") {
+		expanded, ok := cronDescriptors[strings.ToLower(fields[0])]
+		if !ok {
+			return nil, fmt.Errorf("unknown cron descriptor %q", fields[0])
+		}
+		fields = strings.Fields(expanded)
+	}
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("invalid cron specification %q: expecting %d fields, got %d", spec, len(cronFields), len(fields))
+	}
+	masks := [...]*uint64{&c.minute, &c.hour, &c.dom, &c.month, &c.dow}
+	for ii, v := range fields {
+		mask, err := cronFields[ii].parse(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron specification %q: %s", spec, err)
+		}
+		*masks[ii] = mask
+	}
+	// Sunday might be specified either as 0 or 7
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	c.anyHour = strings.HasPrefix(fields[1], "*")
+	c.anyDom = strings.HasPrefix(fields[2], "*")
+	c.anyDow = strings.HasPrefix(fields[4], "*")
+	return c, nil
+}
+
+// MustParseCron works like ParseCron, but panics if
+// there's an error.
+func MustParseCron(spec string, loc *time.Location) *Cron {
+	c, err := ParseCron(spec, loc)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+func (f *cronField) parse(s string) (uint64, error) {
+	var mask uint64
+	for _, part := range strings.Split(s, ",") {
+		rng := part
+		step := 1
+		if p := strings.IndexByte(part, '/'); p >= 0 {
+			rng = part[:p]
+			var err error
+			step, err = strconv.Atoi(part[p+1:])
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in %s %q", f.name, part)
+			}
+		}
+		var start, end int
+		switch {
+		case rng == "*":
+			start, end = f.min, f.max
+		case strings.IndexByte(rng, '-') > 0:
+			p := strings.IndexByte(rng, '-')
+			var err error
+			if start, err = f.value(rng[:p]); err != nil {
+				return 0, err
+			}
+			if end, err = f.value(rng[p+1:]); err != nil {
+				return 0, err
+			}
+			if end < start {
+				return 0, fmt.Errorf("invalid range in %s %q", f.name, part)
+			}
+		default:
+			var err error
+			if start, err = f.value(rng); err != nil {
+				return 0, err
+			}
+			end = start
+			if step > 1 {
+				// e.g. 5/15 means from 5 to the maximum every 15
+				end = f.max
+			}
+		}
+		for ii := start; ii <= end; ii += step {
+			mask |= 1 << uint(ii)
+		}
+	}
+	return mask, nil
+}
+
+func (f *cronField) value(s string) (int, error) {
+	if v, ok := f.names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q", f.name, s)
+	}
+	if v < f.min || v > f.max {
+		return 0, fmt.Errorf("%s %d out of range [%d, %d]", f.name, v, f.min, f.max)
+	}
+	return v, nil
+}
+
+// Location returns the time.Location used to interpret the schedule.
+func (c *Cron) Location() *time.Location {
+	return c.loc
+}
+
+// Next returns the first time matching the schedule which is strictly
+// after t. The returned time is in the Cron location. If there's no
+// such time in the next 5 years (e.g. "0 0 30 2 *"), the zero
+// time.Time is returned.
+//
+// Like most cron implementations, schedules with a fixed hour run
+// only once when the clock goes back due to DST, while the ones
+// falling into the hour skipped when the clock goes forward run
+// right after the change. Schedules with a wildcard hour (e.g.
+// "*/15 * * * *") always follow the actual time.
+func (c *Cron) Next(t time.Time) time.Time {
+	// Don't use time.Date() for moving between hours, since
+	// it's ambiguous when the clock goes back.
+	t = t.In(c.loc).Truncate(time.Minute).Add(time.Minute)
+	limit := t.Year() + 5
+	for t.Year() < limit {
+		if c.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, c.loc)
+			continue
+		}
+		if !c.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, c.loc)
+			continue
+		}
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			next := t.Add(time.Hour - time.Duration(t.Minute())*time.Minute)
+			if c.skipsHour(t, next) {
+				return next
+			}
+			t = next
+			continue
+		}
+		if !c.anyHour && t.Add(-time.Hour).Hour() == t.Hour() {
+			// Repeated hour when the clock goes back (DST),
+			// it already ran in the first one.
+			t = t.Add(time.Hour - time.Duration(t.Minute())*time.Minute)
+			continue
+		}
+		if c.minute&(1<<uint(t.Minute())) == 0 {
+			next := t.Add(time.Minute)
+			if c.skipsHour(t, next) {
+				return next
+			}
+			t = next
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// skipsHour returns true iff going from prev to next skips
+// a wall clock hour in the schedule (because the clock goes
+// forward due to DST).
+func (c *Cron) skipsHour(prev time.Time, next time.Time) bool {
+	if c.anyHour || next.Day() != prev.Day() {
+		return false
+	}
+	for h := prev.Hour() + 1; h < next.Hour(); h++ {
+		if c.hour&(1<<uint(h)) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Cron) matchesDay(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.anyDom || c.anyDow {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// String returns the specification the Cron was parsed from.
+func (c *Cron) String() string {
+	return c.spec
+}
@@ -0,0 +1,114 @@
+package tasks
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		spec  string
+		valid bool
+	}{
+		{"* * * * *", true},
+		{"0 3 * * *", true},
+		{"*/15 0-6,22,23 1-31/2 jan-jun mon-fri", true},
+		{"5/15 * * * 7", true},
+		{"@daily", true},
+		{"@HOURLY", true},
+		{"TZ=UTC 0 0 * * *", true},
+		{"CRON_TZ=Europe/Madrid @weekly", true},
+		{"", false},
+		{"* * * *", false},
+		{"* * * * * *", false},
+		{"60 * * * *", false},
+		{"* 24 * * *", false},
+		{"* * 0 * *", false},
+		{"* * * 13 *", false},
+		{"* * * * 8", false},
+		{"*/0 * * * *", false},
+		{"10-5 * * * *", false},
+		{"* * * foo *", false},
+		{"@never", false},
+		{"TZ=Nowhere/Nothing * * * * *", false},
+	}
+	for _, v := range tests {
+		_, err := ParseCron(v.spec, time.UTC)
+		if v.valid && err != nil {
+			t.Errorf("error parsing %q: %s", v.spec, err)
+		} else if !v.valid && err == nil {
+			t.Errorf("expecting an error parsing %q", v.spec)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	madrid, err := time.LoadLocation("Europe/Madrid")
+	if err != nil {
+		t.Skipf("can't load time zone: %s", err)
+	}
+	tests := []struct {
+		spec   string
+		loc    *time.Location
+		from   string
+		expect string
+	}{
+		{"0 3 * * *", time.UTC, "2023-01-01T03:00:00Z", "2023-01-02T03:00:00Z"},
+		{"*/15 * * * *", time.UTC, "2023-01-01T10:07:30Z", "2023-01-01T10:15:00Z"},
+		{"0 0 * * mon", time.UTC, "2023-01-01T00:00:00Z", "2023-01-02T00:00:00Z"},
+		{"0 0 * * 7", time.UTC, "2023-01-02T00:00:00Z", "2023-01-08T00:00:00Z"},
+		// Either day of month or day of week when both are restricted
+		{"0 0 13 * fri", time.UTC, "2023-01-01T00:00:00Z", "2023-01-06T00:00:00Z"},
+		{"0 0 13 * fri", time.UTC, "2023-01-07T00:00:00Z", "2023-01-13T00:00:00Z"},
+		// Month ends
+		{"0 0 31 * *", time.UTC, "2023-04-01T00:00:00Z", "2023-05-31T00:00:00Z"},
+		{"0 12 30 * *", time.UTC, "2023-01-31T00:00:00Z", "2023-03-30T12:00:00Z"},
+		{"0 0 29 2 *", time.UTC, "2023-03-01T00:00:00Z", "2024-02-29T00:00:00Z"},
+		{"59 23 31 12 *", time.UTC, "2023-12-31T23:59:00Z", "2024-12-31T23:59:00Z"},
+		{"@monthly", time.UTC, "2023-01-31T23:59:59Z", "2023-02-01T00:00:00Z"},
+		{"0 0 30 2 *", time.UTC, "2023-01-01T00:00:00Z", ""},
+		// Schedule location
+		{"0 3 * * *", madrid, "2023-01-01T00:00:00Z", "2023-01-01T03:00:00+01:00"},
+		{"TZ=UTC 0 3 * * *", madrid, "2023-01-01T00:00:00Z", "2023-01-01T03:00:00Z"},
+		// Clock goes forward: 02:00 CET becomes 03:00 CEST
+		{"30 2 * * *", madrid, "2023-03-25T12:00:00+01:00", "2023-03-26T03:00:00+02:00"},
+		{"30 1,2 * * *", madrid, "2023-03-26T01:30:00+01:00", "2023-03-26T03:00:00+02:00"},
+		{"0 3 * * *", madrid, "2023-03-26T00:00:00+01:00", "2023-03-26T03:00:00+02:00"},
+		{"0 * * * *", madrid, "2023-03-26T01:30:00+01:00", "2023-03-26T03:00:00+02:00"},
+		{"30 2 * * *", madrid, "2023-03-26T03:00:00+02:00", "2023-03-27T02:30:00+02:00"},
+		// Clock goes back: 03:00 CEST becomes 02:00 CET
+		{"30 2 * * *", madrid, "2023-10-29T00:00:00+02:00", "2023-10-29T02:30:00+02:00"},
+		{"30 2 * * *", madrid, "2023-10-29T02:30:00+02:00", "2023-10-30T02:30:00+01:00"},
+		{"0 3 * * *", madrid, "2023-10-29T00:00:00+02:00", "2023-10-29T03:00:00+01:00"},
+		{"*/30 * * * *", madrid, "2023-10-29T02:30:00+02:00", "2023-10-29T02:00:00+01:00"},
+		{"*/30 * * * *", madrid, "2023-10-29T02:00:00+01:00", "2023-10-29T02:30:00+01:00"},
+	}
+	for _, v := range tests {
+		c, err := ParseCron(v.spec, v.loc)
+		if err != nil {
+			t.Errorf("error parsing %q: %s", v.spec, err)
+			continue
+		}
+		from, err := time.Parse(time.RFC3339, v.from)
+		if err != nil {
+			t.Fatal(err)
+		}
+		next := c.Next(from)
+		if v.expect == "" {
+			if !next.IsZero() {
+				t.Errorf("expecting no time after %s for %q, got %s", v.from, v.spec, next.Format(time.RFC3339))
+			}
+			continue
+		}
+		expect, err := time.Parse(time.RFC3339, v.expect)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !next.Equal(expect) {
+			t.Errorf("expecting %s after %s for %q, got %s", v.expect, v.from, v.spec, next.Format(time.RFC3339))
+		}
+		if next.Location() != c.Location() {
+			t.Errorf("expecting %s in location %s, got %s", next, c.Location(), next.Location())
+		}
+	}
+}
@@ -0,0 +1,12 @@
+package tasks
+
+import (
+	"gnd.la/app/metrics"
+)
+
+var (
+	taskRuns     = metrics.Default.NewCounter("gondola_task_runs_total", "Number of task runs, by task", "task")
+	taskFailures = metrics.Default.NewCounter("gondola_task_failures_total", "Number of task runs which panicked, by task", "task")
+	jobRuns      = metrics.Default.NewCounter("gondola_job_runs_total", "Number of job attempts, by job", "job")
+	jobFailures  = metrics.Default.NewCounter("gondola_job_failures_total", "Number of failed job attempts, by job", "job")
+)
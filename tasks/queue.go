@@ -0,0 +1,564 @@
+package tasks
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"gnd.la/app"
+	"gnd.la/orm"
+	"gnd.la/orm/index"
+	"gnd.la/orm/query"
+	"gnd.la/signal"
+)
+
+const (
+	// DefaultQueue is the queue used by jobs which don't
+	// specify one.
+	DefaultQueue = "default"
+	// DefaultConcurrency is the number of jobs which can run
+	// simultaneously from the same queue in each process,
+	// unless changed with SetQueueConcurrency.
+	DefaultConcurrency = 4
+
+	defaultMaxAttempts = 10
+	defaultBackoff     = 30 * time.Second
+	defaultMaxBackoff  = time.Hour
+	defaultTimeout     = 10 * time.Minute
+	pollInterval       = time.Second
+	// maximum number of jobs loaded on each poll
+	pollBatchSize = 100
+)
+
+// JobState indicates the state of a Job.
+type JobState int
+
+const (
+	// JobPending indicates the job is waiting to be run, either
+	// for the first time or after a failure.
+	JobPending JobState = iota
+	// JobRunning indicates the job is currently being run by
+	// a worker.
+	JobRunning
+	// JobDead indicates the job failed too many times and
+	// won't be retried unless it's requeued with Requeue.
+	JobDead
+)
+
+// Job represents a unit of work stored in the persistent queue. Jobs
+// are stored using the app ORM in a table named gondola_jobs and
+// removed once they succeed.
+type Job struct {
+	Id          int64  `orm:",primary_key,auto_increment"`
+	Name        string `orm:",max_length=255"`
+	Queue       string `orm:",max_length=255"`
+	Payload     []byte
+	State       JobState
+	Attempts    int
+	MaxAttempts int
+	RunAt       time.Time
+	LockedUntil time.Time
+	LastError   string
+	Created     time.Time
+	// Version is used for atomically claiming and
+	// updating jobs from multiple processes.
+	Version int64
+}
+
+// Decode decodes the job payload into the value pointed by v.
+func (j *Job) Decode(v interface{}) error {
+	if len(j.Payload) == 0 {
+		return nil
+	}
+	return json.Unmarshal(j.Payload, v)
+}
+
+// JobHandler is the function type used for running jobs. If the
+// handler returns an error or panics, the job is retried after a
+// delay which increases exponentially with the number of attempts,
+// until it reaches its maximum number of attempts. At that point,
+// it's moved to the dead letter state (see DeadJobs).
+type JobHandler func(ctx *app.Context, job *Job) error
+
+// JobOptions are used to specify the job options when registering
+// a JobHandler.
+type JobOptions struct {
+	// Queue is the default queue for the job. If empty,
+	// DefaultQueue is used.
+	Queue string
+	// MaxAttempts is the maximum number of times the job will be
+	// run before being moved to the dead letter state. If zero,
+	// it defaults to 10.
+	MaxAttempts int
+	// Backoff is the delay before the first retry. Every following
+	// retry doubles the previous delay. If zero, it defaults to 30
+	// seconds.
+	Backoff time.Duration
+	// MaxBackoff is the maximum delay between retries. If zero,
+	// it defaults to 1 hour.
+	MaxBackoff time.Duration
+	// Timeout is the maximum time a job might run before it's
+	// considered lost (e.g. because the process running it crashed)
+	// and it's picked up again by another worker. If zero, it
+	// defaults to 10 minutes.
+	Timeout time.Duration
+}
+
+func (o *JobOptions) queue() string {
+	if o != nil && o.Queue != "" {
+		return o.Queue
+	}
+	return DefaultQueue
+}
+
+func (o *JobOptions) maxAttempts() int {
+	if o != nil && o.MaxAttempts > 0 {
+		return o.MaxAttempts
+	}
+	return defaultMaxAttempts
+}
+
+func (o *JobOptions) timeout() time.Duration {
+	if o != nil && o.Timeout > 0 {
+		return o.Timeout
+	}
+	return defaultTimeout
+}
+
+// backoff returns the delay before retrying a job which
+// has been attempted the given number of times.
+func (o *JobOptions) backoff(attempts int) time.Duration {
+	delay := defaultBackoff
+	max := defaultMaxBackoff
+	if o != nil {
+		if o.Backoff > 0 {
+			delay = o.Backoff
+		}
+		if o.MaxBackoff > 0 {
+			max = o.MaxBackoff
+		}
+	}
+	for ii := 1; ii < attempts && delay < max; ii++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// EnqueueOptions are used to specify options for an individual job
+// when enqueuing it. Any of them might be omitted.
+type EnqueueOptions struct {
+	// Queue overrides the queue set when registering the job.
+	Queue string
+	// Delay indicates the job should not run until after the
+	// given duration.
+	Delay time.Duration
+	// At indicates the job should not run until the given
+	// time. If both Delay and At are provided, At is ignored.
+	At time.Time
+	// MaxAttempts overrides the MaxAttempts set when
+	// registering the job.
+	MaxAttempts int
+}
+
+var jobType = reflect.TypeOf(Job{})
+
+type jobHandler struct {
+	handler JobHandler
+	opts    *JobOptions
+}
+
+var jobs struct {
+	sync.RWMutex
+	handlers    map[string]*jobHandler
+	concurrency map[string]int
+	workers     map[*app.App]*workerPool
+	registered  bool
+}
+
+// RegisterJob registers a handler for the jobs with the given name. Jobs
+// must be registered before the app ORM is initialized, so this function
+// should usually be called from an init() function. Registering a job
+// also registers the Job model with the ORM. If there was previously another
+// job registered with the same name, it will panic.
+func RegisterJob(name string, handler JobHandler, opts *JobOptions) {
+	jobs.Lock()
+	defer jobs.Unlock()
+	if jobs.handlers == nil {
+		jobs.handlers = make(map[string]*jobHandler)
+	}
+	if jobs.handlers[name] != nil {
+		panic(fmt.Errorf("there's already a job registered as %s", name))
+	}
+	jobs.handlers[name] = &jobHandler{handler: handler, opts: opts}
+	if !jobs.registered {
+		orm.Register((*Job)(nil), &orm.Options{
+			Table:   "gondola_jobs",
+			Indexes: index.Indexes(index.New("Queue", "State", "RunAt")),
+		})
+		jobs.registered = true
+	}
+}
+
+// SetQueueConcurrency sets the maximum number of jobs from the
+// given queue which might run simultaneously in each process. Use
+// it to limit the load generated by expensive jobs. If it's not
+// set, queues use DefaultConcurrency.
+func SetQueueConcurrency(queue string, concurrency int) {
+	jobs.Lock()
+	defer jobs.Unlock()
+	if jobs.concurrency == nil {
+		jobs.concurrency = make(map[string]int)
+	}
+	jobs.concurrency[queue] = concurrency
+}
+
+func queueConcurrency(queue string) int {
+	if c, ok := jobs.concurrency[queue]; ok {
+		return c
+	}
+	return DefaultConcurrency
+}
+
+// Enqueue adds a new job with the given name and payload to the
+// persistent job queue, using the app ORM. The payload is encoded as
+// JSON and might be retrieved by the handler using Job.Decode.
+// opts might be nil. Jobs are run by a worker pool which is started
+// when the app starts listening.
+func Enqueue(ctx *app.Context, name string, payload interface{}, opts *EnqueueOptions) (*Job, error) {
+	return EnqueueOrm(ctx.Orm().Orm, name, payload, opts)
+}
+
+// EnqueueOrm works like Enqueue, but uses the given ORM. This is useful
+// for enqueueing jobs as part of a transaction, so they're only added to
+// the queue if the transaction is committed.
+func EnqueueOrm(o *orm.Orm, name string, payload interface{}, opts *EnqueueOptions) (*Job, error) {
+	jobs.RLock()
+	h := jobs.handlers[name]
+	jobs.RUnlock()
+	if h == nil {
+		return nil, fmt.Errorf("there's no job registered with the name %q", name)
+	}
+	var data []byte
+	if payload != nil {
+		var err error
+		if data, err = json.Marshal(payload); err != nil {
+			return nil, fmt.Errorf("error encoding payload for job %s: %s", name, err)
+		}
+	}
+	now := time.Now().UTC()
+	job := &Job{
+		Name:        name,
+		Queue:       h.opts.queue(),
+		Payload:     data,
+		State:       JobPending,
+		MaxAttempts: h.opts.maxAttempts(),
+		RunAt:       now,
+		Created:     now,
+	}
+	if opts != nil {
+		if opts.Queue != "" {
+			job.Queue = opts.Queue
+		}
+		if opts.Delay > 0 {
+			job.RunAt = now.Add(opts.Delay)
+		} else if !opts.At.IsZero() {
+			job.RunAt = opts.At.UTC()
+		}
+		if opts.MaxAttempts > 0 {
+			job.MaxAttempts = opts.MaxAttempts
+		}
+	}
+	if _, err := o.Insert(job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// DeadJobs returns the jobs with the given name which failed too many
+// times and won't be retried. If name is empty, all dead jobs are
+// returned.
+func DeadJobs(o *orm.Orm, name string) ([]*Job, error) {
+	q := orm.Eq("State", JobDead)
+	if name != "" {
+		q = orm.And(q, orm.Eq("Name", name))
+	}
+	var dead []*Job
+	err := o.Query(q).Sort("Id", orm.ASC).All(&dead)
+	return dead, err
+}
+
+// Requeue moves a dead job back to the queue, resetting its attempts.
+func Requeue(o *orm.Orm, id int64) error {
+	var job *Job
+	ok, err := o.One(orm.And(orm.Eq("Id", id), orm.Eq("State", JobDead)), &job)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("there's no dead job with id %d", id)
+	}
+	job.State = JobPending
+	job.Attempts = 0
+	job.RunAt = time.Now().UTC()
+	return updateJob(o, job)
+}
+
+// updateJob updates the job if it hasn't been modified by
+// another worker since it was loaded.
+func updateJob(o *orm.Orm, job *Job) error {
+	prev := job.Version
+	job.Version++
+	res, err := o.Update(orm.And(orm.Eq("Id", job.Id), orm.Eq("Version", prev)), job)
+	if err != nil {
+		return err
+	}
+	aff, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if aff != 1 {
+		return fmt.Errorf("job %d was modified by another worker", job.Id)
+	}
+	return nil
+}
+
+// workerPool polls the queue for jobs and runs them, respecting
+// the concurrency limit for each queue.
+type workerPool struct {
+	app     *app.App
+	stop    chan struct{}
+	stopped chan struct{}
+	// running jobs, by queue
+	mu      sync.Mutex
+	running map[string]int
+	jobs    sync.WaitGroup
+}
+
+func (w *workerPool) loop() {
+	defer close(w.stopped)
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		w.poll()
+		select {
+		case <-ticker.C:
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+func (w *workerPool) poll() {
+	o, err := w.app.Orm()
+	if err != nil {
+		w.errorf("error obtaining ORM for running jobs: %s", err)
+		return
+	}
+	now := time.Now().UTC()
+	jobs.RLock()
+	names := make([]string, 0, len(jobs.handlers))
+	for k := range jobs.handlers {
+		names = append(names, k)
+	}
+	conds := []query.Q{
+		orm.In("Name", names),
+		orm.Or(
+			orm.And(orm.Eq("State", JobPending), orm.Lte("RunAt", now)),
+			// Jobs which were running in a worker which didn't finish them
+			orm.And(orm.Eq("State", JobRunning), orm.Lt("LockedUntil", now)),
+		),
+	}
+	// Jobs might be enqueued in any queue (see EnqueueOptions), so
+	// just skip the queues which are known to be full and check the
+	// limit for each job's queue before claiming it.
+	w.mu.Lock()
+	for queue, running := range w.running {
+		if running >= queueConcurrency(queue) {
+			conds = append(conds, orm.Neq("Queue", queue))
+		}
+	}
+	w.mu.Unlock()
+	jobs.RUnlock()
+	var candidates []*Job
+	if err := o.Query(orm.And(conds...)).Sort("RunAt", orm.ASC).Limit(pollBatchSize).All(&candidates); err != nil {
+		w.errorf("error polling job queue: %s", err)
+		return
+	}
+	for _, job := range candidates {
+		select {
+		case <-w.stop:
+			return
+		default:
+		}
+		if w.reserve(job.Queue) {
+			w.claim(o.Orm, job)
+		}
+	}
+}
+
+// reserve reserves a slot for running a job from the given
+// queue, returning false if the queue is full. The slot must
+// be released with release.
+func (w *workerPool) reserve(queue string) bool {
+	jobs.RLock()
+	limit := queueConcurrency(queue)
+	jobs.RUnlock()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.running[queue] >= limit {
+		return false
+	}
+	w.running[queue]++
+	return true
+}
+
+func (w *workerPool) release(queue string) {
+	w.mu.Lock()
+	w.running[queue]--
+	w.mu.Unlock()
+}
+
+func (w *workerPool) errorf(format string, args ...interface{}) {
+	if w.app.Logger != nil {
+		w.app.Logger.Errorf(format, args...)
+	}
+}
+
+// claim tries to claim the job, which must have a reserved
+// slot in its queue, and runs it. If the job can't be claimed,
+// the slot is released.
+func (w *workerPool) claim(o *orm.Orm, job *Job) {
+	queue := job.Queue
+	jobs.RLock()
+	h := jobs.handlers[job.Name]
+	jobs.RUnlock()
+	if job.State == JobRunning && job.Attempts >= job.MaxAttempts {
+		// The last attempt was lost (e.g. the process crashed)
+		job.State = JobDead
+		job.LastError = "job timed out"
+		if err := updateJob(o, job); err == nil {
+			w.errorf("Job %s (%d) timed out %d times, moving to dead letter", job.Name, job.Id, job.Attempts)
+		}
+		w.release(queue)
+		return
+	}
+	job.State = JobRunning
+	job.Attempts++
+	job.LockedUntil = time.Now().UTC().Add(h.opts.timeout())
+	if err := updateJob(o, job); err != nil {
+		// Claimed by another worker
+		w.release(queue)
+		return
+	}
+	w.jobs.Add(1)
+	go func() {
+		defer w.jobs.Done()
+		defer w.release(queue)
+		w.run(o, h, job)
+	}()
+}
+
+func (w *workerPool) run(o *orm.Orm, h *jobHandler, job *Job) {
+	ctx := w.app.NewContext(contextProvider(0))
+	defer w.app.CloseContext(ctx)
+	started := time.Now()
+	ctx.Logger().Infof("Starting job %s (%d) attempt %d", job.Name, job.Id, job.Attempts)
+	err := runJob(ctx, h.handler, job)
+	jobRuns.Inc(job.Name)
+	if err == nil {
+		ctx.Logger().Infof("Finished job %s (%d) (took %v)", job.Name, job.Id, time.Since(started))
+		if _, err := o.DeleteFrom(o.TypeTable(jobType), orm.And(orm.Eq("Id", job.Id), orm.Eq("Version", job.Version))); err != nil {
+			ctx.Logger().Errorf("error removing finished job %s (%d): %s", job.Name, job.Id, err)
+		}
+		return
+	}
+	jobFailures.Inc(job.Name)
+	job.LastError = err.Error()
+	if job.Attempts >= job.MaxAttempts {
+		ctx.Logger().Errorf("Job %s (%d) failed %d times, moving to dead letter: %s", job.Name, job.Id, job.Attempts, err)
+		job.State = JobDead
+	} else {
+		delay := h.opts.backoff(job.Attempts)
+		ctx.Logger().Errorf("Job %s (%d) failed, retrying in %v: %s", job.Name, job.Id, delay, err)
+		job.State = JobPending
+		job.RunAt = time.Now().UTC().Add(delay)
+	}
+	if err := updateJob(o, job); err != nil {
+		ctx.Logger().Errorf("error updating failed job %s (%d): %s", job.Name, job.Id, err)
+	}
+}
+
+func runJob(ctx *app.Context, handler JobHandler, job *Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = panicError("job "+job.Name, r)
+		}
+	}()
+	return handler(ctx, job)
+}
+
+func startWorkers(a *app.App) {
+	jobs.Lock()
+	defer jobs.Unlock()
+	if len(jobs.handlers) == 0 || jobs.workers[a] != nil {
+		return
+	}
+	w := &workerPool{
+		app:     a,
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+		running: make(map[string]int),
+	}
+	if jobs.workers == nil {
+		jobs.workers = make(map[*app.App]*workerPool)
+	}
+	jobs.workers[a] = w
+	go w.loop()
+}
+
+func stopWorkers(a *app.App) {
+	jobs.Lock()
+	w := jobs.workers[a]
+	delete(jobs.workers, a)
+	jobs.Unlock()
+	if w == nil {
+		return
+	}
+	close(w.stop)
+	<-w.stopped
+	done := make(chan struct{})
+	go func() {
+		w.jobs.Wait()
+		close(done)
+	}()
+	ctx := a.ShutdownContext()
+	if ctx == nil {
+		<-done
+		return
+	}
+	select {
+	case <-done:
+	case <-ctx.Done():
+		// The jobs still running keep their lease, so
+		// they'll be retried once it expires.
+		if a.Logger != nil {
+			a.Logger.Warningf("not waiting for running jobs, shutdown deadline exceeded")
+		}
+	}
+}
+
+func init() {
+	signal.Listen(app.WILL_LISTEN, func(_ string, obj interface{}) {
+		startWorkers(obj.(*app.App))
+	})
+	// Wait for the running jobs before the app closes its resources,
+	// until the deadline passed to App.Shutdown expires.
+	signal.Listen(app.WILL_STOP, func(_ string, obj interface{}) {
+		stopWorkers(obj.(*app.App))
+	})
+}
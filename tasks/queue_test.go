@@ -0,0 +1,228 @@
+package tasks
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"gnd.la/app"
+	"gnd.la/config"
+	"gnd.la/orm"
+
+	_ "gnd.la/orm/driver/sqlite"
+)
+
+var (
+	errTestJob = errors.New("job failed")
+
+	testQueues struct {
+		sync.Mutex
+		ran []string
+	}
+	testBlock = make(chan struct{})
+)
+
+func init() {
+	RegisterJob("test-queue", func(ctx *app.Context, job *Job) error {
+		testQueues.Lock()
+		testQueues.ran = append(testQueues.ran, job.Queue)
+		testQueues.Unlock()
+		return nil
+	}, &JobOptions{Queue: "test-registered"})
+	RegisterJob("test-block", func(ctx *app.Context, job *Job) error {
+		<-testBlock
+		return nil
+	}, &JobOptions{Queue: "test-limited"})
+	RegisterJob("test-fail", func(ctx *app.Context, job *Job) error {
+		return errTestJob
+	}, &JobOptions{MaxAttempts: 2, Backoff: time.Hour})
+	SetQueueConcurrency("test-limited", 1)
+}
+
+var testOrm struct {
+	sync.Once
+	app  *app.App
+	orm  *orm.Orm
+	file string
+	err  error
+}
+
+// The job table can only be registered once, so all the
+// tests share the same App and database.
+func initTestOrm() {
+	f, err := ioutil.TempFile("", "tasks-")
+	if err != nil {
+		testOrm.err = err
+		return
+	}
+	f.Close()
+	testOrm.file = f.Name()
+	a := app.New()
+	a.Logger = nil
+	a.Config().Database = config.MustParseURL("sqlite://" + f.Name())
+	o, err := a.Orm()
+	if err != nil {
+		testOrm.err = err
+		return
+	}
+	if err := o.Initialize(); err != nil {
+		testOrm.err = err
+		return
+	}
+	testOrm.app = a
+	testOrm.orm = o.Orm
+}
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if testOrm.file != "" {
+		os.Remove(testOrm.file)
+	}
+	os.Exit(code)
+}
+
+func newTestWorkers(t *testing.T) (*workerPool, *orm.Orm, func()) {
+	testOrm.Do(initTestOrm)
+	if testOrm.orm == nil {
+		t.Skipf("can't open sqlite database: %s", testOrm.err)
+	}
+	o := testOrm.orm
+	w := &workerPool{
+		app:     testOrm.app,
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+		running: make(map[string]int),
+	}
+	return w, o, func() {
+		w.jobs.Wait()
+		if _, err := o.DeleteFrom(o.TypeTable(jobType), nil); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func loadJob(t *testing.T, o *orm.Orm, id int64) *Job {
+	var job *Job
+	if _, err := o.One(orm.Eq("Id", id), &job); err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+func TestBackoff(t *testing.T) {
+	opts := &JobOptions{Backoff: time.Second, MaxBackoff: 10 * time.Second}
+	tests := []struct {
+		opts     *JobOptions
+		attempts int
+		expect   time.Duration
+	}{
+		{nil, 1, defaultBackoff},
+		{nil, 2, 2 * defaultBackoff},
+		{nil, 20, defaultMaxBackoff},
+		{opts, 1, time.Second},
+		{opts, 3, 4 * time.Second},
+		{opts, 4, 8 * time.Second},
+		{opts, 5, 10 * time.Second},
+	}
+	for _, v := range tests {
+		if d := v.opts.backoff(v.attempts); d != v.expect {
+			t.Errorf("expecting backoff %v after %d attempts, got %v", v.expect, v.attempts, d)
+		}
+	}
+}
+
+func TestEnqueueQueue(t *testing.T) {
+	w, o, done := newTestWorkers(t)
+	defer done()
+	if _, err := EnqueueOrm(o, "test-queue", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := EnqueueOrm(o, "test-queue", nil, &EnqueueOptions{Queue: "test-override"}); err != nil {
+		t.Fatal(err)
+	}
+	w.poll()
+	w.jobs.Wait()
+	testQueues.Lock()
+	ran := testQueues.ran
+	testQueues.ran = nil
+	testQueues.Unlock()
+	if len(ran) != 2 {
+		t.Fatalf("expecting 2 jobs to run, %d did (%v)", len(ran), ran)
+	}
+	seen := map[string]bool{ran[0]: true, ran[1]: true}
+	if !seen["test-registered"] || !seen["test-override"] {
+		t.Errorf("expecting jobs from queues test-registered and test-override, got %v", ran)
+	}
+	if c, err := o.Count(o.TypeTable(jobType), nil); err != nil || c != 0 {
+		t.Errorf("expecting finished jobs to be removed, %d remain (error %v)", c, err)
+	}
+}
+
+func TestQueueConcurrency(t *testing.T) {
+	w, o, done := newTestWorkers(t)
+	defer done()
+	for ii := 0; ii < 3; ii++ {
+		if _, err := EnqueueOrm(o, "test-block", nil, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.poll()
+	w.poll()
+	w.mu.Lock()
+	running := w.running["test-limited"]
+	w.mu.Unlock()
+	if running != 1 {
+		t.Errorf("expecting 1 running job in test-limited, got %d", running)
+	}
+	for ii := 0; ii < 3; ii++ {
+		testBlock <- struct{}{}
+		w.jobs.Wait()
+		w.poll()
+	}
+	w.jobs.Wait()
+	if c, err := o.Count(o.TypeTable(jobType), nil); err != nil || c != 0 {
+		t.Errorf("expecting finished jobs to be removed, %d remain (error %v)", c, err)
+	}
+}
+
+func TestJobRetry(t *testing.T) {
+	w, o, done := newTestWorkers(t)
+	defer done()
+	job, err := EnqueueOrm(o, "test-fail", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.poll()
+	w.jobs.Wait()
+	job = loadJob(t, o, job.Id)
+	if job.State != JobPending || job.Attempts != 1 || job.LastError != errTestJob.Error() {
+		t.Fatalf("expecting pending job with 1 attempt and error %q, got state %v, %d attempts and error %q", errTestJob, job.State, job.Attempts, job.LastError)
+	}
+	if job.RunAt.Before(time.Now().Add(59 * time.Minute)) {
+		t.Errorf("expecting retry to be delayed by 1h, it runs at %v", job.RunAt)
+	}
+	// Make the job runnable again
+	job.RunAt = time.Now().UTC().Add(-time.Second)
+	if err := updateJob(o, job); err != nil {
+		t.Fatal(err)
+	}
+	w.poll()
+	w.jobs.Wait()
+	dead, err := DeadJobs(o, "test-fail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dead) != 1 || dead[0].Id != job.Id || dead[0].Attempts != 2 {
+		t.Fatalf("expecting job %d to be dead after 2 attempts, got %v", job.Id, dead)
+	}
+	if err := Requeue(o, job.Id); err != nil {
+		t.Fatal(err)
+	}
+	job = loadJob(t, o, job.Id)
+	if job.State != JobPending || job.Attempts != 0 {
+		t.Errorf("expecting requeued job to be pending with 0 attempts, got state %v and %d attempts", job.State, job.Attempts)
+	}
+}
@@ -0,0 +1,77 @@
+package tasks
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"gnd.la/app"
+	"gnd.la/orm"
+	"gnd.la/signal"
+)
+
+const signalJobName = "gondola-signal"
+
+type signalPayload struct {
+	Event string
+	Data  json.RawMessage
+}
+
+// RegisterSignals registers the job used by DispatchQueued for
+// dispatching events through the persistent job queue. Like
+// RegisterJob, it must be called before the app ORM is initialized,
+// usually from an init() function. opts might be nil.
+func RegisterSignals(opts *JobOptions) {
+	RegisterJob(signalJobName, dispatchSignalJob, opts)
+}
+
+// DispatchQueued stores the given event in the persistent job queue
+// and dispatches it to the listeners in gnd.la/signal.DefaultBus when
+// the job runs, possibly in another process. The event is encoded as
+// JSON, so its type must support it. The job is only completed once
+// all the listeners, including the asynchronous ones, have finished.
+// If any of them fails, the job is retried, so listeners for queued
+// events should be idempotent. If the process running the job has no
+// listeners for the event, it's dropped. RegisterSignals must be
+// called before using this function. opts might be nil.
+func DispatchQueued(ctx *app.Context, event interface{}, opts *EnqueueOptions) (*Job, error) {
+	return DispatchQueuedOrm(ctx.Orm().Orm, event, opts)
+}
+
+// DispatchQueuedOrm works like DispatchQueued, but uses the given ORM.
+// When called with a transaction, the event is only dispatched if the
+// transaction is committed, which allows reliably dispatching events
+// triggered by changes in the database, even if the process crashes
+// before the listeners run.
+func DispatchQueuedOrm(o *orm.Orm, event interface{}, opts *EnqueueOptions) (*Job, error) {
+	if event == nil {
+		return nil, fmt.Errorf("can't dispatch a nil event")
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding %T event: %s", event, err)
+	}
+	payload := &signalPayload{
+		Event: signal.EventName(event),
+		Data:  data,
+	}
+	return EnqueueOrm(o, signalJobName, payload, opts)
+}
+
+func dispatchSignalJob(ctx *app.Context, job *Job) error {
+	var payload signalPayload
+	if err := job.Decode(&payload); err != nil {
+		return err
+	}
+	event, err := signal.DefaultBus.Decode(payload.Event, func(v interface{}) error {
+		return json.Unmarshal(payload.Data, v)
+	})
+	if err != nil {
+		if err == signal.ErrUnknownEvent {
+			// No listeners for this event in this process
+			ctx.Logger().Debugf("no listeners for queued %s event", payload.Event)
+			return nil
+		}
+		return fmt.Errorf("error decoding %s event: %s", payload.Event, err)
+	}
+	return signal.DefaultBus.DispatchWait(event)
+}
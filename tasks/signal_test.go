@@ -0,0 +1,65 @@
+package tasks
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"gnd.la/app"
+	"gnd.la/signal"
+)
+
+type testSignalEvent struct {
+	Value int
+}
+
+type unknownSignalEvent struct{}
+
+func signalJob(t *testing.T, event interface{}) *Job {
+	data, err := json.Marshal(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(&signalPayload{Event: signal.EventName(event), Data: data})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Job{Name: signalJobName, Payload: payload}
+}
+
+func TestDispatchSignalJob(t *testing.T) {
+	errListener := errors.New("listener failed")
+	release := make(chan struct{})
+	values := make(chan int, 1)
+	tok := signal.OnAsync(func(e *testSignalEvent) error {
+		<-release
+		values <- e.Value
+		return errListener
+	})
+	defer signal.Off(tok)
+	done := make(chan error)
+	go func() {
+		done <- dispatchSignalJob(nil, signalJob(t, &testSignalEvent{Value: 42}))
+	}()
+	select {
+	case <-done:
+		t.Fatal("job completed before the asynchronous listener finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if err := <-done; err == nil {
+		t.Error("expecting an error from the failed listener, so the job is retried")
+	}
+	if v := <-values; v != 42 {
+		t.Errorf("expecting event value 42, got %d", v)
+	}
+	// Events without listeners are dropped
+	a := app.New()
+	a.Logger = nil
+	ctx := a.NewContext(contextProvider(0))
+	defer a.CloseContext(ctx)
+	if err := dispatchSignalJob(ctx, signalJob(t, &unknownSignalEvent{})); err != nil {
+		t.Errorf("expecting event without listeners to be dropped, got error %s", err)
+	}
+}
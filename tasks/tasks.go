@@ -1,11 +1,13 @@
 // Package tasks provides functions for scheduling
-// periodic tasks (e.g. background jobs).
+// periodic tasks (e.g. background jobs) and a persistent
+// job queue with retries (see RegisterJob and Enqueue).
 package tasks
 
 import (
 	"bytes"
 	"errors"
 	"fmt"
+	"os"
 	"reflect"
 	"sync"
 	"time"
@@ -25,6 +27,10 @@ var registered struct {
 	tasks map[string]*Task
 }
 
+// leaseHolder identifies this process as the holder of
+// task leases.
+var leaseHolder = fmt.Sprintf("%s:%d", hostname(), os.Getpid())
+
 var onListenTasks struct {
 	sync.RWMutex
 	tasks []*Task
@@ -35,10 +41,15 @@ type Task struct {
 	App      *app.App
 	Handler  app.Handler
 	Interval time.Duration
-	Options  *Options
-	ticker   *time.Ticker
-	stop     chan struct{}
-	stopped  chan struct{}
+	// Cron is the cron schedule for the task, if any. When
+	// it's non-nil, Interval is ignored.
+	Cron    *Cron
+	Options *Options
+	ticker  *time.Ticker
+	stop    chan struct{}
+	stopped chan struct{}
+	// running tracks the instances started by the scheduler
+	running sync.WaitGroup
 }
 
 // Stop de-schedules the task. After stopping the task, it
@@ -53,9 +64,18 @@ func (t *Task) Stop() {
 	}
 }
 
+// Resume starts scheduling the task again after it has been
+// stopped. If now is true, the task is also run immediately.
+// Tasks without an Interval nor a Cron schedule are never
+// scheduled.
 func (t *Task) Resume(now bool) {
 	t.Stop()
-	t.ticker = time.NewTicker(t.Interval)
+	if t.Cron == nil {
+		if t.Interval <= 0 {
+			return
+		}
+		t.ticker = time.NewTicker(t.Interval)
+	}
 	t.stop = make(chan struct{}, 1)
 	t.stopped = make(chan struct{}, 1)
 	go t.execute(now)
@@ -82,26 +102,102 @@ func (t *Task) deleteLocked() {
 	delete(registered.tasks, t.Name())
 }
 
+// run executes the task, tracking it as a running instance
+// until it finishes.
+func (t *Task) run() {
+	t.running.Add(1)
+	defer t.running.Done()
+	t.executeTask(time.Time{})
+}
+
 func (t *Task) execute(now bool) {
 	if now {
-		t.executeTask()
+		t.run()
 	}
 	for {
-		c := t.ticker.C
+		var c <-chan time.Time
+		var timer *time.Timer
+		var scheduled time.Time
+		if t.Cron != nil {
+			// A zero time means the schedule never matches,
+			// leave c as nil and just wait for Stop().
+			if scheduled = t.Cron.Next(time.Now()); !scheduled.IsZero() {
+				timer = time.NewTimer(scheduled.Sub(time.Now()))
+				c = timer.C
+			}
+		} else {
+			c = t.ticker.C
+		}
 		select {
-		case <-c:
-			go t.executeTask()
+		case tick := <-c:
+			if t.Cron == nil {
+				// Align the ticks of different instances, so
+				// they can share the lease when using Lock.
+				scheduled = tick.Truncate(t.Interval)
+			}
+			t.running.Add(1)
+			go func() {
+				defer t.running.Done()
+				t.executeTask(scheduled)
+			}()
 		case <-t.stop:
 			close(t.stop)
 			t.stop = nil
-			t.ticker.Stop()
-			t.ticker = nil
+			if timer != nil {
+				timer.Stop()
+			}
+			if t.ticker != nil {
+				t.ticker.Stop()
+				t.ticker = nil
+			}
 			t.stopped <- struct{}{}
 			return
 		}
 	}
 }
 
+// period returns the time between the tick scheduled at the
+// given time and the next one.
+func (t *Task) period(tick time.Time) time.Duration {
+	if t.Cron != nil {
+		if next := t.Cron.Next(tick); !next.IsZero() {
+			return next.Sub(tick)
+		}
+	}
+	return t.Interval
+}
+
+// acquireLease tries to obtain the lease for running the tick
+// scheduled at the given time, when the task uses Options.Lock.
+// It returns true if the task should be run by this instance.
+// Otherwise, the returned string identifies the instance holding
+// the lease, if known.
+func (t *Task) acquireLease(tick time.Time) (bool, string, error) {
+	if tick.IsZero() || t.Options == nil || !t.Options.Lock {
+		return true, leaseHolder, nil
+	}
+	c, err := t.App.Cache()
+	if err != nil {
+		return false, "", err
+	}
+	ttl := t.Options.LockTTL
+	if ttl <= 0 {
+		ttl = t.period(tick)
+	}
+	timeout := int(ttl / time.Second)
+	if timeout < 1 {
+		timeout = 1
+	}
+	key := fmt.Sprintf("gondola-task-lease-%s-%d", t.Name(), tick.Unix())
+	acquired, err := c.Add(key, leaseHolder, timeout)
+	if err != nil || acquired {
+		return acquired, leaseHolder, err
+	}
+	holder := "another instance"
+	c.Get(key, &holder)
+	return false, holder, nil
+}
+
 // Options are used to specify task options when registering them.
 type Options struct {
 	// Name indicates the task name, used for checking the number
@@ -113,30 +209,30 @@ type Options struct {
 	// this function that can be simultaneously running. If zero,
 	// there is no limit.
 	MaxInstances int
+	// Lock makes each scheduled run of the task acquire a lease
+	// through the App cache before starting, so when several
+	// instances of the App are running (e.g. behind a load balancer)
+	// only one of them executes the task for each tick. The cache
+	// must be shared among all the instances (e.g. memcache or redis)
+	// and its driver must support adding keys atomically. Ticks are
+	// identified by their scheduled time, so Lock works best with cron
+	// schedules. Interval schedules are aligned to multiples of the
+	// interval. Runs which are not triggered by the scheduler (e.g.
+	// onListen, Run or Resume(true)) don't acquire any lease.
+	Lock bool
+	// LockTTL indicates how long the lease acquired when Lock is
+	// true is kept. If zero, the time until the next tick is used.
+	LockTTL time.Duration
 }
 
 func afterTask(ctx *app.Context, task *Task, started time.Time, terr *error) {
 	name := task.Name()
 	if err := recover(); err != nil {
-		skip, stackSkip, _, _ := runtimeutil.GetPanic()
-		var buf bytes.Buffer
-		fmt.Fprintf(&buf, "Panic executing task %s: %v\n", name, err)
-		stack := runtimeutil.FormatStack(stackSkip)
-		location, code := runtimeutil.FormatCaller(skip, 5, true, true)
-		if location != "" {
-			buf.WriteString("\n At ")
-			buf.WriteString(location)
-			if code != "" {
-				buf.WriteByte('\n')
-				buf.WriteString(code)
-				buf.WriteByte('\n')
-			}
-		}
-		if stack != "" {
-			buf.WriteString("\nStack:\n")
-			buf.WriteString(stack)
-		}
-		*terr = errors.New(buf.String())
+		*terr = panicError("task "+name, err)
+	}
+	taskRuns.Inc(name)
+	if *terr != nil {
+		taskFailures.Inc(name)
 	}
 	end := time.Now()
 	running.Lock()
@@ -150,6 +246,36 @@ func afterTask(ctx *app.Context, task *Task, started time.Time, terr *error) {
 	ctx.Logger().Infof("Finished task %s (%d instances now running) at %v (took %v)", name, c, end, end.Sub(started))
 }
 
+// panicError returns an error describing the recovered panic err,
+// including its location and stack. It must be called from the
+// deferred function which recovered from the panic.
+func panicError(what string, err interface{}) error {
+	skip, stackSkip, _, _ := runtimeutil.GetPanic()
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Panic executing %s: %v\n", what, err)
+	stack := runtimeutil.FormatStack(stackSkip)
+	location, code := runtimeutil.FormatCaller(skip, 5, true, true)
+	if location != "" {
+		buf.WriteString("\n At ")
+		buf.WriteString(location)
+		if code != "" {
+			buf.WriteByte('\n')
+			buf.WriteString(code)
+			buf.WriteByte('\n')
+		}
+	}
+	if stack != "" {
+		buf.WriteString("\nStack:\n")
+		buf.WriteString(stack)
+	}
+	return errors.New(buf.String())
+}
+
+func hostname() string {
+	h, _ := os.Hostname()
+	return h
+}
+
 func numberOfInstances(task *Task) (int, error) {
 	running.Lock()
 	defer running.Unlock()
@@ -220,6 +346,25 @@ func Schedule(m *app.App, task app.Handler, opts *Options, interval time.Duratio
 	return t
 }
 
+// ScheduleCron registers and schedules a task to be run according to
+// the given cron specification (e.g. "0 3 * * *" runs the task every day
+// at 03:00). See ParseCron for the supported syntax and for specifying the
+// time zone. The returned error is non-nil only if spec is not valid, in
+// which case the task is not registered.
+//
+// Note that on App Engine, the task will be started when the next cron
+// request comes in after its scheduled time.
+func ScheduleCron(m *app.App, task app.Handler, opts *Options, spec string) (*Task, error) {
+	c, err := ParseCron(spec, nil)
+	if err != nil {
+		return nil, err
+	}
+	t := Register(m, task, opts)
+	t.Cron = c
+	go t.Resume(false)
+	return t, nil
+}
+
 // Run starts the given task identifier by it's name, unless
 // it has been previously registered with Options which
 // prevent from running it right now (e.g. it was registered
@@ -274,7 +419,7 @@ func init() {
 		var pending []*Task
 		for _, v := range onListenTasks.tasks {
 			if v.App == a {
-				go v.executeTask()
+				go v.run()
 			} else {
 				pending = append(pending, v)
 			}
@@ -282,4 +427,39 @@ func init() {
 		onListenTasks.tasks = pending
 		onListenTasks.Unlock()
 	})
+	// Stop the scheduled tasks before the app closes its
+	// resources, waiting for any running instances to finish.
+	signal.Listen(app.WILL_STOP, func(_ string, obj interface{}) {
+		a := obj.(*app.App)
+		var tasks []*Task
+		registered.RLock()
+		for _, v := range registered.tasks {
+			if v.App == a {
+				tasks = append(tasks, v)
+			}
+		}
+		registered.RUnlock()
+		for _, v := range tasks {
+			v.Stop()
+		}
+		done := make(chan struct{})
+		go func() {
+			for _, v := range tasks {
+				v.running.Wait()
+			}
+			close(done)
+		}()
+		ctx := a.ShutdownContext()
+		if ctx == nil {
+			<-done
+			return
+		}
+		select {
+		case <-done:
+		case <-ctx.Done():
+			if a.Logger != nil {
+				a.Logger.Warningf("not waiting for running tasks, shutdown deadline exceeded")
+			}
+		}
+	})
 }
@@ -4,6 +4,7 @@ package tasks
 
 import (
 	"sync"
+	"time"
 
 	"gnd.la/app"
 	"gnd.la/signal"
@@ -14,7 +15,9 @@ var pendingTasks struct {
 	tasks []*Task
 }
 
-func (t *Task) executeTask() {
+// executeTask ignores the tick, since App Engine cron requests
+// are already delivered to just one instance.
+func (t *Task) executeTask(tick time.Time) {
 	pendingTasks.Lock()
 	pendingTasks.tasks = append(pendingTasks.tasks, t)
 	pendingTasks.Unlock()
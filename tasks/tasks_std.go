@@ -2,10 +2,23 @@
 
 package tasks
 
-func (t *Task) executeTask() {
+import (
+	"time"
+)
+
+func (t *Task) executeTask(tick time.Time) {
 	ctx := t.App.NewContext(contextProvider(0))
 	defer t.App.CloseContext(ctx)
-	_, err := executeTask(ctx, t)
+	acquired, holder, err := t.acquireLease(tick)
+	if err != nil {
+		ctx.Logger().Errorf("not starting task %s, error acquiring lease: %s", t.Name(), err)
+		return
+	}
+	if !acquired {
+		ctx.Logger().Debugf("not starting task %s, lease for tick at %v held by %s", t.Name(), tick, holder)
+		return
+	}
+	_, err = executeTask(ctx, t)
 	if err != nil {
 		ctx.Logger().Error(err)
 	}
@@ -0,0 +1,68 @@
+package tasks
+
+import (
+	"testing"
+	"time"
+
+	"gnd.la/app"
+	"gnd.la/config"
+)
+
+func TestAcquireLease(t *testing.T) {
+	a := app.New()
+	a.Config().Cache = config.MustParseURL("memory://")
+	task := &Task{
+		App:     a,
+		Handler: func(ctx *app.Context) {},
+		Options: &Options{Name: "lease", Lock: true, LockTTL: time.Second},
+	}
+	tick := time.Now().Truncate(time.Minute)
+	tests := []struct {
+		tick     time.Time
+		acquired bool
+		holder   string
+	}{
+		{tick, true, leaseHolder},
+		// Already held by this instance
+		{tick, false, leaseHolder},
+		{tick.Add(time.Minute), true, leaseHolder},
+		// Unscheduled runs don't acquire a lease
+		{time.Time{}, true, leaseHolder},
+		{time.Time{}, true, leaseHolder},
+	}
+	for ii, v := range tests {
+		acquired, holder, err := task.acquireLease(v.tick)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if acquired != v.acquired || holder != v.holder {
+			t.Errorf("%d: expecting lease acquired = %v held by %q, got %v held by %q", ii, v.acquired, v.holder, acquired, holder)
+		}
+	}
+	// Wait for the lease to expire
+	time.Sleep(2100 * time.Millisecond)
+	if acquired, _, err := task.acquireLease(tick); err != nil || !acquired {
+		t.Errorf("expecting expired lease to be acquired again, got %v (error %v)", acquired, err)
+	}
+	task.Options.Lock = false
+	if acquired, _, err := task.acquireLease(tick); err != nil || !acquired {
+		t.Errorf("expecting tasks without Lock to always run, got %v (error %v)", acquired, err)
+	}
+}
+
+func TestPeriod(t *testing.T) {
+	task := &Task{Interval: time.Hour}
+	tick := time.Date(2023, 1, 1, 10, 0, 0, 0, time.UTC)
+	if p := task.period(tick); p != time.Hour {
+		t.Errorf("expecting period 1h, got %v", p)
+	}
+	task.Cron = MustParseCron("*/10 * * * *", time.UTC)
+	if p := task.period(tick); p != 10*time.Minute {
+		t.Errorf("expecting cron period 10m, got %v", p)
+	}
+	// No next time, fall back to the interval
+	task.Cron = MustParseCron("0 0 30 2 *", time.UTC)
+	if p := task.period(tick); p != time.Hour {
+		t.Errorf("expecting period 1h for a cron without next time, got %v", p)
+	}
+}